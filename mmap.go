@@ -0,0 +1,80 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package script
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// openMmap opens the file path and maps it into memory, returning a reader
+// that reads from the mapped region. If the file can't be mapped (for example,
+// because it's empty, or not a regular file), the file itself is returned
+// instead.
+func openMmap(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := info.Size()
+	if !info.Mode().IsRegular() || size == 0 || size > math.MaxInt {
+		return f, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return f, nil
+	}
+	// The mapping remains valid after the file is closed
+	f.Close()
+	return &mmapReader{data: data, r: bytes.NewReader(data)}, nil
+}
+
+// mmapReader reads from a memory-mapped file, unmapping it when closed. Its
+// methods are safe to call concurrently: in particular, a stage timeout (see
+// [Pipe.StageTimeout]) may close the reader while a filter is reading from it,
+// so the region is never unmapped while a Read is in progress.
+type mmapReader struct {
+	mu   sync.Mutex
+	data []byte
+	r    *bytes.Reader
+}
+
+// Read reads up to len(b) bytes from the mapped region into b. Once the reader
+// has been closed, Read returns 0, [io.EOF].
+func (m *mmapReader) Read(b []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return 0, io.EOF
+	}
+	return m.r.Read(b)
+}
+
+// Seek sets the offset for the next Read, as for [io.Seeker].
+func (m *mmapReader) Seek(offset int64, whence int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.r.Seek(offset, whence)
+}
+
+// Close unmaps the mapped region, waiting for any Read in progress to finish
+// first. It's safe to call Close more than once.
+func (m *mmapReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(m.data)
+	m.data = nil
+	return err
+}
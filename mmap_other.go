@@ -0,0 +1,14 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package script
+
+import (
+	"io"
+	"os"
+)
+
+// openMmap opens the file path for reading. Memory mapping isn't supported on
+// this platform, so the file is read normally.
+func openMmap(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
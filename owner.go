@@ -0,0 +1,20 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package script
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// copyOwner gives the file path the same owner and group as the file
+// described by info, if the program is running as root. Otherwise, it does
+// nothing, since only root can give files away.
+func copyOwner(path string, info fs.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(path, int(st.Uid), int(st.Gid))
+}
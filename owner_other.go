@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package script
+
+import "io/fs"
+
+// copyOwner does nothing, because file ownership can't be copied on this
+// platform.
+func copyOwner(path string, info fs.FileInfo) error {
+	return nil
+}
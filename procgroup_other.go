@@ -0,0 +1,15 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package script
+
+import "os/exec"
+
+// setProcessGroup does nothing, because process groups aren't supported on
+// this platform.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the started cmd. Any processes it started are left
+// running, because process groups aren't supported on this platform.
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,44 @@
+package script
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// isolateNetwork arranges for cmd to run in new, empty user and network
+// namespaces, so that it has no network interfaces other than an unconfigured
+// loopback device.
+func isolateNetwork(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	uid, gid := os.Getuid(), os.Getgid()
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+}
+
+// limitCommand rewrites cmd so that it runs under a shell which first sets the
+// resource limits l, then replaces itself with the original program. This
+// way, the limits are in force before the program executes its first
+// instruction.
+func limitCommand(cmd *exec.Cmd, l execLimits) {
+	script := "set -e"
+	if l.cpu > 0 {
+		script += fmt.Sprintf("; ulimit -t %d", (l.cpu+999999999)/1000000000)
+	}
+	if l.mem > 0 {
+		script += fmt.Sprintf("; ulimit -v %d", (l.mem+1023)/1024)
+	}
+	if l.files > 0 {
+		script += fmt.Sprintf("; ulimit -n %d", l.files)
+	}
+	if script == "set -e" {
+		return
+	}
+	args := append([]string{"sh", "-c", script + `; exec "$0" "$@"`, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	cmd.Args = args
+}
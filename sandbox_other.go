@@ -0,0 +1,13 @@
+//go:build !linux
+
+package script
+
+import "os/exec"
+
+// isolateNetwork does nothing, because network isolation isn't supported on
+// this platform.
+func isolateNetwork(cmd *exec.Cmd) {}
+
+// limitCommand does nothing, because resource limits aren't supported on this
+// platform.
+func limitCommand(cmd *exec.Cmd, l execLimits) {}
@@ -2,31 +2,58 @@ package script
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"container/ring"
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"hash"
+	"hash/fnv"
 	"io"
 	"io/fs"
 	"math"
+	"math/big"
+	"math/bits"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/itchyny/gojq"
+	"gopkg.in/yaml.v3"
 	"mvdan.cc/sh/v3/shell"
 )
 
+// pipePool holds released pipes for reuse by [NewPooledPipe].
+var pipePool = sync.Pool{
+	New: func() interface{} {
+		return NewPipe()
+	},
+}
+
 // Pipe represents a pipe object with an associated [ReadAutoCloser].
 type Pipe struct {
 	// Reader is the underlying reader.
@@ -34,10 +61,41 @@ type Pipe struct {
 	stdout     io.Writer
 	httpClient *http.Client
 
-	mu     *sync.Mutex
-	err    error
-	stderr io.Writer
-	env    []string
+	mu           *sync.Mutex
+	err          error
+	stderr       io.Writer
+	env          []string
+	scanBufSize  int
+	scanMaxSize  int
+	unordered    bool
+	dryRun       io.Writer
+	commandLog   io.Writer
+	limits       execLimits
+	stageTimeout time.Duration
+	breaker      int
+	batch        Summary
+	batchStart   time.Time
+	prefixMode   int
+	cache        *stageCache
+	httpCache    string
+	passthrough  bool
+	header       http.Header
+	metrics      *Metrics
+	jsonErrors   bool
+	errPrefix    *template.Template
+	retries      int
+	backoff      time.Duration
+	respStatus   int
+	respHeader   http.Header
+	rejects      io.Writer
+	checkpoint   *checkpoint
+	finishers    []func() error
+	retry        *stageRetry
+	timeLimit    time.Duration
+	outputSep    *string
+	metaSrc      string
+	sparse       bool
+	jqRaw        bool
 }
 
 // Args creates a pipe containing the program's command-line arguments from
@@ -46,6 +104,27 @@ func Args() *Pipe {
 	return Slice(os.Args[1:])
 }
 
+// Command registers run as the subcommand name, for use with [RunCommands].
+// This lets a single program bundle a family of related scripts, each
+// selected by its first argument:
+//
+//	func main() {
+//		script.Command("backup", func() *script.Pipe {
+//			return script.Exec("tar czf backup.tgz data")
+//		})
+//		script.Command("errors", func() *script.Pipe {
+//			return script.File("app.log").Match("error")
+//		})
+//		script.RunCommands()
+//	}
+//
+// Registering the same name twice replaces the earlier command.
+func Command(name string, run func() *Pipe) {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	commands[name] = run
+}
+
 // Do creates a pipe that makes the HTTP request req and produces the response.
 // See [Pipe.Do] for how the HTTP response status is interpreted.
 func Do(req *http.Request) *Pipe {
@@ -67,6 +146,12 @@ func Exec(cmdLine string) *Pipe {
 	return NewPipe().Exec(cmdLine)
 }
 
+// ExecArgs creates a pipe that runs the command name with the arguments args,
+// exactly as given, and produces its output. See [Pipe.ExecArgs].
+func ExecArgs(name string, args ...string) *Pipe {
+	return NewPipe().ExecArgs(name, args...)
+}
+
 // File creates a pipe that reads from the file path.
 func File(path string) *Pipe {
 	f, err := os.Open(path)
@@ -76,6 +161,72 @@ func File(path string) *Pipe {
 	return NewPipe().WithReader(f)
 }
 
+// FileMmap creates a pipe that reads from the file path via a read-only memory
+// mapping, rather than by buffered reads. This can be considerably faster for
+// scanning very large files, especially repeatedly. The mapping is released
+// once the pipe has been fully read, or closed.
+//
+// The mapping is shared with the file, so changes to the file while the pipe
+// is being read may be seen in its contents. In particular, the file must not
+// be truncated until the pipe has been read: reading the part of the mapping
+// beyond the new end of the file raises SIGBUS, which crashes the program.
+//
+// On platforms that don't support memory mapping, or if the file can't be
+// mapped (for example, because it's empty, or not a regular file), FileMmap
+// reads the file normally, exactly as for [File].
+func FileMmap(path string) *Pipe {
+	r, err := openMmap(path)
+	if err != nil {
+		return NewPipe().WithError(err)
+	}
+	return NewPipe().WithReader(r)
+}
+
+// FileRange creates a pipe that reads at most length bytes from the file path,
+// starting at byte offset, like Unix dd(1). If offset is negative, it is
+// counted backwards from the end of the file, so that, for example, this
+// reads the last 100 MiB of a log file:
+//
+//	FileRange("/var/log/syslog", -100<<20, -1).Stdout()
+//
+// If length is negative, FileRange reads to the end of the file. The file is
+// not read or scanned before offset, so this is efficient even for very
+// large files.
+func FileRange(path string, offset, length int64) *Pipe {
+	f, err := os.Open(path)
+	if err != nil {
+		return NewPipe().WithError(err)
+	}
+	whence := io.SeekStart
+	if offset < 0 {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return NewPipe().WithError(err)
+		}
+		// Starting before the beginning of the file means reading all of it
+		if -offset > info.Size() {
+			offset = -info.Size()
+		}
+		whence = io.SeekEnd
+	}
+	_, err = f.Seek(offset, whence)
+	if err != nil {
+		f.Close()
+		return NewPipe().WithError(err)
+	}
+	if length < 0 {
+		return NewPipe().WithReader(f)
+	}
+	return NewPipe().WithReader(readCloser{io.LimitReader(f, length), f})
+}
+
+// FindDirs is like [FindFiles], but lists directories instead of files,
+// including dir itself, like Unix find(1) with the -type d flag.
+func FindDirs(dir string) *Pipe {
+	return find(dir, true)
+}
+
 // FindFiles creates a pipe listing all the files in the directory dir and its
 // subdirectories recursively, one per line, like Unix find(1).
 // Errors are ignored unless no files are found (in which case the pipe's error
@@ -92,16 +243,68 @@ func File(path string) *Pipe {
 //
 //	test/1.txt
 //	test/2.txt
+//
+// The directory tree is walked in lexical order: the entries in each
+// directory, files and subdirectories alike, are visited in lexical order of
+// their names, and a subdirectory's contents are listed as soon as it's
+// reached, before the entries that follow it. This means the output is the
+// same on every platform and filesystem. To list files in some other order,
+// use [Pipe.SortFiles].
 func FindFiles(dir string) *Pipe {
+	return find(dir, false)
+}
+
+// FindFilesJSON is like [FindFiles], but produces a JSON object for each file,
+// one per line, describing its path, size in bytes, mode, and modification
+// time, ready for analysis by [Pipe.JQEach] without having to examine each
+// file again. If hash is true, each object also contains the SHA-256 hash of
+// the file's contents, as a hex string, except for files that can't be read.
+// For example:
+//
+//	{"path":"test/1.txt","size":8,"mode":"-rw-r--r--","mtime":"2024-05-01T09:30:00Z"}
+//
+// Files that disappear before they can be examined are skipped.
+func FindFilesJSON(dir string, hash bool) *Pipe {
+	return FindFiles(dir).FilterScan(func(path string, w io.Writer) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		record := fileRecord{
+			Path:    path,
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			ModTime: info.ModTime(),
+		}
+		if hash {
+			record.SHA256, _ = File(path).Hash(sha256.New())
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "%s\n", data)
+	})
+}
+
+func find(dir string, dirs bool) *Pipe {
 	var paths []string
 	var innerErr error
-	fs.WalkDir(os.DirFS(dir), ".", func(path string, d fs.DirEntry, err error) error {
+	// Walk the native path, rather than an os.DirFS, so that Windows
+	// drive-relative paths (C:foo), UNC shares, and long paths with the \\?\
+	// prefix are joined correctly.
+	root := dir
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+		// filepath.WalkDir doesn't follow a symlink at the root otherwise
+		root += string(filepath.Separator)
+	}
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			innerErr = err
 			return fs.SkipDir
 		}
-		if !d.IsDir() {
-			paths = append(paths, filepath.Join(dir, path))
+		if d.IsDir() == dirs {
+			paths = append(paths, filepath.Clean(path))
 		}
 		return nil
 	})
@@ -111,12 +314,176 @@ func FindFiles(dir string) *Pipe {
 	return Slice(paths)
 }
 
+// FollowFile creates a pipe that produces the lines appended to the file path
+// from now on, as they're written, like Unix tail -f. It doesn't produce any of
+// the file's existing contents (use [TailFile] for that). If the file is
+// truncated, FollowFile starts again from the beginning, and if it's replaced
+// by a new file with the same name, as when logs are rotated, FollowFile
+// switches to the new file, like tail -F.
+//
+// The pipe never reaches end of file by itself: it ends when ctx is cancelled,
+// or when the pipe is closed. For example, to print any errors logged in the
+// next hour:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+//	defer cancel()
+//	FollowFile(ctx, "/var/log/app.log").Match("ERROR").Stdout()
+func FollowFile(ctx context.Context, path string) *Pipe {
+	f, err := os.Open(path)
+	if err != nil {
+		return NewPipe().WithError(err)
+	}
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return NewPipe().WithError(err)
+	}
+	return NewPipe().WithReader(&followReader{
+		ctx:    ctx,
+		path:   path,
+		f:      f,
+		closed: make(chan struct{}),
+	})
+}
+
+// FromSpec creates a pipe from a declarative description of its stages, read
+// as YAML or JSON from r. This lets users of a compiled program change what a
+// pipeline does without recompiling it. The spec is a list of stages, each
+// naming a pipe method or source function, along with its arguments:
+//
+//	# The ten busiest API clients
+//	- stage: File
+//	  args: [access.log]
+//	- stage: MatchRegexp
+//	  args: ["GET /api/"]
+//	- stage: Column
+//	  args: [7]
+//	- stage: Freq
+//	- stage: First
+//	  args: [10]
+//
+// Since JSON is a subset of YAML, the same spec can also be written as JSON:
+//
+//	[
+//		{"stage": "File", "args": ["access.log"]},
+//		{"stage": "MatchRegexp", "args": ["GET /api/"]},
+//		{"stage": "Column", "args": [7]},
+//		{"stage": "Freq"},
+//		{"stage": "First", "args": [10]}
+//	]
+//
+// The available stages are sources that need no existing pipe (Echo, File,
+// FindFiles, ListFiles, and Stdin), which may only be the first stage, and
+// filters (Basename, Column, Concat, CSVColumn, Dirname, Exec, ExecForEach,
+// First, Freq, Get, Gunzip, Gzip, Join, JQ, JQEach, Last, Match, MatchRegexp,
+// Reject, RejectRegexp, Replace, ReplaceRegexp, Sleep, Sort, SortNumeric,
+// StageTimeout, Uniq, Words, XMLToJSON, and YQ), along with any added using
+// [RegisterStage]. Arguments that are regular expressions are given as
+// strings, and durations as strings accepted by [ParseDuration], such as
+// "1m30s" or "2d".
+//
+// The resulting pipe can be used like any other: for example, by calling
+// [Pipe.Stdout]. If the spec is not valid, or names an unknown stage, or
+// gives the wrong arguments for a stage, or has a source anywhere but first,
+// the pipe's error status is set.
+func FromSpec(r io.Reader) *Pipe {
+	var spec []struct {
+		Stage string        `yaml:"stage"`
+		Args  []interface{} `yaml:"args"`
+	}
+	err := yaml.NewDecoder(r).Decode(&spec)
+	if err != nil {
+		return NewPipe().WithError(fmt.Errorf("reading pipeline spec: %w", err))
+	}
+	p := NewPipe()
+	for i, s := range spec {
+		if i > 0 && sourceStages[s.Stage] {
+			return NewPipe().WithError(fmt.Errorf("stage %d (%s): source stages can only come first", i+1, s.Stage))
+		}
+		stagesMu.RLock()
+		stage, ok := stages[s.Stage]
+		stagesMu.RUnlock()
+		if !ok {
+			return NewPipe().WithError(fmt.Errorf("stage %d: unknown stage %q", i+1, s.Stage))
+		}
+		args := make([]string, len(s.Args))
+		for j, arg := range s.Args {
+			switch arg := arg.(type) {
+			case string:
+				args[j] = arg
+			case float64:
+				args[j] = strconv.FormatFloat(arg, 'f', -1, 64)
+			default:
+				args[j] = fmt.Sprint(arg)
+			}
+		}
+		p, err = stage(p, args)
+		if err != nil {
+			return NewPipe().WithError(fmt.Errorf("stage %d (%s): %w", i+1, s.Stage, err))
+		}
+	}
+	return p
+}
+
 // Get creates a pipe that makes an HTTP GET request to url, and produces the
 // response. See [Pipe.Do] for how the HTTP response status is interpreted.
 func Get(url string) *Pipe {
 	return NewPipe().Get(url)
 }
 
+// Handler returns an [http.Handler] that calls build for each request to get a
+// pipe, and streams the pipe's output to the client as the response, so that
+// existing pipelines can easily be served over HTTP. For example:
+//
+//	http.Handle("/errors", script.Handler(func(r *http.Request) *script.Pipe {
+//		return script.File("app.log").Match(r.URL.Query().Get("q"))
+//	}))
+//
+// If the pipe's error status is set before it produces any output, including
+// by a stage that fails without producing any, the response is an HTTP error
+// instead, with the error message as its body. The status is 404 Not Found if
+// the error is [fs.ErrNotExist], 403 Forbidden if it's [fs.ErrPermission],
+// 504 Gateway Timeout if it's [context.DeadlineExceeded], and otherwise 500
+// Internal Server Error. Once the pipe has produced some output, the response
+// status is 200 OK, and can't be changed, so an error after that just ends the
+// response early.
+func Handler(build func(r *http.Request) *Pipe) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := build(r)
+		defer p.Close()
+		buf := make([]byte, 32*1024)
+		n, err := p.Read(buf)
+		for n == 0 && err == nil {
+			n, err = p.Read(buf)
+		}
+		if n == 0 && err == io.EOF && p.Error() != nil {
+			// A stage failed without producing output, and the error was
+			// only set once the output had been closed
+			err = p.Error()
+		}
+		if n == 0 && err != io.EOF {
+			http.Error(w, err.Error(), handlerStatus(err))
+			return
+		}
+		flusher, _ := w.(http.Flusher)
+		for {
+			if n > 0 {
+				_, werr := w.Write(buf[:n])
+				if werr != nil {
+					return // client went away
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if err != nil {
+				return
+			}
+			n, err = p.Read(buf)
+		}
+	})
+}
+
 // IfExists tests whether path exists, and creates a pipe whose error status
 // reflects the result. If the file doesn't exist, the pipe's error status will
 // be set, and if the file does exist, the pipe will have no error status. This
@@ -165,6 +532,34 @@ func ListFiles(path string) *Pipe {
 	return Slice(matches)
 }
 
+// Main runs the pipe returned by run, sending its output to the pipe's
+// configured standard output (usually [os.Stdout]). If the pipe's error status
+// is then set, Main prints the error and exits, as [Pipe.ExitOnError] does.
+// Either way, any functions registered with [OnExit] are called first.
+// This takes care of the usual boilerplate at the end of a command-line
+// program built with script:
+//
+//	func main() {
+//		script.Main(func() *script.Pipe {
+//			return script.Stdin().Match("error")
+//		})
+//	}
+func Main(run func() *Pipe) {
+	defer runExitHooks()
+	p := run()
+	_, err := p.Stdout()
+	p.exitWith(err)
+}
+
+// NewMetrics creates an empty [Metrics] registry, ready for use with
+// [Pipe.WithMetrics].
+func NewMetrics() *Metrics {
+	return &Metrics{
+		stages: map[string]*stageMetrics{},
+		exits:  map[commandExit]int64{},
+	}
+}
+
 // NewPipe creates a new pipe with an empty reader (use [Pipe.WithReader] to
 // attach another reader to it).
 func NewPipe() *Pipe {
@@ -177,6 +572,152 @@ func NewPipe() *Pipe {
 	}
 }
 
+// NewPooledPipe is like [NewPipe], but reuses a pipe previously returned to
+// the pool with [Pipe.Release], if one is available. Programs that create
+// very large numbers of short-lived pipes, such as servers running a pipeline
+// for every request, can use NewPooledPipe and Release to reduce the load on
+// the garbage collector.
+//
+// A pooled pipe's lifecycle is:
+//
+//  1. Get the pipe from NewPooledPipe, and configure it as usual.
+//  2. Run the pipeline, ending with a sink such as [Pipe.String], which reads
+//     the pipe to completion.
+//  3. Call [Pipe.Release] to return the pipe to the pool.
+//
+// The pipe must not be used in any way after it has been released.
+func NewPooledPipe() *Pipe {
+	p, ok := pipePool.Get().(*Pipe)
+	if !ok {
+		return NewPipe()
+	}
+	return p
+}
+
+// OnExit registers fn to be called when the program exits by way of [Main] or
+// [Pipe.ExitOnError], or when it's interrupted or terminated by a signal,
+// giving scripts reliable teardown of things like temporary files, background
+// processes, and locks:
+//
+//	script.OnExit(func() { os.Remove(lockFile) })
+//	script.Main(func() *script.Pipe {
+//		return script.Exec("long-running-job")
+//	})
+//
+// Functions are called in the reverse order to that in which they were
+// registered, like deferred calls, and each is called at most once. They
+// aren't called if the program ends some other way, such as by returning from
+// main without calling Main. See also [Pipe.Cleanup].
+//
+// Note that while any such functions are registered, including by
+// [Pipe.Cleanup] and [NewWorkspace], script takes over the handling of the
+// SIGINT and SIGTERM signals, using [signal.Notify]. When one arrives, the
+// functions are called, and then the signal is raised again with its default
+// handling restored, so that the program is terminated by it as usual. A
+// program that needs to handle these signals some other way shouldn't use
+// these functions.
+func OnExit(fn func()) {
+	addExitHook(fn)
+}
+
+// ParseDuration parses a duration string, as [time.ParseDuration] does, but
+// also accepts the units "d" for days of 24 hours and "w" for weeks of 7
+// days, so that scripts can accept the same durations users type into other
+// command-line tools, such as "2d3h" or "1.5w". It returns an error if s isn't
+// a valid duration.
+func ParseDuration(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid duration %q", s)
+	rest := s
+	neg := false
+	if rest != "" && (rest[0] == '-' || rest[0] == '+') {
+		neg = rest[0] == '-'
+		rest = rest[1:]
+	}
+	if rest == "0" {
+		return 0, nil
+	}
+	if rest == "" {
+		return 0, invalid
+	}
+	isNum := func(c byte) bool {
+		return c == '.' || c >= '0' && c <= '9'
+	}
+	var total time.Duration
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isNum(rest[i]) {
+			i++
+		}
+		j := i
+		for j < len(rest) && !isNum(rest[j]) {
+			j++
+		}
+		num, unit := rest[:i], rest[i:j]
+		rest = rest[j:]
+		switch unit {
+		case "d", "w":
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				return 0, invalid
+			}
+			day := 24 * time.Hour
+			if unit == "w" {
+				day *= 7
+			}
+			total += time.Duration(n * float64(day))
+		default:
+			d, err := time.ParseDuration(num + unit)
+			if err != nil {
+				return 0, invalid
+			}
+			total += d
+		}
+	}
+	if neg {
+		total = -total
+	}
+	return total, nil
+}
+
+// ParseSize parses a human-friendly data size, such as "1.5GiB", "200 MB",
+// or "64k", and returns the number of bytes it represents. The number may be
+// followed by a unit: SI units such as "kB", "MB", "GB", "TB", and "PB" are
+// powers of 1000, and IEC units such as "KiB", "MiB", and "GiB" are powers of
+// 1024. A bare "K", "M", "G", "T", or "P" is a power of 1024, as with most
+// Unix tools, and "B", or no unit at all, means bytes. Units are not case
+// sensitive. It returns an error if s isn't a valid size.
+func ParseSize(s string) (int64, error) {
+	invalid := fmt.Errorf("invalid size %q", s)
+	text := strings.TrimSpace(s)
+	i := 0
+	for i < len(text) && (text[i] == '.' || text[i] >= '0' && text[i] <= '9') {
+		i++
+	}
+	n, err := strconv.ParseFloat(text[:i], 64)
+	if err != nil {
+		return 0, invalid
+	}
+	unit := strings.ToLower(strings.TrimSpace(text[i:]))
+	base, suffix := 1024.0, unit
+	switch {
+	case unit == "" || unit == "b":
+		return int64(math.Round(n)), nil
+	case len(unit) == 3 && strings.HasSuffix(unit, "ib"):
+		suffix = unit[:1]
+	case len(unit) == 2 && strings.HasSuffix(unit, "b"):
+		base, suffix = 1000, unit[:1]
+	}
+	power := strings.Index("kmgtp", suffix)
+	if len(suffix) != 1 || power < 0 {
+		return 0, invalid
+	}
+	size := n * math.Pow(base, float64(power+1))
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q too large", s)
+	}
+	return int64(math.Round(size)), nil
+}
+
 // Post creates a pipe that makes an HTTP POST request to url, with an empty
 // body, and produces the response. See [Pipe.Do] for how the HTTP response
 // status is interpreted.
@@ -184,6 +725,58 @@ func Post(url string) *Pipe {
 	return NewPipe().Post(url)
 }
 
+// RegisterStage makes stage available to [FromSpec] under the given name,
+// replacing any existing stage with that name. The stage's arguments from the
+// spec are passed to it as strings. For example, to add a stage that
+// uppercases its input:
+//
+//	script.RegisterStage("Upper", func(p *script.Pipe, args []string) (*script.Pipe, error) {
+//		return p.FilterLine(strings.ToUpper), nil
+//	})
+//
+// A stage that ignores p, and returns a new pipe instead, discards the output
+// of any stages before it in the spec.
+func RegisterStage(name string, stage Stage) {
+	stagesMu.Lock()
+	defer stagesMu.Unlock()
+	stages[name] = stage
+}
+
+// RunCommands runs the subcommand named by the program's first argument, as
+// registered with [Command], in the same way as [Main]. The subcommand name is
+// removed from [os.Args] first, so that [Args] produces only the arguments
+// that follow it.
+//
+// If the first argument is “-h”, “-help”, “--help” or “help”, RunCommands
+// prints the names of the available subcommands and exits with status 0.
+// If there is no first argument, or it doesn't name a registered subcommand,
+// RunCommands prints the same list to standard error and exits with status 2.
+// If the subcommand's pipe ends with its error status set, RunCommands prints
+// the error and exits with the pipe's [Pipe.ExitStatus], or 1 if that is zero.
+func RunCommands() {
+	prog := filepath.Base(os.Args[0])
+	if len(os.Args) < 2 {
+		printCommands(os.Stderr, prog)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	switch name {
+	case "-h", "-help", "--help", "help":
+		printCommands(os.Stdout, prog)
+		os.Exit(0)
+	}
+	commandsMu.RLock()
+	run, ok := commands[name]
+	commandsMu.RUnlock()
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: unknown command %q\n", prog, name)
+		printCommands(os.Stderr, prog)
+		os.Exit(2)
+	}
+	os.Args = append([]string{os.Args[0]}, os.Args[2:]...)
+	Main(run)
+}
+
 // Slice creates a pipe containing each element of s, one per line. If s is
 // empty or nil, then the pipe is empty.
 func Slice(s []string) *Pipe {
@@ -198,874 +791,8409 @@ func Stdin() *Pipe {
 	return NewPipe().WithReader(os.Stdin)
 }
 
-// AppendFile appends the contents of the pipe to the file path, creating it if
-// necessary, and returns the number of bytes successfully written, or an
-// error.
-func (p *Pipe) AppendFile(path string) (int64, error) {
-	return p.writeOrAppendFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
-}
-
-// Basename reads paths from the pipe, one per line, and removes any leading
-// directory components from each. So, for example, /usr/local/bin/foo would
-// become just foo. This is the complementary operation to [Pipe.Dirname].
+// Step waits for p to finish, as [Pipe.Wait] does, showing its progress as a
+// step in a multi-step process, such as an installation script. While p is
+// running, Step shows label beside a spinner, and when it's finished, Step
+// shows a tick (✓) or a cross (✗), according to whether p succeeded, with
+// the time it took, and the error, if any:
 //
-// If any line is empty, Basename will transform it to a single dot. Trailing
-// slashes are removed. The behaviour of Basename is the same as
-// [filepath.Base] (not by coincidence).
-func (p *Pipe) Basename() *Pipe {
-	return p.FilterLine(filepath.Base)
-}
-
-// Bytes returns the contents of the pipe as a []byte, or an error.
-func (p *Pipe) Bytes() ([]byte, error) {
-	if p.Error() != nil {
-		return nil, p.Error()
+//	✓ Downloading release (1.4s)
+//	✗ Verifying checksum (0.2s): unexpected HTTP response status: 404 Not Found
+//
+// Output goes to the pipe's standard output (see [Pipe.WithStdout]). The
+// spinner is only shown if that's a terminal, so logs don't fill up with
+// animation frames. The pipe's own output is discarded.
+func Step(label string, p *Pipe) error {
+	out := p.stdOut()
+	f, ok := out.(*os.File)
+	animate := ok && ttyWidth(f) > 0
+	start := time.Now()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if animate {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(100 * time.Millisecond)
+			defer ticker.Stop()
+			frames := []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+			for i := 0; ; i++ {
+				fmt.Fprintf(out, "\r%c %s", frames[i%len(frames)], label)
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
 	}
-	data, err := io.ReadAll(p)
+	err := p.Wait()
+	close(done)
+	wg.Wait()
+	if animate {
+		fmt.Fprint(out, "\r\x1b[K")
+	}
+	elapsed := time.Since(start).Round(100 * time.Millisecond)
 	if err != nil {
-		p.SetError(err)
+		fmt.Fprintf(out, "✗ %s (%s): %v\n", label, elapsed, err)
+		return err
 	}
-	return data, p.Error()
-}
-
-// Close closes the pipe's associated reader. This is a no-op if the reader is
-// not an [io.Closer].
-func (p *Pipe) Close() error {
-	return p.Reader.Close()
-}
-
-// Column produces column col of each line of input, where the first column is
-// column 1, and columns are delimited by Unicode whitespace. Lines containing
-// fewer than col columns will be skipped.
-func (p *Pipe) Column(col int) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		columns := strings.Fields(line)
-		if col > 0 && col <= len(columns) {
-			fmt.Fprintln(w, columns[col-1])
-		}
-	})
+	fmt.Fprintf(out, "✓ %s (%s)\n", label, elapsed)
+	return nil
 }
 
-// Concat reads paths from the pipe, one per line, and produces the contents of
-// all the corresponding files in sequence. If there are any errors (for
-// example, non-existent files), these will be ignored, execution will
-// continue, and the pipe's error status will not be set.
-//
-// This makes it convenient to write programs that take a list of paths on the
-// command line. For example:
+// Sync copies new and changed files from the directory tree srcDir to dstDir,
+// creating dstDir and any subdirectories as necessary, like a simple version
+// of rsync. It produces a report of the changes made, one per line, giving
+// the kind of change and the path relative to dstDir:
 //
-//	script.Args().Concat().Stdout()
-//
-// The list of paths could also come from a file:
-//
-//	script.File("filelist.txt").Concat()
-//
-// Or from the output of a command:
+//	new docs/index.html
+//	changed config.yaml
+//	deleted old.txt
 //
-//	script.Exec("ls /var/app/config/").Concat().Stdout()
+// By default, a file is considered changed if its size or modification time
+// differs from the copy in dstDir. Copied files get the same permissions and
+// modification time as the originals, so unchanged files are skipped on the
+// next run. Only directories and regular files are synced: other kinds of
+// file, such as symlinks, are ignored.
 //
-// Each input file will be closed once it has been fully read. If any of the
-// files can't be opened or read, Concat will simply skip these and carry on,
-// without setting the pipe's error status. This mimics the behaviour of Unix
-// cat(1).
-func (p *Pipe) Concat() *Pipe {
-	var readers []io.Reader
-	p.FilterScan(func(line string, w io.Writer) {
-		input, err := os.Open(line)
-		if err == nil {
-			readers = append(readers, NewReadAutoCloser(input))
+// The behaviour can be changed by passing one or more [SyncOption] values:
+// [SyncChecksum] compares the contents of files instead, and [SyncDelete]
+// removes any files in dstDir that aren't in srcDir. If an error occurs, the
+// sync stops, and the pipe's error status is set.
+func Sync(srcDir, dstDir string, opts ...SyncOption) *Pipe {
+	var checksum, remove bool
+	for _, opt := range opts {
+		switch opt {
+		case SyncChecksum:
+			checksum = true
+		case SyncDelete:
+			remove = true
 		}
-	}).Wait()
-	return p.WithReader(io.MultiReader(readers...))
-}
-
-// CountLines returns the number of lines of input, or an error.
-func (p *Pipe) CountLines() (lines int, err error) {
-	p.FilterScan(func(line string, w io.Writer) {
-		lines++
-	}).Wait()
-	return lines, p.Error()
-}
-
-// DecodeBase64 produces the string represented by the base64 encoded input.
-func (p *Pipe) DecodeBase64() *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		decoder := base64.NewDecoder(base64.StdEncoding, r)
-		_, err := io.Copy(w, decoder)
+	}
+	report := new(strings.Builder)
+	present := map[string]bool{}
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		return nil
-	})
-}
-
-// Dirname reads paths from the pipe, one per line, and produces only the
-// parent directories of each path. For example, /usr/local/bin/foo would
-// become just /usr/local/bin. This is the complementary operation to
-// [Pipe.Basename].
-//
-// If a line is empty, Dirname will transform it to a single dot. Trailing
-// slashes are removed, unless Dirname returns the root folder. Otherwise, the
-// behaviour of Dirname is the same as [filepath.Dir] (not by coincidence).
-func (p *Pipe) Dirname() *Pipe {
-	return p.FilterLine(func(line string) string {
-		// filepath.Dir() does not handle trailing slashes correctly
-		if len(line) > 1 && strings.HasSuffix(line, "/") {
-			line = line[:len(line)-1]
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
 		}
-		dirname := filepath.Dir(line)
-		// filepath.Dir() does not preserve a leading './'
-		if strings.HasPrefix(line, "./") {
-			return "./" + dirname
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
 		}
-		return dirname
-	})
-}
-
-// Do performs the HTTP request req using the pipe's configured HTTP client, as
-// set by [Pipe.WithHTTPClient], or [http.DefaultClient] otherwise. The
-// response body is streamed concurrently to the pipe's output. If the response
-// status is anything other than HTTP 200-299, the pipe's error status is set.
-func (p *Pipe) Do(req *http.Request) *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		resp, err := p.httpClient.Do(req)
+		present[rel] = true
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		defer resp.Body.Close()
-		_, err = io.Copy(w, resp.Body)
-		if err != nil {
+		dst := filepath.Join(dstDir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dst, info.Mode().Perm()|0o700)
+		}
+		change, err := syncChange(path, dst, info, checksum)
+		if err != nil || change == "" {
 			return err
 		}
-		// Any HTTP 2xx status code is considered okay
-		if resp.StatusCode/100 != 2 {
-			return fmt.Errorf("unexpected HTTP response status: %s", resp.Status)
+		err = syncFile(path, dst, info)
+		if err != nil {
+			return err
 		}
+		fmt.Fprintln(report, change, rel)
 		return nil
 	})
+	if err == nil && remove {
+		err = filepath.WalkDir(dstDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dstDir, path)
+			if err != nil || present[rel] {
+				return err
+			}
+			err = os.RemoveAll(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(report, "deleted", rel)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		})
+	}
+	p := Echo(report.String())
+	if err != nil {
+		p.SetError(err)
+	}
+	return p
 }
 
-// EachLine calls the function process on each line of input, passing it the
-// line as a string, and a [*strings.Builder] to write its output to.
+// TailFile creates a pipe containing the last n lines of the file path, like
+// Unix tail(1). Unlike File(path).Last(n), TailFile reads the file backwards
+// from the end, rather than scanning all of it, so it's efficient even for
+// very large files. If n is zero or negative, there is no output at all.
 //
-// Deprecated: use [Pipe.FilterLine] or [Pipe.FilterScan] instead, which run
-// concurrently and don't do unnecessary reads on the input.
-func (p *Pipe) EachLine(process func(string, *strings.Builder)) *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
-		output := new(strings.Builder)
-		for scanner.Scan() {
-			process(scanner.Text(), output)
+// If path is not a regular file (for example, if it's a named pipe), TailFile
+// falls back to reading all of it, as for [Pipe.Last].
+func TailFile(path string, n int) *Pipe {
+	f, err := os.Open(path)
+	if err != nil {
+		return NewPipe().WithError(err)
+	}
+	if n <= 0 {
+		f.Close()
+		return NewPipe()
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return NewPipe().WithError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return NewPipe().WithReader(f).Last(n)
+	}
+	offset, err := tailOffset(f, info.Size(), n)
+	if err != nil {
+		f.Close()
+		return NewPipe().WithError(err)
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return NewPipe().WithError(err)
+	}
+	return NewPipe().WithReader(f)
+}
+
+// Target rebuilds the file dst from the source files listed in srcs, one per
+// line, but only if it needs rebuilding, like a rule in a Makefile. If dst
+// doesn't exist, or any of the source files has been modified more recently
+// than dst, Target calls build with a pipe listing the source files, and
+// returns any error it returns. Otherwise, build is not called, and Target
+// returns nil. For example:
+//
+//	err := script.Target("site.css", script.ListFiles("css/*.css"), func(srcs *script.Pipe) error {
+//		_, err := srcs.Concat().WriteFile("site.css")
+//		return err
+//	})
+//
+// If srcs has an error status, or any of the source files doesn't exist,
+// Target returns the error without calling build.
+func Target(dst string, srcs *Pipe, build func(*Pipe) error) error {
+	paths, err := srcs.Slice()
+	if err != nil {
+		return err
+	}
+	var newest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
 		}
-		fmt.Fprint(w, output.String())
-		return scanner.Err()
-	})
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	info, err := os.Stat(dst)
+	if err == nil && !newest.After(info.ModTime()) {
+		return nil
+	}
+	return build(Slice(paths))
 }
 
-// Echo sets the pipe's reader to one that produces the string s, detaching any
-// existing reader without draining or closing it.
-func (p *Pipe) Echo(s string) *Pipe {
+// AppendFile appends the contents of the pipe to the file path, creating it if
+// necessary, and returns the number of bytes successfully written, or an
+// error.
+func (p *Pipe) AppendFile(path string) (int64, error) {
+	return p.writeOrAppendFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+}
+
+// AppendFileRotating is like [Pipe.AppendFile], but keeps the size of the
+// file path below maxBytes by rotating it, as log rotation tools do. Whenever
+// appending the next line of input would take the file over maxBytes, it's
+// renamed to path.1, any existing path.1 is renamed to path.2, and so on, up
+// to keep old files, and the oldest is removed. Writing then continues to a
+// new, empty file at path. If keep is zero or negative, the file is simply
+// emptied instead. Lines are never split across files, so a single line longer
+// than maxBytes gets a file of its own.
+//
+// AppendFileRotating returns the total number of bytes successfully written,
+// or an error.
+func (p *Pipe) AppendFileRotating(path string, maxBytes int64, keep int) (int64, error) {
 	if p.Error() != nil {
-		return p
+		return 0, p.Error()
 	}
-	return p.WithReader(strings.NewReader(s))
+	if dw := p.dryRunWriter(); dw != nil {
+		return p.writeOrAppendFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+	}
+	open := func() (*os.File, int64, error) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+	out, size, err := open()
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	recordWrite(path)
+	defer func() {
+		out.Close()
+	}()
+	var wrote int64
+	r := bufio.NewReader(p)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if size > 0 && size+int64(len(line)) > maxBytes {
+				out.Close()
+				err := rotateFile(path, keep)
+				if err == nil {
+					out, size, err = open()
+				}
+				if err != nil {
+					p.SetError(err)
+					return wrote, err
+				}
+			}
+			n, err := out.Write(line)
+			wrote += int64(n)
+			size += int64(n)
+			if err != nil {
+				p.SetError(err)
+				return wrote, err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			p.SetError(readErr)
+			return wrote, readErr
+		}
+	}
+	return wrote, p.Error()
 }
 
-// EncodeBase64 produces the base64 encoding of the input.
-func (p *Pipe) EncodeBase64() *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		encoder := base64.NewEncoder(base64.StdEncoding, w)
-		defer encoder.Close()
-		_, err := io.Copy(encoder, r)
+// AppendJSONArray reads JSON values from the pipe, such as the records
+// produced by [Pipe.JQ], and appends them to the JSON array in the file path,
+// creating it if necessary. The file is rewritten atomically, as by
+// [Pipe.WriteFileAtomic], so it's never left half-written, and if the input
+// contains invalid JSON, or the file doesn't contain an array, the file is
+// left unchanged and the pipe's error status is set. AppendJSONArray returns
+// the size in bytes of the updated file, or an error.
+func (p *Pipe) AppendJSONArray(path string) (int64, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	var records []json.RawMessage
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		p.SetError(err)
+		return 0, err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		err = json.Unmarshal(data, &records)
 		if err != nil {
-			return err
+			err = fmt.Errorf("%s: %w", path, err)
+			p.SetError(err)
+			return 0, err
 		}
-		return nil
+	}
+	dec := json.NewDecoder(p)
+	for {
+		var record json.RawMessage
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.SetError(err)
+			return 0, err
+		}
+		records = append(records, record)
+	}
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	if records == nil {
+		records = []json.RawMessage{}
+	}
+	out, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	out = append(out, '\n')
+	if dw := p.dryRunWriter(); dw != nil {
+		fmt.Fprintf(dw, "write: %d bytes to %s\n", len(out), path)
+		return 0, nil
+	}
+	wrote, err := writeFileAtomic(path, false, "", func(w io.Writer) (int64, error) {
+		n, err := w.Write(out)
+		return int64(n), err
 	})
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	return wrote, nil
 }
 
-func (p *Pipe) environment() []string {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	return p.env
+// Basename reads paths from the pipe, one per line, and removes any leading
+// directory components from each. So, for example, /usr/local/bin/foo would
+// become just foo. This is the complementary operation to [Pipe.Dirname].
+//
+// If any line is empty, Basename will transform it to a single dot. Trailing
+// slashes are removed. The behaviour of Basename is the same as
+// [filepath.Base] (not by coincidence), so on Windows it understands
+// drive-relative paths (C:foo), UNC shares, and long paths with the \\?\
+// prefix.
+func (p *Pipe) Basename() *Pipe {
+	return p.FilterLine(filepath.Base)
 }
 
-// Error returns any error present on the pipe, or nil otherwise.
-// Error is not a sink and does not wait until the pipe reaches
-// completion. To wait for completion before returning the error,
-// see [Pipe.Wait].
-func (p *Pipe) Error() error {
+// BottomBy is like [Pipe.TopBy], but produces the n lines with the smallest
+// numbers in column col, smallest first.
+func (p *Pipe) BottomBy(col, n int) *Pipe {
+	return p.topBy(col, n, func(x, y float64) bool {
+		return x < y
+	})
+}
+
+// breakerLimit returns the number of consecutive failures set by
+// [Pipe.WithCircuitBreaker], or zero if there is no limit.
+func (p *Pipe) breakerLimit() int {
 	if p.mu == nil { // uninitialised pipe
-		return nil
+		return 0
 	}
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	return p.err
+	return p.breaker
 }
 
-// Exec runs cmdLine as an external command, sending it the contents of the
-// pipe as input, and produces the command's standard output (see below for
-// error output). The effect of this is to filter the contents of the pipe
-// through the external command.
-//
-// # Environment
-//
-// The command inherits the current process's environment, optionally modified
-// by [Pipe.WithEnv].
+// Bytes returns the contents of the pipe as a []byte, or an error.
+func (p *Pipe) Bytes() ([]byte, error) {
+	if p.Error() != nil {
+		return nil, p.Error()
+	}
+	data, err := io.ReadAll(p)
+	if err != nil {
+		p.SetError(err)
+	}
+	return data, p.Error()
+}
+
+// CacheTo caches the output of the next stage added to the pipe (such as
+// [Pipe.Exec], [Pipe.Get], or any other filter) in the file path. If the file
+// already exists, and is younger than ttl, the stage is not run at all:
+// instead, the cached output is produced, and the stage's input is ignored.
+// Otherwise, the stage runs as usual, and if it succeeds, its output is saved
+// to path for next time. If ttl is zero or negative, the cached output never
+// expires.
 //
-// # Error handling
+// This is useful during development of scripts that repeatedly query slow
+// services, such as package indexes or cloud inventories:
 //
-// If the command had a non-zero exit status, the pipe's error status will also
-// be set to the string “exit status X”, where X is the integer exit status.
-// Even in the event of a non-zero exit status, the command's output will still
-// be available in the pipe. This is often helpful for debugging. However,
-// because [Pipe.String] is a no-op if the pipe's error status is set, if you
-// want output you will need to reset the error status before calling
-// [Pipe.String].
+//	NewPipe().CacheTo(".cache/instances.json", time.Hour).Exec("aws ec2 describe-instances")
 //
-// If the command writes to its standard error stream, this will also go to the
-// pipe, along with its standard output. However, the standard error text can
-// instead be redirected to a supplied writer, using [Pipe.WithStderr].
-func (p *Pipe) Exec(cmdLine string) *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		args, err := shell.Fields(cmdLine, nil)
-		if err != nil {
-			return err
-		}
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdin = r
-		cmd.Stdout = w
-		cmd.Stderr = w
-		pipeStderr := p.stdErr()
-		if pipeStderr != nil {
-			cmd.Stderr = pipeStderr
-		}
-		pipeEnv := p.environment()
-		if pipeEnv != nil {
-			cmd.Env = pipeEnv
-		}
-		err = cmd.Start()
-		if err != nil {
-			fmt.Fprintln(cmd.Stderr, err)
-			return err
-		}
-		return cmd.Wait()
-	})
+// To force the stage to run again, delete the cache file.
+func (p *Pipe) CacheTo(path string, ttl time.Duration) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cache = &stageCache{path: path, ttl: ttl}
+	return p
 }
 
-// ExecForEach renders cmdLine as a Go template for each line of input, running
-// the resulting command, and produces the combined output of all these
-// commands in sequence. See [Pipe.Exec] for details on error handling and
-// environment variables.
+// Changed reads paths from the pipe, one per line, and produces only those
+// whose contents have changed since the last time they were seen by Changed,
+// using the same stateFile. This makes it easy to write incremental scripts
+// that only reprocess files that have changed since the last run:
 //
-// This is mostly useful for substituting data into commands using Go template
-// syntax. For example:
+//	FindFiles("images").Changed(".thumbnails.state").ExecForEach("make-thumb {{.}}").Wait()
 //
-//	ListFiles("*").ExecForEach("touch {{.}}").Wait()
-func (p *Pipe) ExecForEach(cmdLine string) *Pipe {
-	tpl, err := template.New("").Parse(cmdLine)
+// The state file records the SHA-256 hash of each file, in the same format as
+// the output of sha256sum(1). If it doesn't exist, every file is considered
+// changed. The state file is updated with the new hashes only once the whole
+// pipe has finished, that is, once its contents have been read to the end, as
+// by [Pipe.Wait], provided that the pipe's error status is not set, so that a
+// failure in any later stage means the files are processed again next time.
+// Any files that cannot be opened or read will be ignored.
+func (p *Pipe) Changed(stateFile string) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	state, order, err := readHashState(stateFile)
 	if err != nil {
 		return p.WithError(err)
 	}
 	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
+		scanner := p.newScanner(r)
 		for scanner.Scan() {
-			cmdLine := new(strings.Builder)
-			err := tpl.Execute(cmdLine, scanner.Text())
-			if err != nil {
-				return err
-			}
-			args, err := shell.Fields(cmdLine.String(), nil)
+			path := scanner.Text()
+			sum, err := File(path).Hash(sha256.New())
 			if err != nil {
-				return err
-			}
-			cmd := exec.Command(args[0], args[1:]...)
-			cmd.Stdout = w
-			cmd.Stderr = w
-			pipeStderr := p.stdErr()
-			if pipeStderr != nil {
-				cmd.Stderr = pipeStderr
-			}
-			if p.env != nil {
-				cmd.Env = p.env
+				continue // skip unreadable files
 			}
-			err = cmd.Start()
-			if err != nil {
-				fmt.Fprintln(cmd.Stderr, err)
+			old, ok := state[path]
+			if ok && old == sum {
 				continue
 			}
-			err = cmd.Wait()
-			if err != nil {
-				fmt.Fprintln(cmd.Stderr, err)
-				continue
+			if !ok {
+				order = append(order, path)
 			}
+			state[path] = sum
+			fmt.Fprintln(w, path)
 		}
-		return scanner.Err()
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		p.onSuccess(func() error {
+			output := new(strings.Builder)
+			for _, path := range order {
+				fmt.Fprintf(output, "%s  %s\n", state[path], path)
+			}
+			return os.WriteFile(stateFile, []byte(output.String()), 0o666)
+		})
+		return nil
 	})
 }
 
-var exitStatusPattern = regexp.MustCompile(`exit status (\d+)$`)
-
-// ExitStatus returns the integer exit status of a previous command (for
-// example run by [Pipe.Exec]). This will be zero unless the pipe's error
-// status is set and the error matches the pattern “exit status %d”.
-func (p *Pipe) ExitStatus() int {
-	if p.Error() == nil {
-		return 0
+// Checkpoint makes a long batch pipeline resumable after an interruption. It
+// skips any input lines that were recorded in stateFile as successfully
+// processed on a previous run, and, if the stage immediately after it is one
+// that acts on each line, such as [Pipe.ExecForEach], [Pipe.ExecForEachMap],
+// or [Pipe.GetEach], makes that stage record each line in stateFile as soon
+// as it has processed it successfully. Lines that failed, or weren't reached,
+// are processed again when the pipeline is re-run with the same stateFile:
+//
+//	File("uploads.txt").Checkpoint(".uploads.done").ExecForEach("upload {{.}}").Wait()
+//
+// No other stage records anything, not even a per-line stage that comes
+// later, because its input lines may no longer be the lines that Checkpoint
+// skips: for example, after [Pipe.Column] has transformed them. To process
+// transformed lines, transform them before Checkpoint, not after.
+//
+// Lines are identified by their contents, so a line that occurs more than
+// once is skipped entirely once it has been processed. If stateFile doesn't
+// exist, no lines are skipped; it's created when the first line is recorded.
+// Delete it to start the batch from scratch. If stateFile can't be read, the
+// pipe's error status is set.
+func (p *Pipe) Checkpoint(stateFile string) *Pipe {
+	if p.Error() != nil {
+		return p
 	}
-	match := exitStatusPattern.FindStringSubmatch(p.Error().Error())
-	if len(match) < 2 {
-		return 0
+	done := map[string]bool{}
+	data, err := os.ReadFile(stateFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return p.WithError(err)
 	}
-	status, err := strconv.Atoi(match[1])
-	if err != nil {
-		// This seems unlikely, but...
-		return 0
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			done[line] = true
+		}
 	}
-	return status
+	p = p.FilterScan(func(line string, w io.Writer) {
+		if !done[line] {
+			fmt.Fprintln(w, line)
+		}
+	})
+	// Set after the filter is added, since adding any filter discards it
+	p.mu.Lock()
+	p.checkpoint = &checkpoint{path: stateFile}
+	p.mu.Unlock()
+	return p
 }
 
-// Filter sends the contents of the pipe to the function filter and produces
-// the result. filter takes an [io.Reader] to read its input from and an
-// [io.Writer] to write its output to, and returns an error, which will be set
-// on the pipe.
+// ChunkCDC splits the pipe's contents into chunks at content-defined
+// boundaries, averaging roughly avgSize bytes each, and produces one line per
+// chunk containing the chunk's SHA-256 hash, its offset in the input, and its
+// length in bytes, separated by spaces:
 //
-// filter runs concurrently, so its goroutine will not exit until the pipe has
-// been fully read. Use [Pipe.Wait] to wait for all concurrent filters to
-// complete.
-func (p *Pipe) Filter(filter func(io.Reader, io.Writer) error) *Pipe {
+//	9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08 0 8021
+//
+// Because chunk boundaries depend only on the data near them, inserting or
+// deleting bytes changes only the chunks around the edit: the rest keep the
+// same hashes. This makes ChunkCDC useful for deduplication and incremental
+// backups. If avgSize is zero or negative, chunks average 8 KiB.
+func (p *Pipe) ChunkCDC(avgSize int) *Pipe {
+	if avgSize <= 0 {
+		avgSize = 8 * 1024
+	}
+	bits := 0
+	for 1<<(bits+1) <= avgSize {
+		bits++
+	}
+	minSize, maxSize := avgSize/4, avgSize*8
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		hasher := sha256.New()
+		var offset, size int64
+		var fp uint64
+		emit := func() {
+			fmt.Fprintf(w, "%x %d %d\n", hasher.Sum(nil), offset, size)
+			offset += size
+			size, fp = 0, 0
+			hasher.Reset()
+		}
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := r.Read(buf)
+			// Hash each run of bytes belonging to the same chunk in one go,
+			// when the chunk ends or the buffer runs out
+			start := 0
+			for i, b := range buf[:n] {
+				size++
+				fp = fp<<1 + gearTable[b]
+				if size >= int64(maxSize) || size >= int64(minSize) && fp>>(64-bits) == 0 {
+					hasher.Write(buf[start : i+1])
+					start = i + 1
+					emit()
+				}
+			}
+			hasher.Write(buf[start:n])
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if size > 0 {
+			emit()
+		}
+		return nil
+	})
+}
+
+// Cleanup calls fn once all the pipe's contents up to this point have been
+// read, whether or not there was an error, so that resources used by earlier
+// stages, such as temporary files or background processes, can be released
+// as soon as the pipeline is done with them:
+//
+//	File(tmp).Cleanup(func() { os.Remove(tmp) }).Match("error").Stdout()
+//
+// If the program exits first, by way of [Main] or [Pipe.ExitOnError], or
+// because of a signal, fn is called then, as for [OnExit], which explains how
+// signals are handled meanwhile. Either way, fn is called at most once. If
+// the pipe's error status is already set, fn is called straight away.
+func (p *Pipe) Cleanup(fn func()) *Pipe {
 	if p.Error() != nil {
+		fn()
 		return p
 	}
-	pr, pw := io.Pipe()
-	origReader := p.Reader
-	p = p.WithReader(pr)
-	go func() {
-		defer pw.Close()
-		err := filter(origReader, pw)
-		if err != nil {
-			p.SetError(err)
+	h := addExitHook(fn)
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		defer func() {
+			removeExitHook(h)
+			h.run()
+		}()
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// Close closes the pipe's associated reader. This is a no-op if the reader is
+// not an [io.Closer].
+func (p *Pipe) Close() error {
+	return p.Reader.Close()
+}
+
+// Column produces column col of each line of input, where the first column is
+// column 1, and columns are delimited by Unicode whitespace. Lines containing
+// fewer than col columns will be skipped.
+func (p *Pipe) Column(col int) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		columns := strings.Fields(line)
+		if col > 0 && col <= len(columns) {
+			fmt.Fprintln(w, columns[col-1])
 		}
-	}()
-	return p
+	})
 }
 
-// FilterLine sends the contents of the pipe to the function filter, a line at
-// a time, and produces the result. filter takes each line as a string and
-// returns a string as its output. See [Pipe.Filter] for concurrency handling.
-func (p *Pipe) FilterLine(filter func(string) string) *Pipe {
+// Columns produces the columns cols of each line of input, in the order given,
+// joined by a single space, or by the separator set with
+// [Pipe.WithOutputSeparator], like awk '{print $3, $1}'. Columns are numbered
+// and delimited as for [Pipe.Column], and a column may be given more than
+// once. Lines containing fewer columns than the highest requested will be
+// skipped. For example, to list the owner and name of each file:
+//
+//	Exec("ls -l").Columns(3, 9).Stdout()
+func (p *Pipe) Columns(cols ...int) *Pipe {
+	sep := p.outputSeparator()
+	max := 0
+	for _, col := range cols {
+		if col < 1 {
+			return p.WithError(fmt.Errorf("invalid column %d", col))
+		}
+		if col > max {
+			max = col
+		}
+	}
 	return p.FilterScan(func(line string, w io.Writer) {
-		fmt.Fprintln(w, filter(line))
+		columns := strings.Fields(line)
+		if len(columns) < max {
+			return
+		}
+		selected := make([]string, len(cols))
+		for i, col := range cols {
+			selected[i] = columns[col-1]
+		}
+		fmt.Fprintln(w, strings.Join(selected, sep))
 	})
 }
 
-// FilterScan sends the contents of the pipe to the function filter, a line at
-// a time, and produces the result. filter takes each line as a string and an
-// [io.Writer] to write its output to. See [Pipe.Filter] for concurrency
-// handling.
-func (p *Pipe) FilterScan(filter func(string, io.Writer)) *Pipe {
+// commandOutput returns the writer that commands run by [Pipe.Exec] and
+// [Pipe.ExecForEach] should write their output to, given the pipe writer w.
+// In pass-through mode (see [Pipe.WithPassthrough]), this also copies the
+// output to the pipe's standard output.
+func (p *Pipe) commandOutput(w io.Writer) io.Writer {
+	if p.mu == nil { // uninitialised pipe
+		return w
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.passthrough || p.stdout == nil {
+		return w
+	}
+	return io.MultiWriter(w, p.stdout)
+}
+
+// Compute evaluates the arithmetic expression expr for each line of input,
+// and produces the line with the result appended as an extra column. In expr,
+// $1, $2, and so on refer to the numeric values of the line's columns, which
+// are numbered and delimited as for [Pipe.Column], and can be combined with
+// numbers, the operators +, -, *, /, and % (remainder), and parentheses. For
+// example, to add a column showing what percentage column 3 is of column 2:
+//
+//	p.Compute("$3 * 100 / $2")
+//
+// To replace an existing column instead, assign the result to it with "=",
+// like this:
+//
+//	p.Compute("$2 = $2 / 1024")
+//
+// If the line doesn't have that column, the result is appended.
+// A line that has a result is produced with its columns separated by single
+// spaces. If the expression can't be evaluated for some line, because a
+// column it refers to is missing or isn't a number, or because it divides by
+// zero, the line is produced unchanged. This makes it easy to keep header
+// lines. If expr isn't a valid expression, the pipe's error status is set.
+func (p *Pipe) Compute(expr string) *Pipe {
+	target, eval, err := parseComputation(expr)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.FilterScan(func(line string, w io.Writer) {
+		columns := strings.Fields(line)
+		result, err := eval(columns)
+		if err != nil {
+			fmt.Fprintln(w, line)
+			return
+		}
+		value := strconv.FormatFloat(result, 'f', -1, 64)
+		if target == 0 || target > len(columns) {
+			columns = append(columns, value)
+		} else {
+			columns[target-1] = value
+		}
+		fmt.Fprintln(w, strings.Join(columns, " "))
+	})
+}
+
+// Concat reads paths from the pipe, one per line, and produces the contents of
+// all the corresponding files in sequence. If there are any errors (for
+// example, non-existent files), these will be ignored, execution will
+// continue, and the pipe's error status will not be set.
+//
+// This makes it convenient to write programs that take a list of paths on the
+// command line. For example:
+//
+//	script.Args().Concat().Stdout()
+//
+// The list of paths could also come from a file:
+//
+//	script.File("filelist.txt").Concat()
+//
+// Or from the output of a command:
+//
+//	script.Exec("ls /var/app/config/").Concat().Stdout()
+//
+// Each input file will be closed once it has been fully read. If any of the
+// files can't be opened or read, Concat will simply skip these and carry on,
+// without setting the pipe's error status. This mimics the behaviour of Unix
+// cat(1).
+func (p *Pipe) Concat() *Pipe {
+	return p.concat(false, false)
+}
+
+// ConcatStrict is like [Pipe.Concat], except that if any of the files can't be
+// opened, the pipe's error status will be set to the last such error. This
+// means that a typo in a list of paths won't go unnoticed:
+//
+//	script.Args().ConcatStrict().Stdout()
+func (p *Pipe) ConcatStrict() *Pipe {
+	return p.concat(true, false)
+}
+
+// ConcatWithHeaders is like [Pipe.Concat], except that the contents of each
+// file are preceded by a header line giving its path, like the output of
+// head(1) with the -v flag:
+//
+//	==> testdata/test.txt <==
+//
+// The output for each file after the first is separated from the previous one
+// by an empty line. Files that can't be opened are skipped, and no header is
+// produced for them.
+func (p *Pipe) ConcatWithHeaders() *Pipe {
+	return p.concat(false, true)
+}
+
+// ConcatWithPrefix is like [Pipe.Concat], except that each line of the output
+// is prefixed with the path of the file it came from, and its line number
+// within that file, in the same format as [Pipe.MatchInFiles]:
+//
+//	testdata/test.txt:2:Hello, world.
+//
+// This preserves the origin of each line, so that later stages such as
+// [Pipe.Match] can report where their results were found. Files that can't be
+// opened are skipped, and any final line without a trailing newline will have
+// one added.
+func (p *Pipe) ConcatWithPrefix() *Pipe {
 	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
+		scanner := p.newScanner(r)
 		for scanner.Scan() {
-			filter(scanner.Text(), w)
+			path := scanner.Text()
+			f, err := os.Open(path)
+			if err != nil {
+				continue // skip unopenable files
+			}
+			lines := p.newScanner(f)
+			for n := 1; lines.Scan(); n++ {
+				fmt.Fprintf(w, "%s:%d:%s\n", path, n, lines.Text())
+			}
+			f.Close()
 		}
 		return scanner.Err()
 	})
 }
 
-// First produces only the first n lines of the pipe's contents, or all the
-// lines if there are less than n. If n is zero or negative, there is no output
-// at all. When n lines have been produced, First stops reading its input and
-// sends EOF to its output.
-func (p *Pipe) First(n int) *Pipe {
+func (p *Pipe) concat(strict, headers bool) *Pipe {
+	var readers []io.Reader
+	var openErr error
+	p.FilterScan(func(line string, w io.Writer) {
+		input, err := os.Open(line)
+		if err != nil {
+			openErr = err
+			return
+		}
+		if headers {
+			header := fmt.Sprintf("==> %s <==\n", line)
+			if len(readers) > 0 {
+				header = "\n" + header
+			}
+			readers = append(readers, strings.NewReader(header))
+		}
+		readers = append(readers, NewReadAutoCloser(input))
+	}).Wait()
+	p = p.WithReader(io.MultiReader(readers...))
+	if strict && openErr != nil {
+		p.SetError(openErr)
+	}
+	return p
+}
+
+// CopyFileMeta makes subsequent [Pipe.WriteFile], [Pipe.WriteFileAtomic], and
+// [Pipe.AppendFile] calls give the file they write the same metadata as the
+// file src: its permissions, including the executable bit, and its
+// modification time. If the program is running as root, the file also gets
+// the same owner and group as src, where the platform supports it. This is
+// useful for installer scripts, which would otherwise lose the executable bit
+// when copying binaries:
+//
+//	File("build/app").CopyFileMeta("build/app").WriteFile("/usr/local/bin/app")
+//
+// If src can't be read, or its metadata can't be applied, the pipe's error
+// status is set.
+func (p *Pipe) CopyFileMeta(src string) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metaSrc = src
+	return p
+}
+
+// CountDistinct returns an estimate of the number of distinct lines in the
+// pipe's contents, or an error. Unlike counting the output of [Pipe.Freq] or
+// [Pipe.Uniq], it uses a fixed, small amount of memory (about 16 KiB), however
+// many lines there are, by means of the HyperLogLog algorithm. The estimate
+// is usually within 1% of the true count, and exact for very small counts.
+// For example, to count the unique visitors in an enormous access log:
+//
+//	visitors, err := File("access.log").Column(1).CountDistinct()
+func (p *Pipe) CountDistinct() (int, error) {
+	hll := newHyperLogLog()
+	p.FilterBytes(func(line []byte, w io.Writer) {
+		hll.add(line)
+	}).Wait()
 	if p.Error() != nil {
-		return p
+		return 0, p.Error()
 	}
-	if n <= 0 {
-		return NewPipe()
+	return hll.count(), nil
+}
+
+// CountLines returns the number of lines of input, or an error.
+func (p *Pipe) CountLines() (lines int, err error) {
+	p.FilterScan(func(line string, w io.Writer) {
+		lines++
+	}).Wait()
+	return lines, p.Error()
+}
+
+// CSVColumn treats the contents of the pipe as CSV data, and produces field
+// col of each record, where the first field is field 1, one per line. Unlike
+// [Pipe.Column], it handles quoted fields correctly, including those
+// containing commas, spaces, escaped quotes, or line breaks; the quotes are
+// removed from the output. Records containing fewer than col fields will be
+// skipped. If the input isn't valid CSV, the pipe's error status is set.
+func (p *Pipe) CSVColumn(col int) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		cr := csv.NewReader(r)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if col > 0 && col <= len(record) {
+				fmt.Fprintln(w, record[col-1])
+			}
+		}
+	})
+}
+
+// DecodeBase64 produces the string represented by the base64 encoded input.
+func (p *Pipe) DecodeBase64() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		decoder := base64.NewDecoder(base64.StdEncoding, r)
+		_, err := io.Copy(w, decoder)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// DeframeLength32 reads length-prefixed frames, as produced by
+// [Pipe.FrameLength32], and produces the contents of each frame as a line of
+// output. If the input ends partway through a frame, the pipe's error status
+// is set.
+func (p *Pipe) DeframeLength32() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		header := make([]byte, 4)
+		for {
+			_, err := io.ReadFull(r, header)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("truncated frame header: %w", err)
+			}
+			err = copyFrame(w, r, int64(binary.BigEndian.Uint32(header)))
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// DeframeNetstring reads netstrings, as produced by [Pipe.FrameNetstring], and
+// produces the contents of each netstring as a line of output. If the input
+// isn't a valid sequence of netstrings, the pipe's error status is set.
+func (p *Pipe) DeframeNetstring() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		br := bufio.NewReader(r)
+		for {
+			digits, err := br.ReadString(':')
+			if err == io.EOF && digits == "" {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("truncated netstring length: %w", err)
+			}
+			n, err := strconv.ParseUint(strings.TrimSuffix(digits, ":"), 10, 63)
+			if err != nil {
+				return fmt.Errorf("invalid netstring length %q", digits)
+			}
+			err = copyFrame(w, br, int64(n))
+			if err != nil {
+				return err
+			}
+			comma, err := br.ReadByte()
+			if err != nil || comma != ',' {
+				return errors.New("netstring missing trailing comma")
+			}
+		}
+	})
+}
+
+// Delete makes an HTTP DELETE request to url, using the contents of the pipe
+// as the request body, and produces the server's response. See
+// [Pipe.Do] for how the HTTP response status is interpreted.
+func (p *Pipe) Delete(url string) *Pipe {
+	req, err := http.NewRequest(http.MethodDelete, url, p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.Do(req)
+}
+
+// DetectMIME reads paths from the pipe, one per line, and produces the MIME
+// type of each corresponding file, one per line, as detected from its contents
+// (not its name) by [net/http.DetectContentType]. For example:
+//
+//	text/plain; charset=utf-8
+//	image/png
+//
+// Any files that cannot be opened or read will be ignored. To detect the MIME
+// type of the contents of the pipe, see [Pipe.MIMEType].
+func (p *Pipe) DetectMIME() *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		f, err := os.Open(line)
+		if err != nil {
+			return // skip unopenable files
+		}
+		defer f.Close()
+		mimeType, err := detectMIME(f)
+		if err != nil {
+			return // skip unreadable files
+		}
+		fmt.Fprintln(w, mimeType)
+	})
+}
+
+// Dirname reads paths from the pipe, one per line, and produces only the
+// parent directories of each path. For example, /usr/local/bin/foo would
+// become just /usr/local/bin. This is the complementary operation to
+// [Pipe.Basename].
+//
+// If a line is empty, Dirname will transform it to a single dot. Trailing
+// slashes are removed, unless Dirname returns the root folder. Otherwise, the
+// behaviour of Dirname is the same as [filepath.Dir] (not by coincidence). On
+// Windows, that means volume names such as C: or \\host\share, including
+// those of long paths with the \\?\ prefix, are preserved, and a leading .\
+// is kept just as ./ is.
+func (p *Pipe) Dirname() *Pipe {
+	return p.FilterLine(func(line string) string {
+		// filepath.Dir() does not handle trailing slashes correctly, but the
+		// root of a volume (C:\, \\host\share\) keeps its slash
+		rest := line[len(filepath.VolumeName(line)):]
+		if len(rest) > 1 && os.IsPathSeparator(rest[len(rest)-1]) {
+			line = line[:len(line)-1]
+		}
+		dirname := filepath.Dir(line)
+		// filepath.Dir() does not preserve a leading './' (or '.\')
+		if len(line) > 1 && line[0] == '.' && os.IsPathSeparator(line[1]) {
+			return line[:2] + dirname
+		}
+		return dirname
+	})
+}
+
+// Do performs the HTTP request req using the pipe's configured HTTP client, as
+// set by [Pipe.WithHTTPClient], or [http.DefaultClient] otherwise. The
+// response body is streamed concurrently to the pipe's output. If the response
+// status is anything other than HTTP 200-299, the pipe's error status is set.
+func (p *Pipe) Do(req *http.Request) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		if dw := p.dryRunWriter(); dw != nil && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			fmt.Fprintf(dw, "http: %s %s\n", req.Method, req.URL)
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		return p.doRequest(req, w)
+	})
+}
+
+// doRequest performs req, as described for [Pipe.Do], and writes the
+// response body to w.
+func (p *Pipe) doRequest(req *http.Request, w io.Writer) error {
+	if d := p.stageTimeLimit(); d > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	if header := p.httpHeader(); len(header) > 0 {
+		req = req.Clone(req.Context())
+		for key, values := range header {
+			if _, ok := req.Header[key]; !ok {
+				req.Header[key] = values
+			}
+		}
+	}
+	send := func(req *http.Request) (*http.Response, error) {
+		resp, err := p.sendRequest(req)
+		if err == nil {
+			p.setResponse(resp)
+		}
+		return resp, err
+	}
+	if dir := p.httpCacheDir(); dir != "" && req.Method == http.MethodGet {
+		return doCached(send, req, w, dir)
+	}
+	resp, err := send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	// Any HTTP 2xx status code is considered okay
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected HTTP response status: %s", resp.Status)
+	}
+	return nil
+}
+
+// dryRunWriter returns the writer set by [Pipe.WithDryRun], or nil if the pipe
+// is not in dry-run mode.
+func (p *Pipe) dryRunWriter() io.Writer {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dryRun
+}
+
+// EachLine calls the function process on each line of input, passing it the
+// line as a string, and a [*strings.Builder] to write its output to.
+//
+// Deprecated: use [Pipe.FilterLine] or [Pipe.FilterScan] instead, which run
+// concurrently and don't do unnecessary reads on the input.
+func (p *Pipe) EachLine(process func(string, *strings.Builder)) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		output := new(strings.Builder)
+		for scanner.Scan() {
+			process(scanner.Text(), output)
+		}
+		fmt.Fprint(w, output.String())
+		return scanner.Err()
+	})
+}
+
+// Echo sets the pipe's reader to one that produces the string s, detaching any
+// existing reader without draining or closing it.
+func (p *Pipe) Echo(s string) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	return p.WithReader(strings.NewReader(s))
+}
+
+// EncodeBase64 produces the base64 encoding of the input.
+func (p *Pipe) EncodeBase64() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		encoder := base64.NewEncoder(base64.StdEncoding, w)
+		defer encoder.Close()
+		_, err := io.Copy(encoder, r)
+		if err != nil {
+			return err
+		}
+		return nil
+	})
+}
+
+func (p *Pipe) environment() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.env
+}
+
+// Error returns any error present on the pipe, or nil otherwise.
+// Error is not a sink and does not wait until the pipe reaches
+// completion. To wait for completion before returning the error,
+// see [Pipe.Wait].
+func (p *Pipe) Error() error {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// Exec runs cmdLine as an external command, sending it the contents of the
+// pipe as input, and produces the command's standard output (see below for
+// error output). The effect of this is to filter the contents of the pipe
+// through the external command.
+//
+// # Environment
+//
+// The command inherits the current process's environment, optionally modified
+// by [Pipe.WithEnv].
+//
+// # Error handling
+//
+// If the command had a non-zero exit status, the pipe's error status will also
+// be set to an [*ExecError] with the message “exit status X”, where X is the
+// integer exit status. The ExecError also records the command's exit status
+// and the end of its standard error output, for programs that need to examine
+// them. Even in the event of a non-zero exit status, the command's output
+// will still be available in the pipe. This is often helpful for debugging.
+// However, because [Pipe.String] is a no-op if the pipe's error status is
+// set, if you want output you will need to reset the error status before
+// calling [Pipe.String].
+//
+// If the command writes to its standard error stream, this will also go to the
+// pipe, along with its standard output. However, the standard error text can
+// instead be redirected to a supplied writer, using [Pipe.WithStderr].
+func (p *Pipe) Exec(cmdLine string) *Pipe {
+	return p.exec(cmdLine, nil)
+}
+
+// ExecArgs is like [Pipe.Exec], but runs the command name with the arguments
+// args exactly as given, instead of splitting a command line into arguments as
+// a shell would. This is safer when arguments come from untrusted input, or
+// contain spaces or quotes, such as filenames with apostrophes:
+//
+//	p.ExecArgs("grep", "-c", "it's here", path)
+func (p *Pipe) ExecArgs(name string, args ...string) *Pipe {
+	args = append([]string{name}, args...)
+	return p.exec(shellQuote(args), args)
+}
+
+// exec runs the command args, as described for [Pipe.Exec]. If args is nil,
+// the command is obtained by splitting cmdLine into arguments as a shell
+// would; otherwise, cmdLine is used only for dry runs and logging.
+func (p *Pipe) exec(cmdLine string, args []string) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		if dw := p.dryRunWriter(); dw != nil {
+			fmt.Fprintf(dw, "exec: %s\n", cmdLine)
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		if args == nil {
+			var err error
+			args, err = shell.Fields(cmdLine, nil)
+			if err != nil {
+				return err
+			}
+		}
+		abandoned := stageAbandoned(w)
+		w = p.commandOutput(w)
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = r
+		cmd.Stdout = w
+		cmd.Stderr = w
+		pipeStderr := p.stdErr()
+		if pipeStderr != nil {
+			cmd.Stderr = pipeStderr
+		}
+		pipeEnv := p.environment()
+		if pipeEnv != nil {
+			cmd.Env = pipeEnv
+		}
+		errOut := cmd.Stderr
+		err := p.runCommand(cmd, cmdLine, abandoned)
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			// The command couldn't be run at all
+			fmt.Fprintln(errOut, err)
+		}
+		return err
+	})
+}
+
+// ExecForEach renders cmdLine as a Go template for each line of input, running
+// the resulting command, and produces the combined output of all these
+// commands in sequence. See [Pipe.Exec] for details on error handling and
+// environment variables.
+//
+// This is mostly useful for substituting data into commands using Go template
+// syntax. For example:
+//
+//	ListFiles("*").ExecForEach("touch {{.}}").Wait()
+func (p *Pipe) ExecForEach(cmdLine string) *Pipe {
+	tpl, err := template.New("").Parse(cmdLine)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.execForEach(shellCommand(tpl), nil, 1)
+}
+
+// ExecForEachArgs is like [Pipe.ExecForEach], but runs the command name with
+// the arguments args, each rendered as a Go template for each line of input,
+// instead of splitting a rendered command line into arguments as a shell
+// would. Each argument is passed to the command exactly as rendered, even if
+// it contains spaces or quotes, so it's safe to use with arbitrary input:
+//
+//	ListFiles("*.txt").ExecForEachArgs("cp", "{{.}}", "/backup/{{.}}").Wait()
+func (p *Pipe) ExecForEachArgs(name string, args ...string) *Pipe {
+	tpls := make([]*template.Template, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		tpl, err := template.New("").Parse(arg)
+		if err != nil {
+			return p.WithError(err)
+		}
+		tpls = append(tpls, tpl)
+	}
+	return p.execForEach(argsCommand(tpls), nil, 1)
+}
+
+// ExecForEachMap is like [Pipe.ExecForEach], but instead of producing the
+// combined output of all the commands, it returns the output of each one in a
+// map keyed by the input line that produced it, or an error. This gives a
+// structured result for fan-out queries:
+//
+//	uptimes, err := File("hosts.txt").ExecForEachMap("ssh {{.}} uptime")
+//	fmt.Println("web1:", uptimes["web1"])
+//
+// As with ExecForEach, a command that fails doesn't stop the others: its
+// entry contains its output followed by the error. If any commands fail,
+// ExecForEachMap still returns the complete map, together with an error
+// summarising the failures, as [Summary.Err] does, which wraps the first
+// command's error. If the same line occurs more than once in the input, the
+// command is run for each occurrence, and the map holds the output of the
+// last one.
+func (p *Pipe) ExecForEachMap(cmdLine string) (map[string]string, error) {
+	tpl, err := template.New("").Parse(cmdLine)
+	if err != nil {
+		p.SetError(err)
+		return nil, err
+	}
+	render := shellCommand(tpl)
+	results := map[string]string{}
+	var summary Summary
+	c := p.takeCheckpoint()
+	err = p.Filter(func(r io.Reader, w io.Writer) error {
+		p.startBatch()
+		stderr := p.stdErr()
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			out := new(strings.Builder)
+			ran, err := p.execLine(scanner.Text(), render, nil, out, stderr, stageAbandoned(w), c)
+			if !ran {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			summary.add(err)
+			results[scanner.Text()] = out.String()
+		}
+		return scanner.Err()
+	}).Wait()
+	if err != nil {
+		return nil, err
+	}
+	return results, summary.Err()
+}
+
+// ExecForEachParallel is like [Pipe.ExecForEach], but runs up to workers
+// commands at once, which can be much faster when each command spends most of
+// its time waiting, as network clients such as curl or ssh usually do:
+//
+//	File("hosts.txt").ExecForEachParallel("ssh {{.}} uptime", 20).Stdout()
+//
+// The output of each command is collected, and produced in the same order as
+// the input lines, unless the pipe is [Pipe.Unordered], in which case each
+// command's output is produced as soon as it finishes.
+func (p *Pipe) ExecForEachParallel(cmdLine string, workers int) *Pipe {
+	tpl, err := template.New("").Parse(cmdLine)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.execForEach(shellCommand(tpl), nil, workers)
+}
+
+// ExecForEachStdin is like [Pipe.ExecForEach], but also renders stdin as a Go
+// template for each line of input, and sends the result to the command's
+// standard input, adding a final newline if there isn't one. This is useful
+// for commands that only accept data on their standard input. For example,
+// to send each line to the command as it is:
+//
+//	File("queries.sql").ExecForEachStdin("psql mydb", "{{.}}").Stdout()
+//
+// or to render a manifest from a template for each line:
+//
+//	Echo("web\napi\n").ExecForEachStdin("kubectl apply -f -", manifest).Wait()
+func (p *Pipe) ExecForEachStdin(cmdLine, stdin string) *Pipe {
+	tpl, err := template.New("").Parse(cmdLine)
+	if err != nil {
+		return p.WithError(err)
+	}
+	stdinTpl, err := template.New("").Parse(stdin)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.execForEach(shellCommand(tpl), stdinTpl, 1)
+}
+
+// execForEach runs the command returned by render for each line of input, as
+// described for [Pipe.ExecForEach]. If stdinTpl is not nil, the rendered text
+// is also sent to each command's standard input. If workers is greater than
+// 1, up to that many commands run concurrently, as described for
+// [Pipe.ExecForEachParallel].
+func (p *Pipe) execForEach(render commandRenderer, stdinTpl *template.Template, workers int) *Pipe {
+	c := p.takeCheckpoint()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		p.startBatch()
+		maxFailures := p.breakerLimit()
+		var run, failed, consecutive int
+		fail := func(err error) error {
+			failed++
+			consecutive++
+			if maxFailures > 0 && consecutive >= maxFailures {
+				return fmt.Errorf("giving up after %d consecutive failures (%d of %d commands failed), skipping remaining input: %w", consecutive, failed, run, err)
+			}
+			return nil
+		}
+		scanner := p.newScanner(r)
+		if workers <= 1 || p.dryRunWriter() != nil {
+			stderr := p.stdErr()
+			for scanner.Scan() {
+				ran, err := p.execLine(scanner.Text(), render, stdinTpl, w, stderr, stageAbandoned(w), c)
+				if !ran {
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				run++
+				if err != nil {
+					if err := fail(err); err != nil {
+						return err
+					}
+					continue
+				}
+				consecutive = 0
+			}
+			return scanner.Err()
+		}
+		stderr := p.stdErr()
+		if stderr != nil {
+			stderr = &syncWriter{w: stderr}
+		}
+		abandoned := stageAbandoned(w)
+		var mu sync.Mutex
+		var stop error
+		err := forEachLineConcurrently(scanner, w, workers, p.ordered(), func(line string) []byte {
+			mu.Lock()
+			stopped := stop != nil
+			mu.Unlock()
+			if stopped {
+				return nil
+			}
+			out := new(bytes.Buffer)
+			ran, err := p.execLine(line, render, stdinTpl, out, stderr, abandoned, c)
+			mu.Lock()
+			defer mu.Unlock()
+			if !ran {
+				if err != nil && stop == nil {
+					stop = err
+				}
+				return out.Bytes()
+			}
+			run++
+			if err != nil {
+				if err := fail(err); err != nil && stop == nil {
+					stop = err
+				}
+				return out.Bytes()
+			}
+			consecutive = 0
+			return out.Bytes()
+		})
+		if stop != nil {
+			return stop
+		}
+		return err
+	})
+}
+
+// execLine runs the command returned by render for line, as described for
+// [Pipe.ExecForEach], writing its output to w, and its standard error to
+// stderr, or to w if stderr is nil. The command is killed if abandoned is
+// closed (see [stageAbandoned]), and if it succeeds, line is recorded in the
+// checkpoint c, if any. It reports whether the command was run, and
+// any error. If the command wasn't run, any error means that no further
+// commands should be run either: for example, the template couldn't be
+// rendered.
+func (p *Pipe) execLine(line string, render commandRenderer, stdinTpl *template.Template, w, stderr io.Writer, abandoned <-chan struct{}, c *checkpoint) (bool, error) {
+	cmdLine, args, err := render(line)
+	if err != nil {
+		return false, err
+	}
+	if dw := p.dryRunWriter(); dw != nil {
+		fmt.Fprintf(dw, "exec: %s\n", cmdLine)
+		return false, nil
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	if stdinTpl != nil {
+		stdin := new(strings.Builder)
+		err := stdinTpl.Execute(stdin, line)
+		if err != nil {
+			return false, err
+		}
+		if !strings.HasSuffix(stdin.String(), "\n") {
+			stdin.WriteByte('\n')
+		}
+		cmd.Stdin = strings.NewReader(stdin.String())
+	}
+	out := p.commandOutput(w)
+	var pw *prefixWriter
+	if prefix := p.linePrefix(line); prefix != "" {
+		pw = &prefixWriter{w: out, prefix: prefix}
+		out = pw
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if stderr != nil {
+		cmd.Stderr = stderr
+	}
+	var ew *prefixWriter
+	if tpl := p.stderrPrefix(); tpl != nil {
+		prefix := new(strings.Builder)
+		err := tpl.Execute(prefix, stderrLine{Cmd: cmdLine, Line: line})
+		if err != nil {
+			return false, err
+		}
+		if stderr == nil {
+			// The command's output and its prefixed error stream are now
+			// written by separate writers, so keep them from interleaving
+			shared := &syncWriter{w: out}
+			cmd.Stdout = shared
+			cmd.Stderr = shared
+		}
+		ew = &prefixWriter{w: cmd.Stderr, prefix: prefix.String()}
+		cmd.Stderr = ew
+	}
+	if p.env != nil {
+		cmd.Env = p.env
+	}
+	errOut := cmd.Stderr
+	err = p.runCommand(cmd, cmdLine, abandoned)
+	if err == nil {
+		err = c.record(line)
+	}
+	p.recordResult(err)
+	if pw != nil {
+		pw.Flush()
+	}
+	if ew != nil {
+		ew.Flush()
+	}
+	if err != nil {
+		fmt.Fprintln(errOut, err)
+	}
+	return true, err
+}
+
+// ExitOnError waits for the pipe to be fully read, as [Pipe.Wait] does, and
+// if the pipe's error status is set, prints the error to [os.Stderr],
+// prefixed with the program name, and exits the program. The exit status is
+// that of the last command run by the pipe, if any (see [Pipe.ExitStatus]),
+// or 1 otherwise. If there is no error, ExitOnError just returns.
+func (p *Pipe) ExitOnError() {
+	p.exitWith(p.Wait())
+}
+
+// exitWith prints err and exits, as described for [Pipe.ExitOnError], unless
+// err is nil.
+func (p *Pipe) exitWith(err error) {
+	if err == nil {
+		return
+	}
+	status := p.ExitStatus()
+	if status == 0 {
+		status = 1
+	}
+	if p.jsonErrorsEnabled() {
+		report := errorReport{
+			Program:    filepath.Base(os.Args[0]),
+			Error:      err.Error(),
+			ExitStatus: status,
+		}
+		var execErr *ExecError
+		if errors.As(err, &execErr) {
+			report.Command = execErr.Cmd
+			report.Stderr = execErr.Stderr
+		}
+		json.NewEncoder(os.Stderr).Encode(report)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filepath.Base(os.Args[0]), err)
+	}
+	runExitHooks()
+	os.Exit(status)
+}
+
+var exitStatusPattern = regexp.MustCompile(`exit status (\d+)$`)
+
+// ExitStatus returns the integer exit status of a previous command (for
+// example run by [Pipe.Exec]). This will be zero unless the pipe's error
+// status is set to an [*ExecError] for a command that exited with a non-zero
+// status, or to some other error that matches the pattern “exit status %d”.
+func (p *Pipe) ExitStatus() int {
+	if p.Error() == nil {
+		return 0
+	}
+	var execErr *ExecError
+	if errors.As(p.Error(), &execErr) {
+		if execErr.ExitCode < 0 {
+			return 0
+		}
+		return execErr.ExitCode
+	}
+	match := exitStatusPattern.FindStringSubmatch(p.Error().Error())
+	if len(match) < 2 {
+		return 0
+	}
+	status, err := strconv.Atoi(match[1])
+	if err != nil {
+		// This seems unlikely, but...
+		return 0
+	}
+	return status
+}
+
+// ExtractRegexp produces only the parts of each input line that match the
+// compiled regexp re, one match per line, like Unix grep -o. If a line
+// contains several matches, each is produced on its own line, and lines with
+// no matches produce no output. If re contains a capturing group, only the
+// text matched by the first such group is produced, like sed -n 's/…/\1/p';
+// use non-capturing groups, such as (?:…), to group parts of re without
+// selecting them. For example, to list the version numbers mentioned in a
+// changelog:
+//
+//	File("CHANGELOG").ExtractRegexp(regexp.MustCompile(`v(\d+\.\d+\.\d+)`))
+func (p *Pipe) ExtractRegexp(re *regexp.Regexp) *Pipe {
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+	return p.FilterScan(func(line string, w io.Writer) {
+		for _, match := range re.FindAllStringSubmatchIndex(line, -1) {
+			start, end := match[2*group], match[2*group+1]
+			if start < 0 {
+				continue
+			}
+			fmt.Fprintln(w, line[start:end])
+		}
+	})
+}
+
+// extreme returns the number in the pipe's contents that ranks highest
+// according to better, as described for [Pipe.Max] and [Pipe.Min].
+func (p *Pipe) extreme(better func(x, y float64) bool) (float64, error) {
+	var result float64
+	var found bool
+	err := p.numbers(func(x float64) {
+		if !found || better(x, result) {
+			result = x
+			found = true
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errNoNumbers
+	}
+	return result, nil
+}
+
+// fileMetaSource returns the path set by [Pipe.CopyFileMeta], or the empty
+// string if there isn't one.
+func (p *Pipe) fileMetaSource() string {
+	if p.mu == nil { // uninitialised pipe
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metaSrc
+}
+
+// FileSize reads paths from the pipe, one per line, and produces the size in
+// bytes of each file, one per line, like Unix stat -c %s. Paths that don't
+// exist or can't be examined are skipped. Combined with [Pipe.Sum], this makes
+// it easy to total the disk usage of a directory tree:
+//
+//	total, err := FindFiles(".").FileSize().Sum()
+func (p *Pipe) FileSize() *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		info, err := os.Stat(line)
+		if err != nil {
+			return
+		}
+		fmt.Fprintln(w, info.Size())
+	})
+}
+
+// Filter sends the contents of the pipe to the function filter and produces
+// the result. filter takes an [io.Reader] to read its input from and an
+// [io.Writer] to write its output to, and returns an error, which will be set
+// on the pipe.
+//
+// filter runs concurrently, so its goroutine will not exit until the pipe has
+// been fully read. Use [Pipe.Wait] to wait for all concurrent filters to
+// complete.
+//
+// # Ordering
+//
+// Although the stages of a pipeline run concurrently, each stage reads its
+// input strictly in order, and every filter in this package produces its
+// output in the same order as the corresponding input. So, however many
+// stages are chained together, lines are never reordered unless a filter
+// (such as [Pipe.Freq]) does so deliberately. This is true even of filters
+// that do their work concurrently, such as [Pipe.MatchInFiles], unless
+// ordering is explicitly relaxed using [Pipe.Unordered].
+func (p *Pipe) Filter(filter func(io.Reader, io.Writer) error) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	d := p.takeStageTimeout()
+	if d <= 0 {
+		d = p.stageTimeLimit()
+	}
+	if d > 0 {
+		filter = timeoutFilter(filter, d)
+	}
+	if r := p.takeStageRetry(); r != nil {
+		filter = retryFilter(filter, r.attempts, r.delay)
+	}
+	if c := p.takeStageCache(); c != nil {
+		filter = cachedFilter(filter, c.path, c.ttl)
+	}
+	// Stages that record lines for Checkpoint have already claimed it, so if
+	// it's still set, this stage doesn't use it, and later stages mustn't
+	p.takeCheckpoint()
+	pr, pw := io.Pipe()
+	origReader := p.Reader
+	p = p.WithReader(pr)
+	go func() {
+		defer pw.Close()
+		err := filter(origReader, pw)
+		if err != nil {
+			p.SetError(err)
+		}
+	}()
+	return p
+}
+
+// FilterBytes is like [Pipe.FilterScan], except that filter takes each line as
+// a []byte, rather than a string. This avoids allocating a new string for
+// every line of input, which can make a big difference when processing very
+// large numbers of lines.
+//
+// The slice passed to filter is only valid until filter returns, because it
+// refers to the scanner's internal buffer, which will be overwritten by
+// subsequent lines. filter must not modify the slice, or retain it after
+// returning; to keep the data, make a copy.
+func (p *Pipe) FilterBytes(filter func([]byte, io.Writer)) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			filter(scanner.Bytes(), w)
+		}
+		return scanner.Err()
+	})
+}
+
+// FilterFields sends the contents of the pipe to the function filter, a line
+// at a time, split into fields delimited by Unicode whitespace, as for
+// [Pipe.Column], and produces whatever filter writes, like an awk program.
+// This makes it easy to do per-record arithmetic, conditional output, or
+// reformatting. For example, to print the name and size in KiB of each file
+// larger than 1 MiB:
+//
+//	Exec("ls -l").FilterFields(func(fields []string, w io.Writer) {
+//		if len(fields) < 9 {
+//			return
+//		}
+//		size, err := strconv.Atoi(fields[4])
+//		if err == nil && size > 1<<20 {
+//			fmt.Fprintln(w, fields[8], size/1024)
+//		}
+//	}).Stdout()
+//
+// The fields slice is only valid until filter returns. See [Pipe.Filter] for
+// concurrency handling.
+func (p *Pipe) FilterFields(filter func(fields []string, w io.Writer)) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		filter(strings.Fields(line), w)
+	})
+}
+
+// FilterIgnoreFile reads paths from the pipe, one per line, and produces only
+// those that are not excluded by the patterns in the ignore file path, which
+// uses the same syntax as a .gitignore file. For example, to list only the
+// files in a project that Git would track:
+//
+//	FindFiles(".").FilterIgnoreFile(".gitignore").Stdout()
+//
+// As with Git, patterns are interpreted relative to the directory containing
+// the ignore file, and paths are also taken to be relative to the current
+// directory, unless they're absolute. Any paths outside the ignore file's
+// directory are produced unchanged. If the ignore file can't be read, the
+// pipe's error status is set.
+//
+// The same syntax is used by many other tools, such as Docker, so this filter
+// also works with files like .dockerignore.
+func (p *Pipe) FilterIgnoreFile(path string) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	patterns, err := readIgnoreFile(path)
+	if err != nil {
+		return p.WithError(err)
+	}
+	base := filepath.Dir(path)
+	return p.FilterScan(func(line string, w io.Writer) {
+		rel, err := filepath.Rel(base, line)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			fmt.Fprintln(w, line)
+			return
+		}
+		if !isIgnored(patterns, filepath.ToSlash(rel), line) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// FilterInSet produces only the input lines that are in the set described by
+// setFile, like a join against a reference list. setFile can be either a text
+// file listing the members of the set, one per line, or a Bloom filter
+// prebuilt from such a list by [Pipe.WriteBloomFilter], which is quicker to
+// load. Either way, the set is held in memory as a Bloom filter, which takes
+// less than 2 bytes per member, however long the members are, so huge streams
+// can be checked against huge sets, such as lists of known-bad file hashes:
+//
+//	File("hashes.txt").FilterInSet("known-bad.bloom").Stdout()
+//
+// The price is that about one line in a thousand that isn't in the set will
+// be produced anyway. For exact results, check the lines produced against the
+// set itself, which is now a much smaller job. If setFile can't be read, the
+// pipe's error status is set. See also [Pipe.FilterNotInSet].
+func (p *Pipe) FilterInSet(setFile string) *Pipe {
+	return p.filterSet(setFile, true)
+}
+
+// FilterLine sends the contents of the pipe to the function filter, a line at
+// a time, and produces the result. filter takes each line as a string and
+// returns a string as its output. See [Pipe.Filter] for concurrency handling.
+func (p *Pipe) FilterLine(filter func(string) string) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		fmt.Fprintln(w, filter(line))
+	})
+}
+
+// FilterNotInSet is the opposite of [Pipe.FilterInSet]: it produces only the
+// input lines that are not in the set described by setFile. Lines that are
+// in the set are never produced, but about one line in a thousand that isn't
+// in the set will be dropped anyway.
+func (p *Pipe) FilterNotInSet(setFile string) *Pipe {
+	return p.filterSet(setFile, false)
+}
+
+// FilterScan sends the contents of the pipe to the function filter, a line at
+// a time, and produces the result. filter takes each line as a string and an
+// [io.Writer] to write its output to. See [Pipe.Filter] for concurrency
+// handling.
+func (p *Pipe) FilterScan(filter func(string, io.Writer)) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			filter(scanner.Text(), w)
+		}
+		return scanner.Err()
+	})
+}
+
+// filterSet produces only the input lines whose membership of the set
+// described by setFile is member, as described for [Pipe.FilterInSet].
+func (p *Pipe) filterSet(setFile string, member bool) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	set, err := loadBloomFilter(setFile)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.FilterBytes(func(line []byte, w io.Writer) {
+		if set.has(hash64(line)) == member {
+			w.Write(line)
+			w.Write([]byte{'\n'})
+		}
+	})
+}
+
+// FilterState sends the contents of the pipe to the function filter, a line at
+// a time, along with a state value carried over from the previous line, and
+// produces whatever filter writes. filter returns the state to pass with the
+// next line; the first line gets initial. This makes it easy to handle input
+// where lines belong together, such as continuation lines or indented blocks,
+// without writing a scanner loop. For example, to join lines ending with a
+// backslash to the following line:
+//
+//	p.FilterState("", func(state interface{}, line string, w io.Writer) interface{} {
+//		joined := state.(string) + line
+//		if strings.HasSuffix(joined, "\\") {
+//			return strings.TrimSuffix(joined, "\\")
+//		}
+//		fmt.Fprintln(w, joined)
+//		return ""
+//	})
+//
+// When the input ends, filter is not called again, and the final state is
+// discarded. See [Pipe.Filter] for concurrency handling.
+func (p *Pipe) FilterState(initial interface{}, filter func(state interface{}, line string, w io.Writer) interface{}) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		state := initial
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			state = filter(state, scanner.Text(), w)
+		}
+		return scanner.Err()
+	})
+}
+
+// FindDuplicates reads paths from the pipe, one per line, and produces groups
+// of files with identical contents, like Unix fdupes(1). Each group lists the
+// paths of the identical files, one per line, and groups are separated by an
+// empty line:
+//
+//	photos/IMG_001.jpg
+//	backup/IMG_001.jpg
+//
+//	notes.txt
+//	old/notes.txt
+//	old/notes (copy).txt
+//
+// Files are only compared if they have the same size, and then by their
+// SHA-256 hashes, so that most files need not be read at all. Groups are
+// produced in the order of their first file's appearance in the input, and
+// the paths in each group in input order. Any files that cannot be opened or
+// read will be ignored, as will repeated paths.
+func (p *Pipe) FindDuplicates() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		var paths []string
+		seen := map[string]bool{}
+		sizes := map[int64][]string{}
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			path := scanner.Text()
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			paths = append(paths, path)
+			sizes[info.Size()] = append(sizes[info.Size()], path)
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		groups := map[string][]string{}
+		groupOf := map[string]string{}
+		for _, candidates := range sizes {
+			if len(candidates) < 2 {
+				continue
+			}
+			for _, path := range candidates {
+				sum, err := File(path).Hash(sha256.New())
+				if err != nil {
+					continue // skip unreadable files
+				}
+				groups[sum] = append(groups[sum], path)
+				groupOf[path] = sum
+			}
+		}
+		first := true
+		for _, path := range paths {
+			group := groups[groupOf[path]]
+			if len(group) < 2 || group[0] != path {
+				continue
+			}
+			if !first {
+				fmt.Fprintln(w)
+			}
+			first = false
+			for _, dup := range group {
+				fmt.Fprintln(w, dup)
+			}
+		}
+		return nil
+	})
+}
+
+// finish calls the functions registered with [Pipe.onSuccess], now that the
+// pipe's contents have been read to the end, provided that its error status
+// isn't set. Each function is called at most once, and if one returns an
+// error, the pipe's error status is set to it, and finish returns it.
+func (p *Pipe) finish() error {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	fns := p.finishers
+	p.finishers = nil
+	failed := p.err != nil
+	p.mu.Unlock()
+	if failed {
+		return nil
+	}
+	for _, fn := range fns {
+		err := fn()
+		if err != nil {
+			p.SetError(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// First produces only the first n lines of the pipe's contents, or all the
+// lines if there are less than n. If n is zero or negative, there is no output
+// at all. When n lines have been produced, First stops reading its input and
+// sends EOF to its output.
+func (p *Pipe) First(n int) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	if n <= 0 {
+		return NewPipe()
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		for i := 0; i < n && scanner.Scan(); i++ {
+			_, err := fmt.Fprintln(w, scanner.Text())
+			if err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// FirstMatch produces only the first line of input that matches the compiled
+// regexp re, if any. Once it has found a match, FirstMatch stops reading its
+// input, which makes it an efficient way to pull a single value out of a long
+// output. For example, to get the version of Go in use:
+//
+//	version, err := Exec("go version").FirstMatch(regexp.MustCompile(`go\d`)).String()
+func (p *Pipe) FirstMatch(re *regexp.Regexp) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			if re.MatchString(scanner.Text()) {
+				_, err := fmt.Fprintln(w, scanner.Text())
+				return err
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// FormatNumber reformats the number in column col of each line of input to
+// make it easier to read, according to format. Columns are numbered and
+// delimited as for [Pipe.Column]. The format is made up of these optional
+// parts, in this order:
+//
+//   - "," separates thousands with commas, as in "1,234,567"
+//   - ".N" shows exactly N decimal places, as in ".2" for "1234.50"
+//   - "si" scales the number by powers of 1000, adding a suffix from k, M, G,
+//     T, P, or E, as in "1.5M"; or "iec" scales by powers of 1024, adding a
+//     suffix from Ki, Mi, Gi, Ti, Pi, or Ei, as in "1.5Gi"
+//
+// Without ".N", the number is shown with as many decimal places as it needs,
+// but with "si" or "iec", it's rounded to one decimal place first. The format
+// can also include literal text, such as a currency symbol or unit, around
+// these parts, if they're enclosed in braces. For example:
+//
+//	p.FormatNumber(2, "${,.2}")   // 1234.5 becomes $1,234.50
+//	p.FormatNumber(5, "{iec}B")   // 1610612736 becomes 1.5GiB
+//
+// A line whose column is reformatted is produced with its columns separated by
+// single spaces. Lines with fewer than col columns, or where the column isn't
+// a number, are produced unchanged. If format is not valid, the pipe's error
+// status is set.
+func (p *Pipe) FormatNumber(col int, format string) *Pipe {
+	nf, err := parseNumberFormat(format)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.FilterScan(func(line string, w io.Writer) {
+		columns := strings.Fields(line)
+		if col < 1 || col > len(columns) {
+			fmt.Fprintln(w, line)
+			return
+		}
+		x, err := strconv.ParseFloat(columns[col-1], 64)
+		if err != nil {
+			fmt.Fprintln(w, line)
+			return
+		}
+		columns[col-1] = nf.format(x)
+		fmt.Fprintln(w, strings.Join(columns, " "))
+	})
+}
+
+// FrameLength32 produces each line of input as a length-prefixed frame: the
+// length of the line in bytes, as a 4-byte big-endian integer, followed by the
+// line itself, without its trailing newline. This is a common framing for
+// simple binary protocols. [Pipe.DeframeLength32] reverses the process.
+func (p *Pipe) FrameLength32() *Pipe {
+	return p.FilterBytes(func(line []byte, w io.Writer) {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(line)))
+		w.Write(header)
+		w.Write(line)
+	})
+}
+
+// FrameNetstring produces each line of input as a netstring: the length of
+// the line in bytes, as a decimal number, then a colon, the line itself
+// (without its trailing newline), and a comma. For example, the line “hello”
+// becomes “5:hello,”. [Pipe.DeframeNetstring] reverses the process.
+func (p *Pipe) FrameNetstring() *Pipe {
+	return p.FilterBytes(func(line []byte, w io.Writer) {
+		fmt.Fprintf(w, "%d:%s,", len(line), line)
+	})
+}
+
+// Freq produces only the unique lines from the pipe's contents, each prefixed
+// with a frequency count, in descending numerical order (most frequent lines
+// first). Lines with equal frequency will be sorted alphabetically.
+//
+// For example, we could take a common shell pipeline like this:
+//
+//	sort input.txt |uniq -c |sort -rn
+//
+// and replace it with:
+//
+//	File("input.txt").Freq().Stdout()
+//
+// Or to get only the ten most common lines:
+//
+//	File("input.txt").Freq().First(10).Stdout()
+//
+// Like Unix uniq(1), Freq right-justifies its count values in a column for
+// readability, padding with spaces if necessary.
+func (p *Pipe) Freq() *Pipe {
+	freq := map[string]int{}
+	type frequency struct {
+		line  string
+		count int
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			freq[scanner.Text()]++
+		}
+		freqs := make([]frequency, 0, len(freq))
+		max := 0
+		for line, count := range freq {
+			freqs = append(freqs, frequency{line, count})
+			if count > max {
+				max = count
+			}
+		}
+		sort.Slice(freqs, func(i, j int) bool {
+			x, y := freqs[i].count, freqs[j].count
+			if x == y {
+				return freqs[i].line < freqs[j].line
+			}
+			return x > y
+		})
+		fieldWidth := len(strconv.Itoa(max))
+		for _, item := range freqs {
+			fmt.Fprintf(w, "%*d %s\n", fieldWidth, item.count, item.line)
+		}
+		return nil
+	})
+}
+
+// Get makes an HTTP GET request to url, sending the contents of the pipe as
+// the request body, and produces the server's response. See [Pipe.Do] for how
+// the HTTP response status is interpreted.
+func (p *Pipe) Get(url string) *Pipe {
+	req, err := http.NewRequest(http.MethodGet, url, p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.Do(req)
+}
+
+// GetEach treats each line of input as a URL, makes an HTTP GET request to
+// it, as [Pipe.Get] does, and produces the concatenated response bodies. Up
+// to concurrency requests are made at once; the responses are produced in the
+// same order as the input URLs, unless the pipe is [Pipe.Unordered].
+//
+// If a request fails, or its response status isn't HTTP 200-299, the URL and
+// the error are printed to the pipe's configured standard error (see
+// [Pipe.WithStderr]), or to [os.Stderr], and that response is omitted, but
+// the remaining URLs are still fetched. To find out how many requests
+// succeeded or failed, use [Pipe.Summary].
+func (p *Pipe) GetEach(concurrency int) *Pipe {
+	return p.getEach(func(line string) (string, error) {
+		return line, nil
+	}, concurrency)
+}
+
+// GetEachTemplate is like [Pipe.GetEach], but the URL for each line of input
+// is produced by rendering the Go template urlTpl with the line as its data,
+// as [Pipe.ExecForEach] does with a command line. For example:
+//
+//	Echo("alice\nbob\n").GetEachTemplate("https://api.example.com/users/{{.}}", 4)
+//
+// The line is inserted as it is; to escape it for use in a URL query, use
+// the template function urlquery, as in "https://example.com/?q={{urlquery .}}".
+// If urlTpl isn't a valid template, the pipe's error status is set.
+func (p *Pipe) GetEachTemplate(urlTpl string, concurrency int) *Pipe {
+	tpl, err := template.New("").Parse(urlTpl)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.getEach(func(line string) (string, error) {
+		url := new(strings.Builder)
+		err := tpl.Execute(url, line)
+		return url.String(), err
+	}, concurrency)
+}
+
+// getEach implements [Pipe.GetEach] and [Pipe.GetEachTemplate], fetching the
+// URL produced by render for each line of input.
+func (p *Pipe) getEach(render func(line string) (string, error), concurrency int) *Pipe {
+	c := p.takeCheckpoint()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		p.startBatch()
+		stderr := p.stdErr()
+		if stderr == nil {
+			stderr = os.Stderr
+		}
+		var mu sync.Mutex
+		return forEachLineConcurrently(p.newScanner(r), w, concurrency, p.ordered(), func(line string) []byte {
+			body := new(bytes.Buffer)
+			url, err := render(line)
+			if err == nil {
+				var req *http.Request
+				req, err = http.NewRequest(http.MethodGet, url, nil)
+				if err == nil {
+					err = p.doRequest(req, body)
+				}
+			}
+			if err == nil {
+				err = c.record(line)
+			}
+			p.recordResult(err)
+			if err != nil {
+				mu.Lock()
+				fmt.Fprintf(stderr, "%s: %v\n", url, err)
+				mu.Unlock()
+				return nil
+			}
+			return body.Bytes()
+		})
+	})
+}
+
+// Gunzip decompresses the gzip-compressed contents of the pipe, like Unix
+// gunzip(1), streaming the data rather than holding it all in memory. If the
+// input contains several gzip streams one after another, as produced by
+// concatenating .gz files, they're all decompressed. For example:
+//
+//	File("app.log.gz").Gunzip().Match("ERROR").Stdout()
+//
+// If the input isn't valid gzip data, the pipe's error status is set.
+func (p *Pipe) Gunzip() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		_, err = io.Copy(w, zr)
+		return err
+	})
+}
+
+// Gzip produces the gzip-compressed contents of the pipe, like Unix gzip(1),
+// streaming the data rather than holding it all in memory. For example:
+//
+//	File("app.log").Gzip().WriteFile("app.log.gz")
+func (p *Pipe) Gzip() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		_, err := io.Copy(zw, r)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+// Heartbeat passes the contents of the pipe through unchanged, but whenever
+// no data has passed for interval, it prints msg to the pipe's configured
+// standard error (see [Pipe.WithStderr]), or to [os.Stderr], along with the
+// time elapsed so far:
+//
+//	still downloading (1m0s)
+//
+// This keeps CI systems, which often kill jobs that produce no output for a
+// while, from giving up on a long but healthy stage, such as a large download
+// or a slow command:
+//
+//	Get(url).Heartbeat(30*time.Second, "still downloading").WriteFile("big.iso")
+//
+// If interval isn't positive, the pipe's error status is set.
+func (p *Pipe) Heartbeat(interval time.Duration, msg string) *Pipe {
+	if interval <= 0 {
+		return p.WithError(fmt.Errorf("invalid heartbeat interval %s", interval))
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		stderr := p.stdErr()
+		if stderr == nil {
+			stderr = os.Stderr
+		}
+		start := time.Now()
+		var mu sync.Mutex
+		last := start
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					mu.Lock()
+					idle := now.Sub(last)
+					mu.Unlock()
+					if idle >= interval {
+						fmt.Fprintf(stderr, "%s (%s)\n", msg, now.Sub(start).Round(time.Second))
+					}
+				}
+			}
+		}()
+		defer wg.Wait()
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				mu.Lock()
+				last = time.Now()
+				mu.Unlock()
+				if _, err := w.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// Hash returns the hex-encoded hash of the entire contents of the
+// pipe based on the provided hasher, or an error.
+// To perform hashing on files, see [Pipe.HashSums].
+func (p *Pipe) Hash(hasher hash.Hash) (string, error) {
+	if p.Error() != nil {
+		return "", p.Error()
+	}
+	_, err := io.Copy(hasher, p)
+	if err != nil {
+		p.SetError(err)
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// HashSums reads paths from the pipe, one per line, and produces the
+// hex-encoded hash of each corresponding file based on the provided hasher,
+// one per line. Any files that cannot be opened or read will be ignored.
+// To perform hashing on the contents of the pipe, see [Pipe.Hash].
+func (p *Pipe) HashSums(hasher hash.Hash) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		f, err := os.Open(line)
+		if err != nil {
+			return // skip unopenable files
+		}
+		defer f.Close()
+		_, err = io.Copy(hasher, f)
+		if err != nil {
+			return // skip unreadable files
+		}
+		fmt.Fprintln(w, hex.EncodeToString(hasher.Sum(nil)))
+	})
+}
+
+// httpCacheDir returns the cache directory set by [Pipe.WithHTTPCache], or the
+// empty string if responses aren't cached.
+func (p *Pipe) httpCacheDir() string {
+	if p.mu == nil { // uninitialised pipe
+		return ""
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.httpCache
+}
+
+// httpHeader returns a copy of the headers set by [Pipe.WithHeader] and
+// [Pipe.WithHeaders].
+func (p *Pipe) httpHeader() http.Header {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.header.Clone()
+}
+
+// httpRetryPolicy returns the number of retries and the initial backoff set by
+// [Pipe.WithHTTPRetries].
+func (p *Pipe) httpRetryPolicy() (int, time.Duration) {
+	if p.mu == nil { // uninitialised pipe
+		return 0, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.retries, p.backoff
+}
+
+// Join joins all the lines in the pipe's contents into a single
+// space-separated string, which will always end with a newline.
+func (p *Pipe) Join() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		first := true
+		for scanner.Scan() {
+			if !first {
+				fmt.Fprint(w, " ")
+			}
+			line := scanner.Text()
+			fmt.Fprint(w, line)
+			first = false
+		}
+		fmt.Fprintln(w)
+		return scanner.Err()
+	})
+}
+
+// JQ executes query on the pipe's contents (presumed to be JSON), producing
+// the result. An invalid query will set the appropriate error on the pipe.
+//
+// The exact dialect of JQ supported is that provided by
+// [github.com/itchyny/gojq], whose documentation explains the differences
+// between it and standard JQ. To produce string results without quotes, like
+// jq -r, use [Pipe.WithJQRawOutput].
+func (p *Pipe) JQ(query string) *Pipe {
+	raw := p.jqRawOutput()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		q, err := gojq.Parse(query)
+		if err != nil {
+			return err
+		}
+		var input interface{}
+		err = json.NewDecoder(r).Decode(&input)
+		if err != nil {
+			return err
+		}
+		return runJQ(q, input, w, raw)
+	})
+}
+
+// JQEach is like [Pipe.JQ], but executes query on each JSON document in the
+// pipe's contents in turn, producing all the results. This is useful for
+// newline-delimited JSON (also known as NDJSON or JSON Lines), as produced by
+// many APIs and log shippers, where each line is a separate JSON object:
+//
+//	File("events.jsonl").JQEach(`select(.level == "error") | .msg`).Stdout()
+//
+// Documents don't have to be on separate lines; any sequence of JSON values,
+// separated by whitespace, will do. If a document isn't valid JSON, JQEach
+// stops, and the pipe's error status is set.
+func (p *Pipe) JQEach(query string) *Pipe {
+	raw := p.jqRawOutput()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		q, err := gojq.Parse(query)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(r)
+		for {
+			var input interface{}
+			err = dec.Decode(&input)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = runJQ(q, input, w, raw)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// jqRawOutput reports whether [Pipe.WithJQRawOutput] has been set.
+func (p *Pipe) jqRawOutput() bool {
+	if p.mu == nil { // uninitialised pipe
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jqRaw
+}
+
+// jsonErrorsEnabled reports whether [Pipe.WithJSONErrors] has been set.
+func (p *Pipe) jsonErrorsEnabled() bool {
+	if p.mu == nil { // uninitialised pipe
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jsonErrors
+}
+
+// Last produces only the last n lines of the pipe's contents, or all the lines
+// if there are less than n. If n is zero or negative, there is no output at
+// all.
+func (p *Pipe) Last(n int) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	if n <= 0 {
+		return NewPipe()
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		input := ring.New(n)
+		for scanner.Scan() {
+			input.Value = scanner.Text()
+			input = input.Next()
+		}
+		input.Do(func(p interface{}) {
+			if p != nil {
+				fmt.Fprintln(w, p)
+			}
+		})
+		return scanner.Err()
+	})
+}
+
+// LastMatch produces only the last line of input that matches the compiled
+// regexp re, if any. Unlike [Pipe.FirstMatch], it must read all its input to
+// find the last match.
+func (p *Pipe) LastMatch(re *regexp.Regexp) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		last, found := "", false
+		for scanner.Scan() {
+			if re.MatchString(scanner.Text()) {
+				last, found = scanner.Text(), true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if found {
+			_, err := fmt.Fprintln(w, last)
+			return err
+		}
+		return nil
+	})
+}
+
+// linePrefix returns the prefix that [Pipe.WithPrefixedOutput] adds to each
+// line of output from the command for the input line key, or the empty string
+// if output isn't prefixed.
+func (p *Pipe) linePrefix(key string) string {
+	if p.mu == nil { // uninitialised pipe
+		return ""
+	}
+	p.mu.Lock()
+	mode := p.prefixMode
+	p.mu.Unlock()
+	switch mode {
+	case prefixPlain:
+		return key + " | "
+	case prefixColor:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		color := 31 + h.Sum32()%uint32(6)
+		return fmt.Sprintf("\x1b[%dm%s |\x1b[0m ", color, key)
+	}
+	return ""
+}
+
+// logCommand records the command cmd, run from cmdLine at time start, to the
+// writer set by [Pipe.WithCommandLog], if any. err is the error returned by
+// starting or waiting for the command.
+func (p *Pipe) logCommand(cmd *exec.Cmd, cmdLine string, start time.Time, err error) {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.commandLog == nil {
+		return
+	}
+	dir := cmd.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	status := -1
+	if cmd.ProcessState != nil {
+		status = cmd.ProcessState.ExitCode()
+	}
+	entry := fmt.Sprintf("%s dir=%q cmd=%q status=%d duration=%s", start.Format(time.RFC3339), dir, cmdLine, status, time.Since(start))
+	if cmd.ProcessState == nil && err != nil {
+		entry += fmt.Sprintf(" error=%q", err)
+	}
+	fmt.Fprintln(p.commandLog, entry)
+}
+
+// Match produces only the input lines that contain the string s.
+func (p *Pipe) Match(s string) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		if strings.Contains(line, s) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// MatchFuzzy produces only the input lines that contain an approximate match
+// for the string s: that is, some part of the line that could be turned into
+// s with at most maxDist single-character insertions, deletions, or
+// substitutions. This is useful for finding things despite typos or small
+// variations in spelling. For example, MatchFuzzy("conection", 1) matches
+// lines containing "connection", and MatchFuzzy("web-01", 1) matches lines
+// containing "web01" or "web-02". With maxDist 0, MatchFuzzy behaves like
+// [Pipe.Match].
+func (p *Pipe) MatchFuzzy(s string, maxDist int) *Pipe {
+	pattern := []rune(s)
+	return p.FilterScan(func(line string, w io.Writer) {
+		if fuzzyContains(line, pattern, maxDist) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// MatchInFiles reads paths from the pipe, one per line, and produces every line
+// of each corresponding file that contains the string s, prefixed by the path
+// and line number, like the output of grep -n with multiple files:
+//
+//	testdata/test.txt:2:Hello, world.
+//
+// The files are searched concurrently, but the results are produced in the
+// same order as the input paths. Any files that cannot be opened or read will
+// be ignored.
+func (p *Pipe) MatchInFiles(s string) *Pipe {
+	return p.matchInFiles(func(line string) bool {
+		return strings.Contains(line, s)
+	})
+}
+
+func (p *Pipe) matchInFiles(match func(string) bool) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		return forEachLineConcurrently(p.newScanner(r), w, runtime.NumCPU(), p.ordered(), func(path string) []byte {
+			f, err := os.Open(path)
+			if err != nil {
+				return nil // skip unopenable files
+			}
+			defer f.Close()
+			output := new(bytes.Buffer)
+			scanner := p.newScanner(f)
+			for n := 1; scanner.Scan(); n++ {
+				if match(scanner.Text()) {
+					fmt.Fprintf(output, "%s:%d:%s\n", path, n, scanner.Text())
+				}
+			}
+			return output.Bytes()
+		})
+	})
+}
+
+// MatchRegexp produces only the input lines that match the compiled regexp re.
+func (p *Pipe) MatchRegexp(re *regexp.Regexp) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		if re.MatchString(line) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// MatchRegexpInFiles is like [Pipe.MatchInFiles], but produces the lines of
+// each file that match the compiled regexp re.
+func (p *Pipe) MatchRegexpInFiles(re *regexp.Regexp) *Pipe {
+	return p.matchInFiles(re.MatchString)
+}
+
+// Max returns the largest number in the pipe's contents, read as for
+// [Pipe.Sum], or an error if there are no numbers at all.
+func (p *Pipe) Max() (float64, error) {
+	return p.extreme(func(x, y float64) bool {
+		return x > y
+	})
+}
+
+// Mean returns the arithmetic mean of the numbers in the pipe's contents, read
+// as for [Pipe.Sum], or an error if there are no numbers at all.
+func (p *Pipe) Mean() (float64, error) {
+	var sum float64
+	var n int
+	err := p.numbers(func(x float64) {
+		sum += x
+		n++
+	})
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, errNoNumbers
+	}
+	return sum / float64(n), nil
+}
+
+// Measure passes the contents of the pipe through unchanged, recording the
+// number of bytes and lines, and the time taken for the input to be fully
+// read, in stats. Inserting Measure after any stage of a pipeline shows how
+// much data that stage produced, and how fast:
+//
+//	stats := new(script.Stats)
+//	script.File("access.log").Match("GET").Measure(stats).Wait()
+//	fmt.Println(stats)
+//
+// stats will not be complete until the pipe has been fully read (for example,
+// using [Pipe.Wait]).
+func (p *Pipe) Measure(stats *Stats) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		return measure(w, r, stats, nil)
+	})
+}
+
+// Meter passes the contents of the pipe through unchanged, adding the number
+// of bytes and lines to the totals recorded for stage in the pipe's [Metrics]
+// registry (see [Pipe.WithMetrics]) as the data passes through, and the time
+// taken for the input to be fully read once it has been. If the pipe has no
+// registry, Meter does nothing. For example, to count the lines a
+// long-running watcher matches, which never finishes:
+//
+//	script.FollowFile(ctx, "app.log").WithMetrics(m).Match("ERROR").Meter("errors")
+func (p *Pipe) Meter(stage string) *Pipe {
+	m := p.metricsRegistry()
+	if m == nil {
+		return p
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		stats := new(Stats)
+		err := measure(w, r, stats, func(bytes, lines int64) {
+			m.recordChunk(stage, bytes, lines)
+		})
+		m.recordRun(stage, stats.Elapsed)
+		return err
+	})
+}
+
+// metricsRegistry returns the registry set by [Pipe.WithMetrics], or nil if
+// there is none.
+func (p *Pipe) metricsRegistry() *Metrics {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.metrics
+}
+
+// MIMEType returns the MIME type of the contents of the pipe, as detected by
+// [net/http.DetectContentType], or an error. Only the first 512 bytes of the
+// pipe are examined. To detect the MIME types of files, see
+// [Pipe.DetectMIME].
+func (p *Pipe) MIMEType() (string, error) {
+	if p.Error() != nil {
+		return "", p.Error()
+	}
+	mimeType, err := detectMIME(p)
+	if err != nil {
+		p.SetError(err)
+		return "", err
+	}
+	return mimeType, nil
+}
+
+// Min returns the smallest number in the pipe's contents, read as for
+// [Pipe.Sum], or an error if there are no numbers at all.
+func (p *Pipe) Min() (float64, error) {
+	return p.extreme(func(x, y float64) bool {
+		return x < y
+	})
+}
+
+// newScanner returns a [bufio.Scanner] reading lines from r, using the pipe's
+// configured buffer sizes (see [Pipe.WithScannerBuffer]).
+func (p *Pipe) newScanner(r io.Reader) *bufio.Scanner {
+	size, max := 4096, math.MaxInt
+	if p.mu != nil { // uninitialised pipe
+		p.mu.Lock()
+		if p.scanMaxSize > 0 {
+			size, max = p.scanBufSize, p.scanMaxSize
+		}
+		p.mu.Unlock()
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, size), max)
+	return scanner
+}
+
+var errNoNumbers = errors.New("no numbers in input")
+
+// numbers calls fn with each line of input that is a number, ignoring
+// surrounding whitespace and skipping any other lines, and returns the
+// pipe's error status once the input is exhausted.
+func (p *Pipe) numbers(fn func(x float64)) error {
+	p.FilterScan(func(line string, w io.Writer) {
+		x, err := strconv.ParseFloat(strings.TrimSpace(line), 64)
+		if err == nil {
+			fn(x)
+		}
+	}).Wait()
+	return p.Error()
+}
+
+// onSuccess registers fn to be called once the whole pipe has finished
+// successfully: that is, once its contents have been read to the end, by
+// [Pipe.Read] or [Pipe.WriteTo], and its error status isn't set (see
+// [Pipe.finish]). Stages use this to commit changes, such as updating state
+// files, only when every later stage has succeeded too.
+func (p *Pipe) onSuccess(fn func() error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finishers = append(p.finishers, fn)
+}
+
+// ordered reports whether concurrent filters on the pipe must preserve the
+// order of their input (see [Pipe.Unordered]).
+func (p *Pipe) ordered() bool {
+	if p.mu == nil { // uninitialised pipe
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.unordered
+}
+
+// outputSeparator returns the separator set by [Pipe.WithOutputSeparator], or
+// a single space if there is none.
+func (p *Pipe) outputSeparator() string {
+	if p.mu == nil { // uninitialised pipe
+		return " "
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.outputSep == nil {
+		return " "
+	}
+	return *p.outputSep
+}
+
+// ParseRegexp converts each line of input that matches the compiled regexp re
+// into a JSON object, with a field for each named capturing group in re, in
+// the order they appear, and produces the objects one per line. Lines that
+// don't match are skipped, or written to the pipe's rejects writer if it has
+// one (see [Pipe.WithRejects]), and a group that doesn't participate in the
+// match gives an empty string. This turns unstructured log lines into
+// records ready for [Pipe.JQEach]. For example:
+//
+//	re := regexp.MustCompile(`^(?P<ip>\S+) .* "(?P<method>[A-Z]+) (?P<path>\S+)`)
+//	File("access.log").ParseRegexp(re).Stdout()
+//
+// might produce:
+//
+//	{"ip":"192.0.2.1","method":"POST","path":"/login"}
+func (p *Pipe) ParseRegexp(re *regexp.Regexp) *Pipe {
+	names := re.SubexpNames()
+	rejects := p.rejectWriter()
+	n := 0
+	return p.FilterScan(func(line string, w io.Writer) {
+		n++
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			if rejects != nil {
+				writeReject(rejects, fmt.Errorf("line %d: doesn't match %s", n, re), line)
+			}
+			return
+		}
+		record := new(bytes.Buffer)
+		record.WriteByte('{')
+		for i, name := range names {
+			if name == "" {
+				continue
+			}
+			if record.Len() > 1 {
+				record.WriteByte(',')
+			}
+			key, _ := json.Marshal(name)
+			value, _ := json.Marshal(match[i])
+			record.Write(key)
+			record.WriteByte(':')
+			record.Write(value)
+		}
+		record.WriteString("}\n")
+		w.Write(record.Bytes())
+	})
+}
+
+// Patch makes an HTTP PATCH request to url, using the contents of the pipe
+// as the request body, and produces the server's response. See
+// [Pipe.Do] for how the HTTP response status is interpreted.
+func (p *Pipe) Patch(url string) *Pipe {
+	req, err := http.NewRequest(http.MethodPatch, url, p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.Do(req)
+}
+
+// Post makes an HTTP POST request to url, using the contents of the pipe as
+// the request body, and produces the server's response. See [Pipe.Do] for how
+// the HTTP response status is interpreted.
+func (p *Pipe) Post(url string) *Pipe {
+	req, err := http.NewRequest(http.MethodPost, url, p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.Do(req)
+}
+
+// Put makes an HTTP PUT request to url, using the contents of the pipe
+// as the request body, and produces the server's response. See
+// [Pipe.Do] for how the HTTP response status is interpreted.
+func (p *Pipe) Put(url string) *Pipe {
+	req, err := http.NewRequest(http.MethodPut, url, p.Reader)
+	if err != nil {
+		return p.WithError(err)
+	}
+	return p.Do(req)
+}
+
+// recordResult adds the outcome of a command, whose error status is err, to
+// the results reported by [Pipe.Summary].
+func (p *Pipe) recordResult(err error) {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.batch.add(err)
+	p.batch.Elapsed = time.Since(p.batchStart)
+}
+
+// Reject produces only lines that do not contain the string s.
+func (p *Pipe) Reject(s string) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		if !strings.Contains(line, s) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// RejectRegexp produces only lines that don't match the compiled regexp re.
+func (p *Pipe) RejectRegexp(re *regexp.Regexp) *Pipe {
+	return p.FilterScan(func(line string, w io.Writer) {
+		if !re.MatchString(line) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// rejectWriter returns the writer set by [Pipe.WithRejects], or nil if there
+// is none.
+func (p *Pipe) rejectWriter() io.Writer {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rejects
+}
+
+// Release closes the pipe's reader and returns the pipe to the pool used by
+// [NewPooledPipe], resetting its configuration and error status. Release
+// should only be called once the pipe has been fully read (for example, by a
+// sink such as [Pipe.Wait]), and the pipe must not be used afterwards.
+func (p *Pipe) Release() {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.Reader.Close()
+	// Reset the pipe to the state NewPipe creates, without allocating
+	*p = Pipe{
+		Reader:     ReadAutoCloser{},
+		mu:         p.mu,
+		stdout:     os.Stdout,
+		httpClient: http.DefaultClient,
+	}
+	pipePool.Put(p)
+}
+
+// Replace replaces all occurrences of the string search with the string
+// replace.
+func (p *Pipe) Replace(search, replace string) *Pipe {
+	return p.FilterLine(func(line string) string {
+		return strings.ReplaceAll(line, search, replace)
+	})
+}
+
+// ReplaceRegexp replaces all matches of the compiled regexp re with the string
+// replace. $x variables in the replace string are interpreted as by
+// [regexp#Regexp.Expand]; for example, $1 represents the text of the first submatch.
+func (p *Pipe) ReplaceRegexp(re *regexp.Regexp, replace string) *Pipe {
+	return p.FilterLine(func(line string) string {
+		return re.ReplaceAllString(line, replace)
+	})
+}
+
+// Profile passes the contents of the pipe through unchanged, recording a CPU
+// profile to cpu while the pipeline runs, and writing a profile of memory
+// allocations to allocs once the input has been fully read. The profiles are
+// in the format used by [runtime/pprof], so they can be analysed with 'go
+// tool pprof'. Either writer may be nil, in which case that profile is not
+// recorded.
+//
+// Because earlier stages of the pipeline run concurrently, and only produce
+// data as it's read, placing Profile at the end of a pipeline profiles the
+// whole pipeline:
+//
+//	cpu, _ := os.Create("cpu.pprof")
+//	script.File("huge.log").Match("ERROR").Freq().Profile(cpu, nil).Stdout()
+//
+// Go only allows one CPU profile to be recorded at a time, so if another
+// profile is already being recorded, the pipe's error status is set (but the
+// data is still passed through).
+func (p *Pipe) Profile(cpu, allocs io.Writer) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		var profileErr error
+		if cpu != nil {
+			profileErr = pprof.StartCPUProfile(cpu)
+			if profileErr == nil {
+				defer pprof.StopCPUProfile()
+			}
+		}
+		_, err := io.Copy(w, r)
+		if err != nil {
+			return err
+		}
+		if allocs != nil {
+			err = pprof.Lookup("allocs").WriteTo(allocs, 0)
+			if err != nil {
+				return err
+			}
+		}
+		return profileErr
+	})
+}
+
+// Read reads up to len(b) bytes from the pipe into b. It returns the number of
+// bytes read and any error encountered. At end of file, or on a nil pipe, Read
+// returns 0, [io.EOF].
+func (p *Pipe) Read(b []byte) (int, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	n, err := p.Reader.Read(b)
+	if err == io.EOF {
+		if err := p.finish(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// ReplaceRegexpTemplate replaces all matches of the compiled regexp re with
+// the result of rendering tpl as a Go template. The template's data is a
+// [RegexpMatch] describing the match, which makes possible replacements that
+// $x variables (see [Pipe.ReplaceRegexp]) can't express. For example, to
+// zero-pad the numbers in each line, and prefix it with its line number:
+//
+//	re := regexp.MustCompile(`^(.*?)(\d+)$`)
+//	p.ReplaceRegexpTemplate(re, `{{.LineNumber}}: {{index .Groups 1}}{{printf "%04s" (index .Groups 2)}}`)
+//
+// If tpl is not a valid template, or it can't be rendered for some match, the
+// pipe's error status is set.
+func (p *Pipe) ReplaceRegexpTemplate(re *regexp.Regexp, tpl string) *Pipe {
+	t, err := template.New("").Parse(tpl)
+	if err != nil {
+		return p.WithError(err)
+	}
+	names := re.SubexpNames()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		lineNumber := 0
+		for scanner.Scan() {
+			lineNumber++
+			line := scanner.Text()
+			result := new(strings.Builder)
+			last := 0
+			for _, loc := range re.FindAllStringSubmatchIndex(line, -1) {
+				m := RegexpMatch{
+					Groups:     make([]string, len(names)),
+					Named:      map[string]string{},
+					Line:       line,
+					LineNumber: lineNumber,
+				}
+				for i, name := range names {
+					if loc[2*i] >= 0 {
+						m.Groups[i] = line[loc[2*i]:loc[2*i+1]]
+					}
+					if name != "" {
+						m.Named[name] = m.Groups[i]
+					}
+				}
+				result.WriteString(line[last:loc[0]])
+				err := t.Execute(result, m)
+				if err != nil {
+					return err
+				}
+				last = loc[1]
+			}
+			result.WriteString(line[last:])
+			_, err := fmt.Fprintln(w, result.String())
+			if err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// ResponseHeader returns the headers of the most recent HTTP response received
+// by the pipe, for example via [Pipe.Get], or nil if there hasn't been one.
+// This is useful for reading headers such as Content-Disposition or ETag. The
+// response is only received once the pipe starts to be read, so it's usually
+// best to call ResponseHeader after fully reading the pipe:
+//
+//	p := Get(url)
+//	data, err := p.Bytes()
+//	name := p.ResponseHeader().Get("Content-Disposition")
+func (p *Pipe) ResponseHeader() http.Header {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.respHeader.Clone()
+}
+
+// ResponseStatus returns the status code of the most recent HTTP response
+// received by the pipe, for example via [Pipe.Get], or 0 if there hasn't been
+// one. Since any status other than HTTP 200-299 sets the pipe's error status,
+// ResponseStatus lets a program distinguish between the different kinds of
+// failure, such as 404 Not Found and 500 Internal Server Error:
+//
+//	p := Get(url)
+//	p.Wait()
+//	if p.ResponseStatus() == http.StatusNotFound {
+//		...
+//	}
+//
+// As with [Pipe.ResponseHeader], the response is only received once the pipe
+// starts to be read.
+func (p *Pipe) ResponseStatus() int {
+	if p.mu == nil { // uninitialised pipe
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.respStatus
+}
+
+// Retry makes the next stage added to the pipe (such as [Pipe.Exec], an HTTP
+// request, or a custom [Pipe.Filter]) run again if it fails, up to attempts
+// times in all, so that a flaky command or endpoint doesn't need a
+// hand-written retry loop:
+//
+//	Echo(report).Retry(5, time.Second).Exec("upload-report").Wait()
+//
+// The first retry waits for delay, and the wait doubles for each subsequent
+// retry, with up to half as much again added at random, so that many scripts
+// retrying at once don't all hit the same service together. The stage's input
+// is held in memory so that it can be replayed, and its output is only passed
+// on once an attempt succeeds. If every attempt fails, the pipe's error status
+// is set to the last error. Later stages are not affected.
+func (p *Pipe) Retry(attempts int, delay time.Duration) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retry = &stageRetry{attempts: attempts, delay: delay}
+	return p
+}
+
+// runCommand runs cmd, as [Pipe.startCommand] does, waits for it to finish,
+// and logs it (see [Pipe.WithCommandLog]). If the pipe has a time limit (see
+// [Pipe.WithTimeout]), or the stage running cmd can be abandoned, in which case
+// abandoned is not nil, cmd runs in its own process group, which is killed if
+// it overruns, as described for [waitCommand]. If the command fails,
+// runCommand returns an [*ExecError] describing the failure, including the end
+// of the command's standard error output.
+func (p *Pipe) runCommand(cmd *exec.Cmd, cmdLine string, abandoned <-chan struct{}) error {
+	stderr := &tailBuffer{max: execErrorStderrMax}
+	if cmd.Stderr == cmd.Stdout {
+		// Keep a single writer for both streams, so that they share one pipe
+		// and stay in the order the command wrote them
+		out := io.MultiWriter(cmd.Stdout, stderr)
+		cmd.Stdout = out
+		cmd.Stderr = out
+	} else {
+		cmd.Stderr = io.MultiWriter(cmd.Stderr, stderr)
+	}
+	name := filepath.Base(cmd.Args[0])
+	d := p.stageTimeLimit()
+	var outputs []*commandOutput
+	if d > 0 || abandoned != nil {
+		setProcessGroup(cmd)
+		var err error
+		outputs, err = redirectOutput(cmd)
+		if err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	err := p.startCommand(cmd)
+	for _, o := range outputs {
+		// Only the command needs the writing end now
+		o.w.Close()
+	}
+	if err == nil {
+		err = waitCommand(cmd, outputs, d, abandoned)
+	}
+	p.logCommand(cmd, cmdLine, start, err)
+	exitCode := -1
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+	if m := p.metricsRegistry(); m != nil {
+		m.recordExit(name, exitCode)
+	}
+	if err == nil {
+		return nil
+	}
+	return &ExecError{
+		Cmd:      cmdLine,
+		ExitCode: exitCode,
+		Stderr:   string(stderr.data),
+		Err:      err,
+	}
+}
+
+// sendRequest sends req using the pipe's HTTP client, retrying it if
+// necessary as described for [Pipe.WithHTTPRetries].
+func (p *Pipe) sendRequest(req *http.Request) (*http.Response, error) {
+	retries, backoff := p.httpRetryPolicy()
+	if retries <= 0 {
+		return p.httpClient.Do(req)
+	}
+	req = req.Clone(req.Context())
+	if req.Body != nil && req.GetBody == nil {
+		// Buffer the body so that it can be sent again
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+		resp, err := p.httpClient.Do(req)
+		if attempt == retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		timer := time.NewTimer(backoff << attempt)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Sentences splits the contents of the pipe into sentences, and produces one
+// sentence per line, with any line breaks and runs of whitespace within it
+// replaced by a single space. A sentence ends with a sentence terminator in
+// any script (such as ".", "?", "!", or "。") and any closing quotes or
+// brackets that follow it, or with a blank line. A terminator doesn't end a
+// sentence if the next word starts with a lower-case letter, as in "e.g.
+// this" or "\"Why?\" she asked". Nor does a full stop directly followed by a
+// digit, or between two upper-case letters, so numbers like "3.14" and
+// abbreviations like "U.S.A." are kept intact.
+func (p *Pipe) Sentences() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		scanner.Split(scanSentences)
+		for scanner.Scan() {
+			sentence := strings.Join(strings.Fields(scanner.Text()), " ")
+			if sentence != "" {
+				fmt.Fprintln(w, sentence)
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// SetError sets the error err on the pipe.
+func (p *Pipe) SetError(err error) {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// setResponse records the status and headers of resp for
+// [Pipe.ResponseStatus] and [Pipe.ResponseHeader].
+func (p *Pipe) setResponse(resp *http.Response) {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.respStatus = resp.StatusCode
+	p.respHeader = resp.Header
+}
+
+// SHA256Sum returns the hex-encoded SHA-256 hash of the entire contents of the
+// pipe, or an error.
+// Deprecated: SHA256Sum has been deprecated by [Pipe.Hash]. To get the SHA-256
+// hash for the contents of the pipe, call `Hash(sha256.new())`
+func (p *Pipe) SHA256Sum() (string, error) {
+	return p.Hash(sha256.New())
+}
+
+// SHA256Sums reads paths from the pipe, one per line, and produces the
+// hex-encoded SHA-256 hash of each corresponding file, one per line. Any files
+// that cannot be opened or read will be ignored.
+// Deprecated: SHA256Sums has been deprecated by [Pipe.HashSums]. To get the SHA-256
+// hash for each file path in the pipe, call `HashSums(sha256.new())`
+func (p *Pipe) SHA256Sums() *Pipe {
+	return p.HashSums(sha256.New())
+}
+
+// Sleep passes the lines of input through unchanged, but pauses for d before
+// each line after the first, to pace whatever processes them next. For
+// example, to check a list of URLs without hammering the server:
+//
+//	File("urls.txt").Sleep(time.Second).GetEach(1).Stdout()
+//
+// To vary the pause randomly, use [Pipe.SleepJitter].
+func (p *Pipe) Sleep(d time.Duration) *Pipe {
+	return p.SleepJitter(d, d)
+}
+
+// SleepJitter is like [Pipe.Sleep], but pauses for a random duration between
+// min and max before each line after the first. This avoids many copies of a
+// script all acting in lockstep.
+func (p *Pipe) SleepJitter(min, max time.Duration) *Pipe {
+	if max < min {
+		min, max = max, min
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+		scanner := p.newScanner(r)
+		for first := true; scanner.Scan(); first = false {
+			if !first {
+				d := min
+				if max > min {
+					d += time.Duration(rng.Int63n(int64(max - min + 1)))
+				}
+				time.Sleep(d)
+			}
+			fmt.Fprintln(w, scanner.Text())
+		}
+		return scanner.Err()
+	})
+}
+
+// Slice returns the pipe's contents as a slice of strings, one element per
+// line, or an error.
+//
+// An empty pipe will produce an empty slice. A pipe containing a single empty
+// line (that is, a single \n character) will produce a slice containing the
+// empty string as its single element.
+func (p *Pipe) Slice() ([]string, error) {
+	result := []string{}
+	p.FilterScan(func(line string, w io.Writer) {
+		result = append(result, line)
+	}).Wait()
+	return result, p.Error()
+}
+
+// Skip skips the first n bytes of the pipe's contents, producing the
+// remainder, like the skip operand of Unix dd(1). If the pipe's reader
+// supports seeking (for example, if it was created by [File]), Skip will move
+// the read position directly; otherwise, including when the reader is a file
+// that can't seek, such as standard input connected to a pipe, the skipped
+// data is read and discarded. If n is negative, the pipe's error status is set.
+func (p *Pipe) Skip(n int64) *Pipe {
+	if p.Error() != nil {
+		return p
+	}
+	if n < 0 {
+		return p.WithError(fmt.Errorf("negative skip count %d", n))
+	}
+	if s, ok := p.Reader.r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekCurrent)
+		if err == nil {
+			return p
+		}
+		// Not actually seekable, like a pipe or terminal: read instead
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.CopyN(io.Discard, r, n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, r)
+		return err
+	})
+}
+
+// sparseFiles reports whether [Pipe.WithSparseFiles] is in effect.
+func (p *Pipe) sparseFiles() bool {
+	if p.mu == nil { // uninitialised pipe
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sparse
+}
+
+// stageTimeLimit returns the time limit set by [Pipe.WithTimeout], or zero if
+// there is none.
+func (p *Pipe) stageTimeLimit() time.Duration {
+	if p.mu == nil { // uninitialised pipe
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.timeLimit
+}
+
+// StageTimeout limits the next stage added to the pipe (such as [Pipe.Exec], or
+// any other filter) to run for at most d. If the stage hasn't finished by then,
+// it's abandoned: any output it produced before the deadline is kept, and
+// passed on to the rest of the pipe, and the pipe's error status is set to an
+// error that wraps [context.DeadlineExceeded]. Later stages are not affected.
+//
+// This is useful for best-effort stages, such as enriching a report with DNS
+// lookups, where a slow or hung command shouldn't hold up the whole pipe:
+//
+//	p := File("hosts.txt").StageTimeout(10 * time.Second).ExecForEach("host {{.}}")
+//	report, _ := p.String() // whatever was resolved within 10s
+//
+// An abandoned stage is cancelled: its input is closed, any command it's
+// running is killed, along with any processes that command started, and it
+// can't write any more output. A stage that does some long computation
+// without reading or writing may still run in the background until it
+// finishes, but it has no further effect on the pipe.
+func (p *Pipe) StageTimeout(d time.Duration) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stageTimeout = d
+	return p
+}
+
+// startBatch notes the time the first batch stage started, for the elapsed
+// time reported by [Pipe.Summary].
+func (p *Pipe) startBatch() {
+	if p.mu == nil { // uninitialised pipe
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.batchStart.IsZero() {
+		p.batchStart = time.Now()
+	}
+}
+
+// startCommand starts cmd, applying any restrictions set by
+// [Pipe.WithExecLimits] and [Pipe.WithoutNetwork]. The resource limits are
+// set in the new process before the command itself runs, which means that
+// cmd's Path and Args may be rewritten. If the restrictions can't be applied,
+// for example because the system doesn't allow unprivileged users to create
+// network namespaces, the command isn't run at all, and startCommand returns
+// the error.
+func (p *Pipe) startCommand(cmd *exec.Cmd) error {
+	var l execLimits
+	if p.mu != nil {
+		p.mu.Lock()
+		l = p.limits
+		p.mu.Unlock()
+	}
+	if l.noNetwork {
+		isolateNetwork(cmd)
+	}
+	limitCommand(cmd, l)
+	return cmd.Start()
+}
+
+// stdErr returns the pipe's configured standard error writer for commands run
+// via [Pipe.Exec] and [Pipe.ExecForEach]. The default is nil, which means that
+// error output will go to the pipe.
+func (p *Pipe) stdErr() io.Writer {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stderr
+}
+
+// Sort produces the lines of input sorted in ascending lexical order, like
+// Unix sort(1). See also [Pipe.SortDesc] and [Pipe.SortNumeric].
+func (p *Pipe) Sort() *Pipe {
+	return p.sortLines(func(a, b string) bool {
+		return a < b
+	})
+}
+
+// SortDesc produces the lines of input sorted in descending lexical order,
+// like Unix sort -r.
+func (p *Pipe) SortDesc() *Pipe {
+	return p.sortLines(func(a, b string) bool {
+		return a > b
+	})
+}
+
+// SortFiles reads paths from the pipe, one per line, and produces them sorted
+// in ascending order of the given [FileOrder]: [ByName], [ByModTime], or
+// [BySize]. Paths that compare equal keep their original relative order. For
+// example, to get the most recently modified file in a directory:
+//
+//	FindFiles("/var/log").SortFiles(ByModTime).Last(1).Stdout()
+//
+// Any paths that can't be found are moved to the end of the output.
+func (p *Pipe) SortFiles(order FileOrder) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		type file struct {
+			path string
+			info fs.FileInfo
+		}
+		var files []file
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			info, err := os.Stat(scanner.Text())
+			if err != nil {
+				info = nil
+			}
+			files = append(files, file{scanner.Text(), info})
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			x, y := files[i], files[j]
+			if x.info == nil || y.info == nil {
+				return x.info != nil && y.info == nil
+			}
+			switch order {
+			case ByModTime:
+				return x.info.ModTime().Before(y.info.ModTime())
+			case BySize:
+				return x.info.Size() < y.info.Size()
+			default:
+				return x.path < y.path
+			}
+		})
+		for _, f := range files {
+			fmt.Fprintln(w, f.path)
+		}
+		return nil
+	})
+}
+
+// sortLines produces the lines of input sorted according to less. Lines that
+// compare equal keep their original relative order.
+func (p *Pipe) sortLines(less func(a, b string) bool) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		var lines []string
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		sort.SliceStable(lines, func(i, j int) bool {
+			return less(lines[i], lines[j])
+		})
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+		return nil
+	})
+}
+
+// SortNumeric produces the lines of input sorted in ascending order of the
+// number at the start of each line, like Unix sort -n. Leading whitespace is
+// ignored, and lines that don't start with a number sort as if they started
+// with zero. Lines with equal numbers keep their original relative order. To
+// sort in descending order, as with sort -nr, use [Pipe.SortNumericDesc].
+func (p *Pipe) SortNumeric() *Pipe {
+	return p.sortLines(func(a, b string) bool {
+		return leadingNumber(a) < leadingNumber(b)
+	})
+}
+
+// SortNumericDesc is like [Pipe.SortNumeric], but sorts in descending order.
+func (p *Pipe) SortNumericDesc() *Pipe {
+	return p.sortLines(func(a, b string) bool {
+		return leadingNumber(a) > leadingNumber(b)
+	})
+}
+
+// stderrPrefix returns the template set by [Pipe.WithStderrPrefix], or nil if
+// there is none.
+func (p *Pipe) stderrPrefix() *template.Template {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errPrefix
+}
+
+// Stdout copies the pipe's contents to its configured standard output (using
+// [Pipe.WithStdout]), or to [os.Stdout] otherwise, and returns the number of
+// bytes successfully written, together with any error.
+func (p *Pipe) Stdout() (int, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	n64, err := io.Copy(p.stdout, p)
+	if err != nil {
+		return 0, err
+	}
+	n := int(n64)
+	if int64(n) != n64 {
+		return 0, fmt.Errorf("length %d overflows int", n64)
+	}
+	return n, p.Error()
+}
+
+// stdOut returns the pipe's standard output, as set by [Pipe.WithStdout].
+func (p *Pipe) stdOut() io.Writer {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stdout
+}
+
+// String returns the pipe's contents as a string, together with any error.
+func (p *Pipe) String() (string, error) {
+	data, err := p.Bytes()
+	if err != nil {
+		p.SetError(err)
+	}
+	return string(data), p.Error()
+}
+
+// Sum returns the total of the numbers in the pipe's contents, one per line,
+// or an error. Surrounding whitespace is ignored, and lines that aren't
+// numbers, such as blank lines or headings, are skipped. To add up a
+// particular column, select it first with [Pipe.Column]:
+//
+//	total, err := Exec("du -s *").Column(1).Sum()
+//
+// If there are no numbers, Sum returns zero. See also [Pipe.Mean],
+// [Pipe.Min], and [Pipe.Max].
+func (p *Pipe) Sum() (float64, error) {
+	var sum float64
+	err := p.numbers(func(x float64) {
+		sum += x
+	})
+	if err != nil {
+		return 0, err
+	}
+	return sum, nil
+}
+
+// Summary waits for the pipe to be fully read, as [Pipe.Wait] does, and
+// returns a [Summary] of the outcomes of any commands run by
+// [Pipe.ExecForEach], or requests made by [Pipe.GetEach], along with the
+// pipe's error status. This makes it easy for a script to report on a batch
+// operation, and exit with an error if any part of it failed:
+//
+//	sum, _ := File("hosts.txt").ExecForEach("ssh {{.}} uptime").Summary()
+//	fmt.Println(sum)
+//	if sum.Err() != nil {
+//		os.Exit(1)
+//	}
+func (p *Pipe) Summary() (Summary, error) {
+	err := p.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.batch, err
+}
+
+// takeCheckpoint returns the state file set by [Pipe.Checkpoint], if any, and
+// clears it. Stages that record lines must call it before adding their filter,
+// because [Pipe.Filter] clears it too, so that only the stage immediately
+// after Checkpoint records lines in it.
+func (p *Pipe) takeCheckpoint() *checkpoint {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.checkpoint
+	p.checkpoint = nil
+	return c
+}
+
+// takeStageCache returns the cache set by [Pipe.CacheTo], if any, and clears
+// it, so that it applies only to a single stage.
+func (p *Pipe) takeStageCache() *stageCache {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := p.cache
+	p.cache = nil
+	return c
+}
+
+// takeStageRetry returns the retry policy set by [Pipe.Retry], if any, and
+// clears it, so that it only applies to the next stage.
+func (p *Pipe) takeStageRetry() *stageRetry {
+	if p.mu == nil { // uninitialised pipe
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := p.retry
+	p.retry = nil
+	return r
+}
+
+// takeStageTimeout returns the timeout set by [Pipe.StageTimeout], if any,
+// and clears it, so that it applies only to a single stage.
+func (p *Pipe) takeStageTimeout() time.Duration {
+	if p.mu == nil { // uninitialised pipe
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d := p.stageTimeout
+	p.stageTimeout = 0
+	return d
+}
+
+// Tee copies the pipe's contents to each of the supplied writers, like Unix
+// tee(1). If no writers are supplied, the default is the pipe's standard
+// output.
+func (p *Pipe) Tee(writers ...io.Writer) *Pipe {
+	teeWriter := p.stdout
+	if len(writers) > 0 {
+		teeWriter = io.MultiWriter(writers...)
+	}
+	return p.WithReader(io.TeeReader(p.Reader, teeWriter))
+}
+
+// TopBy produces the n lines of input with the largest numbers in column col,
+// largest first, like Unix sort -k col -nr | head -n n, but without holding
+// all the input in memory. Columns are numbered and delimited as for
+// [Pipe.Column], and lines with fewer than col columns, or where the column
+// isn't a number, are skipped. Lines with equal numbers are produced in their
+// original order. For example, to list the five largest files:
+//
+//	Exec("ls -l").TopBy(5, 5).Stdout()
+func (p *Pipe) TopBy(col, n int) *Pipe {
+	return p.topBy(col, n, func(x, y float64) bool {
+		return x > y
+	})
+}
+
+// topBy produces the n lines of input that rank highest according to better,
+// applied to the numbers in column col, as described for [Pipe.TopBy].
+func (p *Pipe) topBy(col, n int, better func(x, y float64) bool) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		if n < 1 {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		h := &rankedLines{better: better}
+		scanner := p.newScanner(r)
+		for seq := 0; scanner.Scan(); seq++ {
+			columns := strings.Fields(scanner.Text())
+			if col < 1 || col > len(columns) {
+				continue
+			}
+			value, err := strconv.ParseFloat(columns[col-1], 64)
+			if err != nil {
+				continue
+			}
+			line := rankedLine{value: value, seq: seq, text: scanner.Text()}
+			if h.Len() < n {
+				heap.Push(h, line)
+			} else if h.ranksAbove(line, h.lines[0]) {
+				h.lines[0] = line
+				heap.Fix(h, 0)
+			}
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		sort.Slice(h.lines, func(i, j int) bool {
+			return h.ranksAbove(h.lines[i], h.lines[j])
+		})
+		for _, line := range h.lines {
+			fmt.Fprintln(w, line.text)
+		}
+		return nil
+	})
+}
+
+// TopK is like [Pipe.Freq], but produces only the k most frequent lines, each
+// prefixed with its count, most frequent first, and uses a fixed amount of
+// memory (about 2 MiB, plus the k lines themselves) however many distinct lines
+// there are. This makes it suitable for finding the heavy hitters in streams
+// far too large for Freq, such as billions of log lines:
+//
+//	File("access.log").Column(7).TopK(10).Stdout()
+//
+// The counts come from a count-min sketch, so they are estimates: they are
+// never too small, and are exact unless there are a great many distinct
+// lines, in which case they may be slightly too large. Since the results are
+// chosen by these estimates, a line that is only a little more common than the
+// kth most frequent line may occasionally be missing from them, in favour of
+// one whose count was overestimated. Lines that are far more common than most
+// are found reliably, but this isn't guaranteed. If k is less than 1, there
+// is no output at all.
+func (p *Pipe) TopK(k int) *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		if k < 1 {
+			_, err := io.Copy(io.Discard, r)
+			return err
+		}
+		sketch := newCountMinSketch()
+		top := &heavyHitters{index: map[string]int{}}
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			count := sketch.add(scanner.Bytes())
+			top.offer(scanner.Text(), count, k)
+		}
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		items := top.items
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].count == items[j].count {
+				return items[i].line < items[j].line
+			}
+			return items[i].count > items[j].count
+		})
+		fieldWidth := 1
+		if len(items) > 0 {
+			fieldWidth = len(strconv.FormatUint(items[0].count, 10))
+		}
+		for _, item := range items {
+			fmt.Fprintf(w, "%*d %s\n", fieldWidth, item.count, item.line)
+		}
+		return nil
+	})
+}
+
+// Truncate shortens each line of input that is longer than width characters,
+// replacing its end with an ellipsis (…), so that the result is exactly width
+// characters long. ANSI escape sequences, such as those used to color text,
+// don't count towards the width, and are preserved; if a line containing them
+// is truncated, a reset sequence is added after the ellipsis, so the color
+// doesn't leak into following output. If width is zero or negative, the width
+// of the terminal is used (see [Pipe.Wrap]).
+func (p *Pipe) Truncate(width int) *Pipe {
+	if width <= 0 {
+		width = terminalWidth()
+	}
+	return p.FilterLine(func(line string) string {
+		if visibleLen(line) <= width {
+			return line
+		}
+		out := new(strings.Builder)
+		escaped := false
+		visible := 0
+		for i := 0; i < len(line); {
+			if loc := ansiEscape.FindStringIndex(line[i:]); loc != nil && loc[0] == 0 {
+				out.WriteString(line[i : i+loc[1]])
+				escaped = true
+				i += loc[1]
+				continue
+			}
+			if visible == width-1 {
+				break
+			}
+			r, size := utf8.DecodeRuneInString(line[i:])
+			out.WriteRune(r)
+			visible++
+			i += size
+		}
+		out.WriteString("…")
+		if escaped {
+			out.WriteString("\x1b[0m")
+		}
+		return out.String()
+	})
+}
+
+// Uniq produces the lines of input with any duplicates removed, keeping only
+// the first occurrence of each line, like Unix sort -u but preserving the
+// order of the input. It needs to remember every distinct line, so for input
+// where duplicates are always next to each other, [Pipe.UniqAdjacent] uses
+// less memory. To count how many times each line occurs, use [Pipe.Freq].
+func (p *Pipe) Uniq() *Pipe {
+	seen := map[string]bool{}
+	return p.FilterScan(func(line string, w io.Writer) {
+		if !seen[line] {
+			seen[line] = true
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// UniqAdjacent produces the lines of input, dropping any line that's the same
+// as the one before it, like Unix uniq(1).
+func (p *Pipe) UniqAdjacent() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		first, prev := true, ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			if first || line != prev {
+				fmt.Fprintln(w, line)
+			}
+			first, prev = false, line
+		}
+		return scanner.Err()
+	})
+}
+
+// Unordered allows subsequent filters that process lines concurrently, such as
+// [Pipe.MatchInFiles], to produce the results for each line as soon as they're
+// ready, instead of in the same order as their input. This can be faster when
+// some lines take much longer to process than others, and the order of the
+// output doesn't matter. Filters that process one line at a time are not
+// affected, and always preserve the order of their input.
+func (p *Pipe) Unordered() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unordered = true
+	return p
+}
+
+// ValidateCSV passes the contents of the pipe through unchanged, checking that
+// it's CSV data matching headerSpec. The spec is a comma-separated list of the
+// expected column names, each optionally followed by a colon and the type of
+// the column's values: int, float, bool, or string (the default). For
+// example:
+//
+//	File("users.csv").ValidateCSV("name,age:int,admin:bool").WriteFile("clean.csv")
+//
+// The first record must be a header naming the columns in order, and every
+// other record must have the same number of fields, each of which must be
+// valid for its column's type. Blank lines are passed through unchecked. If a
+// record doesn't conform, it isn't produced, and the pipe's error status is
+// set, identifying the line and the problem, so that malformed data isn't
+// silently propagated. If the pipe has a rejects writer (see
+// [Pipe.WithRejects]), the record is written there instead, and validation
+// continues; a header that doesn't conform is always an error, though. If
+// headerSpec isn't valid, the pipe's error status is set.
+func (p *Pipe) ValidateCSV(headerSpec string) *Pipe {
+	cols, err := parseCSVSpec(headerSpec)
+	if err != nil {
+		return p.WithError(err)
+	}
+	rejects := p.rejectWriter()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		var record strings.Builder
+		line, start := 0, 0
+		header := true
+		for scanner.Scan() {
+			line++
+			if record.Len() == 0 {
+				start = line
+				if scanner.Text() == "" {
+					fmt.Fprintln(w, "")
+					continue
+				}
+			}
+			record.WriteString(scanner.Text())
+			record.WriteByte('\n')
+			if strings.Count(record.String(), `"`)%2 != 0 {
+				// a quoted field continues on the next line
+				continue
+			}
+			fields, err := csv.NewReader(strings.NewReader(record.String())).Read()
+			if err == nil {
+				if header {
+					err = checkCSVHeader(cols, fields)
+				} else {
+					err = checkCSVRecord(cols, fields)
+				}
+			}
+			if err != nil {
+				err = fmt.Errorf("line %d: %w", start, err)
+				if rejects == nil || header {
+					return err
+				}
+				writeReject(rejects, err, record.String())
+			} else {
+				io.WriteString(w, record.String())
+			}
+			header = false
+			record.Reset()
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		if record.Len() > 0 {
+			err := fmt.Errorf("line %d: unterminated quoted field", start)
+			if rejects == nil {
+				return err
+			}
+			writeReject(rejects, err, record.String())
+		}
+		return nil
+	})
+}
+
+// ValidateJSONSchema passes the contents of the pipe through unchanged,
+// checking that each line is a JSON value that conforms to the JSON Schema
+// schema. The commonly used validation keywords are supported: type, enum,
+// const, properties, required, additionalProperties, items, minItems,
+// maxItems, minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+// and exclusiveMaximum; the keywords allOf, anyOf, and oneOf combine schemas
+// in the usual way. Other keywords, such as $ref and format, are ignored. For
+// example:
+//
+//	File("events.ndjson").ValidateJSONSchema(`{"type":"object","required":["id"]}`).Stdout()
+//
+// Blank lines are passed through unchecked. If a line isn't valid JSON, or
+// doesn't conform to the schema, it isn't produced, and the pipe's error
+// status is set, identifying the line and the problem, so that malformed data
+// isn't silently propagated. If the pipe has a rejects writer (see
+// [Pipe.WithRejects]), the line is written there instead, and validation
+// continues. If schema isn't valid, the pipe's error status is set.
+func (p *Pipe) ValidateJSONSchema(schema string) *Pipe {
+	s, err := parseJSONSchema(schema)
+	if err != nil {
+		return p.WithError(err)
+	}
+	rejects := p.rejectWriter()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		line := 0
+		for scanner.Scan() {
+			line++
+			if strings.TrimSpace(scanner.Text()) != "" {
+				var v interface{}
+				err := json.Unmarshal(scanner.Bytes(), &v)
+				if err == nil {
+					err = s.validate(s.root, v, "$")
+				}
+				if err != nil {
+					err = fmt.Errorf("line %d: %w", line, err)
+					if rejects == nil {
+						return err
+					}
+					writeReject(rejects, err, scanner.Text())
+					continue
+				}
+			}
+			fmt.Fprintln(w, scanner.Text())
+		}
+		return scanner.Err()
+	})
+}
+
+// Wait reads the pipe to completion and returns any error present on
+// the pipe, or nil otherwise. This is mostly useful for waiting until
+// concurrent filters have completed (see [Pipe.Filter]).
+func (p *Pipe) Wait() error {
+	_, err := io.Copy(io.Discard, p)
+	if err != nil {
+		p.SetError(err)
+	}
+	return p.Error()
+}
+
+// WhereNum produces only the input lines where column col, interpreted as a
+// number, compares with value according to op, which must be one of "<",
+// "<=", ">", ">=", "==", or "!=". Columns are numbered and delimited as for
+// [Pipe.Column]. Lines with fewer than col columns, or where the column isn't
+// a number, are skipped. For example, to list processes using more than 1 GiB
+// of memory (ps reports RSS in KiB):
+//
+//	Exec("ps aux").WhereNum(6, ">", 1024*1024).Stdout()
+//
+// If op is not valid, the pipe's error status is set.
+func (p *Pipe) WhereNum(col int, op string, value float64) *Pipe {
+	var cmp func(float64) bool
+	switch op {
+	case "<":
+		cmp = func(x float64) bool { return x < value }
+	case "<=":
+		cmp = func(x float64) bool { return x <= value }
+	case ">":
+		cmp = func(x float64) bool { return x > value }
+	case ">=":
+		cmp = func(x float64) bool { return x >= value }
+	case "==":
+		cmp = func(x float64) bool { return x == value }
+	case "!=":
+		cmp = func(x float64) bool { return x != value }
+	default:
+		return p.WithError(fmt.Errorf("invalid comparison operator %q", op))
+	}
+	return p.FilterScan(func(line string, w io.Writer) {
+		columns := strings.Fields(line)
+		if col < 1 || col > len(columns) {
+			return
+		}
+		x, err := strconv.ParseFloat(columns[col-1], 64)
+		if err == nil && cmp(x) {
+			fmt.Fprintln(w, line)
+		}
+	})
+}
+
+// Window calls fn on each sliding window of n consecutive lines of input, and
+// produces the results, one per line. The first window holds lines 1 to n,
+// the second lines 2 to n+1, and so on, so that fn can compute things like
+// moving averages or n-grams. If there are fewer than n lines of input, fn is
+// not called. If n is less than 1, each window holds a single line.
+func (p *Pipe) Window(n int, fn func(lines []string) string) *Pipe {
+	if n < 1 {
+		n = 1
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		window := make([]string, 0, n)
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			if len(window) == n {
+				window = window[1:]
+			}
+			window = append(window, scanner.Text())
+			if len(window) == n {
+				fmt.Fprintln(w, fn(window))
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// WithAuthBasic sets the Authorization header for subsequent HTTP requests
+// (see [Pipe.WithHeader]) to use HTTP Basic authentication with the given
+// username and password.
+func (p *Pipe) WithAuthBasic(user, pass string) *Pipe {
+	return p.WithHeader("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+}
+
+// WithAuthBearer sets the Authorization header for subsequent HTTP requests
+// (see [Pipe.WithHeader]) to use the bearer token token, as many APIs expect.
+func (p *Pipe) WithAuthBearer(token string) *Pipe {
+	return p.WithHeader("Authorization", "Bearer "+token)
+}
+
+// WithCircuitBreaker stops subsequent [Pipe.ExecForEach] stages after n
+// consecutive commands have failed, instead of carrying on with the rest of
+// the input. This saves time (and spares the remote end) when every remaining
+// command is likely to fail too, such as when a server has gone away. When the
+// breaker trips, the remaining input is skipped and the pipe's error status is
+// set to an error summarising the failures, which wraps the error from the
+// last failed command. A successful command resets the count. If n is zero or
+// negative, which is the default, ExecForEach never stops early.
+func (p *Pipe) WithCircuitBreaker(n int) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.breaker = n
+	return p
+}
+
+// WithCommandLog sets w as the destination for a log of every external command
+// run by subsequent [Pipe.Exec] and [Pipe.ExecForEach] stages, for auditing
+// or debugging. Each command produces one line, giving the time it started,
+// the working directory, the command line, its exit status, and how long it
+// took to run:
+//
+//	2024-01-02T15:04:05Z dir="/srv/app" cmd="git pull" status=0 duration=1.2s
+//
+// If the command couldn't be started at all, its exit status is given as -1,
+// and the error is also logged.
+func (p *Pipe) WithCommandLog(w io.Writer) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.commandLog = w
+	return p
+}
+
+// WithDryRun puts the pipe into dry-run mode, so that subsequent stages that
+// would change something outside the program don't actually do anything, but
+// instead write a description of what they would have done to w, one per
+// line. This makes it possible to review what a potentially destructive
+// script will do before running it for real:
+//
+//	ListFiles("*.bak").WithDryRun(os.Stderr).ExecForEach("rm {{.}}").Wait()
+//	// exec: rm old.bak
+//	// exec: rm older.bak
+//
+// The affected stages are:
+//
+//   - [Pipe.Exec] and [Pipe.ExecForEach], which describe each command line
+//     instead of running it, and produce no output
+//   - [Pipe.WriteFile] and [Pipe.AppendFile], which read the pipe to
+//     completion, and describe how many bytes would have been written, and to
+//     which file
+//   - [Pipe.Do] and [Pipe.Post], for any HTTP method other than GET or HEAD,
+//     which describe the request instead of making it, and produce no output
+//
+// All other stages, including HTTP GET requests, run as normal.
+func (p *Pipe) WithDryRun(w io.Writer) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dryRun = w
+	return p
+}
+
+// WithEnv sets the environment for subsequent [Pipe.Exec] and [Pipe.ExecForEach]
+// commands to the string slice env, using the same format as [os/exec.Cmd.Env].
+// An empty slice unsets all existing environment variables.
+func (p *Pipe) WithEnv(env []string) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.env = env
+	return p
+}
+
+// WithError sets the error err on the pipe.
+func (p *Pipe) WithError(err error) *Pipe {
+	p.SetError(err)
+	return p
+}
+
+// WithExecLimits restricts the resources available to each subsequent
+// [Pipe.Exec] and [Pipe.ExecForEach] command, so that a runaway or untrusted
+// program can't exhaust the host: cpu is the maximum CPU time, rounded up to
+// the next whole second, mem is the maximum size of its address space in
+// bytes, and files is the maximum number of open file descriptors. A zero
+// value for any of these means no limit. A command that exceeds its CPU limit
+// is killed, while attempts to exceed the others fail.
+//
+// The limits are set in the command's process before the program itself
+// starts, so there's no window in which it runs unrestricted. On platforms
+// other than Linux, they're ignored.
+func (p *Pipe) WithExecLimits(cpu time.Duration, mem int64, files int) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limits.cpu = cpu
+	p.limits.mem = mem
+	p.limits.files = files
+	return p
+}
+
+// WithHeader sets the HTTP header key to value for subsequent requests made
+// via [Pipe.Get], [Pipe.Post], [Pipe.Do], and the other HTTP methods, such as
+// an API token or a Content-Type. It replaces any value previously set for key
+// on this pipe. A header that's already present on a request passed to
+// [Pipe.Do] takes precedence.
+func (p *Pipe) WithHeader(key, value string) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.header == nil {
+		p.header = http.Header{}
+	}
+	p.header.Set(key, value)
+	return p
+}
+
+// WithHeaders sets each of the HTTP headers in header, as [Pipe.WithHeader]
+// does.
+func (p *Pipe) WithHeaders(header map[string]string) *Pipe {
+	for key, value := range header {
+		p.WithHeader(key, value)
+	}
+	return p
+}
+
+// WithHTTPCache caches the responses to subsequent GET requests made via
+// [Pipe.Get] or [Pipe.Do] in the directory dir, which is created if
+// necessary. Only responses with an ETag or Last-Modified header are cached.
+// When a cached URL is requested again, the request includes the
+// corresponding If-None-Match or If-Modified-Since header, and if the server
+// responds that the content hasn't changed, the cached copy is produced
+// instead. This saves polling scripts from repeatedly downloading large files
+// that rarely change.
+//
+// Responses are cached separately for each set of credentials, so that a
+// response to a request with one Authorization or Cookie header is never
+// produced for a request with another. Similarly, if a response has a Vary
+// header, the cached copy is only used for requests with the same values of
+// the headers it names; a response with "Vary: *" isn't cached at all.
+func (p *Pipe) WithHTTPCache(dir string) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.httpCache = dir
+	return p
+}
+
+// WithHTTPClient sets the HTTP client c for use with subsequent requests via
+// [Pipe.Do], [Pipe.Get], or [Pipe.Post]. For example, to make a request using
+// a client with a timeout:
+//
+//	NewPipe().WithHTTPClient(&http.Client{
+//	        Timeout: 10 * time.Second,
+//	}).Get("https://example.com").Stdout()
+func (p *Pipe) WithHTTPClient(c *http.Client) *Pipe {
+	p.httpClient = c
+	return p
+}
+
+// WithHTTPRetries makes subsequent HTTP requests via [Pipe.Get], [Pipe.Post],
+// [Pipe.Do], and the other HTTP methods retry up to n times if the request
+// fails with a connection error, or the server responds with HTTP 429 Too Many
+// Requests or any 5xx status. The first retry waits for backoff, and the wait
+// doubles for each subsequent retry. If all the retries fail, the result of
+// the last attempt is used. The request body, if any, is held in memory so
+// that it can be sent again:
+//
+//	NewPipe().WithHTTPRetries(3, time.Second).Get("https://example.com/flaky").Stdout()
+func (p *Pipe) WithHTTPRetries(n int, backoff time.Duration) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retries = n
+	p.backoff = backoff
+	return p
+}
+
+// WithJQRawOutput makes subsequent [Pipe.JQ] and [Pipe.JQEach] stages produce
+// string results as they are, without the surrounding quotes or escaping, like
+// jq -r. Other results are still produced as JSON. This makes it easy to feed
+// the results to another stage, such as [Pipe.ExecForEach]:
+//
+//	Get(url).WithJQRawOutput().JQ(".assets[].browser_download_url").ExecForEach("curl -LO {{.}}").Wait()
+func (p *Pipe) WithJQRawOutput() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jqRaw = true
+	return p
+}
+
+// WithJSONErrors makes [Pipe.ExitOnError] and [Main] report the pipe's error
+// status as a single-line JSON object on standard error, instead of as free
+// text, so that orchestration systems which run script-based programs can
+// parse failures reliably. For example:
+//
+//	{"program":"backup","error":"exit status 2","exit_status":2,"command":"tar czf backup.tgz data","stderr":"tar: data: Cannot stat\n"}
+//
+// The "command" and "stderr" fields, giving the failing command line and the
+// tail of its standard error, are present only if the error came from a
+// command (see [ExecError]).
+func (p *Pipe) WithJSONErrors() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.jsonErrors = true
+	return p
+}
+
+// WithMetrics records metrics for subsequent stages of the pipe in the
+// registry m, which can be served over HTTP for Prometheus to scrape. The exit
+// status of each command run by [Pipe.Exec], [Pipe.ExecForEach], and
+// similar stages is counted, and [Pipe.Meter] records the throughput of any
+// stage. This makes long-running script-based daemons, such as watchers and
+// schedulers, observable like other services:
+//
+//	m := script.NewMetrics()
+//	http.Handle("/metrics", m)
+//	script.Stdin().WithMetrics(m).ExecForEach("process {{.}}").Meter("process").Stdout()
+func (p *Pipe) WithMetrics(m *Metrics) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.metrics = m
+	return p
+}
+
+// WithOutputSeparator sets the separator that subsequent [Pipe.Columns]
+// stages use to join the columns they select, like awk's OFS. For example,
+// to produce tab-separated output:
+//
+//	Exec("ps aux").WithOutputSeparator("\t").Columns(2, 11).Stdout()
+func (p *Pipe) WithOutputSeparator(sep string) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outputSep = &sep
+	return p
+}
+
+// WithPassthrough makes subsequent [Pipe.Exec] and [Pipe.ExecForEach] commands
+// copy their output to the pipe's standard output (see [Pipe.WithStdout]) as
+// it's produced, as well as to the pipe, like [Pipe.Tee]. This lets a user
+// watch the progress of a long-running command live, while its output
+// remains available for filtering afterwards:
+//
+//	errors, err := NewPipe().WithPassthrough().Exec("make").Match("error:").String()
+//
+// Note that this means a pipe ending in [Pipe.Stdout] will print the command's
+// output twice.
+func (p *Pipe) WithPassthrough() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.passthrough = true
+	return p
+}
+
+// WithPrefixedOutput makes subsequent [Pipe.ExecForEach] stages prefix each
+// line of output from a command with the input line that produced it, followed
+// by a vertical bar, so that it's clear which command produced which output,
+// even when the output of many commands is interleaved or later sorted:
+//
+//	web1 | up 12 days
+//	web2 | up 3 days
+//
+// If color is true, each prefix is also shown in a color chosen from the input
+// line, so that it's the same every time, in the style of “docker compose
+// logs”. The color is set using ANSI escape sequences, so it's best suited to
+// output that will be displayed on a terminal.
+func (p *Pipe) WithPrefixedOutput(color bool) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prefixMode = prefixPlain
+	if color {
+		p.prefixMode = prefixColor
+	}
+	return p
+}
+
+// WithReader sets the pipe's input reader to r. Once r has been completely
+// read, it will be closed if necessary.
+func (p *Pipe) WithReader(r io.Reader) *Pipe {
+	p.Reader = NewReadAutoCloser(r)
+	return p
+}
+
+// WithRejects makes subsequent validating and parsing stages, such as
+// [Pipe.ValidateJSONSchema], [Pipe.ValidateCSV], and [Pipe.ParseRegexp], write
+// any input records they reject to w, instead of failing the pipe or silently
+// dropping them, while valid records continue down the pipe. Each rejected
+// record is written on its own line, preceded by the reason for rejecting it
+// and a tab, as real data pipelines do with bad records:
+//
+//	line 3: $.id: want integer, got string	{"id":"x"}
+//
+// Writes to w are serialised, so it can safely be shared between stages.
+func (p *Pipe) WithRejects(w io.Writer) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rejects = &syncWriter{w: w}
+	return p
+}
+
+// WithScannerBuffer sets the initial buffer size, and the maximum line length,
+// in bytes, used by subsequent line-oriented filters such as
+// [Pipe.FilterScan] and [Pipe.Match]. By default, the initial buffer is 4096
+// bytes, and it will grow as necessary to hold lines of any length, which can
+// use a lot of memory with very long single-line inputs, such as minified
+// JavaScript. If a line is longer than max, the filter reading it will stop,
+// and the pipe's error status will be set to [bufio.ErrTooLong]. If max is
+// zero or negative, the default settings are used. Otherwise, if size isn't
+// between 1 and max, the pipe's error status is set.
+func (p *Pipe) WithScannerBuffer(size, max int) *Pipe {
+	if max > 0 && (size <= 0 || size > max) {
+		return p.WithError(fmt.Errorf("invalid scanner buffer size %d for maximum line length %d", size, max))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scanBufSize = size
+	p.scanMaxSize = max
+	return p
+}
+
+// WithSparseFiles makes subsequent [Pipe.WriteFile] and [Pipe.WriteFileAtomic]
+// calls write sparse files: any block of zero bytes in the pipe's contents
+// becomes a hole in the file, rather than being written to disk, where the
+// filesystem supports it. The file reads back exactly the same, but copying
+// things like VM images or database files, which are often mostly empty,
+// doesn't use up disk space for the empty parts:
+//
+//	File("disk.img").WithSparseFiles().WriteFile("backup/disk.img")
+//
+// Zero blocks are detected in the data itself, so this works whatever the
+// source of the data. [Pipe.AppendFile] always writes every byte.
+func (p *Pipe) WithSparseFiles() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sparse = true
+	return p
+}
+
+// WithStderr sets the standard error output for [Pipe.Exec] or
+// [Pipe.ExecForEach] commands to w, instead of the pipe.
+func (p *Pipe) WithStderr(w io.Writer) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stderr = w
+	return p
+}
+
+// WithStderrPrefix makes subsequent [Pipe.ExecForEach] commands, and those of
+// its variants such as [Pipe.ExecForEachParallel], prefix each line of their
+// standard error, including any error message reported for them, with the Go
+// template tpl. The template is rendered for each command with the
+// fields Cmd, the command line, and Line, the input line, so that a failure
+// among hundreds of iterations identifies the input that caused it:
+//
+//	ListFiles("*.tar").WithStderrPrefix("{{.Line}}: ").ExecForEach("tar tf {{.}}")
+//
+// If tpl isn't a valid template, the pipe's error status is set.
+func (p *Pipe) WithStderrPrefix(tpl string) *Pipe {
+	t, err := template.New("").Parse(tpl)
+	if err != nil {
+		return p.WithError(err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errPrefix = t
+	return p
+}
+
+// WithStdout sets the pipe's standard output to the writer w, instead of the
+// default [os.Stdout].
+func (p *Pipe) WithStdout(w io.Writer) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stdout = w
+	return p
+}
+
+// WithoutNetwork runs subsequent [Pipe.Exec] and [Pipe.ExecForEach] commands
+// without network access, where possible. On Linux, each command runs in its
+// own network namespace, which contains nothing but an unconfigured loopback
+// device. If the system doesn't allow unprivileged users to create namespaces,
+// the command isn't run, and the pipe's error status is set. On other
+// platforms, commands run normally.
+func (p *Pipe) WithoutNetwork() *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limits.noNetwork = true
+	return p
+}
+
+// WithTimeout limits each subsequent stage added to the pipe to run for at
+// most d, including any time spent waiting for input, so that a stuck command
+// or server can't make [Pipe.Wait] hang forever. A command run by [Pipe.Exec],
+// [Pipe.ExecForEach], or similar stages is killed if it's still running after
+// d, along with any processes it started (on Unix-like systems, each command
+// runs in a process group of its own for this purpose), and an HTTP request
+// is aborted. A stage that overruns is abandoned, as with [Pipe.StageTimeout],
+// which takes precedence for the stage it applies to, and the pipe's error
+// status is set to an error that wraps [context.DeadlineExceeded]:
+//
+//	err := NewPipe().WithTimeout(time.Minute).Exec("rsync -a src/ dst/").Wait()
+//
+// A zero or negative d means no limit.
+func (p *Pipe) WithTimeout(d time.Duration) *Pipe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.timeLimit = d
+	return p
+}
+
+// Words splits the contents of the pipe into words, and produces one word per
+// line, so that, for example, the most common words in a text can be found
+// with:
+//
+//	File("book.txt").Words().Freq().First(20)
+//
+// A word is a run of letters, digits, and combining marks in any script,
+// which may contain an apostrophe between letters (as in "can't"), or a
+// decimal point or thousands separator between digits (as in "3.14" or
+// "1,000"). Any other characters, such as spaces and punctuation, separate
+// words and are dropped. Chinese and Japanese ideographs, which aren't
+// usually separated by spaces, are treated as a word each.
+func (p *Pipe) Words() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		scanner := p.newScanner(r)
+		scanner.Split(scanWords)
+		for scanner.Scan() {
+			fmt.Fprintln(w, scanner.Text())
+		}
+		return scanner.Err()
+	})
+}
+
+// Wrap breaks each line of input that is longer than width characters into
+// several lines, at spaces where possible, like Unix fold -s. Runs of spaces
+// between words are collapsed to a single space, and a word longer than width
+// is split across lines. ANSI escape sequences don't count towards the width.
+//
+// If width is zero or negative, the width of the terminal is used: this is
+// taken from the COLUMNS environment variable, if set, or otherwise from the
+// terminal attached to standard output, if any. If neither is available, the
+// width is 80.
+func (p *Pipe) Wrap(width int) *Pipe {
+	if width <= 0 {
+		width = terminalWidth()
+	}
+	return p.FilterScan(func(line string, w io.Writer) {
+		current, currentLen := "", 0
+		for _, word := range strings.Fields(line) {
+			wordLen := visibleLen(word)
+			if currentLen > 0 && currentLen+1+wordLen <= width {
+				current += " " + word
+				currentLen += 1 + wordLen
+				continue
+			}
+			if currentLen > 0 {
+				fmt.Fprintln(w, current)
+			}
+			for wordLen > width {
+				runes := []rune(word)
+				fmt.Fprintln(w, string(runes[:width]))
+				word = string(runes[width:])
+				wordLen = visibleLen(word)
+			}
+			current, currentLen = word, wordLen
+		}
+		fmt.Fprintln(w, current)
+	})
+}
+
+// WriteBloomFilter builds a Bloom filter from the lines of the pipe's
+// contents, and writes it to the file path, atomically, ready for use by
+// [Pipe.FilterInSet] and [Pipe.FilterNotInSet]. It returns the number of
+// bytes written, or an error. Building the filter once, rather than every time
+// a reference list is used, saves reading the whole list each time:
+//
+//	File("known-bad.txt").WriteBloomFilter("known-bad.bloom")
+//
+// The filter is sized so that about one lookup in a thousand of a line that
+// isn't in the set gives the wrong answer. While it's being built, it needs
+// 8 bytes of memory for each line.
+func (p *Pipe) WriteBloomFilter(path string) (int64, error) {
+	var hashes []uint64
+	p.FilterBytes(func(line []byte, w io.Writer) {
+		hashes = append(hashes, hash64(line))
+	}).Wait()
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	bf := newBloomFilter(len(hashes))
+	for _, x := range hashes {
+		bf.add(x)
+	}
+	wrote, err := writeFileAtomic(path, false, "", bf.writeTo)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	return wrote, nil
+}
+
+// WriteTo copies the pipe's contents to w, returning the number of bytes
+// written, together with any error, implementing [io.WriterTo]. Where the
+// pipe's reader supports it, the data is copied directly, without any
+// intermediate buffering; for example, copying one file to another via
+// [File] and [Pipe.WriteFile] can use the operating system's fast copy
+// facilities, if available.
+func (p *Pipe) WriteTo(w io.Writer) (int64, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	n, err := p.Reader.WriteTo(w)
+	if err != nil {
+		p.SetError(err)
+	}
+	p.finish()
+	return n, p.Error()
+}
+
+// WriteFile writes the pipe's contents to the file path, truncating it if it
+// exists, and returns the number of bytes successfully written, or an error.
+func (p *Pipe) WriteFile(path string) (int64, error) {
+	return p.writeOrAppendFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// WriteFileAtomic is like [Pipe.WriteFile], but writes the contents of the
+// pipe to a temporary file in the same directory as path, then renames it to
+// path. Since the rename is atomic, other programs reading path will see
+// either its old contents, or its new contents, but never a partly-written
+// file; and if the pipe has an error, path is left unchanged. If path already
+// exists, its permissions are preserved; otherwise, the new file has
+// permissions 0o644.
+//
+// If fsync is true, the data is flushed to stable storage before the rename,
+// so that it will survive a crash or power failure, at some cost in speed.
+func (p *Pipe) WriteFileAtomic(path string, fsync bool) (int64, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	if dw := p.dryRunWriter(); dw != nil {
+		return p.writeOrAppendFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	}
+	wrote, err := writeFileAtomic(path, fsync, p.fileMetaSource(), func(w io.Writer) (int64, error) {
+		var wrote int64
+		var err error
+		if f, ok := w.(truncater); ok && p.sparseFiles() {
+			wrote, err = copySparse(f, p)
+		} else {
+			wrote, err = io.Copy(w, p)
+		}
+		if err == nil {
+			err = p.Error()
+		}
+		return wrote, err
+	})
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	return wrote, nil
+}
+
+// WriteFilesByTemplate writes each line of input to a file whose path is
+// computed by rendering pathTpl as a Go template for that line, and returns
+// the total number of bytes successfully written, or an error. This is useful
+// for splitting a stream into several files: for example, to split a log by
+// the date at the start of each line:
+//
+//	File("app.log").WriteFilesByTemplate(`logs/{{slice . 0 10}}.log`)
+//
+// If a line is a JSON object, the template's data is the decoded object, so
+// that records can be split by their fields:
+//
+//	File("events.json").WriteFilesByTemplate(`events/{{.host}}.json`)
+//
+// Otherwise, the data is the line itself. Each file, and any missing parent
+// directories, is created when the first line for it is written; existing
+// files are truncated, like [Pipe.WriteFile]. All the files are closed when
+// the input has been completely read.
+func (p *Pipe) WriteFilesByTemplate(pathTpl string) (int64, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	tpl, err := template.New("").Parse(pathTpl)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	dw := p.dryRunWriter()
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	dryRunSizes := map[string]int64{}
+	var dryRunPaths []string
+	var wrote int64
+	scanner := p.newScanner(p)
+	for scanner.Scan() {
+		line := scanner.Text()
+		var data interface{} = line
+		var record map[string]interface{}
+		if json.Unmarshal([]byte(line), &record) == nil {
+			data = record
+		}
+		path := new(strings.Builder)
+		err := tpl.Execute(path, data)
+		if err != nil {
+			p.SetError(err)
+			return wrote, err
+		}
+		name := path.String()
+		if dw != nil {
+			if _, ok := dryRunSizes[name]; !ok {
+				dryRunPaths = append(dryRunPaths, name)
+			}
+			dryRunSizes[name] += int64(len(line) + 1)
+			continue
+		}
+		f, ok := files[name]
+		if !ok {
+			err := os.MkdirAll(filepath.Dir(name), 0o755)
+			if err == nil {
+				f, err = os.Create(name)
+			}
+			if err != nil {
+				p.SetError(err)
+				return wrote, err
+			}
+			recordWrite(name)
+			files[name] = f
+		}
+		n, err := fmt.Fprintln(f, line)
+		wrote += int64(n)
+		if err != nil {
+			p.SetError(err)
+			return wrote, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		p.SetError(err)
+		return wrote, err
+	}
+	for name, f := range files {
+		delete(files, name)
+		if err := f.Close(); err != nil {
+			p.SetError(err)
+			return wrote, err
+		}
+	}
+	for _, name := range dryRunPaths {
+		fmt.Fprintf(dw, "write: %d bytes to %s\n", dryRunSizes[name], name)
+	}
+	return wrote, p.Error()
+}
+
+// WriteFileTx writes the contents of the pipe to path as part of the
+// transaction tx, returning the number of bytes written, or an error. The data
+// is written to a temporary file in the same directory as path, and flushed
+// to stable storage, but path itself is only updated when tx is committed,
+// together with every other file written in the same transaction. If the pipe
+// has an error, or the file can't be written, tx will be rolled back instead
+// (see [TxWriter.Commit]). Permissions are preserved as for
+// [Pipe.WriteFileAtomic].
+func (p *Pipe) WriteFileTx(tx *TxWriter, path string) (int64, error) {
+	if p.Error() != nil {
+		tx.fail(p.Error())
+		return 0, p.Error()
+	}
+	if dw := p.dryRunWriter(); dw != nil {
+		return p.writeOrAppendFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+	}
+	tmp, wrote, err := stageFile(path, true, func(w io.Writer) (int64, error) {
+		wrote, err := io.Copy(w, p)
+		if err == nil {
+			err = p.Error()
+		}
+		return wrote, err
+	})
+	if err != nil {
+		p.SetError(err)
+		tx.fail(err)
+		return 0, err
+	}
+	tx.add(tmp, path)
+	return wrote, nil
+}
+
+func (p *Pipe) writeOrAppendFile(path string, mode int) (int64, error) {
+	if p.Error() != nil {
+		return 0, p.Error()
+	}
+	if dw := p.dryRunWriter(); dw != nil {
+		verb := "write"
+		if mode&os.O_APPEND != 0 {
+			verb = "append"
+		}
+		n, err := io.Copy(io.Discard, p)
+		if err != nil {
+			p.SetError(err)
+			return 0, err
+		}
+		fmt.Fprintf(dw, "%s: %d bytes to %s\n", verb, n, path)
+		return 0, p.Error()
+	}
+	out, err := os.OpenFile(path, mode, 0o666)
+	if err != nil {
+		p.SetError(err)
+		return 0, err
+	}
+	recordWrite(path)
+	defer out.Close()
+	var wrote int64
+	if mode&os.O_APPEND == 0 && p.sparseFiles() {
+		wrote, err = copySparse(out, p)
+	} else {
+		wrote, err = io.Copy(out, p)
+	}
+	if err != nil {
+		p.SetError(err)
+	}
+	if src := p.fileMetaSource(); src != "" && p.Error() == nil {
+		err = copyFileMeta(src, path)
+		if err != nil {
+			p.SetError(err)
+		}
+	}
+	return wrote, p.Error()
+}
+
+// ansiEscape matches an ANSI escape sequence, such as a color change.
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// visibleLen returns the number of characters in s, not counting any ANSI
+// escape sequences.
+func visibleLen(s string) int {
+	return utf8.RuneCountInString(ansiEscape.ReplaceAllString(s, ""))
+}
+
+// terminalWidth returns the width of the terminal in columns, as described
+// for [Pipe.Wrap].
+func terminalWidth() int {
+	if cols, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && cols > 0 {
+		return cols
+	}
+	if cols := ttyWidth(os.Stdout); cols > 0 {
+		return cols
+	}
+	return 80
+}
+
+// xargsMaxBytes is the maximum total size of the arguments that [Pipe.XArgs]
+// will pass to a single command, which is comfortably within the limits of
+// all common operating systems.
+const xargsMaxBytes = 128 * 1024
+
+// XArgs runs the command cmdLine with the lines of input appended to it as
+// arguments, like Unix xargs(1). Each line is passed as a single argument,
+// without further splitting, so paths containing spaces are safe. Lines are
+// batched into as few invocations of the command as possible: each gets at
+// most maxArgs arguments (or any number, if maxArgs is zero or negative), up
+// to a total of 128 KiB. This is much faster than [Pipe.ExecForEach] for
+// commands that accept many arguments at once. For example:
+//
+//	FindFiles(".").Match(".tmp").XArgs("rm -f", 0).Wait()
+//
+// The combined output of all the commands is produced. Every batch is run,
+// even if earlier ones failed, but if any command fails, the pipe's error
+// status is set to the first such error. See [Pipe.Exec] for details of
+// error handling and environment variables.
+func (p *Pipe) XArgs(cmdLine string, maxArgs int) *Pipe {
+	base, err := shell.Fields(cmdLine, nil)
+	if err != nil {
+		return p.WithError(err)
+	}
+	if len(base) == 0 {
+		return p.WithError(errors.New("empty command line"))
+	}
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		abandoned := stageAbandoned(w)
+		w = p.commandOutput(w)
+		var firstErr error
+		run := func(args []string) {
+			line := strings.Join(append(base[:len(base):len(base)], args...), " ")
+			if dw := p.dryRunWriter(); dw != nil {
+				fmt.Fprintf(dw, "exec: %s\n", line)
+				return
+			}
+			cmd := exec.Command(base[0], append(base[1:len(base):len(base)], args...)...)
+			cmd.Stdout = w
+			cmd.Stderr = w
+			pipeStderr := p.stdErr()
+			if pipeStderr != nil {
+				cmd.Stderr = pipeStderr
+			}
+			pipeEnv := p.environment()
+			if pipeEnv != nil {
+				cmd.Env = pipeEnv
+			}
+			errOut := cmd.Stderr
+			err := p.runCommand(cmd, line, abandoned)
+			if err != nil {
+				fmt.Fprintln(errOut, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		var batch []string
+		size := 0
+		scanner := p.newScanner(r)
+		for scanner.Scan() {
+			arg := scanner.Text()
+			full := maxArgs > 0 && len(batch) >= maxArgs
+			if len(batch) > 0 && (full || size+len(arg)+1 > xargsMaxBytes) {
+				run(batch)
+				batch, size = nil, 0
+			}
+			batch = append(batch, arg)
+			size += len(arg) + 1
+		}
+		if len(batch) > 0 {
+			run(batch)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return firstErr
+	})
+}
+
+// XMLToJSON converts the pipe's contents from XML, such as a Maven POM, an
+// RSS feed, or a SOAP response, to a single line of JSON, so that it can be
+// queried with [Pipe.JQ]. For example, to list the titles of the items in an
+// RSS feed:
+//
+//	Get(feedURL).XMLToJSON().WithJQRawOutput().JQ(".rss.channel.item[].title").Stdout()
+//
+// The result is an object with a single field, named after the document's
+// root element. Each element becomes its text content, as a string, if it
+// has no attributes or child elements. Otherwise, it becomes an object with
+// fields named after its child elements, its attributes, prefixed with "@",
+// and its text content, if any, as "#text". An element that appears more
+// than once in the same parent becomes an array. For example:
+//
+//	<feed lang="en"><item id="1">One</item><item id="2">Two</item></feed>
+//
+// becomes:
+//
+//	{"feed":{"@lang":"en","item":[{"#text":"One","@id":"1"},{"#text":"Two","@id":"2"}]}}
+//
+// Names are used without their namespace prefixes, and leading and trailing
+// whitespace is removed from text content. If the input isn't valid XML, the
+// pipe's error status is set.
+func (p *Pipe) XMLToJSON() *Pipe {
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		dec := xml.NewDecoder(r)
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				return errors.New("no XML element in input")
+			}
+			if err != nil {
+				return err
+			}
+			start, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			value, err := xmlToValue(dec, start)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(w)
+			enc.SetEscapeHTML(false)
+			return enc.Encode(map[string]interface{}{start.Name.Local: value})
+		}
+	})
+}
+
+// YQ is like [Pipe.JQ], but for YAML: it parses the pipe's contents as YAML,
+// such as a Kubernetes manifest, CI configuration, or Helm values file,
+// executes query on it, and produces the results as JSON, one per line. If
+// the input contains several YAML documents, separated by "---" lines, query
+// is executed on each of them in turn. For example, to list the images used by
+// all the deployments in a set of manifests:
+//
+//	File("k8s.yaml").WithJQRawOutput().YQ(`select(.kind == "Deployment") | .spec.template.spec.containers[].image`).Stdout()
+//
+// Timestamps are converted to strings in RFC 3339 format, and mapping keys
+// that aren't strings are converted to strings, since JSON has no equivalent
+// of either. If the input isn't valid YAML, or query isn't valid, the pipe's
+// error status is set.
+func (p *Pipe) YQ(query string) *Pipe {
+	raw := p.jqRawOutput()
+	return p.Filter(func(r io.Reader, w io.Writer) error {
+		q, err := gojq.Parse(query)
+		if err != nil {
+			return err
+		}
+		dec := yaml.NewDecoder(r)
+		for {
+			var input interface{}
+			err = dec.Decode(&input)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = runJQ(q, normalizeYAML(input), w, raw)
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// Stats holds the throughput statistics recorded by [Pipe.Measure].
+type Stats struct {
+	Bytes   int64
+	Lines   int64
+	Elapsed time.Duration
+}
+
+// String returns a human-readable summary of the statistics, such as:
+//
+//	3 lines, 85 bytes in 1.2ms (70.8 kB/s)
+func (s *Stats) String() string {
+	rate := 0.0
+	if s.Elapsed > 0 {
+		rate = float64(s.Bytes) / s.Elapsed.Seconds() / 1000
+	}
+	return fmt.Sprintf("%d lines, %d bytes in %s (%.1f kB/s)", s.Lines, s.Bytes, s.Elapsed, rate)
+}
+
+// Metrics is a registry of pipe metrics, recorded by pipes configured with
+// [Pipe.WithMetrics]. It implements [http.Handler], serving the metrics in the
+// Prometheus text exposition format, so that it can be scraped by Prometheus
+// or a compatible collector:
+//
+//	script_stage_lines_total{stage="errors"} 17
+//	script_command_exits_total{command="tar",status="0"} 3
+//
+// A Metrics is safe for concurrent use by multiple pipes. Create one with
+// [NewMetrics].
+type Metrics struct {
+	mu     sync.Mutex
+	stages map[string]*stageMetrics
+	exits  map[commandExit]int64
+}
+
+// stageMetrics holds the totals recorded for a stage by [Pipe.Meter].
+type stageMetrics struct {
+	runs    int64
+	lines   int64
+	bytes   int64
+	elapsed time.Duration
+}
+
+// commandExit identifies a command name and exit status, for counting in
+// [Metrics].
+type commandExit struct {
+	command string
+	status  int
+}
+
+// recordChunk adds a chunk of data passing through stage, of the given
+// number of bytes and lines, to the totals for stage.
+func (m *Metrics) recordChunk(stage string, bytes, lines int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.stage(stage)
+	sm.lines += lines
+	sm.bytes += bytes
+}
+
+// recordRun counts a completed run of stage, which took elapsed.
+func (m *Metrics) recordRun(stage string, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sm := m.stage(stage)
+	sm.runs++
+	sm.elapsed += elapsed
+}
+
+// stage returns the totals for stage, creating them if necessary. The caller
+// must hold m.mu.
+func (m *Metrics) stage(stage string) *stageMetrics {
+	sm, ok := m.stages[stage]
+	if !ok {
+		sm = new(stageMetrics)
+		m.stages[stage] = sm
+	}
+	return sm
+}
+
+// recordExit counts an exit with status by the command name.
+func (m *Metrics) recordExit(command string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exits[commandExit{command, status}]++
+}
+
+// ServeHTTP writes the current metrics to w in the Prometheus text exposition
+// format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the current metrics to w in the Prometheus text exposition
+// format, returning the number of bytes written, or an error.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	stages := make([]string, 0, len(m.stages))
+	for stage := range m.stages {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	exits := make([]commandExit, 0, len(m.exits))
+	for exit := range m.exits {
+		exits = append(exits, exit)
+	}
+	sort.Slice(exits, func(i, j int) bool {
+		if exits[i].command != exits[j].command {
+			return exits[i].command < exits[j].command
+		}
+		return exits[i].status < exits[j].status
+	})
+	buf := new(bytes.Buffer)
+	stageMetric := func(name, help string, value func(*stageMetrics) string) {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, stage := range stages {
+			fmt.Fprintf(buf, "%s{stage=\"%s\"} %s\n", name, labelEscaper.Replace(stage), value(m.stages[stage]))
+		}
+	}
+	stageMetric("script_stage_runs_total", "Number of times each metered stage has completed.", func(sm *stageMetrics) string {
+		return strconv.FormatInt(sm.runs, 10)
+	})
+	stageMetric("script_stage_lines_total", "Lines passed through each metered stage.", func(sm *stageMetrics) string {
+		return strconv.FormatInt(sm.lines, 10)
+	})
+	stageMetric("script_stage_bytes_total", "Bytes passed through each metered stage.", func(sm *stageMetrics) string {
+		return strconv.FormatInt(sm.bytes, 10)
+	})
+	stageMetric("script_stage_duration_seconds_total", "Time taken by each metered stage.", func(sm *stageMetrics) string {
+		return strconv.FormatFloat(sm.elapsed.Seconds(), 'g', -1, 64)
+	})
+	buf.WriteString("# HELP script_command_exits_total Commands run, by name and exit status.\n# TYPE script_command_exits_total counter\n")
+	for _, exit := range exits {
+		fmt.Fprintf(buf, "script_command_exits_total{command=\"%s\",status=\"%d\"} %d\n", labelEscaper.Replace(exit.command), exit.status, m.exits[exit])
+	}
+	m.mu.Unlock()
+	return buf.WriteTo(w)
+}
+
+// labelEscaper escapes a Prometheus label value.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Summary holds the outcomes of a batch of commands, as reported by
+// [Pipe.Summary].
+type Summary struct {
+	OK       int
+	Failed   int
+	FirstErr error
+	LastErr  error
+	Elapsed  time.Duration
+}
+
+// String returns a human-readable summary of the results, such as:
+//
+//	3 of 250 commands failed in 1m2s (first error: exit status 255)
+func (s Summary) String() string {
+	total := s.OK + s.Failed
+	if s.Failed == 0 {
+		return fmt.Sprintf("%d commands succeeded in %s", total, s.Elapsed)
+	}
+	return fmt.Sprintf("%d of %d commands failed in %s (first error: %v)", s.Failed, total, s.Elapsed, s.FirstErr)
+}
+
+// Err returns an error describing the failures if any commands failed, or nil
+// otherwise. The error wraps [Summary.FirstErr].
+func (s Summary) Err() error {
+	if s.Failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d commands failed: %w", s.Failed, s.OK+s.Failed, s.FirstErr)
+}
+
+// add counts the outcome of a command, whose error status is err.
+func (s *Summary) add(err error) {
+	if err != nil {
+		s.Failed++
+		if s.FirstErr == nil {
+			s.FirstErr = err
+		}
+		s.LastErr = err
+	} else {
+		s.OK++
+	}
+}
+
+// errorReport is the JSON error report printed when [Pipe.WithJSONErrors] is
+// set.
+type errorReport struct {
+	Program    string `json:"program"`
+	Error      string `json:"error"`
+	ExitStatus int    `json:"exit_status"`
+	Command    string `json:"command,omitempty"`
+	Stderr     string `json:"stderr,omitempty"`
+}
+
+// execErrorStderrMax is the maximum amount of a command's standard error
+// output kept in an [ExecError].
+const execErrorStderrMax = 4096
+
+// ExecError describes the failure of a command run by [Pipe.Exec],
+// [Pipe.ExecForEach], and similar methods. It's set as the pipe's error
+// status, or, for methods that run many commands, recorded in the pipe's
+// [Summary]. To find out why a command failed, use [errors.As]:
+//
+//	var execErr *script.ExecError
+//	if errors.As(p.Error(), &execErr) {
+//		fmt.Println(execErr.ExitCode, execErr.Stderr)
+//	}
+//
+// If the command couldn't be started at all, ExitCode is -1, and Err is the
+// reason, so that, for example, a missing program can be distinguished from
+// one that exited with status 127 using errors.Is(err, [exec.ErrNotFound]).
+type ExecError struct {
+	// Cmd is the command line that was run.
+	Cmd string
+	// ExitCode is the command's exit status, or -1 if it didn't exit
+	// normally.
+	ExitCode int
+	// Stderr holds the last 4 KiB of the command's standard error output.
+	// If that went to the pipe along with its standard output, which is the
+	// default, Stderr holds the end of the combined output instead.
+	Stderr string
+	// Err is the underlying error, such as an [*exec.ExitError].
+	Err error
+}
+
+// Error returns the message of the underlying error, such as “exit status
+// 1”.
+func (e *ExecError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Group runs several pipes concurrently, and waits for them all to finish.
+// For example, to fetch several files at once:
+//
+//	g := script.NewGroup()
+//	g.Go(script.Get(url1).Tee(f1))
+//	g.Go(script.Get(url2).Tee(f2))
+//	err := g.Wait()
+//
+// The zero value is a valid Group, which doesn't fail fast (see
+// [Group.FailFast]).
+type Group struct {
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	pipes    []*Pipe
+	err      error
+	failFast bool
+}
+
+// NewGroup creates a new, empty [Group].
+func NewGroup() *Group {
+	return &Group{}
+}
+
+// FailFast makes the group cancel all its other pipes as soon as any of them
+// fails, by closing them, and returns the group. A cancelled pipe's stages
+// stop when they next try to write output.
+func (g *Group) FailFast() *Group {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failFast = true
+	return g
+}
+
+// Go starts waiting for p to finish, as [Pipe.Wait] does, in the background.
+// The pipe's output is discarded, so to keep it, end the pipe with a filter
+// such as [Pipe.Tee].
+func (g *Group) Go(p *Pipe) {
+	g.mu.Lock()
+	g.pipes = append(g.pipes, p)
+	if g.failFast && g.err != nil {
+		p.Close()
+	}
+	g.mu.Unlock()
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := p.Wait()
+		if err == nil {
+			return
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.err != nil {
+			return
+		}
+		g.err = err
+		if !g.failFast {
+			return
+		}
+		for _, other := range g.pipes {
+			if other != p {
+				other.Close()
+			}
+		}
+	}()
+}
+
+// Wait waits for all the pipes started by [Group.Go] to finish, and returns
+// the first error from any of them, or nil if all succeeded. Each pipe's own
+// error status is available from its [Pipe.Error] method.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Workspace is a temporary directory for the intermediate files used by a
+// script, which is removed, along with everything in it, when the workspace is
+// closed, or when the program exits by way of [Main] or [Pipe.ExitOnError], or
+// is interrupted or terminated by a signal (see [OnExit]). For example:
+//
+//	ws, err := script.NewWorkspace()
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer ws.Close()
+//	script.Get(url).WriteFile(ws.Path("download.tar.gz"))
+//
+// While the workspace is open, it keeps track of the files written into it by
+// pipe sinks such as [Pipe.WriteFile] and [Pipe.AppendFile] (see
+// [Workspace.Written]).
+type Workspace struct {
+	// Dir is the path of the workspace directory.
+	Dir     string
+	hook    *exitHook
+	once    sync.Once
+	err     error
+	mu      sync.Mutex
+	written []string
+}
+
+// NewWorkspace creates a new [Workspace] in the default directory for
+// temporary files (see [os.TempDir]).
+func NewWorkspace() (*Workspace, error) {
+	dir, err := os.MkdirTemp("", "script-")
+	if err != nil {
+		return nil, err
+	}
+	ws := &Workspace{Dir: dir}
+	ws.hook = addExitHook(func() {
+		ws.Close()
+	})
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	workspaces = append(workspaces, ws)
+	return ws, nil
+}
+
+// Path returns the path of the file elem within the workspace, joining any
+// additional elements, as [filepath.Join] does. It doesn't create the file.
+func (ws *Workspace) Path(elem ...string) string {
+	return filepath.Join(append([]string{ws.Dir}, elem...)...)
+}
+
+// Files creates a pipe listing all the files in the workspace, as
+// [FindFiles] does.
+func (ws *Workspace) Files() *Pipe {
+	return FindFiles(ws.Dir)
+}
+
+// Written creates a pipe listing the paths of the files in the workspace
+// written by pipe sinks, such as [Pipe.WriteFile], [Pipe.AppendFile], or
+// [Pipe.WriteFileAtomic], in the order they were first written. Unlike
+// [Workspace.Files], it doesn't include files created by other means, such as
+// by external commands.
+func (ws *Workspace) Written() *Pipe {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return Slice(append([]string(nil), ws.written...))
+}
+
+// Close removes the workspace directory and everything in it. After the
+// first call, Close does nothing, and returns the same result.
+func (ws *Workspace) Close() error {
+	ws.once.Do(func() {
+		removeExitHook(ws.hook)
+		workspacesMu.Lock()
+		for i, w := range workspaces {
+			if w == ws {
+				workspaces = append(workspaces[:i], workspaces[i+1:]...)
+				break
+			}
+		}
+		workspacesMu.Unlock()
+		ws.err = os.RemoveAll(ws.Dir)
+	})
+	return ws.err
+}
+
+// record adds path to the list of files written into the workspace, if it's
+// within the workspace directory and not already listed.
+func (ws *Workspace) record(path string) {
+	rel, err := filepath.Rel(ws.Dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, p := range ws.written {
+		if p == path {
+			return
+		}
+	}
+	ws.written = append(ws.written, path)
+}
+
+var (
+	workspacesMu sync.Mutex
+	workspaces   []*Workspace
+)
+
+// recordWrite tells every open [Workspace] containing path that a pipe sink
+// has written to it.
+func recordWrite(path string) {
+	workspacesMu.Lock()
+	defer workspacesMu.Unlock()
+	if len(workspaces) == 0 {
+		return
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	for _, ws := range workspaces {
+		ws.record(path)
+	}
+}
+
+// TxWriter is a transaction grouping several file writes, made with
+// [Pipe.WriteFileTx], so that either all of the files are updated, or none of
+// them are. This prevents a set of related files, such as configuration files
+// that must agree with each other, from being left half-updated if a later
+// stage fails:
+//
+//	tx := script.NewTxWriter()
+//	defer tx.Rollback()
+//	script.File("app.tpl").Replace("PORT", port).WriteFileTx(tx, "app.conf")
+//	script.File("proxy.tpl").Replace("PORT", port).WriteFileTx(tx, "proxy.conf")
+//	if err := tx.Commit(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// A TxWriter is safe for concurrent use by multiple pipes. Create one with
+// [NewTxWriter].
+type TxWriter struct {
+	mu    sync.Mutex
+	files []txFile
+	err   error
+	done  bool
+}
+
+// txFile is a file written as part of a [TxWriter] transaction: the
+// temporary file tmp holds the new contents of path.
+type txFile struct {
+	tmp  string
+	path string
+}
+
+// NewTxWriter creates a new, empty [TxWriter].
+func NewTxWriter() *TxWriter {
+	return &TxWriter{}
+}
+
+// add records that tmp holds the new contents of path.
+func (tx *TxWriter) add(tmp, path string) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		os.Remove(tmp)
+		return
+	}
+	tx.files = append(tx.files, txFile{tmp: tmp, path: path})
+}
+
+// fail records err as the reason the transaction must be rolled back, unless
+// there is already one.
+func (tx *TxWriter) fail(err error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// Commit updates all the files written in the transaction, by renaming each
+// temporary file to its destination. If any write in the transaction failed,
+// or any rename fails, Commit rolls back the transaction instead, restoring
+// any files it has already updated to their previous contents, and returns an
+// error. After the first call to Commit or [TxWriter.Rollback], Commit just
+// returns an error.
+func (tx *TxWriter) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return errors.New("transaction already committed or rolled back")
+	}
+	tx.done = true
+	if tx.err != nil {
+		tx.removeTemps(0)
+		return fmt.Errorf("transaction rolled back: %w", tx.err)
+	}
+	backups := make([]string, len(tx.files))
+	for i, f := range tx.files {
+		err := tx.commitFile(f, &backups[i])
+		if err != nil {
+			for j := i; j >= 0; j-- {
+				tx.restoreFile(tx.files[j], backups[j])
+			}
+			tx.removeTemps(i)
+			return fmt.Errorf("transaction rolled back: %w", err)
+		}
+	}
+	for _, backup := range backups {
+		if backup != "" {
+			os.Remove(backup)
+		}
+	}
+	for _, f := range tx.files {
+		recordWrite(f.path)
+	}
+	return nil
+}
+
+// commitFile moves any existing file at f.path aside, setting *backup to its
+// new path, and renames f.tmp to f.path.
+func (tx *TxWriter) commitFile(f txFile, backup *string) error {
+	if _, err := os.Lstat(f.path); err == nil {
+		old := f.tmp + ".old"
+		err := os.Rename(f.path, old)
+		if err != nil {
+			return err
+		}
+		*backup = old
+	}
+	return os.Rename(f.tmp, f.path)
+}
+
+// restoreFile undoes commitFile, as far as it got: it moves backup, if any,
+// back to f.path, or otherwise removes any new file at f.path.
+func (tx *TxWriter) restoreFile(f txFile, backup string) {
+	if _, err := os.Stat(f.tmp); err == nil {
+		// the new file was never renamed into place
+		if backup != "" {
+			os.Rename(backup, f.path)
+		}
+		return
+	}
+	if backup != "" {
+		os.Rename(backup, f.path)
+		return
+	}
+	os.Remove(f.path)
+}
+
+// removeTemps removes the temporary files for all the files in the
+// transaction from the i'th on.
+func (tx *TxWriter) removeTemps(i int) {
+	for _, f := range tx.files[i:] {
+		os.Remove(f.tmp)
+	}
+}
+
+// Rollback abandons the transaction, removing the temporary files written for
+// it, and leaving all their destinations unchanged. After the first call to
+// [TxWriter.Commit] or Rollback, Rollback does nothing, so it's safe to defer
+// a call to Rollback as soon as the transaction is created.
+func (tx *TxWriter) Rollback() {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return
+	}
+	tx.done = true
+	tx.removeTemps(0)
+}
+
+// fileRecord is the description of a file produced by [FindFilesJSON].
+type fileRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// RegexpMatch describes a single match of a regexp within a line, for use in
+// templates rendered by [Pipe.ReplaceRegexpTemplate].
+type RegexpMatch struct {
+	// Groups holds the text of the whole match, followed by the text of each
+	// capturing group, so that Groups[1] corresponds to $1, and so on. A group
+	// that didn't participate in the match is the empty string.
+	Groups []string
+	// Named maps the name of each named capturing group to its text.
+	Named map[string]string
+	// Line is the whole input line containing the match.
+	Line string
+	// LineNumber is the number of the line in the input, starting from 1.
+	LineNumber int
+}
+
+// FileOrder is a criterion for sorting files using [Pipe.SortFiles].
+type FileOrder int
+
+const (
+	// ByName sorts files in lexical order of their paths.
+	ByName FileOrder = iota
+	// ByModTime sorts files in order of their last modification time, oldest
+	// first.
+	ByModTime
+	// BySize sorts files in order of their size in bytes, smallest first.
+	BySize
+)
+
+// SyncOption changes the behaviour of [Sync]. The zero SyncOption isn't any
+// of the options, and has no effect.
+type SyncOption int
+
+const (
+	// SyncChecksum compares files by their contents, rather than by their
+	// size and modification time.
+	SyncChecksum SyncOption = iota + 1
+	// SyncDelete removes any files and directories in the destination that
+	// don't exist in the source.
+	SyncDelete
+)
+
+// tailBuffer is a writer that keeps only the last max bytes written to it.
+type tailBuffer struct {
+	max  int
+	data []byte
+}
+
+// Write appends data to the buffer, discarding its oldest contents if
+// necessary. It never returns an error.
+func (b *tailBuffer) Write(data []byte) (int, error) {
+	b.data = append(b.data, data...)
+	if excess := len(b.data) - b.max; excess > 0 {
+		b.data = b.data[excess:]
+	}
+	return len(data), nil
+}
+
+// followInterval is how often [FollowFile] checks for new data.
+const followInterval = 250 * time.Millisecond
+
+// followReader reads data appended to a file, as described for [FollowFile].
+type followReader struct {
+	ctx    context.Context
+	path   string
+	mu     sync.Mutex // guards f
+	f      *os.File
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Read reads up to len(b) bytes of new data from the file into b, waiting for
+// some to arrive if necessary. Once the reader's context is cancelled, or the
+// reader is closed, Read returns 0, [io.EOF].
+func (fr *followReader) Read(b []byte) (int, error) {
+	for {
+		fr.mu.Lock()
+		f := fr.f
+		fr.mu.Unlock()
+		n, err := f.Read(b)
+		if errors.Is(err, os.ErrClosed) {
+			return 0, io.EOF
+		}
+		if n > 0 || err != nil && err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-fr.ctx.Done():
+			return 0, io.EOF
+		case <-fr.closed:
+			return 0, io.EOF
+		case <-time.After(followInterval):
+		}
+		err = fr.reopenIfChanged()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// reopenIfChanged starts reading from the beginning of the file again if it's
+// been truncated, or reopens it if it's been replaced by a different file,
+// once everything written to the old file has been read.
+func (fr *followReader) reopenIfChanged() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	info, err := os.Stat(fr.path)
+	if err != nil {
+		return nil // perhaps it's being rotated, so check again later
+	}
+	current, err := fr.f.Stat()
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(info, current) {
+		offset, err := fr.f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if offset < current.Size() {
+			return nil // finish reading the old file first
+		}
+		f, err := os.Open(fr.path)
+		if err != nil {
+			return nil
+		}
+		fr.f.Close()
+		fr.f = f
+		return nil
+	}
+	offset, err := fr.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if info.Size() < offset {
+		_, err = fr.f.Seek(0, io.SeekStart)
+	}
+	return err
+}
+
+// Close stops the reader and closes the file. It's safe to call Close more
+// than once.
+func (fr *followReader) Close() error {
+	var err error
+	fr.once.Do(func() {
+		close(fr.closed)
+		fr.mu.Lock()
+		defer fr.mu.Unlock()
+		err = fr.f.Close()
+	})
+	return err
+}
+
+// commandRenderer returns the command to run for a line of input, both as a
+// command line, for dry runs and logging, and as a list of arguments.
+type commandRenderer func(line string) (cmdLine string, args []string, err error)
+
+// stderrLine is the data for the template set by [Pipe.WithStderrPrefix].
+type stderrLine struct {
+	Cmd  string
+	Line string
+}
+
+// rankedLine is a line of input considered by [Pipe.TopBy], with its number
+// and position in the input.
+type rankedLine struct {
+	value float64
+	seq   int
+	text  string
+}
+
+// rankedLines is a heap of lines, implementing [heap.Interface], with the
+// lowest-ranking line on top, so that it can be replaced by a better one.
+type rankedLines struct {
+	lines  []rankedLine
+	better func(x, y float64) bool
+}
+
+// ranksAbove reports whether a ranks above b: that is, whether its value is
+// better, or, if the values are equal, whether it came first.
+func (h *rankedLines) ranksAbove(a, b rankedLine) bool {
+	if a.value == b.value {
+		return a.seq < b.seq
+	}
+	return h.better(a.value, b.value)
+}
+
+// Len, Less, Swap, Push, and Pop implement [heap.Interface].
+func (h *rankedLines) Len() int           { return len(h.lines) }
+func (h *rankedLines) Less(i, j int) bool { return h.ranksAbove(h.lines[j], h.lines[i]) }
+func (h *rankedLines) Swap(i, j int)      { h.lines[i], h.lines[j] = h.lines[j], h.lines[i] }
+func (h *rankedLines) Push(x interface{}) { h.lines = append(h.lines, x.(rankedLine)) }
+
+func (h *rankedLines) Pop() interface{} {
+	last := h.lines[len(h.lines)-1]
+	h.lines = h.lines[:len(h.lines)-1]
+	return last
+}
+
+// bloomMagic identifies a file written by [Pipe.WriteBloomFilter].
+const bloomMagic = "script-bloom-v1\n"
+
+// bloomFalsePositiveRate is the proportion of lookups of items that aren't in
+// a [bloomFilter] that it's sized to get wrong.
+const bloomFalsePositiveRate = 0.001
+
+// bloomMaxHashes is the largest number of hash functions that
+// [loadBloomFilter] accepts in a filter file. Filters written by
+// [Pipe.WriteBloomFilter] use about ten, so anything much larger indicates a
+// corrupt file, which would otherwise make every lookup very slow.
+const bloomMaxHashes = 64
+
+// bloomFilter is a Bloom filter, as used by [Pipe.FilterInSet]: a set that
+// answers whether an item is a member in fixed space, at the cost of
+// sometimes wrongly answering yes. Items are added and checked by their
+// hashes, as returned by [hash64].
+type bloomFilter struct {
+	words []uint64
+	k     uint64
+}
+
+// newBloomFilter returns an empty [bloomFilter] sized for n items.
+func newBloomFilter(n int) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		words: make([]uint64, int(m+63)/64),
+		k:     uint64(k),
+	}
+}
+
+// add adds the item with hash x to the set.
+func (bf *bloomFilter) add(x uint64) {
+	bf.probe(x, func(word int, bit uint64) bool {
+		bf.words[word] |= bit
+		return true
+	})
+}
+
+// has reports whether the item with hash x is probably in the set. If it
+// returns false, the item is definitely not in the set.
+func (bf *bloomFilter) has(x uint64) bool {
+	return bf.probe(x, func(word int, bit uint64) bool {
+		return bf.words[word]&bit != 0
+	})
+}
+
+// probe calls fn with each of the k bits belonging to the item with hash x,
+// as a word index and bit mask, stopping if fn returns false, and reports
+// whether it got to the end.
+func (bf *bloomFilter) probe(x uint64, fn func(word int, bit uint64) bool) bool {
+	m := uint64(len(bf.words)) * 64
+	h1, h2 := x, bits.RotateLeft64(x, 32)|1
+	for i := uint64(0); i < bf.k; i++ {
+		pos := (h1 + i*h2) % m
+		if !fn(int(pos/64), 1<<(pos%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+// writeTo writes the filter to w, in the format read by [loadBloomFilter],
+// and returns the number of bytes written.
+func (bf *bloomFilter) writeTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(bloomMagic)
+	binary.Write(bw, binary.LittleEndian, []uint64{bf.k, uint64(len(bf.words))})
+	binary.Write(bw, binary.LittleEndian, bf.words)
+	err := bw.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(bloomMagic) + 16 + 8*len(bf.words)), nil
+}
+
+// loadBloomFilter reads the set described by path, which is either a filter
+// written by [Pipe.WriteBloomFilter] or a text file listing the members of
+// the set, one per line, as described for [Pipe.FilterInSet].
+func loadBloomFilter(path string) (*bloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(len(bloomMagic))
+	if err == nil && string(magic) == bloomMagic {
+		r.Discard(len(bloomMagic))
+		var header [2]uint64
+		err = binary.Read(r, binary.LittleEndian, header[:])
+		if err != nil {
+			return nil, fmt.Errorf("reading Bloom filter %s: %w", path, err)
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		size := int64(len(bloomMagic)) + 16 + 8*int64(header[1])
+		if header[0] < 1 || header[0] > bloomMaxHashes || header[1] < 1 || header[1] > uint64(info.Size()) || size != info.Size() {
+			return nil, fmt.Errorf("reading Bloom filter %s: invalid header", path)
+		}
+		bf := &bloomFilter{k: header[0], words: make([]uint64, header[1])}
+		err = binary.Read(r, binary.LittleEndian, bf.words)
+		if err != nil {
+			return nil, fmt.Errorf("reading Bloom filter %s: %w", path, err)
+		}
+		return bf, nil
+	}
+	// A list of members: count them, to size the filter, then add them
+	n, err := File(path).CountLines()
+	if err != nil {
+		return nil, err
+	}
+	bf := newBloomFilter(n)
+	err = File(path).FilterBytes(func(line []byte, w io.Writer) {
+		bf.add(hash64(line))
+	}).Wait()
+	if err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// hllPrecision is the number of hash bits used to choose a register in a
+// [hyperLogLog], which has 2^hllPrecision registers.
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct items added to it, as
+// described for [Pipe.CountDistinct].
+type hyperLogLog struct {
+	registers []uint8
+}
+
+// newHyperLogLog returns an empty [hyperLogLog].
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// add adds item to the set whose size is being estimated.
+func (h *hyperLogLog) add(item []byte) {
+	x := hash64(item)
+	i := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// count returns the estimated number of distinct items added so far.
+func (h *hyperLogLog) count() int {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// For small sets, linear counting is much more accurate
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(estimate))
+}
+
+// countMinSketch estimates how many times each item has been added to it, in
+// fixed space, as described for [Pipe.TopK].
+type countMinSketch struct {
+	rows [4][1 << 16]uint64
+}
+
+// newCountMinSketch returns an empty [countMinSketch].
+func newCountMinSketch() *countMinSketch {
+	return new(countMinSketch)
+}
+
+// add counts one more occurrence of item, and returns the new estimate of
+// its count: the smallest of its counters, which is never less than the true
+// count.
+func (s *countMinSketch) add(item []byte) uint64 {
+	x := hash64(item)
+	h1, h2 := uint32(x), uint32(x>>32)
+	estimate := uint64(math.MaxUint64)
+	for i := range s.rows {
+		j := (h1 + uint32(i)*h2) % uint32(len(s.rows[i]))
+		s.rows[i][j]++
+		if s.rows[i][j] < estimate {
+			estimate = s.rows[i][j]
+		}
+	}
+	return estimate
+}
+
+// heavyItem is a line and its estimated count, as tracked by [heavyHitters].
+type heavyItem struct {
+	line  string
+	count uint64
+}
+
+// heavyHitters is a min-heap of the most frequent lines seen so far, with
+// the least frequent at the top, so that it's the first to be displaced.
+type heavyHitters struct {
+	items []heavyItem
+	index map[string]int
+}
+
+// offer records that line has the estimated count, adding it to the heap if
+// it's already there, if there are fewer than k items, or if it's more
+// frequent than the least frequent item, which it then replaces.
+func (h *heavyHitters) offer(line string, count uint64, k int) {
+	if i, ok := h.index[line]; ok {
+		h.items[i].count = count
+		heap.Fix(h, i)
+		return
+	}
+	if len(h.items) < k {
+		heap.Push(h, heavyItem{line: line, count: count})
+		return
+	}
+	if count <= h.items[0].count {
+		return
+	}
+	delete(h.index, h.items[0].line)
+	h.items[0] = heavyItem{line: line, count: count}
+	h.index[line] = 0
+	heap.Fix(h, 0)
+}
+
+// Len, Less, Swap, Push, and Pop implement [heap.Interface].
+func (h *heavyHitters) Len() int           { return len(h.items) }
+func (h *heavyHitters) Less(i, j int) bool { return h.items[i].count < h.items[j].count }
+
+func (h *heavyHitters) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.index[h.items[i].line] = i
+	h.index[h.items[j].line] = j
+}
+
+func (h *heavyHitters) Push(x interface{}) {
+	item := x.(heavyItem)
+	h.index[item.line] = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *heavyHitters) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	delete(h.index, last.line)
+	return last
+}
+
+// numberFormat describes how [Pipe.FormatNumber] formats numbers.
+type numberFormat struct {
+	prefix, suffix string
+	thousands      bool
+	decimals       int // or -1 for as many as needed
+	scale          string
+}
+
+// format returns x formatted according to nf.
+func (nf numberFormat) format(x float64) string {
+	decimals := nf.decimals
+	unit := ""
+	if nf.scale != "" {
+		base, units := 1000.0, []string{"k", "M", "G", "T", "P", "E"}
+		if nf.scale == "iec" {
+			base, units = 1024.0, []string{"Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+		}
+		for i := 0; i < len(units) && math.Abs(x) >= base; i++ {
+			x /= base
+			unit = units[i]
+		}
+		if decimals < 0 {
+			x = math.Round(x*10) / 10
+		}
+	}
+	s := strconv.FormatFloat(x, 'f', decimals, 64)
+	if nf.thousands {
+		s = groupThousands(s)
+	}
+	return nf.prefix + s + unit + nf.suffix
+}
+
+// csvColumn is a column expected by [Pipe.ValidateCSV], with the type of its
+// values.
+type csvColumn struct {
+	name string
+	kind string
+}
+
+// jsonSchema is a JSON Schema for use by [Pipe.ValidateJSONSchema], with its
+// patterns compiled in advance.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// validate checks that v conforms to schema, reporting the first problem
+// found, if any, as an error naming path, the location of v in the document.
+func (s jsonSchema) validate(schema, v interface{}, path string) error {
+	if b, ok := schema.(bool); ok {
+		if !b {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	}
+	rules, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if t, ok := rules["type"]; ok && !jsonTypeMatches(t, v) {
+		return fmt.Errorf("%s: want %s, got %s", path, jsonTypeName(t), jsonType(v))
+	}
+	if c, ok := rules["const"]; ok && !jsonEqual(c, v) {
+		return fmt.Errorf("%s: want %s", path, jsonText(c))
+	}
+	if enum, ok := rules["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %s is not one of %s", path, jsonText(v), jsonText(enum))
+		}
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		subs, ok := rules[key].([]interface{})
+		if !ok {
+			continue
+		}
+		matched := 0
+		for _, sub := range subs {
+			err := s.validate(sub, v, path)
+			if key == "allOf" && err != nil {
+				return err
+			}
+			if err == nil {
+				matched++
+			}
+		}
+		if key == "anyOf" && matched == 0 {
+			return fmt.Errorf("%s: doesn't match any schema in anyOf", path)
+		}
+		if key == "oneOf" && matched != 1 {
+			return fmt.Errorf("%s: matches %d schemas in oneOf, want exactly 1", path, matched)
+		}
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if required, ok := rules["required"].([]interface{}); ok {
+			for _, name := range required {
+				if name, ok := name.(string); ok {
+					if _, ok := v[name]; !ok {
+						return fmt.Errorf("%s: missing required property %q", path, name)
+					}
+				}
+			}
+		}
+		props, _ := rules["properties"].(map[string]interface{})
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub, ok := props[name]
+			if !ok {
+				sub, ok = rules["additionalProperties"]
+			}
+			if !ok {
+				continue
+			}
+			if err := s.validate(sub, v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n, ok := rules["minItems"].(float64); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s: want at least %v items, got %d", path, n, len(v))
+		}
+		if n, ok := rules["maxItems"].(float64); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s: want at most %v items, got %d", path, n, len(v))
+		}
+		if items, ok := rules["items"]; ok {
+			for i, item := range v {
+				if err := s.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n, ok := rules["minLength"].(float64); ok && float64(length) < n {
+			return fmt.Errorf("%s: want at least %v characters, got %d", path, n, length)
+		}
+		if n, ok := rules["maxLength"].(float64); ok && float64(length) > n {
+			return fmt.Errorf("%s: want at most %v characters, got %d", path, n, length)
+		}
+		if pattern, ok := rules["pattern"].(string); ok && !s.patterns[pattern].MatchString(v) {
+			return fmt.Errorf("%s: %q doesn't match pattern %q", path, v, pattern)
+		}
+	case float64:
+		if n, ok := rules["minimum"].(float64); ok && v < n {
+			return fmt.Errorf("%s: want at least %v, got %v", path, n, v)
+		}
+		if n, ok := rules["maximum"].(float64); ok && v > n {
+			return fmt.Errorf("%s: want at most %v, got %v", path, n, v)
+		}
+		if n, ok := rules["exclusiveMinimum"].(float64); ok && v <= n {
+			return fmt.Errorf("%s: want more than %v, got %v", path, n, v)
+		}
+		if n, ok := rules["exclusiveMaximum"].(float64); ok && v >= n {
+			return fmt.Errorf("%s: want less than %v, got %v", path, n, v)
+		}
+	}
+	return nil
+}
+
+// sparseBlockSize is the size of the blocks checked for zeros by
+// [Pipe.WithSparseFiles]. It matches the block size of most filesystems.
+const sparseBlockSize = 4096
+
+// truncater is a file that can be written sparsely, by seeking past holes and
+// setting its final size.
+type truncater interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+}
+
+// copySparse copies r to f, as for [io.Copy], but seeks past any block of
+// zero bytes instead of writing it, leaving a hole, as described for
+// [Pipe.WithSparseFiles].
+func copySparse(f truncater, r io.Reader) (int64, error) {
+	sw := &sparseWriter{f: f}
+	wrote, err := io.Copy(sw, r)
+	if err != nil {
+		return wrote, err
+	}
+	return wrote, sw.flush()
+}
+
+// sparseWriter writes data to f a block at a time, seeking past blocks that
+// are all zeros.
+type sparseWriter struct {
+	f    truncater
+	buf  []byte
+	size int64
+}
+
+// Write writes data to the underlying file, holding back any incomplete block
+// until the rest of it arrives.
+func (sw *sparseWriter) Write(data []byte) (int, error) {
+	n := len(data)
+	for len(data) > 0 {
+		if len(sw.buf) == 0 && len(data) >= sparseBlockSize {
+			err := sw.writeBlock(data[:sparseBlockSize])
+			if err != nil {
+				return n - len(data), err
+			}
+			data = data[sparseBlockSize:]
+			continue
+		}
+		k := sparseBlockSize - len(sw.buf)
+		if k > len(data) {
+			k = len(data)
+		}
+		sw.buf = append(sw.buf, data[:k]...)
+		data = data[k:]
+		if len(sw.buf) == sparseBlockSize {
+			err := sw.writeBlock(sw.buf)
+			if err != nil {
+				return n - len(data), err
+			}
+			sw.buf = sw.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+// writeBlock writes block to the underlying file, or seeks past it if it's
+// all zeros.
+func (sw *sparseWriter) writeBlock(block []byte) error {
+	var err error
+	if bytes.Count(block, []byte{0}) == len(block) {
+		_, err = sw.f.Seek(int64(len(block)), io.SeekCurrent)
+	} else {
+		_, err = sw.f.Write(block)
+	}
+	if err != nil {
+		return err
+	}
+	sw.size += int64(len(block))
+	return nil
+}
+
+// flush writes any incomplete final block, and sets the size of the file, so
+// that it includes any hole at the end.
+func (sw *sparseWriter) flush() error {
+	if len(sw.buf) > 0 {
+		err := sw.writeBlock(sw.buf)
+		if err != nil {
+			return err
+		}
+		sw.buf = sw.buf[:0]
+	}
+	return sw.f.Truncate(sw.size)
+}
+
+// normalizeYAML converts the value v, decoded from YAML, into the types that
+// gojq accepts, as described for [Pipe.YQ].
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, elem := range v {
+			v[k] = normalizeYAML(elem)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(elem)
+		}
+		return m
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeYAML(elem)
+		}
+		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case int64:
+		return new(big.Int).SetInt64(v)
+	case uint64:
+		return new(big.Int).SetUint64(v)
+	default:
+		return v
+	}
+}
+
+// hash64 returns a 64-bit hash of data, with its bits well mixed, as the
+// probabilistic counters used by [Pipe.CountDistinct] and [Pipe.TopK] need.
+func hash64(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	// FNV's high bits depend little on the last bytes of the data, so
+	// finish with the MurmurHash3 mixing function
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// xmlToValue reads the contents of the element start from dec, up to and
+// including its end tag, and returns them as a value ready to encode as JSON,
+// as described for [Pipe.XMLToJSON].
+func xmlToValue(dec *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	fields := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+			continue
+		}
+		fields["@"+attr.Name.Local] = attr.Value
+	}
+	text := new(strings.Builder)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			child, err := xmlToValue(dec, tok)
+			if err != nil {
+				return nil, err
+			}
+			name := tok.Name.Local
+			switch prev := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []interface{}:
+				fields[name] = append(prev, child)
+			default:
+				fields[name] = []interface{}{prev, child}
+			}
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			content := strings.TrimSpace(text.String())
+			if len(fields) == 0 {
+				return content, nil
+			}
+			if content != "" {
+				fields["#text"] = content
+			}
+			return fields, nil
+		}
+	}
+}
+
+// runJQ executes the query q on input, writing each result to w as a line of
+// JSON, or, if raw is true, writing string results as they are.
+func runJQ(q *gojq.Query, input interface{}, w io.Writer, raw bool) error {
+	iter := q.Run(input)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return nil
+		}
+		if err, ok := v.(error); ok {
+			return err
+		}
+		if s, ok := v.(string); ok && raw {
+			fmt.Fprintln(w, s)
+			continue
+		}
+		result, err := gojq.Marshal(v)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(result))
+	}
+}
+
+var (
+	exitHooksMu sync.Mutex
+	exitHooks   []*exitHook
+	exitSignals chan os.Signal
+)
+
+// exitHook is a function to be called when the program exits, registered by
+// [OnExit], [Pipe.Cleanup], or [NewWorkspace].
+type exitHook struct {
+	once sync.Once
+	fn   func()
+}
+
+// run calls the hook's function, unless it has already been called.
+func (h *exitHook) run() {
+	h.once.Do(h.fn)
+}
+
+// addExitHook registers fn to be called by [runExitHooks], and returns the
+// resulting hook. While any hooks are registered, the program's SIGINT and
+// SIGTERM signals are caught, so that the hooks can be run before it's
+// terminated (see [exitOnSignal]).
+func addExitHook(fn func()) *exitHook {
+	h := &exitHook{fn: fn}
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, h)
+	if exitSignals == nil {
+		exitSignals = make(chan os.Signal, 1)
+		signal.Notify(exitSignals, os.Interrupt, syscall.SIGTERM)
+		go exitOnSignal(exitSignals)
+	}
+	return h
+}
+
+// removeExitHook unregisters the hook h, if it's still registered.
+func removeExitHook(h *exitHook) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	for i, hook := range exitHooks {
+		if hook == h {
+			exitHooks = append(exitHooks[:i], exitHooks[i+1:]...)
+			break
+		}
+	}
+	if len(exitHooks) == 0 {
+		stopExitSignals()
+	}
+}
+
+// runExitHooks calls each registered hook, most recently registered first,
+// and unregisters them all.
+func runExitHooks() {
+	exitHooksMu.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	stopExitSignals()
+	exitHooksMu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i].run()
+	}
+}
+
+// stopExitSignals restores the default handling of the signals caught by
+// [addExitHook], now that there are no hooks left to run. The caller must
+// hold exitHooksMu.
+func stopExitSignals() {
+	if exitSignals == nil {
+		return
+	}
+	signal.Stop(exitSignals)
+	close(exitSignals)
+	exitSignals = nil
+}
+
+// exitOnSignal waits for a signal on signals, then runs the exit hooks, and
+// raises the signal again with its default disposition, so that the program
+// is terminated by it, just as it would have been without the hooks. If that
+// doesn't terminate the program, because the signal is being ignored, or
+// can't be raised on this platform, it exits with status 1 instead. If
+// signals is closed first, exitOnSignal just returns.
+func exitOnSignal(signals chan os.Signal) {
+	sig, ok := <-signals
+	if !ok {
+		return
+	}
+	runExitHooks()
+	signal.Reset(sig)
+	if self, err := os.FindProcess(os.Getpid()); err == nil && self.Signal(sig) == nil {
+		// Give the signal time to be delivered
+		time.Sleep(time.Second)
+	}
+	os.Exit(1)
+}
+
+// syncWriter serialises writes to w, so that it can be shared by concurrent
+// commands.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes data to the underlying writer, waiting for any other write in
+// progress to finish first.
+func (s *syncWriter) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(data)
+}
+
+// Stage adds a stage to the pipe p, configured by args, for [FromSpec], and
+// returns the resulting pipe, or an error if args aren't valid.
+type Stage func(p *Pipe, args []string) (*Pipe, error)
+
+// checkpoint is the state file set by [Pipe.Checkpoint].
+type checkpoint struct {
+	mu   sync.Mutex
+	path string
+}
+
+// record appends line to the state file, syncing it to disk so that the
+// record survives a crash. On a nil checkpoint, it does nothing.
+func (c *checkpoint) record(line string) error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f, err := os.OpenFile(c.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o666)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, line)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// stageCache holds the cache file and expiry time set by [Pipe.CacheTo].
+type stageCache struct {
+	path string
+	ttl  time.Duration
+}
+
+// stageRetry holds the retry policy set by [Pipe.Retry].
+type stageRetry struct {
+	attempts int
+	delay    time.Duration
+}
+
+// execLimits holds the restrictions on commands set by [Pipe.WithExecLimits]
+// and [Pipe.WithoutNetwork].
+type execLimits struct {
+	cpu       time.Duration
+	mem       int64
+	files     int
+	noNetwork bool
+}
+
+// Modes for [Pipe.WithPrefixedOutput].
+const (
+	prefixNone = iota
+	prefixPlain
+	prefixColor
+)
+
+// ReadAutoCloser wraps an [io.ReadCloser] so that it will be automatically
+// closed once it has been fully read.
+type ReadAutoCloser struct {
+	r io.ReadCloser
+}
+
+// NewReadAutoCloser returns a [ReadAutoCloser] wrapping the reader r.
+func NewReadAutoCloser(r io.Reader) ReadAutoCloser {
+	if _, ok := r.(io.Closer); !ok {
+		return ReadAutoCloser{io.NopCloser(r)}
+	}
+	rc, ok := r.(io.ReadCloser)
+	if !ok {
+		// This can never happen, but just in case it does...
+		panic("internal error: type assertion to io.ReadCloser failed")
+	}
+	return ReadAutoCloser{rc}
+}
+
+// Close closes ra's reader, returning any resulting error.
+func (ra ReadAutoCloser) Close() error {
+	if ra.r == nil {
+		return nil
+	}
+	return ra.r.Close()
+}
+
+// Read reads up to len(b) bytes from ra's reader into b. It returns the number
+// of bytes read and any error encountered. At end of file, Read returns 0,
+// [io.EOF]. If end-of-file is reached, the reader will be closed.
+func (ra ReadAutoCloser) Read(b []byte) (n int, err error) {
+	if ra.r == nil {
+		return 0, io.EOF
+	}
+	n, err = ra.r.Read(b)
+	if err == io.EOF {
+		ra.Close()
+	}
+	return n, err
+}
+
+// WriteTo copies all remaining data from ra's reader to w, then closes the
+// reader, returning the number of bytes written and any error encountered. If
+// the reader implements [io.WriterTo], or w implements [io.ReaderFrom], the
+// copy is done directly, without any intermediate buffering.
+func (ra ReadAutoCloser) WriteTo(w io.Writer) (int64, error) {
+	if ra.r == nil {
+		return 0, nil
+	}
+	n, err := io.Copy(w, ra.r)
+	if err == nil {
+		ra.Close()
+	}
+	return n, err
+}
+
+// detectMIME returns the MIME type of the data read from r, based on (at
+// most) its first 512 bytes.
+func detectMIME(r io.Reader) (string, error) {
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// readHashState reads a file of hashes in the format produced by
+// sha256sum(1), returning a map of paths to hashes, and the paths in the order
+// they appear. If the file doesn't exist, the map is empty.
+func readHashState(path string) (map[string]string, []string, error) {
+	state := map[string]string{}
+	var order []string
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, order, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		sum, file, ok := strings.Cut(line, "  ")
+		if !ok {
+			continue
+		}
+		if _, seen := state[file]; !seen {
+			order = append(order, file)
+		}
+		state[file] = sum
+	}
+	return state, order, nil
+}
+
+// ignorePattern is a compiled pattern from a .gitignore-style file.
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// readIgnoreFile reads and compiles the patterns in the .gitignore-style file
+// path.
+func readIgnoreFile(path string) ([]ignorePattern, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []ignorePattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are ignored, unless escaped with a backslash
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pat ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pat.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pat.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		re, err := regexp.Compile(ignorePatternToRegexp(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad pattern %q: %w", path, line, err)
+		}
+		pat.re = re
+		patterns = append(patterns, pat)
+	}
+	return patterns, nil
+}
+
+// ignorePatternToRegexp translates a single .gitignore pattern (without any
+// leading ! or trailing /) into an equivalent regular expression, matching
+// slash-separated paths relative to the ignore file's directory.
+func ignorePatternToRegexp(pattern string) string {
+	re := new(strings.Builder)
+	re.WriteString("^")
+	// A pattern containing a slash, other than at the end, only matches
+	// relative to the ignore file's directory; otherwise, it can match at any
+	// level
+	if strings.HasPrefix(pattern, "/") {
+		pattern = pattern[1:]
+	} else if !strings.Contains(pattern, "/") {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "**" && (i == 0 || pattern[i-1] == '/'):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return re.String()
+}
+
+// isIgnored reports whether the slash-separated relative path rel is excluded
+// by patterns. As with Git, a path is excluded if any of its parent
+// directories is excluded, whatever any later patterns say. path is the
+// original path, used to check whether it's a directory if necessary.
+func isIgnored(patterns []ignorePattern, rel, path string) bool {
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if matchIgnore(patterns, strings.Join(parts[:i], "/"), func() bool { return true }) {
+			return true
+		}
+	}
+	return matchIgnore(patterns, rel, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && info.IsDir()
+	})
+}
+
+// matchIgnore reports whether the last of patterns to match rel excludes it.
+// isDir is called, if necessary, to check whether rel is a directory.
+func matchIgnore(patterns []ignorePattern, rel string, isDir func() bool) bool {
+	ignored := false
+	for _, pat := range patterns {
+		if pat.negate != ignored {
+			// This pattern can't change the result
+			continue
+		}
+		if !pat.re.MatchString(rel) {
+			continue
+		}
+		if pat.dirOnly && !isDir() {
+			continue
+		}
+		ignored = !pat.negate
+	}
+	return ignored
+}
+
+// readCloser combines a reader with a separate closer, so that, for example,
+// a limited view of a file can still close the file when it has been read.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// tailOffset returns the offset at which the last n lines of r begin, where
+// size is the total size of r in bytes, by reading backwards from the end.
+func tailOffset(r io.ReaderAt, size int64, n int) (int64, error) {
+	buf := make([]byte, 64*1024)
+	lines := 0
+	end := size
+	for end > 0 {
+		start := end - int64(len(buf))
+		if start < 0 {
+			start = 0
+		}
+		chunk := buf[:end-start]
+		_, err := r.ReadAt(chunk, start)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := len(chunk) - 1; i >= 0; i-- {
+			// A final newline ends the last line, rather than starting a new one
+			if chunk[i] != '\n' || start+int64(i) == size-1 {
+				continue
+			}
+			lines++
+			if lines == n {
+				return start + int64(i) + 1, nil
+			}
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// forEachLineConcurrently reads lines from scanner and calls process on each
+// of them, running up to workers calls concurrently, and writes the results to
+// w. If ordered is true, the results are written in the same order as the
+// corresponding input lines; otherwise, each result is written as soon as it's
+// ready.
+func forEachLineConcurrently(scanner *bufio.Scanner, w io.Writer, workers int, ordered bool, process func(string) []byte) error {
+	if workers < 1 {
+		workers = 1
+	}
+	// Each queued channel delivers the result for one line. When ordering
+	// matters, every line gets its own channel, queued in input order;
+	// otherwise, all lines share a channel, so results arrive as they finish.
+	results := make(chan chan []byte, workers)
+	shared := make(chan []byte, workers)
+	slots := make(chan struct{}, workers)
+	var scanErr error
+	go func() {
+		defer close(results)
+		for scanner.Scan() {
+			line := scanner.Text()
+			result := shared
+			if ordered {
+				result = make(chan []byte, 1)
+			}
+			results <- result
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots }()
+				result <- process(line)
+			}()
+		}
+		scanErr = scanner.Err()
+	}()
+	var writeErr error
+	for result := range results {
+		data := <-result
+		if writeErr == nil {
+			_, writeErr = w.Write(data)
+		}
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return scanErr
+}
+
+// cachedFilter wraps filter so that its output is copied from the file path,
+// if that exists and is younger than ttl, and otherwise saved to path once
+// filter has succeeded.
+func cachedFilter(filter func(io.Reader, io.Writer) error, path string, ttl time.Duration) func(io.Reader, io.Writer) error {
+	return func(r io.Reader, w io.Writer) error {
+		info, err := os.Stat(path)
+		if err == nil && (ttl <= 0 || time.Since(info.ModTime()) < ttl) {
+			f, err := os.Open(path)
+			if err == nil {
+				defer f.Close()
+				_, err = io.Copy(w, f)
+				return err
+			}
+		}
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		err = filter(r, io.MultiWriter(w, tmp))
+		closeErr := tmp.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+		return os.Rename(tmp.Name(), path)
+	}
+}
+
+// httpCacheEntry holds the validators for a response cached by
+// [Pipe.WithHTTPCache].
+type httpCacheEntry struct {
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"last_modified,omitempty"`
+	Vary         map[string]string `json:"vary,omitempty"`
+}
+
+// matches reports whether the cached response can be used for req: that is,
+// whether req has the same values as the original request for each of the
+// headers named by the response's Vary header.
+func (e httpCacheEntry) matches(req *http.Request) bool {
+	for name, value := range e.Vary {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// httpCacheKey returns the name of the file in which the response to req is
+// cached by [Pipe.WithHTTPCache]. It depends on the request's credentials, as
+// well as its URL, so that responses for one user are never served to another.
+func httpCacheKey(req *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintln(h, req.URL.String())
+	fmt.Fprintln(h, req.Header.Values("Authorization"))
+	fmt.Fprintln(h, req.Header.Values("Cookie"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// varyHeaders returns the values in req of the headers named by the Vary
+// header of resp, and reports whether the response can be cached at all: that
+// is, whether it doesn't have "Vary: *".
+func varyHeaders(req *http.Request, resp *http.Response) (map[string]string, bool) {
+	var vary map[string]string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			if vary == nil {
+				vary = map[string]string{}
+			}
+			vary[http.CanonicalHeaderKey(name)] = req.Header.Get(name)
+		}
+	}
+	return vary, true
+}
+
+// doCached makes the GET request req using send, writing the response body to
+// w, as [Pipe.Do] does, but revalidating and updating any cached copy of the
+// response in dir.
+func doCached(send func(*http.Request) (*http.Response, error), req *http.Request, w io.Writer, dir string) error {
+	body := filepath.Join(dir, httpCacheKey(req))
+	meta := body + ".json"
+	var cached httpCacheEntry
+	revalidating := false
+	data, err := os.ReadFile(meta)
+	if err == nil && json.Unmarshal(data, &cached) == nil && cached.matches(req) {
+		if _, err := os.Stat(body); err == nil {
+			revalidating = true
+			req = req.Clone(req.Context())
+			if cached.ETag != "" {
+				req.Header.Set("If-None-Match", cached.ETag)
+			}
+			if cached.LastModified != "" {
+				req.Header.Set("If-Modified-Since", cached.LastModified)
+			}
+		}
+	}
+	resp, err := send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && revalidating {
+		f, err := os.Open(body)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
+	vary, cacheable := varyHeaders(req, resp)
+	entry := httpCacheEntry{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Vary:         vary,
+	}
+	if entry.ETag == "" && entry.LastModified == "" {
+		cacheable = false
+	}
+	// Any HTTP 2xx status code is considered okay
+	if resp.StatusCode/100 != 2 || !cacheable {
+		_, err = io.Copy(w, resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("unexpected HTTP response status: %s", resp.Status)
+		}
+		return nil
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(io.MultiWriter(w, tmp), resp.Body)
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	// Remove the old validators first, so they can never be paired with the
+	// new body.
+	os.Remove(meta)
+	err = os.Rename(tmp.Name(), body)
+	if err != nil {
+		return err
+	}
+	data, err = json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(meta, data, 0o644)
+}
+
+// writeFileAtomic calls write to write the new contents of the file path to
+// a temporary file, and if that succeeds, renames it to path, as described for
+// [Pipe.WriteFileAtomic]. If metaSrc isn't empty, the metadata of the file
+// metaSrc is copied to the temporary file before the rename, as for
+// [Pipe.CopyFileMeta], so that path never has the new contents without the
+// new metadata.
+func writeFileAtomic(path string, fsync bool, metaSrc string, write func(io.Writer) (int64, error)) (int64, error) {
+	tmp, wrote, err := stageFile(path, fsync, write)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+	if metaSrc != "" {
+		err = copyFileMeta(metaSrc, tmp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return 0, err
+	}
+	recordWrite(path)
+	return wrote, nil
+}
+
+// stageFile writes data to a new temporary file in the same directory as
+// path, ready to be renamed to path, as described for [Pipe.WriteFileAtomic],
+// and returns the temporary file's path and the number of bytes written. If
+// there's an error, the temporary file is removed.
+func stageFile(path string, fsync bool, write func(io.Writer) (int64, error)) (string, int64, error) {
+	perm := fs.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	wrote, err := write(tmp)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil && fsync {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), wrote, nil
+}
+
+// rotateFile renames path to path.1, path.1 to path.2, and so on, keeping at
+// most keep old files. If keep is zero or negative, path is removed instead.
+func rotateFile(path string, keep int) error {
+	if keep <= 0 {
+		err := os.Remove(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for i := keep - 1; i >= 0; i-- {
+		from := path
+		if i > 0 {
+			from = fmt.Sprintf("%s.%d", path, i)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncChange compares the file src, whose info is given, with dst, as
+// described for [Sync], and returns "new" if dst doesn't exist, "changed" if
+// it differs from src, or the empty string if it's the same.
+func syncChange(src, dst string, info fs.FileInfo, checksum bool) (string, error) {
+	dstInfo, err := os.Stat(dst)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "new", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !dstInfo.Mode().IsRegular() || dstInfo.Size() != info.Size() {
+		return "changed", nil
+	}
+	if !checksum {
+		if !dstInfo.ModTime().Equal(info.ModTime()) {
+			return "changed", nil
+		}
+		return "", nil
+	}
+	srcSum, err := File(src).Hash(sha256.New())
+	if err != nil {
+		return "", err
+	}
+	dstSum, err := File(dst).Hash(sha256.New())
+	if err != nil {
+		return "", err
+	}
+	if srcSum != dstSum {
+		return "changed", nil
+	}
+	return "", nil
+}
+
+// copyFileMeta gives dst the same permissions and modification time as src,
+// and the same owner and group, if possible, as described for
+// [Pipe.CopyFileMeta].
+func copyFileMeta(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	// changing the owner may clear the setuid and setgid bits, so it must
+	// come before the chmod
+	err = copyOwner(dst, info)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dst, info.Mode())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// syncFile atomically replaces dst with a copy of src, whose info is given,
+// with the same permissions and modification time.
+func syncFile(src, dst string, info fs.FileInfo) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = writeFileAtomic(dst, false, "", func(w io.Writer) (int64, error) {
+		return io.Copy(w, f)
+	})
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dst, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// scanWords is a [bufio.SplitFunc] that returns each word of input, as
+// described for [Pipe.Words].
+func scanWords(data []byte, atEOF bool) (int, []byte, error) {
+	start := 0
+	for start < len(data) {
+		if !atEOF && !utf8.FullRune(data[start:]) {
+			return start, nil, nil
+		}
+		r, size := utf8.DecodeRune(data[start:])
+		if isWordRune(r) {
+			break
+		}
+		start += size
+	}
+	var prev rune
+	for i := start; i < len(data); {
+		if !atEOF && !utf8.FullRune(data[i:]) {
+			return start, nil, nil
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		switch {
+		case unicode.Is(unicode.Han, r):
+			if i == start {
+				return i + size, data[i : i+size], nil
+			}
+			return i, data[start:i], nil
+		case isWordRune(r):
+			prev = r
+			i += size
+			continue
+		case r == '\'' || r == '’' || r == '.' || r == ',':
+			if i+size >= len(data) || !utf8.FullRune(data[i+size:]) {
+				if !atEOF {
+					return start, nil, nil
+				}
+				break
+			}
+			next, _ := utf8.DecodeRune(data[i+size:])
+			letters := (r == '\'' || r == '’') && unicode.IsLetter(prev) && unicode.IsLetter(next)
+			digits := (r == '.' || r == ',') && unicode.IsDigit(prev) && unicode.IsDigit(next)
+			if letters || digits {
+				prev = r
+				i += size
+				continue
+			}
+		}
+		return i, data[start:i], nil
+	}
+	if atEOF && start < len(data) {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+// isWordRune reports whether r can be part of a word, as described for
+// [Pipe.Words].
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// scanSentences is a [bufio.SplitFunc] that returns each sentence of input,
+// as described for [Pipe.Sentences].
+func scanSentences(data []byte, atEOF bool) (int, []byte, error) {
+	var prev rune
+	for i := 0; i < len(data); {
+		if !atEOF && !utf8.FullRune(data[i:]) {
+			return 0, nil, nil
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if r == '\n' {
+			// A blank line ends a sentence
+			rest := bytes.TrimLeft(data[i+size:], " \t\r")
+			if len(rest) == 0 && !atEOF {
+				return 0, nil, nil
+			}
+			if len(rest) > 0 && rest[0] == '\n' {
+				return i + size, data[:i], nil
+			}
+		}
+		if !unicode.Is(unicode.Sentence_Terminal, r) {
+			prev = r
+			i += size
+			continue
+		}
+		// Include any further terminators and closing punctuation
+		end := i + size
+		for end < len(data) {
+			if !atEOF && !utf8.FullRune(data[end:]) {
+				return 0, nil, nil
+			}
+			c, n := utf8.DecodeRune(data[end:])
+			if !unicode.Is(unicode.Sentence_Terminal, c) && !unicode.In(c, unicode.Pe, unicode.Pf) && c != '"' && c != '\'' {
+				break
+			}
+			end += n
+		}
+		rest := bytes.TrimLeftFunc(data[end:], unicode.IsSpace)
+		if len(rest) == 0 || !utf8.FullRune(rest) {
+			if !atEOF {
+				return 0, nil, nil
+			}
+			return len(data), data[:end], nil
+		}
+		next, _ := utf8.DecodeRune(rest)
+		spaced := len(rest) < len(data[end:])
+		if unicode.IsLower(next) ||
+			r == '.' && !spaced && unicode.IsDigit(next) ||
+			r == '.' && !spaced && unicode.IsUpper(prev) && unicode.IsUpper(next) {
+			prev = r
+			i += size
+			continue
+		}
+		return end, data[:end], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// shellCommand returns a [commandRenderer] that renders tpl for each line, and
+// splits the result into arguments as a shell would.
+func shellCommand(tpl *template.Template) commandRenderer {
+	return func(line string) (string, []string, error) {
+		cmdLine := new(strings.Builder)
+		err := tpl.Execute(cmdLine, line)
+		if err != nil {
+			return "", nil, err
+		}
+		args, err := shell.Fields(cmdLine.String(), nil)
+		if err != nil {
+			return "", nil, err
+		}
+		return cmdLine.String(), args, nil
 	}
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
-		for i := 0; i < n && scanner.Scan(); i++ {
-			_, err := fmt.Fprintln(w, scanner.Text())
+}
+
+// argsCommand returns a [commandRenderer] that renders each of tpls for each
+// line, producing one argument each.
+func argsCommand(tpls []*template.Template) commandRenderer {
+	return func(line string) (string, []string, error) {
+		args := make([]string, len(tpls))
+		for i, tpl := range tpls {
+			arg := new(strings.Builder)
+			err := tpl.Execute(arg, line)
 			if err != nil {
-				return err
+				return "", nil, err
 			}
+			args[i] = arg.String()
 		}
-		return scanner.Err()
-	})
+		return shellQuote(args), args, nil
+	}
 }
 
-// Freq produces only the unique lines from the pipe's contents, each prefixed
-// with a frequency count, in descending numerical order (most frequent lines
-// first). Lines with equal frequency will be sorted alphabetically.
-//
-// For example, we could take a common shell pipeline like this:
-//
-//	sort input.txt |uniq -c |sort -rn
-//
-// and replace it with:
-//
-//	File("input.txt").Freq().Stdout()
-//
-// Or to get only the ten most common lines:
-//
-//	File("input.txt").Freq().First(10).Stdout()
-//
-// Like Unix uniq(1), Freq right-justifies its count values in a column for
-// readability, padding with spaces if necessary.
-func (p *Pipe) Freq() *Pipe {
-	freq := map[string]int{}
-	type frequency struct {
-		line  string
-		count int
-	}
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
-		for scanner.Scan() {
-			freq[scanner.Text()]++
+// shellQuote joins args into a command line, quoting any that contain
+// characters special to the shell, so that the result can be pasted into a
+// shell and will run the same command.
+func shellQuote(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+			quoted[i] = arg
+			continue
 		}
-		freqs := make([]frequency, 0, len(freq))
-		max := 0
-		for line, count := range freq {
-			freqs = append(freqs, frequency{line, count})
-			if count > max {
-				max = count
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// fuzzyContains reports whether line contains a substring within edit
+// distance maxDist of pattern, using Sellers' algorithm.
+func fuzzyContains(line string, pattern []rune, maxDist int) bool {
+	m := len(pattern)
+	if m <= maxDist {
+		return true
+	}
+	// dist[i] is the smallest edit distance between pattern[:i] and some
+	// substring of line ending at the current position
+	dist := make([]int, m+1)
+	for i := range dist {
+		dist[i] = i
+	}
+	for _, c := range line {
+		diag := dist[0]
+		for i := 1; i <= m; i++ {
+			cost := 1
+			if pattern[i-1] == c {
+				cost = 0
 			}
-		}
-		sort.Slice(freqs, func(i, j int) bool {
-			x, y := freqs[i].count, freqs[j].count
-			if x == y {
-				return freqs[i].line < freqs[j].line
+			next := diag + cost
+			if dist[i]+1 < next {
+				next = dist[i] + 1
 			}
-			return x > y
-		})
-		fieldWidth := len(strconv.Itoa(max))
-		for _, item := range freqs {
-			fmt.Fprintf(w, "%*d %s\n", fieldWidth, item.count, item.line)
+			if dist[i-1]+1 < next {
+				next = dist[i-1] + 1
+			}
+			diag, dist[i] = dist[i], next
 		}
-		return nil
-	})
+		if dist[m] <= maxDist {
+			return true
+		}
+	}
+	return false
 }
 
-// Get makes an HTTP GET request to url, sending the contents of the pipe as
-// the request body, and produces the server's response. See [Pipe.Do] for how
-// the HTTP response status is interpreted.
-func (p *Pipe) Get(url string) *Pipe {
-	req, err := http.NewRequest(http.MethodGet, url, p.Reader)
+// numberPrefix matches a decimal number at the start of a line, after any
+// leading whitespace.
+var numberPrefix = regexp.MustCompile(`^\s*[-+]?(?:\d+(?:\.\d*)?|\.\d+)`)
+
+// leadingNumber returns the number at the start of line, as described for
+// [Pipe.SortNumeric], or zero if there isn't one.
+func leadingNumber(line string) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSpace(numberPrefix.FindString(line)), 64)
 	if err != nil {
-		return p.WithError(err)
+		return 0
 	}
-	return p.Do(req)
+	return n
 }
 
-// Hash returns the hex-encoded hash of the entire contents of the
-// pipe based on the provided hasher, or an error.
-// To perform hashing on files, see [Pipe.HashSums].
-func (p *Pipe) Hash(hasher hash.Hash) (string, error) {
-	if p.Error() != nil {
-		return "", p.Error()
+// numExpr evaluates an arithmetic expression for a line split into columns,
+// as described for [Pipe.Compute].
+type numExpr func(columns []string) (float64, error)
+
+// parseComputation parses expr, as described for [Pipe.Compute], returning
+// the column to assign the result to (or zero to append it), and the parsed
+// expression.
+func parseComputation(expr string) (int, numExpr, error) {
+	target := 0
+	ep := &exprParser{input: expr}
+	if m := computeTarget.FindStringSubmatch(expr); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n < 1 {
+			return 0, nil, fmt.Errorf("invalid column in %q", expr)
+		}
+		target = n
+		ep.pos = len(m[0])
+	}
+	eval, err := ep.sum()
+	if err == nil && ep.peek() != 0 {
+		err = fmt.Errorf("unexpected %q at position %d", ep.input[ep.pos:], ep.pos+1)
 	}
-	_, err := io.Copy(hasher, p)
 	if err != nil {
-		p.SetError(err)
-		return "", err
+		return 0, nil, fmt.Errorf("parsing %q: %w", expr, err)
 	}
-	return hex.EncodeToString(hasher.Sum(nil)), nil
+	return target, eval, nil
 }
 
-// HashSums reads paths from the pipe, one per line, and produces the
-// hex-encoded hash of each corresponding file based on the provided hasher,
-// one per line. Any files that cannot be opened or read will be ignored.
-// To perform hashing on the contents of the pipe, see [Pipe.Hash].
-func (p *Pipe) HashSums(hasher hash.Hash) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		f, err := os.Open(line)
+// computeTarget matches the assignment at the start of an expression for
+// [Pipe.Compute], such as "$3 =".
+var computeTarget = regexp.MustCompile(`^\s*\$(\d+)\s*=`)
+
+// exprParser is a recursive-descent parser for the expressions used by
+// [Pipe.Compute].
+type exprParser struct {
+	input string
+	pos   int
+}
+
+// peek skips any whitespace, and returns the next byte of input without
+// consuming it, or zero at the end of the input.
+func (ep *exprParser) peek() byte {
+	for ep.pos < len(ep.input) && (ep.input[ep.pos] == ' ' || ep.input[ep.pos] == '\t') {
+		ep.pos++
+	}
+	if ep.pos == len(ep.input) {
+		return 0
+	}
+	return ep.input[ep.pos]
+}
+
+// sum parses a sequence of terms separated by + or -.
+func (ep *exprParser) sum() (numExpr, error) {
+	left, err := ep.product()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ep.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		ep.pos++
+		right, err := ep.product()
 		if err != nil {
-			return // skip unopenable files
+			return nil, err
 		}
-		defer f.Close()
-		_, err = io.Copy(hasher, f)
+		left = binaryExpr(op, left, right)
+	}
+}
+
+// product parses a sequence of factors separated by *, /, or %.
+func (ep *exprParser) product() (numExpr, error) {
+	left, err := ep.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ep.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return left, nil
+		}
+		ep.pos++
+		right, err := ep.factor()
 		if err != nil {
-			return // skip unreadable files
+			return nil, err
 		}
-		fmt.Fprintln(w, hex.EncodeToString(hasher.Sum(nil)))
-	})
+		left = binaryExpr(op, left, right)
+	}
 }
 
-// Join joins all the lines in the pipe's contents into a single
-// space-separated string, which will always end with a newline.
-func (p *Pipe) Join() *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
-		first := true
-		for scanner.Scan() {
-			if !first {
-				fmt.Fprint(w, " ")
+// factor parses a number, a column reference, a parenthesised expression, or
+// a negated factor.
+func (ep *exprParser) factor() (numExpr, error) {
+	switch c := ep.peek(); {
+	case c == '-':
+		ep.pos++
+		operand, err := ep.factor()
+		if err != nil {
+			return nil, err
+		}
+		return func(columns []string) (float64, error) {
+			x, err := operand(columns)
+			return -x, err
+		}, nil
+	case c == '(':
+		ep.pos++
+		inner, err := ep.sum()
+		if err != nil {
+			return nil, err
+		}
+		if ep.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", ep.pos+1)
+		}
+		ep.pos++
+		return inner, nil
+	case c == '$':
+		ep.pos++
+		start := ep.pos
+		for ep.pos < len(ep.input) && ep.input[ep.pos] >= '0' && ep.input[ep.pos] <= '9' {
+			ep.pos++
+		}
+		col, err := strconv.Atoi(ep.input[start:ep.pos])
+		if err != nil || col < 1 {
+			return nil, fmt.Errorf("invalid column at position %d", start)
+		}
+		return func(columns []string) (float64, error) {
+			if col > len(columns) {
+				return 0, fmt.Errorf("no column %d", col)
 			}
-			line := scanner.Text()
-			fmt.Fprint(w, line)
-			first = false
+			return strconv.ParseFloat(columns[col-1], 64)
+		}, nil
+	case c == '.' || c >= '0' && c <= '9':
+		start := ep.pos
+		for ep.pos < len(ep.input) && (ep.input[ep.pos] == '.' || ep.input[ep.pos] >= '0' && ep.input[ep.pos] <= '9') {
+			ep.pos++
 		}
-		fmt.Fprintln(w)
-		return scanner.Err()
-	})
+		value, err := strconv.ParseFloat(ep.input[start:ep.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", ep.input[start:ep.pos])
+		}
+		return func([]string) (float64, error) {
+			return value, nil
+		}, nil
+	case c == 0:
+		return nil, errors.New("unexpected end of expression")
+	default:
+		return nil, fmt.Errorf("unexpected %q at position %d", c, ep.pos+1)
+	}
 }
 
-// JQ executes query on the pipe's contents (presumed to be JSON), producing
-// the result. An invalid query will set the appropriate error on the pipe.
-//
-// The exact dialect of JQ supported is that provided by
-// [github.com/itchyny/gojq], whose documentation explains the differences
-// between it and standard JQ.
-func (p *Pipe) JQ(query string) *Pipe {
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		q, err := gojq.Parse(query)
+// binaryExpr returns an expression applying the arithmetic operator op to the
+// results of left and right.
+func binaryExpr(op byte, left, right numExpr) numExpr {
+	return func(columns []string) (float64, error) {
+		x, err := left(columns)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		var input interface{}
-		err = json.NewDecoder(r).Decode(&input)
+		y, err := right(columns)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		iter := q.Run(input)
-		for {
-			v, ok := iter.Next()
-			if !ok {
-				return nil
-			}
-			if err, ok := v.(error); ok {
-				return err
-			}
-			result, err := gojq.Marshal(v)
-			if err != nil {
-				return err
-			}
-			fmt.Fprintln(w, string(result))
+		switch op {
+		case '+':
+			return x + y, nil
+		case '-':
+			return x - y, nil
+		case '*':
+			return x * y, nil
 		}
-	})
+		if y == 0 {
+			return 0, errors.New("division by zero")
+		}
+		if op == '%' {
+			return math.Mod(x, y), nil
+		}
+		return x / y, nil
+	}
 }
 
-// Last produces only the last n lines of the pipe's contents, or all the lines
-// if there are less than n. If n is zero or negative, there is no output at
-// all.
-func (p *Pipe) Last(n int) *Pipe {
-	if p.Error() != nil {
-		return p
+// numberFormatSpec matches the part of a format for [Pipe.FormatNumber] that
+// says how to format the number.
+var numberFormatSpec = regexp.MustCompile(`^(,)?(?:\.(\d+))?(si|iec)?$`)
+
+// parseNumberFormat parses format, as described for [Pipe.FormatNumber].
+func parseNumberFormat(format string) (numberFormat, error) {
+	nf := numberFormat{decimals: -1}
+	spec := format
+	if open := strings.Index(format, "{"); open >= 0 {
+		end := strings.Index(format[open:], "}")
+		if end < 0 {
+			return nf, fmt.Errorf("invalid number format %q: missing '}'", format)
+		}
+		nf.prefix, spec, nf.suffix = format[:open], format[open+1:open+end], format[open+end+1:]
 	}
-	if n <= 0 {
-		return NewPipe()
+	m := numberFormatSpec.FindStringSubmatch(spec)
+	if m == nil {
+		return nf, fmt.Errorf("invalid number format %q", format)
 	}
-	return p.Filter(func(r io.Reader, w io.Writer) error {
-		scanner := newScanner(r)
-		input := ring.New(n)
-		for scanner.Scan() {
-			input.Value = scanner.Text()
-			input = input.Next()
+	nf.thousands = m[1] != ""
+	if m[2] != "" {
+		decimals, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nf, fmt.Errorf("invalid number format %q: %w", format, err)
 		}
-		input.Do(func(p interface{}) {
-			if p != nil {
-				fmt.Fprintln(w, p)
-			}
-		})
-		return scanner.Err()
-	})
+		nf.decimals = decimals
+	}
+	nf.scale = m[3]
+	return nf, nil
 }
 
-// Match produces only the input lines that contain the string s.
-func (p *Pipe) Match(s string) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		if strings.Contains(line, s) {
-			fmt.Fprintln(w, line)
+// groupThousands inserts commas between each group of three digits in the
+// integer part of the decimal number s.
+func groupThousands(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	intPart, frac := s, ""
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		intPart, frac = s[:dot], s[dot:]
+	}
+	var b strings.Builder
+	for i, c := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteByte(',')
 		}
-	})
+		b.WriteRune(c)
+	}
+	return sign + b.String() + frac
 }
 
-// MatchRegexp produces only the input lines that match the compiled regexp re.
-func (p *Pipe) MatchRegexp(re *regexp.Regexp) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		if re.MatchString(line) {
-			fmt.Fprintln(w, line)
+// stagesMu guards stages.
+var stagesMu sync.RWMutex
+
+// stages holds the stages available to [FromSpec], by name.
+var stages = map[string]Stage{
+	"Basename":      noArgStage((*Pipe).Basename),
+	"Column":        intStage((*Pipe).Column),
+	"Concat":        noArgStage((*Pipe).Concat),
+	"CSVColumn":     intStage((*Pipe).CSVColumn),
+	"Dirname":       noArgStage((*Pipe).Dirname),
+	"Echo":          stringStage((*Pipe).Echo),
+	"Exec":          stringStage((*Pipe).Exec),
+	"ExecForEach":   stringStage((*Pipe).ExecForEach),
+	"File":          stringStage(func(_ *Pipe, path string) *Pipe { return File(path) }),
+	"FindFiles":     stringStage(func(_ *Pipe, dir string) *Pipe { return FindFiles(dir) }),
+	"First":         intStage((*Pipe).First),
+	"Freq":          noArgStage((*Pipe).Freq),
+	"Get":           stringStage((*Pipe).Get),
+	"Gunzip":        noArgStage((*Pipe).Gunzip),
+	"Gzip":          noArgStage((*Pipe).Gzip),
+	"Join":          noArgStage((*Pipe).Join),
+	"JQ":            stringStage((*Pipe).JQ),
+	"JQEach":        stringStage((*Pipe).JQEach),
+	"Last":          intStage((*Pipe).Last),
+	"ListFiles":     stringStage(func(_ *Pipe, path string) *Pipe { return ListFiles(path) }),
+	"Match":         stringStage((*Pipe).Match),
+	"MatchRegexp":   regexpStage((*Pipe).MatchRegexp),
+	"Reject":        stringStage((*Pipe).Reject),
+	"RejectRegexp":  regexpStage((*Pipe).RejectRegexp),
+	"Replace":       stringPairStage((*Pipe).Replace),
+	"ReplaceRegexp": regexpPairStage((*Pipe).ReplaceRegexp),
+	"Sleep":         durationStage((*Pipe).Sleep),
+	"Sort":          noArgStage((*Pipe).Sort),
+	"SortNumeric":   noArgStage((*Pipe).SortNumeric),
+	"StageTimeout":  durationStage((*Pipe).StageTimeout),
+	"Stdin":         noArgStage(func(*Pipe) *Pipe { return Stdin() }),
+	"Uniq":          noArgStage((*Pipe).Uniq),
+	"Words":         noArgStage((*Pipe).Words),
+	"XMLToJSON":     noArgStage((*Pipe).XMLToJSON),
+	"YQ":            stringStage((*Pipe).YQ),
+}
+
+// sourceStages holds the names of the built-in stages that discard the pipe's
+// existing contents, which [FromSpec] only allows as the first stage.
+var sourceStages = map[string]bool{
+	"Echo":      true,
+	"File":      true,
+	"FindFiles": true,
+	"ListFiles": true,
+	"Stdin":     true,
+}
+
+// wantArgs returns an error unless args has n elements.
+func wantArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("want %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+// noArgStage returns a [Stage] that calls method, which takes no arguments.
+func noArgStage(method func(*Pipe) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 0); err != nil {
+			return nil, err
 		}
-	})
+		return method(p), nil
+	}
 }
 
-// Post makes an HTTP POST request to url, using the contents of the pipe as
-// the request body, and produces the server's response. See [Pipe.Do] for how
-// the HTTP response status is interpreted.
-func (p *Pipe) Post(url string) *Pipe {
-	req, err := http.NewRequest(http.MethodPost, url, p.Reader)
-	if err != nil {
-		return p.WithError(err)
+// stringStage returns a [Stage] that calls method with a string argument.
+func stringStage(method func(*Pipe, string) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 1); err != nil {
+			return nil, err
+		}
+		return method(p, args[0]), nil
 	}
-	return p.Do(req)
 }
 
-// Reject produces only lines that do not contain the string s.
-func (p *Pipe) Reject(s string) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		if !strings.Contains(line, s) {
-			fmt.Fprintln(w, line)
+// stringPairStage returns a [Stage] that calls method with two string
+// arguments.
+func stringPairStage(method func(*Pipe, string, string) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 2); err != nil {
+			return nil, err
 		}
-	})
+		return method(p, args[0], args[1]), nil
+	}
 }
 
-// RejectRegexp produces only lines that don't match the compiled regexp re.
-func (p *Pipe) RejectRegexp(re *regexp.Regexp) *Pipe {
-	return p.FilterScan(func(line string, w io.Writer) {
-		if !re.MatchString(line) {
-			fmt.Fprintln(w, line)
+// intStage returns a [Stage] that calls method with an integer argument.
+func intStage(method func(*Pipe, int) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 1); err != nil {
+			return nil, err
 		}
-	})
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return method(p, n), nil
+	}
 }
 
-// Replace replaces all occurrences of the string search with the string
-// replace.
-func (p *Pipe) Replace(search, replace string) *Pipe {
-	return p.FilterLine(func(line string) string {
-		return strings.ReplaceAll(line, search, replace)
-	})
+// durationStage returns a [Stage] that calls method with a duration argument,
+// parsed by [ParseDuration].
+func durationStage(method func(*Pipe, time.Duration) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 1); err != nil {
+			return nil, err
+		}
+		d, err := ParseDuration(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return method(p, d), nil
+	}
+}
+
+// regexpStage returns a [Stage] that calls method with a regular expression
+// compiled from its argument.
+func regexpStage(method func(*Pipe, *regexp.Regexp) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 1); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return method(p, re), nil
+	}
 }
 
-// ReplaceRegexp replaces all matches of the compiled regexp re with the string
-// replace. $x variables in the replace string are interpreted as by
-// [regexp#Regexp.Expand]; for example, $1 represents the text of the first submatch.
-func (p *Pipe) ReplaceRegexp(re *regexp.Regexp, replace string) *Pipe {
-	return p.FilterLine(func(line string) string {
-		return re.ReplaceAllString(line, replace)
-	})
+// regexpPairStage returns a [Stage] that calls method with a regular
+// expression compiled from its first argument, and its second argument.
+func regexpPairStage(method func(*Pipe, *regexp.Regexp, string) *Pipe) Stage {
+	return func(p *Pipe, args []string) (*Pipe, error) {
+		if err := wantArgs(args, 2); err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return method(p, re, args[1]), nil
+	}
 }
 
-// Read reads up to len(b) bytes from the pipe into b. It returns the number of
-// bytes read and any error encountered. At end of file, or on a nil pipe, Read
-// returns 0, [io.EOF].
-func (p *Pipe) Read(b []byte) (int, error) {
-	if p.Error() != nil {
-		return 0, p.Error()
+// handlerStatus returns the HTTP status that [Handler] responds with when a
+// pipe fails with err.
+func handlerStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
 	}
-	return p.Reader.Read(b)
 }
 
-// SetError sets the error err on the pipe.
-func (p *Pipe) SetError(err error) {
-	if p.mu == nil { // uninitialised pipe
-		return
+// commandsMu guards commands.
+var commandsMu sync.RWMutex
+
+// commands holds the subcommands registered with [Command], by name.
+var commands = map[string]func() *Pipe{}
+
+// printCommands writes a usage message for prog to w, listing the registered
+// subcommands in alphabetical order.
+func printCommands(w io.Writer, prog string) {
+	commandsMu.RLock()
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	commandsMu.RUnlock()
+	sort.Strings(names)
+	fmt.Fprintf(w, "Usage: %s COMMAND [ARGS...]\n\nCommands:\n", prog)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\n", name)
 	}
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.err = err
 }
 
-// SHA256Sum returns the hex-encoded SHA-256 hash of the entire contents of the
-// pipe, or an error.
-// Deprecated: SHA256Sum has been deprecated by [Pipe.Hash]. To get the SHA-256
-// hash for the contents of the pipe, call `Hash(sha256.new())`
-func (p *Pipe) SHA256Sum() (string, error) {
-	return p.Hash(sha256.New())
+// measure copies r to w, recording the number of bytes and lines copied, and
+// the time taken, in stats. If progress is not nil, it's called with the
+// number of bytes and lines in each chunk of data as it's copied.
+func measure(w io.Writer, r io.Reader, stats *Stats, progress func(bytes, lines int64)) error {
+	start := time.Now()
+	buf := make([]byte, 32*1024)
+	var size, lines int64
+	var err error
+	for {
+		n, readErr := r.Read(buf)
+		chunkLines := int64(bytes.Count(buf[:n], []byte{'\n'}))
+		size += int64(n)
+		lines += chunkLines
+		if n > 0 {
+			if progress != nil {
+				progress(int64(n), chunkLines)
+			}
+			_, err = w.Write(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		if readErr != nil {
+			if readErr != io.EOF {
+				err = readErr
+			}
+			break
+		}
+	}
+	stats.Bytes = size
+	stats.Lines = lines
+	stats.Elapsed = time.Since(start)
+	return err
 }
 
-// SHA256Sums reads paths from the pipe, one per line, and produces the
-// hex-encoded SHA-256 hash of each corresponding file, one per line. Any files
-// that cannot be opened or read will be ignored.
-// Deprecated: SHA256Sums has been deprecated by [Pipe.HashSums]. To get the SHA-256
-// hash for each file path in the pipe, call `HashSums(sha256.new())`
-func (p *Pipe) SHA256Sums() *Pipe {
-	return p.HashSums(sha256.New())
+// parseCSVSpec parses a header spec for [Pipe.ValidateCSV].
+func parseCSVSpec(spec string) ([]csvColumn, error) {
+	var cols []csvColumn
+	for _, field := range strings.Split(spec, ",") {
+		name, kind := field, "string"
+		if i := strings.LastIndex(field, ":"); i >= 0 {
+			name, kind = field[:i], field[i+1:]
+		}
+		switch kind {
+		case "int", "float", "bool", "string":
+		default:
+			return nil, fmt.Errorf("column %q: unknown type %q (want int, float, bool, or string)", name, kind)
+		}
+		cols = append(cols, csvColumn{name: name, kind: kind})
+	}
+	return cols, nil
 }
 
-// Slice returns the pipe's contents as a slice of strings, one element per
-// line, or an error.
-//
-// An empty pipe will produce an empty slice. A pipe containing a single empty
-// line (that is, a single \n character) will produce a slice containing the
-// empty string as its single element.
-func (p *Pipe) Slice() ([]string, error) {
-	result := []string{}
-	p.FilterScan(func(line string, w io.Writer) {
-		result = append(result, line)
-	}).Wait()
-	return result, p.Error()
+// checkCSVHeader checks that the header record fields names the columns
+// cols, in order.
+func checkCSVHeader(cols []csvColumn, fields []string) error {
+	names := make([]string, len(cols))
+	for i, col := range cols {
+		names[i] = col.name
+	}
+	match := len(fields) == len(names)
+	for i := 0; match && i < len(names); i++ {
+		match = fields[i] == names[i]
+	}
+	if !match {
+		return fmt.Errorf("want header %q, got %q", strings.Join(names, ","), strings.Join(fields, ","))
+	}
+	return nil
 }
 
-// stdErr returns the pipe's configured standard error writer for commands run
-// via [Pipe.Exec] and [Pipe.ExecForEach]. The default is nil, which means that
-// error output will go to the pipe.
-func (p *Pipe) stdErr() io.Writer {
-	if p.mu == nil { // uninitialised pipe
-		return nil
+// checkCSVRecord checks that the record fields has a valid value for each of
+// the columns cols.
+func checkCSVRecord(cols []csvColumn, fields []string) error {
+	if len(fields) != len(cols) {
+		return fmt.Errorf("want %d fields, got %d", len(cols), len(fields))
 	}
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	return p.stderr
+	for i, col := range cols {
+		var err error
+		switch col.kind {
+		case "int":
+			_, err = strconv.ParseInt(fields[i], 10, 64)
+		case "float":
+			_, err = strconv.ParseFloat(fields[i], 64)
+		case "bool":
+			_, err = strconv.ParseBool(fields[i])
+		}
+		if err != nil {
+			return fmt.Errorf("column %q: %q is not a valid %s", col.name, fields[i], col.kind)
+		}
+	}
+	return nil
 }
 
-// Stdout copies the pipe's contents to its configured standard output (using
-// [Pipe.WithStdout]), or to [os.Stdout] otherwise, and returns the number of
-// bytes successfully written, together with any error.
-func (p *Pipe) Stdout() (int, error) {
-	if p.Error() != nil {
-		return 0, p.Error()
-	}
-	n64, err := io.Copy(p.stdout, p)
+// parseJSONSchema parses the JSON Schema text schema for
+// [Pipe.ValidateJSONSchema], compiling any patterns it contains.
+func parseJSONSchema(schema string) (jsonSchema, error) {
+	s := jsonSchema{patterns: map[string]*regexp.Regexp{}}
+	err := json.Unmarshal([]byte(schema), &s.root)
 	if err != nil {
-		return 0, err
+		return s, fmt.Errorf("invalid schema: %w", err)
 	}
-	n := int(n64)
-	if int64(n) != n64 {
-		return 0, fmt.Errorf("length %d overflows int", n64)
+	var compile func(v interface{}) error
+	compile = func(v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, sub := range v {
+				if pattern, ok := sub.(string); ok && key == "pattern" {
+					re, err := regexp.Compile(pattern)
+					if err != nil {
+						return fmt.Errorf("invalid schema: %w", err)
+					}
+					s.patterns[pattern] = re
+				}
+				if err := compile(sub); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for _, sub := range v {
+				if err := compile(sub); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
 	}
-	return n, p.Error()
+	return s, compile(s.root)
 }
 
-// String returns the pipe's contents as a string, together with any error.
-func (p *Pipe) String() (string, error) {
-	data, err := p.Bytes()
-	if err != nil {
-		p.SetError(err)
+// jsonType returns the JSON Schema type name of the decoded JSON value v.
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
 	}
-	return string(data), p.Error()
 }
 
-// Tee copies the pipe's contents to each of the supplied writers, like Unix
-// tee(1). If no writers are supplied, the default is the pipe's standard
-// output.
-func (p *Pipe) Tee(writers ...io.Writer) *Pipe {
-	teeWriter := p.stdout
-	if len(writers) > 0 {
-		teeWriter = io.MultiWriter(writers...)
+// jsonTypeMatches reports whether v has the type t, which is a JSON Schema
+// type name or a list of them.
+func jsonTypeMatches(t, v interface{}) bool {
+	got := jsonType(v)
+	names, ok := t.([]interface{})
+	if !ok {
+		names = []interface{}{t}
 	}
-	return p.WithReader(io.TeeReader(p.Reader, teeWriter))
+	for _, name := range names {
+		if name == got || (name == "number" && got == "integer") {
+			return true
+		}
+	}
+	return false
 }
 
-// Wait reads the pipe to completion and returns any error present on
-// the pipe, or nil otherwise. This is mostly useful for waiting until
-// concurrent filters have completed (see [Pipe.Filter]).
-func (p *Pipe) Wait() error {
-	_, err := io.Copy(io.Discard, p)
-	if err != nil {
-		p.SetError(err)
+// jsonTypeName describes the JSON Schema type t, which may be a list of type
+// names.
+func jsonTypeName(t interface{}) string {
+	names, ok := t.([]interface{})
+	if !ok {
+		return fmt.Sprint(t)
 	}
-	return p.Error()
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprint(name)
+	}
+	return strings.Join(parts, " or ")
 }
 
-// WithEnv sets the environment for subsequent [Pipe.Exec] and [Pipe.ExecForEach]
-// commands to the string slice env, using the same format as [os/exec.Cmd.Env].
-// An empty slice unsets all existing environment variables.
-func (p *Pipe) WithEnv(env []string) *Pipe {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.env = env
-	return p
+// jsonEqual reports whether the decoded JSON values a and b are equal.
+func jsonEqual(a, b interface{}) bool {
+	return jsonText(a) == jsonText(b)
 }
 
-// WithError sets the error err on the pipe.
-func (p *Pipe) WithError(err error) *Pipe {
-	p.SetError(err)
-	return p
+// jsonText returns the decoded JSON value v encoded as JSON text.
+func jsonText(v interface{}) string {
+	data, _ := json.Marshal(v)
+	return string(data)
 }
 
-// WithHTTPClient sets the HTTP client c for use with subsequent requests via
-// [Pipe.Do], [Pipe.Get], or [Pipe.Post]. For example, to make a request using
-// a client with a timeout:
-//
-//	NewPipe().WithHTTPClient(&http.Client{
-//	        Timeout: 10 * time.Second,
-//	}).Get("https://example.com").Stdout()
-func (p *Pipe) WithHTTPClient(c *http.Client) *Pipe {
-	p.httpClient = c
-	return p
+// writeReject writes the rejected record to w, preceded by the reason err, as
+// described for [Pipe.WithRejects].
+func writeReject(w io.Writer, err error, record string) {
+	fmt.Fprintf(w, "%v\t%s\n", err, strings.TrimSuffix(record, "\n"))
 }
 
-// WithReader sets the pipe's input reader to r. Once r has been completely
-// read, it will be closed if necessary.
-func (p *Pipe) WithReader(r io.Reader) *Pipe {
-	p.Reader = NewReadAutoCloser(r)
-	return p
+// retryable reports whether the request req, which resulted in resp and err,
+// is worth retrying, as described for [Pipe.WithHTTPRetries].
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5
 }
 
-// WithStderr sets the standard error output for [Pipe.Exec] or
-// [Pipe.ExecForEach] commands to w, instead of the pipe.
-func (p *Pipe) WithStderr(w io.Writer) *Pipe {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	p.stderr = w
-	return p
+// copyFrame copies a frame of n bytes from r to w, followed by a newline. It
+// returns an error if r ends before the whole frame has been read.
+func copyFrame(w io.Writer, r io.Reader, n int64) error {
+	copied, err := io.CopyN(w, r, n)
+	if err == io.EOF {
+		return fmt.Errorf("truncated frame: want %d bytes, got %d", n, copied)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte{'\n'})
+	return err
 }
 
-// WithStdout sets the pipe's standard output to the writer w, instead of the
-// default [os.Stdout].
-func (p *Pipe) WithStdout(w io.Writer) *Pipe {
-	p.stdout = w
-	return p
+// gearTable maps each byte value to a pseudo-random 64-bit value, for the
+// rolling hash used by [Pipe.ChunkCDC]. It's generated with splitmix64 from a
+// fixed seed, so that chunk boundaries are the same on every run.
+var gearTable = func() (table [256]uint64) {
+	var x uint64
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// retryFilter wraps filter so that it's run up to attempts times until it
+// succeeds, as described for [Pipe.Retry]. Its input is buffered so that it
+// can be replayed, and only the output of the successful attempt is passed
+// through to w.
+func retryFilter(filter func(io.Reader, io.Writer) error, attempts int, delay time.Duration) func(io.Reader, io.Writer) error {
+	return func(r io.Reader, w io.Writer) error {
+		input, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		wait := delay
+		for attempt := 1; ; attempt++ {
+			output := new(bytes.Buffer)
+			err = filter(bytes.NewReader(input), output)
+			if err == nil {
+				_, err = output.WriteTo(w)
+				return err
+			}
+			if attempt >= attempts {
+				return err
+			}
+			jitter := time.Duration(0)
+			if wait > 1 {
+				jitter = time.Duration(rand.Int63n(int64(wait / 2)))
+			}
+			time.Sleep(wait + jitter)
+			wait *= 2
+		}
+	}
 }
 
-// WriteFile writes the pipe's contents to the file path, truncating it if it
-// exists, and returns the number of bytes successfully written, or an error.
-func (p *Pipe) WriteFile(path string) (int64, error) {
-	return p.writeOrAppendFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+// timeoutFilter wraps filter so that it returns an error if it hasn't
+// finished within d. Any output filter writes before then is passed through
+// to w. At the deadline, filter is cancelled: its input r is closed, so that
+// its reads fail, its writes fail from then on, and any command it's running
+// is killed (see [stageAbandoned]).
+func timeoutFilter(filter func(io.Reader, io.Writer) error, d time.Duration) func(io.Reader, io.Writer) error {
+	return func(r io.Reader, w io.Writer) error {
+		dw := &deadlineWriter{w: w, abandoned: make(chan struct{})}
+		done := make(chan error, 1)
+		go func() {
+			done <- filter(r, dw)
+		}()
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case err := <-done:
+			return err
+		case <-timer.C:
+			dw.expire()
+			if c, ok := r.(io.Closer); ok {
+				c.Close()
+			}
+			return fmt.Errorf("stage timed out after %s, output may be incomplete: %w", d, context.DeadlineExceeded)
+		}
+	}
 }
 
-func (p *Pipe) writeOrAppendFile(path string, mode int) (int64, error) {
-	if p.Error() != nil {
-		return 0, p.Error()
+// waitCommand waits for the started cmd to finish, and for everything it wrote
+// to outputs to be copied to their destinations. If cmd is still running after
+// d (if d is positive), or when abandoned is closed, it's killed, along with
+// any other processes in its process group, and the outputs are closed, so
+// that waitCommand returns even if some process that escaped the group still
+// has them open.
+func waitCommand(cmd *exec.Cmd, outputs []*commandOutput, d time.Duration, abandoned <-chan struct{}) error {
+	if d <= 0 && abandoned == nil {
+		return cmd.Wait()
 	}
-	out, err := os.OpenFile(path, mode, 0o666)
-	if err != nil {
-		p.SetError(err)
-		return 0, err
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		for _, o := range outputs {
+			<-o.done
+			if err == nil {
+				err = o.err
+			}
+		}
+		done <- err
+	}()
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
 	}
-	defer out.Close()
-	wrote, err := io.Copy(out, p)
-	if err != nil {
-		p.SetError(err)
+	var err error
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		err = fmt.Errorf("command killed after %s: %w", d, context.DeadlineExceeded)
+	case <-abandoned:
+		err = fmt.Errorf("command killed because its stage timed out: %w", context.DeadlineExceeded)
 	}
-	return wrote, p.Error()
+	killProcessGroup(cmd)
+	for _, o := range outputs {
+		o.r.Close()
+	}
+	<-done
+	return err
 }
 
-// ReadAutoCloser wraps an [io.ReadCloser] so that it will be automatically
-// closed once it has been fully read.
-type ReadAutoCloser struct {
-	r io.ReadCloser
+// commandOutput is an operating system pipe that a command writes its output
+// to, in place of the writer it was given, which the data is copied on to.
+// Unlike the pipes that [exec.Cmd] creates for this, it can be closed at any
+// time, so that waiting for a killed command doesn't hang just because some
+// process it started still has the pipe open.
+type commandOutput struct {
+	r, w *os.File
+	done chan struct{}
+	err  error
 }
 
-// NewReadAutoCloser returns a [ReadAutoCloser] wrapping the reader r.
-func NewReadAutoCloser(r io.Reader) ReadAutoCloser {
-	if _, ok := r.(io.Closer); !ok {
-		return ReadAutoCloser{io.NopCloser(r)}
-	}
-	rc, ok := r.(io.ReadCloser)
-	if !ok {
-		// This can never happen, but just in case it does...
-		panic("internal error: type assertion to io.ReadCloser failed")
+// redirectOutput replaces cmd's standard output and error writers, unless
+// they're already files, with [commandOutput] pipes that copy to them. The
+// pipes' writing ends should be closed once cmd has started.
+func redirectOutput(cmd *exec.Cmd) ([]*commandOutput, error) {
+	var outputs []*commandOutput
+	for _, stream := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+		if *stream == nil {
+			continue
+		}
+		if _, ok := (*stream).(*os.File); ok {
+			continue
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			for _, o := range outputs {
+				o.w.Close()
+			}
+			return nil, err
+		}
+		o := &commandOutput{r: r, w: w, done: make(chan struct{})}
+		go func(dst io.Writer) {
+			defer close(o.done)
+			_, o.err = io.Copy(dst, r)
+			r.Close()
+		}(*stream)
+		if cmd.Stderr == cmd.Stdout {
+			// Keep both streams going to the same pipe
+			cmd.Stderr = w
+		}
+		*stream = w
+		outputs = append(outputs, o)
 	}
-	return ReadAutoCloser{rc}
+	return outputs, nil
 }
 
-// Close closes ra's reader, returning any resulting error.
-func (ra ReadAutoCloser) Close() error {
-	if ra.r == nil {
-		return nil
+// deadlineWriter is a writer that passes writes through to w until expire is
+// called, and fails them after that. The abandoned channel is closed when it
+// expires.
+type deadlineWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	expired   bool
+	abandoned chan struct{}
+}
+
+func (dw *deadlineWriter) Write(data []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.expired {
+		return 0, context.DeadlineExceeded
 	}
-	return ra.r.Close()
+	return dw.w.Write(data)
 }
 
-// Read reads up to len(b) bytes from ra's reader into b. It returns the number
-// of bytes read and any error encountered. At end of file, Read returns 0,
-// [io.EOF]. If end-of-file is reached, the reader will be closed.
-func (ra ReadAutoCloser) Read(b []byte) (n int, err error) {
-	if ra.r == nil {
-		return 0, io.EOF
+func (dw *deadlineWriter) expire() {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	dw.expired = true
+	close(dw.abandoned)
+}
+
+// stageAbandoned returns a channel that's closed when the stage writing its
+// output to w is abandoned because it overran its time limit (see
+// [timeoutFilter]), or nil if the stage has no time limit. Stages that run
+// commands use this to kill them.
+func stageAbandoned(w io.Writer) <-chan struct{} {
+	if dw, ok := w.(*deadlineWriter); ok {
+		return dw.abandoned
 	}
-	n, err = ra.r.Read(b)
-	if err == io.EOF {
-		ra.Close()
+	return nil
+}
+
+// prefixWriter is a writer that writes each line written to it to w, preceded
+// by prefix. An incomplete final line is held back until Flush is called.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func (pw *prefixWriter) Write(data []byte) (int, error) {
+	pw.buf = append(pw.buf, data...)
+	for {
+		i := bytes.IndexByte(pw.buf, '\n')
+		if i < 0 {
+			return len(data), nil
+		}
+		_, err := pw.w.Write(append([]byte(pw.prefix), pw.buf[:i+1]...))
+		if err != nil {
+			return 0, err
+		}
+		pw.buf = pw.buf[i+1:]
 	}
-	return n, err
 }
 
-func newScanner(r io.Reader) *bufio.Scanner {
-	scanner := bufio.NewScanner(r)
-	scanner.Buffer(make([]byte, 4096), math.MaxInt)
-	return scanner
+// Flush writes any incomplete final line, terminating it with a newline.
+func (pw *prefixWriter) Flush() error {
+	if len(pw.buf) == 0 {
+		return nil
+	}
+	_, err := pw.w.Write(append(append([]byte(pw.prefix), pw.buf...), '\n'))
+	pw.buf = nil
+	return err
 }
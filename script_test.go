@@ -3,21 +3,31 @@ package script_test
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"testing/iotest"
+	"time"
 
 	"github.com/bitfield/script"
 	"github.com/google/go-cmp/cmp"
@@ -34,6 +44,46 @@ func TestMain(m *testing.M) {
 			script.Stdin().Stdout()
 			return 0
 		},
+		"exitonerror": func() int {
+			script.Exec(os.Args[1]).ExitOnError()
+			return 0
+		},
+		"jsonerrors": func() int {
+			script.NewPipe().WithJSONErrors().Exec(os.Args[1]).ExitOnError()
+			return 0
+		},
+		"main": func() int {
+			script.Main(func() *script.Pipe {
+				return script.Exec(os.Args[1])
+			})
+			return 0
+		},
+		"multi": func() int {
+			script.Command("echo", script.Args)
+			script.Command("exec", func() *script.Pipe {
+				return script.Exec(os.Args[1])
+			})
+			script.RunCommands()
+			return 0
+		},
+		"onexit": func() int {
+			script.OnExit(func() { fmt.Println("second cleanup") })
+			script.OnExit(func() { fmt.Println("first cleanup") })
+			script.Main(func() *script.Pipe {
+				return script.Exec(os.Args[1])
+			})
+			return 0
+		},
+		"onsignal": func() int {
+			script.OnExit(func() { fmt.Println("cleanup") })
+			self, err := os.FindProcess(os.Getpid())
+			if err != nil {
+				panic(err)
+			}
+			self.Signal(syscall.SIGTERM)
+			time.Sleep(10 * time.Second)
+			return 0
+		},
 	}))
 }
 
@@ -73,6 +123,317 @@ func TestBasenameRemovesLeadingPathComponentsFromInputLines(t *testing.T) {
 	}
 }
 
+func TestCacheTo_ServesCachedOutputInsteadOfRunningStageAgain(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "cache", "output.txt")
+	runs := 0
+	stage := func(r io.Reader, w io.Writer) error {
+		runs++
+		fmt.Fprintf(w, "run %d\n", runs)
+		return nil
+	}
+	for i := 0; i < 2; i++ {
+		got, err := script.NewPipe().CacheTo(path, time.Hour).Filter(stage).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "run 1\n" {
+			t.Errorf("want cached output %q, got %q", "run 1\n", got)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("want stage run once, got %d runs", runs)
+	}
+}
+
+func TestCacheTo_RunsStageAgainOnceCacheHasExpired(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "output.txt")
+	err := os.WriteFile(path, []byte("stale\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo("fresh\n").CacheTo(path, time.Hour).FilterLine(strings.ToUpper).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "FRESH\n" {
+		t.Errorf("want %q, got %q", "FRESH\n", got)
+	}
+	cached, err := script.File(path).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != "FRESH\n" {
+		t.Errorf("want cache updated to %q, got %q", "FRESH\n", cached)
+	}
+}
+
+func TestCacheTo_DoesNotCacheOutputOfFailedStage(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "output.txt")
+	err := script.NewPipe().CacheTo(path, time.Hour).Filter(func(r io.Reader, w io.Writer) error {
+		fmt.Fprintln(w, "partial")
+		return errors.New("oh no")
+	}).Wait()
+	if err == nil {
+		t.Fatal("want error from failed stage")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want no cache file, got %v", err)
+	}
+}
+
+func TestChanged_OutputsOnlyFilesChangedSinceLastRun(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	for _, path := range []string{a, b} {
+		err := os.WriteFile(path, []byte(path), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	input := []string{a, b, filepath.Join(dir, "doesntexist")}
+	got, err := script.Slice(input).Changed(state).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{a, b}; !cmp.Equal(want, got) {
+		t.Fatalf("first run: %s", cmp.Diff(want, got))
+	}
+	got, err = script.Slice(input).Changed(state).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{}; !cmp.Equal(want, got) {
+		t.Fatalf("unchanged: %s", cmp.Diff(want, got))
+	}
+	err = os.WriteFile(b, []byte("new contents"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = script.Slice(input).Changed(state).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{b}; !cmp.Equal(want, got) {
+		t.Fatalf("after change: %s", cmp.Diff(want, got))
+	}
+	sumA, err := script.File(a).Hash(sha256.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sumB, err := script.File(b).Hash(sha256.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantState := sumA + "  " + a + "\n" + sumB + "  " + b + "\n"
+	gotState, err := script.File(state).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wantState != gotState {
+		t.Error(cmp.Diff(wantState, gotState))
+	}
+}
+
+func TestChanged_DoesNotUpdateStateWhenPipeHasError(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "state")
+	p := script.Echo("testdata/hello.txt").WithError(errors.New("oh no")).Changed(state)
+	p.Wait()
+	_, err := os.Stat(state)
+	if err == nil {
+		t.Error("want no state file written, but it exists")
+	}
+}
+
+func TestChanged_DoesNotUpdateStateWhenLaterStageFails(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "state")
+	p := script.Echo("testdata/hello.txt\n").Changed(state).Filter(func(r io.Reader, w io.Writer) error {
+		io.Copy(w, r)
+		return errors.New("oh no")
+	})
+	p.Wait()
+	_, err := os.Stat(state)
+	if err == nil {
+		t.Error("want no state file written, but it exists")
+	}
+	err = script.Echo("testdata/hello.txt\n").Changed(state).Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(state)
+	if err != nil {
+		t.Errorf("want state file written once pipe succeeds, got %v", err)
+	}
+}
+
+func TestCheckpoint_SkipsLinesProcessedSuccessfullyOnPreviousRun(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "done")
+	input := "version\nbogus\nenv GOROOT\n"
+	run := func() string {
+		t.Helper()
+		sum, err := script.Echo(input).Checkpoint(state).WithStderr(io.Discard).ExecForEach("go {{.}}").Summary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprintf("%d OK, %d failed", sum.OK, sum.Failed)
+	}
+	if got := run(); got != "2 OK, 1 failed" {
+		t.Errorf("first run: want 2 OK, 1 failed, got %s", got)
+	}
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "version\nenv GOROOT\n"
+	if want != string(data) {
+		t.Error(cmp.Diff(want, string(data)))
+	}
+	if got := run(); got != "0 OK, 1 failed" {
+		t.Errorf("second run: want only failed line retried, got %s", got)
+	}
+}
+
+func TestCheckpoint_RecordsLinesOnlyInNextPerLineStage(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "done")
+	err := script.Echo("version\n").Checkpoint(state).ExecForEach("go {{.}}").ExecForEach("go version").Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "version\n"
+	if want != string(data) {
+		t.Error(cmp.Diff(want, string(data)))
+	}
+}
+
+func TestCheckpoint_RecordsNothingWhenLinesAreTransformedBeforePerLineStage(t *testing.T) {
+	t.Parallel()
+	state := filepath.Join(t.TempDir(), "done")
+	got, err := script.Echo("a version\n").Checkpoint(state).Column(2).ExecForEach("go {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "go version") {
+		t.Errorf("want output of go version, got %q", got)
+	}
+	_, err = os.Stat(state)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want no state file, got %v", err)
+	}
+}
+
+func TestCheckpoint_ErrorsWhenStateFileUnreadable(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").Checkpoint(t.TempDir())
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error when state file can't be read")
+	}
+}
+
+func TestChunkCDC_ProducesChunksCoveringWholeInput(t *testing.T) {
+	t.Parallel()
+	data := pseudoRandomBytes(100_000)
+	chunks, err := script.NewPipe().WithReader(bytes.NewReader(data)).ChunkCDC(1024).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 10 {
+		t.Fatalf("want many chunks for 100,000 bytes, got %d", len(chunks))
+	}
+	var next int
+	for _, c := range chunks {
+		var sum string
+		var offset, length int
+		_, err := fmt.Sscanf(c, "%s %d %d", &sum, &offset, &length)
+		if err != nil {
+			t.Fatalf("%q: %v", c, err)
+		}
+		if offset != next {
+			t.Fatalf("want chunk at offset %d, got %d", next, offset)
+		}
+		want := fmt.Sprintf("%x", sha256.Sum256(data[offset:offset+length]))
+		if want != sum {
+			t.Errorf("chunk at %d: want hash %s, got %s", offset, want, sum)
+		}
+		next = offset + length
+	}
+	if next != len(data) {
+		t.Errorf("want chunks to cover %d bytes, got %d", len(data), next)
+	}
+}
+
+func TestChunkCDC_ProducesSameChunksHoweverInputIsRead(t *testing.T) {
+	t.Parallel()
+	data := pseudoRandomBytes(20_000)
+	want, err := script.NewPipe().WithReader(bytes.NewReader(data)).ChunkCDC(1024).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.NewPipe().WithReader(iotest.OneByteReader(bytes.NewReader(data))).ChunkCDC(1024).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestChunkCDC_PreservesMostChunksWhenDataIsInsertedAtStart(t *testing.T) {
+	t.Parallel()
+	data := pseudoRandomBytes(100_000)
+	hashes := func(data []byte) map[string]bool {
+		t.Helper()
+		sums, err := script.NewPipe().WithReader(bytes.NewReader(data)).ChunkCDC(1024).Column(1).Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		set := map[string]bool{}
+		for _, s := range sums {
+			set[s] = true
+		}
+		return set
+	}
+	before := hashes(data)
+	after := hashes(append([]byte("inserted"), data...))
+	var shared int
+	for h := range after {
+		if before[h] {
+			shared++
+		}
+	}
+	if shared < len(before)-3 {
+		t.Errorf("want nearly all of %d chunks unchanged, got %d", len(before), shared)
+	}
+}
+
+// pseudoRandomBytes returns n bytes of deterministic pseudo-random data.
+func pseudoRandomBytes(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(1)
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = byte(x >> 24)
+	}
+	return data
+}
+
 func TestColumnSelects(t *testing.T) {
 	t.Parallel()
 	input := []string{
@@ -196,267 +557,212 @@ func TestColumnSelects(t *testing.T) {
 	}
 }
 
-func TestConcatOutputsContentsOfSpecifiedFilesInOrder(t *testing.T) {
-	t.Parallel()
-	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\nhello world"
-	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").Concat().String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
-	}
-}
-
-func TestDirname_RemovesFilenameComponentFromInputLines(t *testing.T) {
+func TestCSVColumn_HandlesQuotedFields(t *testing.T) {
 	t.Parallel()
+	input := "name,address,note\n\"Smith, Jo\",\"1 High St\",\"says \"\"hi\"\"\"\nAl,\"2 Low Rd\nFlat 3\"\nshort\n"
 	tcs := []struct {
-		path string
+		col  int
 		want string
 	}{
-		{"/", "/\n"},
-		{"./", ".\n"},
-		{"\n", ".\n"},
-		{"/root", "/\n"},
-		{"/tmp/example.php", "/tmp\n"},
-		{"/var/tmp/example.php", "/var/tmp\n"},
-		{"/var/tmp", "/var\n"},
-		{"/var/tmp/", "/var\n"},
-		{"src/filters", "./src\n"},
-		{"src/filters/", "./src\n"},
-		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "/tmp\n/tmp\n"},
-		{"C:/Program Files/PHP", "C:/Program Files\n"},
-		{"C:/Program Files/PHP/", "C:/Program Files\n"},
+		{col: 1, want: "name\nSmith, Jo\nAl\nshort\n"},
+		{col: 2, want: "address\n1 High St\n2 Low Rd\nFlat 3\n"},
+		{col: 3, want: "note\nsays \"hi\"\n"},
+		{col: 4, want: ""},
 	}
 	for _, tc := range tcs {
-		// Expect results to use this platform's path separator
-		want := filepath.Clean(tc.want)
-		got, err := script.Echo(tc.path).Dirname().String()
+		got, err := script.Echo(input).CSVColumn(tc.col).String()
 		if err != nil {
 			t.Fatal(err)
 		}
-		if want != got {
-			t.Errorf("%q: want %q, got %q", tc.path, want, got)
+		if tc.want != got {
+			t.Errorf("column %d: %s", tc.col, cmp.Diff(tc.want, got))
 		}
 	}
 }
 
-func TestDoPerformsSuppliedHTTPRequest(t *testing.T) {
+func TestCSVColumn_ErrorsOnInvalidCSV(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "some data")
-	}))
-	defer ts.Close()
-	req, err := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
-	if err != nil {
-		t.Fatal(err)
-	}
-	want := "some data\n"
-	got, err := script.Do(req).String()
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	p := script.Echo("a,\"b\n").CSVColumn(1)
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error for unterminated quoted field")
 	}
 }
 
-func TestEachLine_FiltersInputThroughSuppliedFunction(t *testing.T) {
+func TestColumns_SelectsAndReordersColumns(t *testing.T) {
 	t.Parallel()
-	want := "Hello world\nGoodbye world\n"
-	got, err := script.Echo("Hello\nGoodbye").
-		EachLine(func(line string, out *strings.Builder) {
-			out.WriteString(line + " world\n")
-		}).String()
+	input := "a b c\nd  e\tf g\nh i\n"
+	got, err := script.Echo(input).Columns(3, 1, 3).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	want := "c a c\nf d f\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestEachLine_HandlesLongLines(t *testing.T) {
+func TestColumns_JoinsColumnsWithOutputSeparator(t *testing.T) {
 	t.Parallel()
-	var got int
-	_, err := script.Echo(longLine).
-		EachLine(func(line string, out *strings.Builder) {
-			got++
-		}).String()
+	got, err := script.Echo("a b c\n").WithOutputSeparator(",").Columns(2, 1).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := 2
+	want := "b,a\n"
 	if want != got {
-		t.Errorf("want %d lines counted, got %d", want, got)
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestEchoProducesSuppliedString(t *testing.T) {
+func TestColumns_ErrorsOnInvalidColumn(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world."
-	p := script.Echo(want)
-	got, err := p.String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	p := script.Echo("a b c\n").Columns(1, 0)
+	if p.Error() == nil {
+		t.Error("want error for column 0")
 	}
 }
 
-func TestEchoReplacesInputWithSuppliedStringWhenUsedAsFilter(t *testing.T) {
+func TestCompute_AppendsOrAssignsResultOfExpression(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world."
-	p := script.Echo("bogus").Echo(want)
-	got, err := p.String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	input := "NAME TOTAL USED\ndisk1 200 50\ndisk2   0 0\ndisk3 10 x\n"
+	tcs := []struct {
+		expr, want string
+	}{
+		{
+			expr: "$3 * 100 / $2",
+			want: "NAME TOTAL USED\ndisk1 200 50 25\ndisk2   0 0\ndisk3 10 x\n",
+		},
+		{
+			expr: "$2 = ($2 - $3) % 7 + -1.5",
+			want: "NAME TOTAL USED\ndisk1 1.5 50\ndisk2 -1.5 0\ndisk3 10 x\n",
+		},
+		{
+			expr: "$9=$2*2",
+			want: "NAME TOTAL USED\ndisk1 200 50 400\ndisk2 0 0 0\ndisk3 10 x 20\n",
+		},
 	}
-}
-
-func TestExecForEach_ErrorsOnInvalidTemplateSyntax(t *testing.T) {
-	t.Parallel()
-	p := script.Echo("a\nb\nc\n").ExecForEach("{{invalid template syntax}}")
-	p.Wait()
-	if p.Error() == nil {
-		t.Error("want error with invalid template syntax")
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Compute(tc.expr).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%q: %s", tc.expr, cmp.Diff(tc.want, got))
+		}
 	}
 }
 
-func TestExecForEach_ErrorsOnUnbalancedQuotes(t *testing.T) {
+func TestCompute_SetsErrorGivenInvalidExpression(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("a\nb\nc\n").ExecForEach("echo \"{{.}}")
-	p.Wait()
-	if p.Error() == nil {
-		t.Error("want error with unbalanced quotes in command line")
+	for _, expr := range []string{"", "$1 +", "($1", "$0", "$1 $2", "$1 ^ 2", "1..2"} {
+		p := script.Echo("1 2\n").Compute(expr)
+		if p.Error() == nil {
+			t.Errorf("%q: want error", expr)
+		}
 	}
 }
 
-func TestExecForEach_SendsStderrOutputToPipeStderr(t *testing.T) {
+func TestCleanup_CallsFunctionOnceWhenPipeHasBeenRead(t *testing.T) {
 	t.Parallel()
-	buf := new(bytes.Buffer)
-	out, err := script.Echo("go").WithStderr(buf).ExecForEach("{{.}}").String()
+	var calls int32
+	p := script.Echo("hello\n").Cleanup(func() {
+		atomic.AddInt32(&calls, 1)
+	})
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if out != "" {
-		t.Fatalf("unexpected output: %q", out)
+	if got != "hello\n" {
+		t.Errorf("want output unchanged, got %q", got)
 	}
-	if !strings.Contains(buf.String(), "Usage") {
-		t.Errorf("want stderr output containing the word 'Usage', got %q", buf.String())
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("want cleanup called once, got %d calls", n)
 	}
 }
 
-func TestExecSendsStderrOutputToPipeStderr(t *testing.T) {
+func TestCleanup_CallsFunctionImmediatelyIfPipeHasError(t *testing.T) {
 	t.Parallel()
-	buf := new(bytes.Buffer)
-	out, err := script.NewPipe().WithStderr(buf).Exec("go").String()
-	if err == nil {
-		t.Fatal("want error when command returns a non-zero exit status")
+	called := false
+	script.NewPipe().WithError(errors.New("oh no")).Cleanup(func() {
+		called = true
+	})
+	if !called {
+		t.Error("want cleanup called for pipe with error")
 	}
-	if out != "" {
-		t.Fatalf("unexpected output: %q", out)
+}
+
+func TestConcatOutputsContentsOfSpecifiedFilesInOrder(t *testing.T) {
+	t.Parallel()
+	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\nhello world"
+	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").Concat().String()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(buf.String(), "Usage") {
-		t.Errorf("want stderr output containing the word 'Usage', got %q", buf.String())
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFilterByCopyPassesInputThroughUnchanged(t *testing.T) {
+func TestConcatStrict_SetsErrorWhenAnyFileCannotBeOpened(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
-		_, err := io.Copy(w, r)
-		return err
-	})
-	want := "hello"
+	p := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").ConcatStrict()
+	if p.Error() == nil {
+		t.Fatal("want error for nonexistent file, got nil")
+	}
+	p.SetError(nil)
+	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\nhello world"
 	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
+	if !cmp.Equal(want, got) {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFilterCanChainFilters(t *testing.T) {
+func TestConcatStrict_DoesNotSetErrorWhenAllFilesCanBeOpened(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
-		_, err := io.Copy(w, r)
-		return err
-	}).Filter(func(r io.Reader, w io.Writer) error {
-		_, err := io.Copy(w, r)
-		return err
-	})
-	want := "hello"
-	got, err := p.String()
+	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\nhello world"
+	got, err := script.Echo("testdata/test.txt\ntestdata/hello.txt").ConcatStrict().String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
+	if !cmp.Equal(want, got) {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFilterByCopyToDiscardGivesNoOutput(t *testing.T) {
+func TestConcatWithHeaders_PrecedesEachFileWithHeaderGivingItsPath(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
-		_, err := io.Copy(io.Discard, r)
-		return err
-	})
-	want := ""
-	got, err := p.String()
+	want := "==> testdata/test.txt <==\nThis is the first line in the file.\nHello, world.\nThis is another line in the file.\n\n==> testdata/hello.txt <==\nhello world"
+	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").ConcatWithHeaders().String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
+	if !cmp.Equal(want, got) {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFilterReadsNoMoreThanRequested(t *testing.T) {
+func TestConcatWithPrefix_PrefixesEachLineWithPathAndLineNumber(t *testing.T) {
 	t.Parallel()
-	input := "firstline\nsecondline"
-	source := bytes.NewBufferString(input)
-	p := script.NewPipe().WithReader(source).Filter(func(r io.Reader, w io.Writer) error {
-		// read just the first line of input
-		var text string
-		_, err := fmt.Fscanln(r, &text)
-		if err != nil {
-			return err
-		}
-		fmt.Fprintln(w, text)
-		return nil
-	})
-	want := "firstline\n"
-	got, err := p.String()
+	want := "testdata/test.txt:1:This is the first line in the file.\n" +
+		"testdata/test.txt:2:Hello, world.\n" +
+		"testdata/test.txt:3:This is another line in the file.\n" +
+		"testdata/hello.txt:1:hello world\n"
+	got, err := script.Echo("testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt").ConcatWithPrefix().String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Fatal(cmp.Diff(want, got))
-	}
-	wantRemaining := "secondline"
-	if wantRemaining != source.String() {
-		t.Errorf("want %q remaining, got %q", wantRemaining, source.String())
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFilterByFirstLineOnlyGivesFirstLineOfInput(t *testing.T) {
+func TestDeframeLength32_ReversesFrameLength32(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("hello\nworld").Filter(func(r io.Reader, w io.Writer) error {
-		scanner := bufio.NewScanner(r)
-		for scanner.Scan() {
-			fmt.Fprintln(w, scanner.Text())
-			break
-		}
-		return scanner.Err()
-	})
-	want := "hello\n"
-	got, err := p.String()
+	want := "hello\n\nworld\n"
+	got, err := script.Echo(want).FrameLength32().DeframeLength32().String()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -465,22 +771,19 @@ func TestFilterByFirstLineOnlyGivesFirstLineOfInput(t *testing.T) {
 	}
 }
 
-func TestFilterSetsErrorOnPipeIfFilterFuncReturnsError(t *testing.T) {
+func TestDeframeLength32_ErrorsOnTruncatedFrame(t *testing.T) {
 	t.Parallel()
-	p := script.Echo("hello").Filter(func(io.Reader, io.Writer) error {
-		return errors.New("oh no")
-	})
-	io.ReadAll(p)
+	p := script.Echo("\x00\x00\x00\x05hel").DeframeLength32()
+	p.Wait()
 	if p.Error() == nil {
-		t.Error("no error")
+		t.Error("want error for truncated frame")
 	}
 }
 
-func TestFilterLine_FiltersEachLineThroughSuppliedFunction(t *testing.T) {
+func TestDeframeNetstring_ReversesFrameNetstring(t *testing.T) {
 	t.Parallel()
-	input := "hello\nworld"
-	want := "HELLO\nWORLD\n"
-	got, err := script.Echo(input).FilterLine(strings.ToUpper).String()
+	want := "hello\n\nworld\n"
+	got, err := script.Echo(want).FrameNetstring().DeframeNetstring().String()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -489,373 +792,397 @@ func TestFilterLine_FiltersEachLineThroughSuppliedFunction(t *testing.T) {
 	}
 }
 
-func TestFilterScan_FiltersInputLineByLine(t *testing.T) {
+func TestDeframeNetstring_ErrorsOnInvalidInput(t *testing.T) {
 	t.Parallel()
-	input := "hello\nworld\ngoodbye"
-	want := "world\n"
-	got, err := script.Echo(input).
-		FilterScan(func(line string, w io.Writer) {
-			if strings.HasPrefix(line, "w") {
-				fmt.Fprintln(w, line)
-			}
-		}).String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	inputs := []string{"5:hello", "5:hello;", "x:hello,", "5", "10:hello,"}
+	for _, input := range inputs {
+		p := script.Echo(input).DeframeNetstring()
+		p.Wait()
+		if p.Error() == nil {
+			t.Errorf("%q: want error for invalid netstring", input)
+		}
 	}
 }
 
-func TestFilterScan_HandlesLongLines(t *testing.T) {
+func TestDetectMIME_OutputsMIMETypeOfEachSpecifiedFile(t *testing.T) {
 	t.Parallel()
-	want := "last line\n"
-	got, err := script.Echo(longLine).
-		FilterScan(func(line string, w io.Writer) {
-			if strings.HasPrefix(line, "last") {
-				fmt.Fprintln(w, line)
-			}
-		}).String()
+	path := filepath.Join(t.TempDir(), "image")
+	err := os.WriteFile(path, []byte("\x89PNG\x0D\x0A\x1A\x0A"), 0o600)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
+	input := []string{"testdata/hello.txt", "testdata/doesntexist.txt", path, "testdata/commits.json"}
+	want := []string{"text/plain; charset=utf-8", "image/png", "text/plain; charset=utf-8"}
+	got, err := script.Slice(input).DetectMIME().Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFirstDropsAllButFirstNLinesOfInput(t *testing.T) {
+func TestDirname_RemovesFilenameComponentFromInputLines(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := "a\nb\n"
-	got, err := script.Echo(input).First(2).String()
-	if err != nil {
-		t.Fatal(err)
+	tcs := []struct {
+		path string
+		want string
+	}{
+		{"/", "/\n"},
+		{"./", ".\n"},
+		{"\n", ".\n"},
+		{"/root", "/\n"},
+		{"/tmp/example.php", "/tmp\n"},
+		{"/var/tmp/example.php", "/var/tmp\n"},
+		{"/var/tmp", "/var\n"},
+		{"/var/tmp/", "/var\n"},
+		{"src/filters", "./src\n"},
+		{"src/filters/", "./src\n"},
+		{"/tmp/script-21345.txt\n/tmp/script-5371253.txt", "/tmp\n/tmp\n"},
+		{"C:/Program Files/PHP", "C:/Program Files\n"},
+		{"C:/Program Files/PHP/", "C:/Program Files\n"},
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	for _, tc := range tcs {
+		// Expect results to use this platform's path separator
+		want := filepath.Clean(tc.want)
+		got, err := script.Echo(tc.path).Dirname().String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%q: want %q, got %q", tc.path, want, got)
+		}
 	}
 }
 
-func TestFirstHasNoOutputWhenNIs0(t *testing.T) {
+func TestDoPerformsSuppliedHTTPRequest(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := ""
-	got, err := script.Echo(input).First(0).String()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
+	want := "some data\n"
+	got, err := script.Do(req).String()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cmp.Equal(want, got) {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestFirstHasNoOutputWhenNIsNegative(t *testing.T) {
+func TestEachLine_FiltersInputThroughSuppliedFunction(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := ""
-	got, err := script.Echo(input).First(-1).String()
+	want := "Hello world\nGoodbye world\n"
+	got, err := script.Echo("Hello\nGoodbye").
+		EachLine(func(line string, out *strings.Builder) {
+			out.WriteString(line + " world\n")
+		}).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestFirstHasNoEffectGivenLessThanNInputLines(t *testing.T) {
+func TestEachLine_HandlesLongLines(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := "a\nb\nc\n"
-	got, err := script.Echo(input).First(4).String()
+	var got int
+	_, err := script.Echo(longLine).
+		EachLine(func(line string, out *strings.Builder) {
+			got++
+		}).String()
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := 2
 	if want != got {
-		t.Error(cmp.Diff(want, got))
+		t.Errorf("want %d lines counted, got %d", want, got)
 	}
 }
 
-func TestFirstDoesNotConsumeUnnecessaryData(t *testing.T) {
+func TestEchoProducesSuppliedString(t *testing.T) {
 	t.Parallel()
-	// First uses a 4096-byte buffer, so will always read at least
-	// that much, but no more (once N lines have been read).
-	r := strings.NewReader(strings.Repeat("line\n", 1000))
-	got, err := script.NewPipe().WithReader(r).First(1).String()
+	want := "Hello, world."
+	p := script.Echo(want)
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := "line\n"
-	if want != got {
-		t.Errorf("want output %q, got %q", want, got)
-	}
-	if r.Len() == 0 {
-		t.Errorf("no data left in reader")
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestFreqHandlesLongLines(t *testing.T) {
+func TestEchoReplacesInputWithSuppliedStringWhenUsedAsFilter(t *testing.T) {
 	t.Parallel()
-	got, err := script.Echo(longLine).Freq().Slice()
+	want := "Hello, world."
+	p := script.Echo("bogus").Echo(want)
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(got) != 2 {
-		t.Fatalf("want 2 results, got %d: %q", len(got), got)
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
-	if got[0] != "1 last line" {
-		t.Fatalf("wrong result: %q", got)
+}
+
+func TestExecForEach_StopsWhenCircuitBreakerTrips(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("bogus1\nbogus2\nversion\n").WithCircuitBreaker(2).WithStderr(io.Discard).ExecForEach("go {{.}}")
+	got, err := p.String()
+	if err == nil {
+		t.Fatal("want error when circuit breaker trips")
+	}
+	if !strings.Contains(err.Error(), "2 consecutive failures") {
+		t.Errorf("want error summarising failures, got %q", err)
+	}
+	if got != "" {
+		t.Errorf("want remaining commands skipped, got output %q", got)
 	}
 }
 
-func TestFreqProducesCorrectFrequencyTableForInput(t *testing.T) {
+func TestExecForEachParallel_StopsWhenCircuitBreakerTrips(t *testing.T) {
 	t.Parallel()
-	input := strings.Join([]string{
-		"apple",
-		"orange",
-		"banana",
-		"banana",
-		"apple",
-		"orange",
-		"kumquat",
-		"apple",
-		"orange",
-		"apple",
-		"banana",
-		"banana",
-		"apple",
-		"apple",
-		"orange",
-		"apple",
-		"apple",
-		"apple",
-		"apple",
-	}, "\n")
-	want := "10 apple\n 4 banana\n 4 orange\n 1 kumquat\n"
-	got, err := script.Echo(input).Freq().String()
+	p := script.Echo("bogus1\nbogus2\nbogus3\nbogus4\n").WithCircuitBreaker(2).WithStderr(io.Discard).ExecForEachParallel("go {{.}}", 2)
+	p.Wait()
+	if p.Error() == nil {
+		t.Fatal("want error when circuit breaker trips")
+	}
+	if !strings.Contains(p.Error().Error(), "giving up after 2 consecutive failures") {
+		t.Errorf("unexpected error: %v", p.Error())
+	}
+}
+
+func TestExecForEach_CircuitBreakerCountsOnlyConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("bogus\nversion\nbogus\n").WithCircuitBreaker(2).WithStderr(io.Discard).ExecForEach("go {{.}}")
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	if !strings.HasPrefix(got, "go version") {
+		t.Errorf("want output of go version, got %q", got)
 	}
 }
 
-func TestGetMakesHTTPGetRequestToGivenURL(t *testing.T) {
+func TestExecForEach_PrefixesOutputLinesWithInputWhenRequested(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			t.Fatalf("want HTTP method GET, got %q", r.Method)
+	got, err := script.Echo("version\nbogus\n").WithPrefixedOutput(false).ExecForEach("go {{.}}").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 3 {
+		t.Fatalf("want at least 3 lines of output, got %q", got)
+	}
+	if !strings.HasPrefix(got[0], "version | go version ") {
+		t.Errorf("want first line prefixed with input, got %q", got[0])
+	}
+	for _, line := range got[1:] {
+		if !strings.HasPrefix(line, "bogus | ") {
+			t.Errorf("want line prefixed with input, got %q", line)
 		}
-		fmt.Fprintln(w, "some data")
-	}))
-	defer ts.Close()
-	want := "some data\n"
-	got, err := script.Get(ts.URL).String()
+	}
+}
+
+func TestExecForEach_ColorsPrefixConsistentlyForSameInput(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("version\nversion\n").WithPrefixedOutput(true).ExecForEach("go {{.}}").Slice()
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	if len(got) != 2 {
+		t.Fatalf("want 2 lines of output, got %q", got)
+	}
+	if !strings.HasPrefix(got[0], "\x1b[") {
+		t.Errorf("want colored prefix, got %q", got[0])
+	}
+	if got[0] != got[1] {
+		t.Errorf("want same prefix color for same input, got %q and %q", got[0], got[1])
 	}
 }
 
-func TestGetSetsErrorStatusWhenHTTPResponseStatusIsNotOK(t *testing.T) {
+func TestExecForEach_ErrorsOnInvalidTemplateSyntax(t *testing.T) {
 	t.Parallel()
-	// With no handler, all requests will get 404
-	ts := httptest.NewServer(nil)
-	defer ts.Close()
-	p := script.Get(ts.URL)
+	p := script.Echo("a\nb\nc\n").ExecForEach("{{invalid template syntax}}")
 	p.Wait()
 	if p.Error() == nil {
-		t.Fatalf("want error for non-OK request, got nil")
+		t.Error("want error with invalid template syntax")
 	}
 }
 
-func TestGetConsidersHTTPStatus201CreatedToBeOK(t *testing.T) {
+func TestExecForEachMap_ErrorsOnInvalidTemplateSyntax(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintln(w, "some data")
-	}))
-	defer ts.Close()
-	want := "some data\n"
-	got, err := script.Get(ts.URL).String()
-	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
-	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	_, err := script.Echo("a\nb\nc\n").ExecForEachMap("{{invalid template syntax}}")
+	if err == nil {
+		t.Error("want error with invalid template syntax")
 	}
 }
 
-func TestGetUsesPipeContentsAsRequestBody(t *testing.T) {
+func TestExecForEachStdin_ErrorsOnInvalidStdinTemplateSyntax(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		want := []byte("request data")
-		got, err := io.ReadAll(r.Body)
-		if err != nil {
-			t.Fatal("reading request body", err)
-		}
-		if !cmp.Equal(want, got) {
-			t.Fatalf(cmp.Diff(want, string(got)))
-		}
-	}))
-	defer ts.Close()
-	_, err := script.Echo("request data").Get(ts.URL).String()
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+	p := script.Echo("a\nb\nc\n").ExecForEachStdin("cat", "{{invalid template syntax}}")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error with invalid template syntax")
 	}
 }
 
-func TestJoinHandlesLongLines(t *testing.T) {
+func TestExecForEach_ErrorsOnUnbalancedQuotes(t *testing.T) {
 	t.Parallel()
-	result, err := script.Echo(longLine).Join().String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	want := len(longLine)
-	if want != len(result) {
-		t.Errorf("want result length %d, got %d", want, len(result))
+	p := script.Echo("a\nb\nc\n").ExecForEach("echo \"{{.}}")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error with unbalanced quotes in command line")
 	}
 }
 
-func TestJoinJoinsInputLinesIntoSpaceSeparatedString(t *testing.T) {
+func TestExecForEach_SendsStderrOutputToPipeStderr(t *testing.T) {
 	t.Parallel()
-	input := "hello\nfrom\nthe\njoin\ntest"
-	want := "hello from the join test\n"
-	got, err := script.Echo(input).Join().String()
+	buf := new(bytes.Buffer)
+	out, err := script.Echo("go").WithStderr(buf).ExecForEach("{{.}}").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	if out != "" {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if !strings.Contains(buf.String(), "Usage") {
+		t.Errorf("want stderr output containing the word 'Usage', got %q", buf.String())
 	}
 }
 
-func TestJQWithDotQueryPrettyPrintsInput(t *testing.T) {
+func TestExecForEach_PrefixesStderrLinesWithRenderedTemplate(t *testing.T) {
 	t.Parallel()
-	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
-	// Fields should be sorted by key, with whitespace removed
-	want := `{"iss_position":{"latitude":"10.8107","longitude":"52.8439"},"message":"success","timestamp":1649264191}` + "\n"
-	got, err := script.Echo(input).JQ(".").String()
+	buf := new(bytes.Buffer)
+	p := script.Echo("version\nbogus\n").WithStderr(buf).WithStderrPrefix("[{{.Line}}] {{.Cmd}}: ").ExecForEach("go {{.}}")
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(want, got)
-		t.Error(cmp.Diff(want, got))
+	if !strings.HasPrefix(got, "go version") {
+		t.Errorf("want unprefixed command output in pipe, got %q", got)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[bogus] go bogus: ") {
+			t.Errorf("want stderr line prefixed with input and command, got %q", line)
+		}
+	}
+	if !strings.HasSuffix(buf.String(), "[bogus] go bogus: exit status 2\n") {
+		t.Errorf("want prefixed error message, got %q", buf)
 	}
 }
 
-func TestJQWithFieldQueryProducesSelectedField(t *testing.T) {
+func TestExecForEach_PrefixesOnlyStderrLinesInPipeWithoutStderr(t *testing.T) {
 	t.Parallel()
-	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
-	want := `{"latitude":"10.8107","longitude":"52.8439"}` + "\n"
-	got, err := script.Echo(input).JQ(".iss_position").String()
+	got, err := script.Echo("version\nbogus\n").WithStderrPrefix("{{.Line}}! ").ExecForEach("go {{.}}").Slice()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(want, got)
-		t.Error(cmp.Diff(want, got))
+	if len(got) < 2 {
+		t.Fatalf("want at least 2 lines of output, got %q", got)
+	}
+	if !strings.HasPrefix(got[0], "go version ") {
+		t.Errorf("want unprefixed standard output, got %q", got[0])
+	}
+	for _, line := range got[1:] {
+		if !strings.HasPrefix(line, "bogus! ") {
+			t.Errorf("want standard error line prefixed, got %q", line)
+		}
 	}
 }
 
-func TestJQWithArrayQueryProducesRequiredArray(t *testing.T) {
+func TestWithStderrPrefix_ErrorsOnInvalidTemplate(t *testing.T) {
 	t.Parallel()
-	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
-	want := `["10.8107","52.8439"]` + "\n"
-	got, err := script.Echo(input).JQ("[.iss_position.latitude, .iss_position.longitude]").String()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if want != got {
-		t.Error(want, got)
-		t.Error(cmp.Diff(want, got))
+	p := script.NewPipe().WithStderrPrefix("{{.")
+	if p.Error() == nil {
+		t.Error("want error with invalid template")
 	}
 }
 
-func TestJQWithArrayInputAndElementQueryProducesSelectedElement(t *testing.T) {
+func TestExec_CopiesOutputToStdoutInPassthroughMode(t *testing.T) {
 	t.Parallel()
-	input := `[1, 2, 3]`
-	want := "1\n"
-	got, err := script.Echo(input).JQ(".[0]").String()
+	buf := new(bytes.Buffer)
+	got, err := script.NewPipe().WithStdout(buf).WithPassthrough().Exec("go version").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(want, got)
-		t.Error(cmp.Diff(want, got))
+	if !strings.HasPrefix(got, "go version") {
+		t.Errorf("want command output in pipe, got %q", got)
+	}
+	if buf.String() != got {
+		t.Errorf("want command output copied to stdout, got %q", buf.String())
 	}
 }
 
-func TestJQHandlesGithubJSONWithRealWorldExampleQuery(t *testing.T) {
+func TestExecForEach_CopiesOutputToStdoutInPassthroughMode(t *testing.T) {
 	t.Parallel()
-	want := `{"message":"restore sample log data (fixes #102)","name":"John Arundel"}` + "\n"
-	got, err := script.File("testdata/commits.json").
-		JQ(".[0] | {message: .commit.message, name: .commit.committer.name}").String()
+	buf := new(bytes.Buffer)
+	got, err := script.Echo("version\n").WithStdout(buf).WithPassthrough().ExecForEach("go {{.}}").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(want, got)
-		t.Error(cmp.Diff(want, got))
+	if !strings.HasPrefix(got, "go version") {
+		t.Errorf("want command output in pipe, got %q", got)
+	}
+	if buf.String() != got {
+		t.Errorf("want command output copied to stdout, got %q", buf.String())
 	}
 }
 
-func TestJQErrorsWithInvalidQuery(t *testing.T) {
+func TestExecSendsStderrOutputToPipeStderr(t *testing.T) {
 	t.Parallel()
-	input := `[1, 2, 3]`
-	_, err := script.Echo(input).JQ(".foo & .bar").String()
+	buf := new(bytes.Buffer)
+	out, err := script.NewPipe().WithStderr(buf).Exec("go").String()
 	if err == nil {
-		t.Error("want error from invalid JQ query, got nil")
+		t.Fatal("want error when command returns a non-zero exit status")
 	}
-}
-
-func TestLastDropsAllButLastNLinesOfInput(t *testing.T) {
-	t.Parallel()
-	input := "a\nb\nc\n"
-	want := "b\nc\n"
-	got, err := script.Echo(input).Last(2).String()
-	if err != nil {
-		t.Fatal(err)
+	if out != "" {
+		t.Fatalf("unexpected output: %q", out)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	if !strings.Contains(buf.String(), "Usage") {
+		t.Errorf("want stderr output containing the word 'Usage', got %q", buf.String())
 	}
 }
 
-func TestLastHandlesLongLines(t *testing.T) {
+func TestExtractRegexp_ProducesEachMatchOnItsOwnLine(t *testing.T) {
 	t.Parallel()
-	want := "last line\n"
-	got, err := script.Echo(longLine).Last(1).String()
+	got, err := script.Echo("a1 b22\nnone\nc333\n").ExtractRegexp(regexp.MustCompile(`\d+`)).String()
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := "1\n22\n333\n"
 	if want != got {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestLastHasNoOutputWhenNIs0(t *testing.T) {
+func TestExtractRegexp_ProducesFirstCaptureGroupWhenPresent(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := ""
-	got, err := script.Echo(input).Last(0).String()
+	got, err := script.Echo("released v1.2.3 and v1.3.0\n").ExtractRegexp(regexp.MustCompile(`v(\d+\.\d+)\.\d+`)).String()
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := "1.2\n1.3\n"
 	if want != got {
 		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestLastHasNoOutputWhenNIsNegative(t *testing.T) {
+func TestFilterByCopyPassesInputThroughUnchanged(t *testing.T) {
 	t.Parallel()
-	input := "a\nb\nc\n"
-	want := ""
-	got, err := script.Echo(input).Last(-1).String()
+	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	want := "hello"
+	got, err := p.String()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -864,7 +1191,1357 @@ func TestLastHasNoOutputWhenNIsNegative(t *testing.T) {
 	}
 }
 
-func TestLastHasNoEffectGivenLessThanNInputLines(t *testing.T) {
+func TestFilterCanChainFilters(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}).Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	want := "hello"
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterByCopyToDiscardGivesNoOutput(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello").Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	})
+	want := ""
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterReadsNoMoreThanRequested(t *testing.T) {
+	t.Parallel()
+	input := "firstline\nsecondline"
+	source := bytes.NewBufferString(input)
+	p := script.NewPipe().WithReader(source).Filter(func(r io.Reader, w io.Writer) error {
+		// read just the first line of input
+		var text string
+		_, err := fmt.Fscanln(r, &text)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, text)
+		return nil
+	})
+	want := "firstline\n"
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	wantRemaining := "secondline"
+	if wantRemaining != source.String() {
+		t.Errorf("want %q remaining, got %q", wantRemaining, source.String())
+	}
+}
+
+func TestFilterByFirstLineOnlyGivesFirstLineOfInput(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello\nworld").Filter(func(r io.Reader, w io.Writer) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			fmt.Fprintln(w, scanner.Text())
+			break
+		}
+		return scanner.Err()
+	})
+	want := "hello\n"
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterSetsErrorOnPipeIfFilterFuncReturnsError(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello").Filter(func(io.Reader, io.Writer) error {
+		return errors.New("oh no")
+	})
+	io.ReadAll(p)
+	if p.Error() == nil {
+		t.Error("no error")
+	}
+}
+
+func TestFilterBytes_FiltersInputLineByLine(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc"
+	want := "*a\n*b\n*c\n"
+	got, err := script.Echo(input).FilterBytes(func(line []byte, w io.Writer) {
+		fmt.Fprintf(w, "*%s\n", line)
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterBytes_HandlesLongLines(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo(longLine).FilterBytes(func(line []byte, w io.Writer) {
+		w.Write(line)
+		w.Write([]byte{'\n'})
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longLine != got {
+		t.Error(cmp.Diff(longLine, got))
+	}
+}
+
+func TestFilter_ChainedFiltersPreserveOrderOfInput(t *testing.T) {
+	t.Parallel()
+	input := make([]string, 10000)
+	for i := range input {
+		input[i] = fmt.Sprintf("line %d", i)
+	}
+	got, err := script.Slice(input).
+		FilterLine(strings.ToUpper).
+		Match("LINE").
+		Replace("LINE", "line").
+		FilterScan(func(line string, w io.Writer) {
+			fmt.Fprintln(w, line)
+		}).
+		Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(input, got) {
+		t.Error(cmp.Diff(input, got))
+	}
+}
+
+func TestFilterIgnoreFile_ExcludesPathsMatchingIgnorePatterns(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ignore := strings.Join([]string{
+		"# comment",
+		"",
+		"*.log",
+		"!keep.log",
+		"/root.txt",
+		"build/",
+		"docs/**/*.tmp",
+		"cache",
+		"file?.bak",
+		"[ab].out",
+		"\\#literal",
+	}, "\n")
+	err := os.WriteFile(filepath.Join(dir, ".gitignore"), []byte(ignore), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(dir, "build"), 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcs := []struct {
+		path    string
+		ignored bool
+	}{
+		{"main.go", false},
+		{"debug.log", true},
+		{"sub/debug.log", true},
+		{"keep.log", false},
+		{"sub/keep.log", false},
+		{"root.txt", true},
+		{"sub/root.txt", false},
+		{"build", true},
+		{"build/out.bin", true},
+		{"sub/build/out.bin", true},
+		{"notdir/build", false},
+		{"docs/a.tmp", true},
+		{"docs/x/y/a.tmp", true},
+		{"other/a.tmp", false},
+		{"cache", true},
+		{"cache/data", true},
+		{"sub/cache/data", true},
+		{"file1.bak", true},
+		{"file10.bak", false},
+		{"a.out", true},
+		{"c.out", false},
+		{"#literal", true},
+	}
+	var input, want []string
+	for _, tc := range tcs {
+		path := filepath.Join(dir, tc.path)
+		input = append(input, path)
+		if !tc.ignored {
+			want = append(want, path)
+		}
+	}
+	outside := filepath.Join(filepath.Dir(dir), "debug.log")
+	input = append(input, outside)
+	want = append(want, outside)
+	got, err := script.Slice(input).FilterIgnoreFile(filepath.Join(dir, ".gitignore")).Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterIgnoreFile_ErrorsOnNonexistentIgnoreFile(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a.txt").FilterIgnoreFile("doesntexist")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent ignore file, got nil")
+	}
+}
+
+func TestFilterInSet_ProducesLinesInSetFromListOrPrebuiltFilter(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	list := filepath.Join(dir, "bad.txt")
+	writeTestFile(t, list, "deadbeef\ncafebabe\n")
+	bloom := filepath.Join(dir, "bad.bloom")
+	_, err := script.File(list).WriteBloomFilter(bloom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "0badf00d\ncafebabe\nfeedface\ndeadbeef\n"
+	for _, setFile := range []string{list, bloom} {
+		got, err := script.Echo(input).FilterInSet(setFile).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "cafebabe\ndeadbeef\n"
+		if want != got {
+			t.Errorf("%s: %s", setFile, cmp.Diff(want, got))
+		}
+		got, err = script.Echo(input).FilterNotInSet(setFile).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = "0badf00d\nfeedface\n"
+		if want != got {
+			t.Errorf("%s: %s", setFile, cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestFilterInSet_RarelyProducesLinesNotInSet(t *testing.T) {
+	t.Parallel()
+	members := new(strings.Builder)
+	others := new(strings.Builder)
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(members, "member%d\n", i)
+		fmt.Fprintf(others, "other%d\n", i)
+	}
+	bloom := filepath.Join(t.TempDir(), "set.bloom")
+	_, err := script.Echo(members.String()).WriteBloomFilter(bloom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := script.Echo(members.String()).FilterInSet(bloom).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20000 {
+		t.Errorf("want all 20000 members produced, got %d", n)
+	}
+	n, err = script.Echo(others.String()).FilterInSet(bloom).CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n > 100 {
+		t.Errorf("want about 20 false positives, got %d", n)
+	}
+}
+
+func TestFilterInSet_ErrorsOnFilterFileWithTooManyHashFunctions(t *testing.T) {
+	t.Parallel()
+	bloom := filepath.Join(t.TempDir(), "set.bloom")
+	_, err := script.Echo("a\n").WriteBloomFilter(bloom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(bloom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Set k, the first header word after the magic string, to 2^32
+	binary.LittleEndian.PutUint64(data[len("script-bloom-v1\n"):], 1<<32)
+	writeTestFile(t, bloom, string(data))
+	p := script.Echo("a\n").FilterInSet(bloom)
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error for invalid header")
+	}
+}
+
+func TestFilterInSet_ErrorsOnNonexistentSetFile(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").FilterInSet("doesntexist.bloom")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent set file")
+	}
+}
+
+func TestFilterLine_FiltersEachLineThroughSuppliedFunction(t *testing.T) {
+	t.Parallel()
+	input := "hello\nworld"
+	want := "HELLO\nWORLD\n"
+	got, err := script.Echo(input).FilterLine(strings.ToUpper).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterFields_PassesWhitespaceSeparatedFieldsOfEachLine(t *testing.T) {
+	t.Parallel()
+	input := "apple  3 0.5\n\tpear 2 1.25\n\nplum\n"
+	want := "apple 1.5\npear 2.5\n"
+	got, err := script.Echo(input).
+		FilterFields(func(fields []string, w io.Writer) {
+			if len(fields) < 3 {
+				return
+			}
+			n, _ := strconv.Atoi(fields[1])
+			price, _ := strconv.ParseFloat(fields[2], 64)
+			fmt.Fprintln(w, fields[0], float64(n)*price)
+		}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterScan_FiltersInputLineByLine(t *testing.T) {
+	t.Parallel()
+	input := "hello\nworld\ngoodbye"
+	want := "world\n"
+	got, err := script.Echo(input).
+		FilterScan(func(line string, w io.Writer) {
+			if strings.HasPrefix(line, "w") {
+				fmt.Fprintln(w, line)
+			}
+		}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterScan_HandlesLongLines(t *testing.T) {
+	t.Parallel()
+	want := "last line\n"
+	got, err := script.Echo(longLine).
+		FilterScan(func(line string, w io.Writer) {
+			if strings.HasPrefix(line, "last") {
+				fmt.Fprintln(w, line)
+			}
+		}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFilterState_CarriesStateAcrossLines(t *testing.T) {
+	t.Parallel()
+	input := "make \\\n  -j4 \\\n  all\nls\n"
+	want := "make   -j4   all\nls\n"
+	got, err := script.Echo(input).
+		FilterState("", func(state interface{}, line string, w io.Writer) interface{} {
+			joined := state.(string) + line
+			if strings.HasSuffix(joined, "\\") {
+				return strings.TrimSuffix(joined, "\\")
+			}
+			fmt.Fprintln(w, joined)
+			return ""
+		}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstDropsAllButFirstNLinesOfInput(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := "a\nb\n"
+	got, err := script.Echo(input).First(2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstHasNoOutputWhenNIs0(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := ""
+	got, err := script.Echo(input).First(0).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstHasNoOutputWhenNIsNegative(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := ""
+	got, err := script.Echo(input).First(-1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstHasNoEffectGivenLessThanNInputLines(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := "a\nb\nc\n"
+	got, err := script.Echo(input).First(4).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstDoesNotConsumeUnnecessaryData(t *testing.T) {
+	t.Parallel()
+	// First uses a 4096-byte buffer, so will always read at least
+	// that much, but no more (once N lines have been read).
+	r := strings.NewReader(strings.Repeat("line\n", 1000))
+	got, err := script.NewPipe().WithReader(r).First(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "line\n"
+	if want != got {
+		t.Errorf("want output %q, got %q", want, got)
+	}
+	if r.Len() == 0 {
+		t.Errorf("no data left in reader")
+	}
+}
+
+func TestFormatNumber_FormatsColumnAccordingToFormat(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		format, input, want string
+	}{
+		{",", "total 1234567.891", "total 1,234,567.891"},
+		{",", "total -123456", "total -123,456"},
+		{".2", "total 3.14159", "total 3.14"},
+		{"${,.2}", "total 1234.5", "total $1,234.50"},
+		{"si", "total 1500000", "total 1.5M"},
+		{"si", "total 999", "total 999"},
+		{".2si", "total 1234", "total 1.23k"},
+		{"{iec}B", "total 1610612736", "total 1.5GiB"},
+		{"iec", "total 2048", "total 2Ki"},
+		{",", "total n/a", "total n/a"},
+		{",", "total", "total"},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(tc.input).FormatNumber(2, tc.format).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want+"\n" != got {
+			t.Errorf("%q of %q: want %q, got %q", tc.format, tc.input, tc.want+"\n", got)
+		}
+	}
+}
+
+func TestFormatNumber_SetsErrorGivenInvalidFormat(t *testing.T) {
+	t.Parallel()
+	for _, format := range []string{"x", ".", "si,", "{,.2"} {
+		p := script.Echo("1\n").FormatNumber(1, format)
+		if p.Error() == nil {
+			t.Errorf("%q: want error", format)
+		}
+	}
+}
+
+func TestFrameLength32_PrefixesEachLineWithItsLength(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello\nworld\n").FrameLength32().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x00\x00\x00\x05hello\x00\x00\x00\x05world"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFrameNetstring_ProducesEachLineAsNetstring(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello\n\nworld\n").FrameNetstring().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "5:hello,0:,5:world,"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstMatch_ProducesFirstMatchingLineOnly(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a 1\nb 2\nc 3\nb 4\n").FirstMatch(regexp.MustCompile(`^b`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "b 2\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFirstMatch_DoesNotConsumeUnnecessaryData(t *testing.T) {
+	t.Parallel()
+	r := strings.NewReader("version 1.2\n" + strings.Repeat("line\n", 1000))
+	got, err := script.NewPipe().WithReader(r).FirstMatch(regexp.MustCompile(`^version`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "version 1.2\n"
+	if want != got {
+		t.Errorf("want output %q, got %q", want, got)
+	}
+	if r.Len() == 0 {
+		t.Errorf("no data left in reader")
+	}
+}
+
+func TestFirstMatch_ProducesNoOutputWhenNothingMatches(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\n").FirstMatch(regexp.MustCompile(`z`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestFreqHandlesLongLines(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo(longLine).Freq().Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 results, got %d: %q", len(got), got)
+	}
+	if got[0] != "1 last line" {
+		t.Fatalf("wrong result: %q", got)
+	}
+}
+
+func TestFreqProducesCorrectFrequencyTableForInput(t *testing.T) {
+	t.Parallel()
+	input := strings.Join([]string{
+		"apple",
+		"orange",
+		"banana",
+		"banana",
+		"apple",
+		"orange",
+		"kumquat",
+		"apple",
+		"orange",
+		"apple",
+		"banana",
+		"banana",
+		"apple",
+		"apple",
+		"orange",
+		"apple",
+		"apple",
+		"apple",
+		"apple",
+	}, "\n")
+	want := "10 apple\n 4 banana\n 4 orange\n 1 kumquat\n"
+	got, err := script.Echo(input).Freq().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFollowFile_ProducesLinesAppendedToFileUntilCancelled(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTestFile(t, path, "old line\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	p := script.FollowFile(ctx, path)
+	go func() {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		fmt.Fprintln(f, "new line 1")
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintln(f, "new line 2")
+		time.Sleep(300 * time.Millisecond)
+		cancel()
+	}()
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "new line 1\nnew line 2\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFollowFile_StartsAgainWhenFileIsTruncated(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	writeTestFile(t, path, "a long old line\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	p := script.FollowFile(ctx, path)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		err := os.WriteFile(path, []byte("new\n"), 0o644)
+		if err != nil {
+			panic(err)
+		}
+		time.Sleep(600 * time.Millisecond)
+		cancel()
+	}()
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "new\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFollowFile_ErrorsGivenNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.FollowFile(context.Background(), "doesntexist")
+	if p.Error() == nil {
+		t.Error("want error following nonexistent file")
+	}
+}
+
+func TestFromSpec_BuildsPipeFromStagesInSpec(t *testing.T) {
+	t.Parallel()
+	spec := `[
+		{"stage": "Echo", "args": ["GET /a 200\nPOST /b 500\nGET /a 404\nGET /c 200\n"]},
+		{"stage": "MatchRegexp", "args": ["^GET"]},
+		{"stage": "Column", "args": [2]},
+		{"stage": "Freq"},
+		{"stage": "First", "args": [1]}
+	]`
+	got, err := script.FromSpec(strings.NewReader(spec)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2 /a\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFromSpec_AcceptsSpecInYAML(t *testing.T) {
+	t.Parallel()
+	spec := `
+- stage: Echo
+  args: ["GET /a 200\nPOST /b 500\nGET /a 404\nGET /c 200\n"]
+- stage: MatchRegexp
+  args: [^GET]
+- stage: Column
+  args: [2]
+- stage: Freq
+- stage: First
+  args: [1]
+`
+	got, err := script.FromSpec(strings.NewReader(spec)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2 /a\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFromSpec_UsesStagesAddedWithRegisterStage(t *testing.T) {
+	t.Parallel()
+	script.RegisterStage("TestUpper", func(p *script.Pipe, args []string) (*script.Pipe, error) {
+		return p.FilterLine(strings.ToUpper), nil
+	})
+	spec := `[{"stage": "Echo", "args": ["hello\n"]}, {"stage": "TestUpper"}]`
+	got, err := script.FromSpec(strings.NewReader(spec)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "HELLO\n" {
+		t.Errorf("want %q, got %q", "HELLO\n", got)
+	}
+}
+
+func TestFromSpec_SetsErrorGivenInvalidSpec(t *testing.T) {
+	t.Parallel()
+	specs := []string{
+		`not JSON`,
+		`[{"stage": "Bogus"}]`,
+		`[{"stage": "First", "args": ["ten"]}]`,
+		`[{"stage": "Match"}]`,
+		`[{"stage": "MatchRegexp", "args": ["("]}]`,
+		`[{"stage": "Echo", "args": ["a"]}, {"stage": "File", "args": ["testdata/hello.txt"]}]`,
+	}
+	for _, spec := range specs {
+		p := script.FromSpec(strings.NewReader(spec))
+		if p.Error() == nil {
+			t.Errorf("%s: want error", spec)
+		}
+	}
+}
+
+func TestGetMakesHTTPGetRequestToGivenURL(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Fatalf("want HTTP method GET, got %q", r.Method)
+		}
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	want := "some data\n"
+	got, err := script.Get(ts.URL).String()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGet_RevalidatesCachedResponseWhenHTTPCacheEnabled(t *testing.T) {
+	t.Parallel()
+	var full, notModified int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full++
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	want := "some data\n"
+	for i := 0; i < 2; i++ {
+		got, err := script.NewPipe().WithHTTPCache(dir).Get(ts.URL).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+	if full != 1 || notModified != 1 {
+		t.Errorf("want 1 full response and 1 not-modified response, got %d and %d", full, notModified)
+	}
+}
+
+func TestGet_CachesResponsesSeparatelyForEachUserWhenHTTPCacheEnabled(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := r.Header.Get("Authorization")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		fmt.Fprintln(w, "secrets for", user)
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	for _, user := range []string{"alice", "bob", "alice"} {
+		got, err := script.NewPipe().WithHTTPCache(dir).WithHeader("Authorization", user).Get(ts.URL).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "secrets for " + user + "\n"
+		if !cmp.Equal(want, got) {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestGet_UsesCachedResponseOnlyForRequestsMatchingVaryHeader(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := r.Header.Get("Accept-Language")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprintln(w, "hello in", lang)
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	for _, lang := range []string{"en", "fr", "fr"} {
+		got, err := script.NewPipe().WithHTTPCache(dir).WithHeader("Accept-Language", lang).Get(ts.URL).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "hello in " + lang + "\n"
+		if !cmp.Equal(want, got) {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestGet_DoesNotCacheResponseWithoutValidators(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match")+r.Header.Get("If-Modified-Since") != "" {
+			t.Errorf("unexpected conditional request")
+		}
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		_, err := script.NewPipe().WithHTTPCache(dir).Get(ts.URL).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("want empty cache, got %d entries", len(entries))
+	}
+}
+
+func TestGetEach_FetchesEachURLAndProducesResponsesInInputOrder(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		fmt.Fprintln(w, r.URL.Path)
+	}))
+	defer ts.Close()
+	input := ts.URL + "/slow\n" + ts.URL + "/a\n" + ts.URL + "/b\n"
+	got, err := script.Echo(input).GetEach(3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/slow\n/a\n/b\n"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGetEach_ReportsFailedURLsAndContinues(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}))
+	defer ts.Close()
+	stderr := new(bytes.Buffer)
+	p := script.Echo(ts.URL + "/missing\n" + ts.URL + "/found\n").WithStderr(stderr).GetEach(2)
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ok\n" {
+		t.Errorf("want %q, got %q", "ok\n", got)
+	}
+	if !strings.Contains(stderr.String(), ts.URL+"/missing: unexpected HTTP response status: 404") {
+		t.Errorf("want failed URL reported, got %q", stderr)
+	}
+	sum, _ := p.Summary()
+	if sum.OK != 1 || sum.Failed != 1 {
+		t.Errorf("want 1 OK and 1 failed, got %+v", sum)
+	}
+}
+
+func TestGetEachTemplate_FetchesRenderedURLForEachLine(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, r.URL.Path, r.URL.Query().Get("q"))
+	}))
+	defer ts.Close()
+	got, err := script.Echo("alice\nbob smith\n").GetEachTemplate(ts.URL+"/users/{{len .}}?q={{urlquery .}}", 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/users/5 alice\n/users/9 bob smith\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGetEachTemplate_ErrorsOnInvalidTemplate(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").GetEachTemplate("{{.", 1)
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error with invalid URL template")
+	}
+}
+
+func TestResponseStatus_ReturnsStatusOfLastHTTPResponse(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	p := script.NewPipe()
+	if p.ResponseStatus() != 0 || p.ResponseHeader() != nil {
+		t.Errorf("want no response metadata before request, got %d %v", p.ResponseStatus(), p.ResponseHeader())
+	}
+	p = p.Get(ts.URL + "/missing")
+	p.Wait()
+	if got := p.ResponseStatus(); got != http.StatusNotFound {
+		t.Errorf("want status 404, got %d", got)
+	}
+	want := `attachment; filename="report.csv"`
+	if got := p.ResponseHeader().Get("Content-Disposition"); want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGetSetsErrorStatusWhenHTTPResponseStatusIsNotOK(t *testing.T) {
+	t.Parallel()
+	// With no handler, all requests will get 404
+	ts := httptest.NewServer(nil)
+	defer ts.Close()
+	p := script.Get(ts.URL)
+	p.Wait()
+	if p.Error() == nil {
+		t.Fatalf("want error for non-OK request, got nil")
+	}
+}
+
+func TestGetConsidersHTTPStatus201CreatedToBeOK(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	want := "some data\n"
+	got, err := script.Get(ts.URL).String()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGetUsesPipeContentsAsRequestBody(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := []byte("request data")
+		got, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal("reading request body", err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Fatalf(cmp.Diff(want, string(got)))
+		}
+	}))
+	defer ts.Close()
+	_, err := script.Echo("request data").Get(ts.URL).String()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestGzip_FollowedByGunzipRecoversOriginal(t *testing.T) {
+	t.Parallel()
+	want := strings.Repeat("hello, world\n", 1000)
+	compressed, err := script.Echo(want).Gzip().Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) >= len(want) {
+		t.Errorf("want compressed data smaller than %d bytes, got %d", len(want), len(compressed))
+	}
+	got, err := script.Echo(string(compressed)).Gunzip().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGunzip_DecompressesConcatenatedStreams(t *testing.T) {
+	t.Parallel()
+	first, err := script.Echo("first\n").Gzip().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := script.Echo("second\n").Gzip().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.Echo(first + second).Gunzip().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "first\nsecond\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestGunzip_SetsErrorGivenInvalidInput(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("not gzip data").Gunzip()
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error for invalid gzip data")
+	}
+}
+
+func TestJoinHandlesLongLines(t *testing.T) {
+	t.Parallel()
+	result, err := script.Echo(longLine).Join().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := len(longLine)
+	if want != len(result) {
+		t.Errorf("want result length %d, got %d", want, len(result))
+	}
+}
+
+func TestJoinJoinsInputLinesIntoSpaceSeparatedString(t *testing.T) {
+	t.Parallel()
+	input := "hello\nfrom\nthe\njoin\ntest"
+	want := "hello from the join test\n"
+	got, err := script.Echo(input).Join().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestJQWithDotQueryPrettyPrintsInput(t *testing.T) {
+	t.Parallel()
+	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
+	// Fields should be sorted by key, with whitespace removed
+	want := `{"iss_position":{"latitude":"10.8107","longitude":"52.8439"},"message":"success","timestamp":1649264191}` + "\n"
+	got, err := script.Echo(input).JQ(".").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(want, got)
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQWithFieldQueryProducesSelectedField(t *testing.T) {
+	t.Parallel()
+	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
+	want := `{"latitude":"10.8107","longitude":"52.8439"}` + "\n"
+	got, err := script.Echo(input).JQ(".iss_position").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(want, got)
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQWithArrayQueryProducesRequiredArray(t *testing.T) {
+	t.Parallel()
+	input := `{"timestamp": 1649264191, "iss_position": {"longitude": "52.8439", "latitude": "10.8107"}, "message": "success"}`
+	want := `["10.8107","52.8439"]` + "\n"
+	got, err := script.Echo(input).JQ("[.iss_position.latitude, .iss_position.longitude]").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(want, got)
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQWithArrayInputAndElementQueryProducesSelectedElement(t *testing.T) {
+	t.Parallel()
+	input := `[1, 2, 3]`
+	want := "1\n"
+	got, err := script.Echo(input).JQ(".[0]").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(want, got)
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQHandlesGithubJSONWithRealWorldExampleQuery(t *testing.T) {
+	t.Parallel()
+	want := `{"message":"restore sample log data (fixes #102)","name":"John Arundel"}` + "\n"
+	got, err := script.File("testdata/commits.json").
+		JQ(".[0] | {message: .commit.message, name: .commit.committer.name}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(want, got)
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQErrorsWithInvalidQuery(t *testing.T) {
+	t.Parallel()
+	input := `[1, 2, 3]`
+	_, err := script.Echo(input).JQ(".foo & .bar").String()
+	if err == nil {
+		t.Error("want error from invalid JQ query, got nil")
+	}
+}
+
+func TestJQEach_AppliesQueryToEachDocumentInNDJSONInput(t *testing.T) {
+	t.Parallel()
+	input := `{"level":"info","msg":"started"}
+{"level":"error","msg":"disk full"}
+{"level":"error","msg":"retrying"} {"level":"info","msg":"done"}
+`
+	want := "\"disk full\"\n\"retrying\"\n"
+	got, err := script.Echo(input).JQEach(`select(.level == "error") | .msg`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestJQEach_ErrorsWithInvalidDocument(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("{\"a\":1}\n{oops}\n").JQEach(".a").String()
+	if err == nil {
+		t.Error("want error from invalid JSON document, got nil")
+	}
+}
+
+func TestWithJQRawOutput_ProducesStringResultsWithoutQuotes(t *testing.T) {
+	t.Parallel()
+	input := `{"name":"a \"quoted\" name","tags":["x"],"n":1}`
+	want := "a \"quoted\" name\n[\"x\"]\n1\n"
+	got, err := script.Echo(input).WithJQRawOutput().JQ(".name, .tags, .n").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	got, err = script.Echo(input + "\n" + input).WithJQRawOutput().JQEach(".name").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "a \"quoted\" name\na \"quoted\" name\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestXMLToJSON_ConvertsElementsAttributesAndRepeatedChildren(t *testing.T) {
+	t.Parallel()
+	input := `<?xml version="1.0" encoding="UTF-8"?>
+<!-- a feed -->
+<feed xmlns="http://www.w3.org/2005/Atom" lang="en">
+  <title>News &amp; views</title>
+  <item id="1">One</item>
+  <item id="2"><![CDATA[<b>Two</b>]]></item>
+  <empty/>
+</feed>
+`
+	want := `{"feed":{"@lang":"en","empty":"","item":[{"#text":"One","@id":"1"},{"#text":"<b>Two</b>","@id":"2"}],"title":"News & views"}}` + "\n"
+	got, err := script.Echo(input).XMLToJSON().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestXMLToJSON_ErrorsWithInvalidXML(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("<a><b></a>").XMLToJSON().String()
+	if err == nil {
+		t.Error("want error from invalid XML, got nil")
+	}
+}
+
+func TestYQ_QueriesEachDocumentInYAMLInput(t *testing.T) {
+	t.Parallel()
+	input := `kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 3
+  containers:
+    - image: nginx:1.25
+---
+kind: Service
+metadata:
+  name: web
+  created: 2024-05-01T09:30:00Z
+`
+	want := "{\"images\":[\"nginx:1.25\"],\"kind\":\"Deployment\",\"replicas\":3}\n\"2024-05-01T09:30:00Z\"\n"
+	got, err := script.Echo(input).YQ(`if .kind == "Deployment" then {kind, replicas: .spec.replicas, images: [.spec.containers[].image]} else .metadata.created end`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestYQ_ErrorsWithInvalidYAML(t *testing.T) {
+	t.Parallel()
+	_, err := script.Echo("a: [1, 2\n").YQ(".a").String()
+	if err == nil {
+		t.Error("want error from invalid YAML, got nil")
+	}
+}
+
+func TestLastMatch_ProducesLastMatchingLineOnly(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a 1\nb 2\nc 3\nb 4\nd 5\n").LastMatch(regexp.MustCompile(`^b`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "b 4\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLastDropsAllButLastNLinesOfInput(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := "b\nc\n"
+	got, err := script.Echo(input).Last(2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLastHandlesLongLines(t *testing.T) {
+	t.Parallel()
+	want := "last line\n"
+	got, err := script.Echo(longLine).Last(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLastHasNoOutputWhenNIs0(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := ""
+	got, err := script.Echo(input).Last(0).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLastHasNoOutputWhenNIsNegative(t *testing.T) {
+	t.Parallel()
+	input := "a\nb\nc\n"
+	want := ""
+	got, err := script.Echo(input).Last(-1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestLastHasNoEffectGivenLessThanNInputLines(t *testing.T) {
 	t.Parallel()
 	input := "a\nb\nc\n"
 	want := "a\nb\nc\n"
@@ -872,121 +2549,2476 @@ func TestLastHasNoEffectGivenLessThanNInputLines(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMeasure_PassesInputThroughUnchangedAndRecordsStats(t *testing.T) {
+	t.Parallel()
+	want := "a\nbb\nccc"
+	stats := new(script.Stats)
+	got, err := script.Echo(want).Measure(stats).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	if stats.Bytes != int64(len(want)) {
+		t.Errorf("want %d bytes, got %d", len(want), stats.Bytes)
+	}
+	if stats.Lines != 2 {
+		t.Errorf("want 2 lines, got %d", stats.Lines)
+	}
+	if stats.Elapsed <= 0 {
+		t.Errorf("want positive elapsed time, got %v", stats.Elapsed)
+	}
+}
+
+func TestStats_StringSummarisesStats(t *testing.T) {
+	t.Parallel()
+	stats := &script.Stats{Bytes: 2000, Lines: 3, Elapsed: time.Second}
+	want := "3 lines, 2000 bytes in 1s (2.0 kB/s)"
+	got := stats.String()
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMeter_RecordsStageTotalsInPipeMetrics(t *testing.T) {
+	t.Parallel()
+	m := script.NewMetrics()
+	for i := 0; i < 2; i++ {
+		got, err := script.Echo("a\nb\nc\n").WithMetrics(m).Match("b").Meter(`say "b"`).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "b\n" {
+			t.Errorf("want input passed through unchanged, got %q", got)
+		}
+	}
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE script_stage_lines_total counter\n",
+		`script_stage_runs_total{stage="say \"b\""} 2` + "\n",
+		`script_stage_lines_total{stage="say \"b\""} 2` + "\n",
+		`script_stage_bytes_total{stage="say \"b\""} 4` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("want metrics to contain %q, got:\n%s", want, buf)
+		}
+	}
+}
+
+func TestMeter_UpdatesTotalsWhileStageIsRunning(t *testing.T) {
+	t.Parallel()
+	m := script.NewMetrics()
+	pr, pw := io.Pipe()
+	p := script.NewPipe().WithReader(pr).WithMetrics(m).Meter("live")
+	defer func() {
+		pw.Close()
+		p.Wait()
+	}()
+	if _, err := pw.Write([]byte("a\nb\n")); err != nil {
+		t.Fatal(err)
+	}
+	want := `script_stage_lines_total{stage="live"} 2` + "\n"
+	buf := new(bytes.Buffer)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		buf.Reset()
+		if _, err := m.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), want) {
+			return
+		}
+	}
+	t.Errorf("want metrics to contain %q before stage finishes, got:\n%s", want, buf)
+}
+
+func TestMeter_DoesNothingWithoutMetrics(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\n").Meter("echo").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a\n" {
+		t.Errorf("want input passed through unchanged, got %q", got)
+	}
+}
+
+func TestWithMetrics_CountsCommandExitStatuses(t *testing.T) {
+	t.Parallel()
+	m := script.NewMetrics()
+	script.NewPipe().WithMetrics(m).Exec("go version").Wait()
+	script.NewPipe().WithMetrics(m).Exec("go bogus").Wait()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	got := rec.Body.String()
+	for _, want := range []string{
+		`script_command_exits_total{command="go",status="0"} 1` + "\n",
+		`script_command_exits_total{command="go",status="2"} 1` + "\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("want metrics to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestMIMEType_DetectsMIMETypeOfPipeContents(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		input, want string
+	}{
+		{"", "text/plain; charset=utf-8"},
+		{"hello world", "text/plain; charset=utf-8"},
+		{"<html><body>hello</body></html>", "text/html; charset=utf-8"},
+		{"%PDF-1.4", "application/pdf"},
+		{"\x00\x01\x02\x03", "application/octet-stream"},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(tc.input).MIMEType()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%q: want %q, got %q", tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestMIMEType_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).MIMEType()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestMatchOutputsOnlyMatchingLinesOfInput(t *testing.T) {
+	t.Parallel()
+	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
+	tcs := []struct {
+		match, want string
+	}{
+		{
+			match: "line",
+			want:  "This is the first line in the file.\nThis is another line in the file.\n",
+		},
+		{
+			match: "another",
+			want:  "This is another line in the file.\n",
+		},
+		{
+			match: "definitely won't match any lines",
+			want:  "",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Match(tc.match).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestMatchOutputsNothingGivenEmptyInput(t *testing.T) {
+	t.Parallel()
+	got, err := script.NewPipe().Match("anything").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Error("want no output given empty input")
+	}
+}
+
+func TestMatchFuzzy_OutputsLinesContainingApproximateMatches(t *testing.T) {
+	t.Parallel()
+	input := "connection refused\nconection reset\nconnexion lost\nconnected\ntimeout\n"
+	want := "connection refused\nconection reset\nconnexion lost\n"
+	got, err := script.Echo(input).MatchFuzzy("connection", 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMatchFuzzy_WithZeroDistanceMatchesExactly(t *testing.T) {
+	t.Parallel()
+	want := "web-01 up\n"
+	got, err := script.Echo("web-01 up\nweb-02 up\nweb01 up\n").MatchFuzzy("web-01", 0).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMatchInFiles_OutputsMatchingLinesOfEachFileInOrderWithPathAndLineNumber(t *testing.T) {
+	t.Parallel()
+	input := "testdata/test.txt\ntestdata/doesntexist.txt\ntestdata/hello.txt\ntestdata/test.txt\n"
+	want := "testdata/test.txt:1:This is the first line in the file.\n" +
+		"testdata/test.txt:3:This is another line in the file.\n" +
+		"testdata/test.txt:1:This is the first line in the file.\n" +
+		"testdata/test.txt:3:This is another line in the file.\n"
+	got, err := script.Echo(input).MatchInFiles("line").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMatchInFiles_OutputsNothingGivenEmptyInput(t *testing.T) {
+	t.Parallel()
+	got, err := script.NewPipe().MatchInFiles("line").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestMatchInFiles_PreservesOrderOfInputPaths(t *testing.T) {
+	t.Parallel()
+	paths := make([]string, 200)
+	want := make([]string, 200)
+	for i := range paths {
+		if i%2 == 0 {
+			paths[i] = "testdata/test.txt"
+			want[i] = "testdata/test.txt:2:Hello, world."
+		} else {
+			paths[i] = "testdata/hello.txt"
+			want[i] = "testdata/hello.txt:1:hello world"
+		}
+	}
+	got, err := script.Slice(paths).MatchInFiles("ello").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMatchInFiles_ProducesAllResultsWhenUnordered(t *testing.T) {
+	t.Parallel()
+	paths := make([]string, 200)
+	for i := range paths {
+		paths[i] = "testdata/test.txt"
+	}
+	got, err := script.Slice(paths).Unordered().MatchInFiles("Hello").CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != len(paths) {
+		t.Errorf("want %d results, got %d", len(paths), got)
+	}
+}
+
+func TestMatchRegexpInFiles_OutputsLinesMatchingRegexpWithPathAndLineNumber(t *testing.T) {
+	t.Parallel()
+	want := "testdata/test.txt:2:Hello, world.\ntestdata/hello.txt:1:hello world\n"
+	got, err := script.Echo("testdata/test.txt\ntestdata/hello.txt\n").MatchRegexpInFiles(regexp.MustCompile(`(?i)hello`)).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestMatchRegexp_OutputsOnlyLinesMatchingRegexp(t *testing.T) {
+	t.Parallel()
+	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
+	tcs := []struct {
+		regex, want string
+	}{
+		{
+			regex: `Hello|file`,
+			want:  "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n",
+		},
+		{
+			regex: `an.ther`,
+			want:  "This is another line in the file.\n",
+		},
+		{
+			regex: `r[a-z]*s`,
+			want:  "This is the first line in the file.\n",
+		},
+		{
+			regex: `r[a-z]+s`,
+			want:  "",
+		},
+		{
+			regex: `bogus$`,
+			want:  "",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).MatchRegexp(regexp.MustCompile(tc.regex)).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestReplaceReplacesMatchesWithSpecifiedText(t *testing.T) {
+	t.Parallel()
+	input := "hello world"
+	tcs := []struct {
+		search, replace, want string
+	}{
+		{
+			search:  "hello",
+			replace: "bye",
+			want:    "bye world\n",
+		},
+		{
+			search:  "Does not exist in input",
+			replace: "Will not appear in output",
+			want:    "hello world\n",
+		},
+		{
+			search:  " world",
+			replace: " string with newline\n",
+			want:    "hello string with newline\n\n",
+		},
+		{
+			search:  "hello",
+			replace: "Ж9",
+			want:    "Ж9 world\n",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Replace(tc.search, tc.replace).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestReplaceRegexpTemplate_RendersTemplateForEachMatch(t *testing.T) {
+	t.Parallel()
+	re := regexp.MustCompile(`^(.*?)(\d+)$`)
+	tpl := `{{.LineNumber}}: {{index .Groups 1}}{{printf "%04s" (index .Groups 2)}}`
+	got, err := script.Echo("file7\nno digits\nfile123\n").ReplaceRegexpTemplate(re, tpl).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1: file0007\nno digits\n3: file0123\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestReplaceRegexpTemplate_ProvidesNamedGroupsAndHandlesMultipleMatches(t *testing.T) {
+	t.Parallel()
+	re := regexp.MustCompile(`(?P<key>\w+)=(?P<value>\w+)`)
+	tpl := `{{.Named.value}}<-{{.Named.key}}`
+	got, err := script.Echo("a=1, b=2\n").ReplaceRegexpTemplate(re, tpl).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1<-a, 2<-b\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestReplaceRegexpTemplate_ErrorsOnInvalidTemplate(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("a\n").ReplaceRegexpTemplate(regexp.MustCompile(`a`), "{{invalid template syntax}}")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error with invalid template syntax")
+	}
+}
+
+func TestReplaceRegexp_ReplacesMatchesWithSpecifiedText(t *testing.T) {
+	t.Parallel()
+	input := "hello world"
+	tcs := []struct {
+		regex, replace, want string
+	}{
+		{
+			regex:   "hel+o",
+			replace: "bye",
+			want:    "bye world\n",
+		},
+		{
+			regex:   "Does not .* in input",
+			replace: "Will not appear in output",
+			want:    "hello world\n",
+		},
+		{
+			regex:   "^([a-z]+) ([a-z]+)",
+			replace: "$1 cruel $2",
+			want:    "hello cruel world\n",
+		},
+		{
+			regex:   "hello{1}",
+			replace: "Ж9",
+			want:    "Ж9 world\n",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).ReplaceRegexp(regexp.MustCompile(tc.regex), tc.replace).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestRejectDropsMatchingLinesFromInput(t *testing.T) {
+	t.Parallel()
+	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
+	tcs := []struct {
+		reject, want string
+	}{
+		{
+			reject: "line",
+			want:   "Hello, world.\n",
+		},
+		{
+			reject: "another",
+			want:   "This is the first line in the file.\nHello, world.\n",
+		},
+		{
+			reject: "definitely won't match any lines",
+			want:   "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).Reject(tc.reject).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestNewPooledPipe_ReturnsUsablePipe(t *testing.T) {
+	t.Parallel()
+	want := "hello\n"
+	p := script.NewPooledPipe()
+	got, err := p.Echo("hello\nworld\n").Match("hello").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	p.Release()
+}
+
+func TestRelease_ResetsPipeForReuse(t *testing.T) {
+	t.Parallel()
+	p := script.NewPooledPipe()
+	p.Echo("hello").WithError(errors.New("oh no"))
+	p.Release()
+	if p.Error() != nil {
+		t.Errorf("want no error after release, got %v", p.Error())
+	}
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want empty pipe after release, got %q", got)
+	}
+}
+
+func TestParseDuration_AcceptsDaysAndWeeksAsWellAsStandardUnits(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		input string
+		want  time.Duration
+	}{
+		{input: "0", want: 0},
+		{input: "90s", want: 90 * time.Second},
+		{input: "1h30m", want: 90 * time.Minute},
+		{input: "2d3h", want: 51 * time.Hour},
+		{input: "1.5d", want: 36 * time.Hour},
+		{input: "1w", want: 7 * 24 * time.Hour},
+		{input: "-1d12h", want: -36 * time.Hour},
+		{input: "250ms", want: 250 * time.Millisecond},
+	}
+	for _, tc := range tcs {
+		got, err := script.ParseDuration(tc.input)
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if tc.want != got {
+			t.Errorf("%q: want %s, got %s", tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestParseDuration_ErrorsOnInvalidInput(t *testing.T) {
+	t.Parallel()
+	for _, input := range []string{"", "5", "d", "2x", "1d2", "-"} {
+		_, err := script.ParseDuration(input)
+		if err == nil {
+			t.Errorf("%q: want error", input)
+		}
+	}
+}
+
+func TestParseSize_AcceptsSIAndIECUnits(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		input string
+		want  int64
+	}{
+		{input: "512", want: 512},
+		{input: "512B", want: 512},
+		{input: "1kB", want: 1000},
+		{input: "1KiB", want: 1024},
+		{input: "64k", want: 64 * 1024},
+		{input: "200 MB", want: 200_000_000},
+		{input: "1.5GiB", want: 1536 * 1024 * 1024},
+		{input: "2g", want: 2 << 30},
+		{input: "1TB", want: 1_000_000_000_000},
+	}
+	for _, tc := range tcs {
+		got, err := script.ParseSize(tc.input)
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if tc.want != got {
+			t.Errorf("%q: want %d, got %d", tc.input, tc.want, got)
+		}
+	}
+}
+
+func TestParseSize_ErrorsOnInvalidInput(t *testing.T) {
+	t.Parallel()
+	for _, input := range []string{"", "MB", "-1k", "1XB", "1 kilobyte", "99999PiB"} {
+		_, err := script.ParseSize(input)
+		if err == nil {
+			t.Errorf("%q: want error", input)
+		}
+	}
+}
+
+func TestParseRegexp_ConvertsMatchingLinesToJSONUsingNamedGroups(t *testing.T) {
+	t.Parallel()
+	re := regexp.MustCompile(`^(?P<level>[A-Z]+) (\d+) (?P<msg>.*?)(?: \((?P<code>\d+)\))?$`)
+	input := "INFO 1 started\nnot a log line\nERROR 2 \"disk\" full (28)\n"
+	got, err := script.Echo(input).ParseRegexp(re).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"level":"INFO","msg":"started","code":""}` + "\n" +
+		`{"level":"ERROR","msg":"\"disk\" full","code":"28"}` + "\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestParseRegexp_WritesNonMatchingLinesToRejects(t *testing.T) {
+	t.Parallel()
+	re := regexp.MustCompile(`^(?P<level>[A-Z]+) (?P<msg>.*)$`)
+	rejects := new(bytes.Buffer)
+	got, err := script.Echo("INFO started\nnot a log line\n").WithRejects(rejects).ParseRegexp(re).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"level":"INFO","msg":"started"}` + "\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	wantRejects := "line 2: doesn't match ^(?P<level>[A-Z]+) (?P<msg>.*)$\tnot a log line\n"
+	if wantRejects != rejects.String() {
+		t.Error(cmp.Diff(wantRejects, rejects.String()))
+	}
+}
+
+func TestPostPostsToGivenURLUsingPipeAsRequestBody(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("want HTTP method POST, got %q", r.Method)
+		}
+		want := []byte("request data")
+		got, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal("reading request body", err)
+		}
+		if !cmp.Equal(want, got) {
+			t.Fatal(cmp.Diff(want, string(got)))
+		}
+		fmt.Fprintln(w, "response data")
+	}))
+	defer ts.Close()
+	want := "response data\n"
+	got, err := script.Echo("request data").Post(ts.URL).String()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestPutPatchDelete_UsePipeAsRequestBodyWithMatchingMethod(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error("reading request body", err)
+		}
+		fmt.Fprintf(w, "%s %s\n", r.Method, body)
+	}))
+	defer ts.Close()
+	tcs := []struct {
+		method string
+		send   func(p *script.Pipe, url string) *script.Pipe
+	}{
+		{method: http.MethodPut, send: (*script.Pipe).Put},
+		{method: http.MethodPatch, send: (*script.Pipe).Patch},
+		{method: http.MethodDelete, send: (*script.Pipe).Delete},
+	}
+	for _, tc := range tcs {
+		got, err := tc.send(script.Echo("request data"), ts.URL).String()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.method, err)
+		}
+		want := tc.method + " request data\n"
+		if want != got {
+			t.Error(cmp.Diff(want, got))
+		}
+	}
+}
+
+func TestRejectRegexp_DropsMatchingLinesFromInput(t *testing.T) {
+	t.Parallel()
+	input := "hello world"
+	tcs := []struct {
+		regex, want string
+	}{
+		{
+			regex: `Hello|line`,
+			want:  "hello world\n",
+		},
+		{
+			regex: `hello|bogus`,
+			want:  "",
+		},
+		{
+			regex: `w.*d`,
+			want:  "",
+		},
+		{
+			regex: "wontmatch",
+			want:  "hello world\n",
+		},
+	}
+	for _, tc := range tcs {
+		got, err := script.Echo(input).RejectRegexp(regexp.MustCompile(tc.regex)).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Error(cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestRetry_ReplaysInputUntilStageSucceeds(t *testing.T) {
+	t.Parallel()
+	attempts := 0
+	got, err := script.Echo("hello\n").Retry(3, time.Millisecond).Filter(func(r io.Reader, w io.Writer) error {
+		attempts++
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "attempt %d: %s", attempts, data)
+		if attempts < 3 {
+			return errors.New("oh no")
+		}
+		return nil
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "attempt 3: hello\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestRetry_SetsLastErrorWhenAllAttemptsFail(t *testing.T) {
+	t.Parallel()
+	attempts := 0
+	p := script.Echo("hello\n").Retry(2, time.Millisecond).Filter(func(r io.Reader, w io.Writer) error {
+		attempts++
+		return fmt.Errorf("failure %d", attempts)
+	})
+	p.Wait()
+	if p.Error() == nil || p.Error().Error() != "failure 2" {
+		t.Errorf("want last error %q, got %v", "failure 2", p.Error())
+	}
+}
+
+func TestRetry_AppliesOnlyToNextStage(t *testing.T) {
+	t.Parallel()
+	attempts := 0
+	p := script.Echo("hello\n").Retry(3, time.Millisecond).FilterLine(strings.ToUpper).Filter(func(r io.Reader, w io.Writer) error {
+		attempts++
+		return errors.New("oh no")
+	})
+	p.Wait()
+	if attempts != 1 {
+		t.Errorf("want 1 attempt at later stage, got %d", attempts)
+	}
+}
+
+func TestSkip_SkipsSpecifiedNumberOfBytesOfFile(t *testing.T) {
+	t.Parallel()
+	want := "Hello, world.\nThis is another line in the file.\n"
+	got, err := script.File("testdata/test.txt").Skip(36).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSkip_SkipsSpecifiedNumberOfBytesOfNonSeekableInput(t *testing.T) {
+	t.Parallel()
+	want := "world\n"
+	got, err := script.Echo("hello world\n").Skip(6).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSkip_SkipsSpecifiedNumberOfBytesOfFileThatCannotSeek(t *testing.T) {
+	t.Parallel()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write([]byte("hello world\n"))
+		w.Close()
+	}()
+	got, err := script.NewPipe().WithReader(r).Skip(6).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "world\n"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSkip_ProducesNoOutputWhenNIsBeyondEndOfInput(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello").Skip(100).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestSkip_ErrorsOnNegativeN(t *testing.T) {
+	t.Parallel()
+	p := script.Echo("hello").Skip(-1)
+	if p.Error() == nil {
+		t.Error("want error for negative skip count, got nil")
+	}
+}
+
+func TestSleep_PausesBetweenLinesAndPassesThemThrough(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	got, err := script.Echo("a\nb\nc\n").Sleep(50 * time.Millisecond).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a\nb\nc\n" {
+		t.Errorf("want input unchanged, got %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("want at least 100ms pause in total, got %s", elapsed)
+	}
+}
+
+func TestSleepJitter_PausesForDurationWithinRange(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	_, err := script.Echo("a\nb\nc\n").SleepJitter(100*time.Millisecond, 20*time.Millisecond).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 40*time.Millisecond || elapsed > time.Second {
+		t.Errorf("want total pause between 40ms and 1s, got %s", elapsed)
+	}
+}
+
+func TestSHA256Sums_OutputsCorrectHashForEachSpecifiedFile(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		testFileName string
+		want         string
+	}{
+		// To get the checksum run: openssl dgst -sha256 <file_name>
+		{"testdata/hashSum.input.txt", "1870478d23b0b4db37735d917f4f0ff9393dd3e52d8b0efa852ab85536ddad8e\n"},
+		{"testdata/hello.txt", "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\n"},
+		{"testdata/multiple_files", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n"},
+	}
+	for _, tc := range tcs {
+		got, err := script.ListFiles(tc.testFileName).SHA256Sums().String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: want %q, got %q", tc.testFileName, tc.want, got)
+		}
+	}
+}
+
+func TestStep_ShowsTickAndDurationWhenPipeSucceeds(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	err := script.Step("Saying hello", script.Echo("hello\n").WithStdout(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := regexp.MustCompile(`^✓ Saying hello \(\S+\)\n$`)
+	if !want.MatchString(buf.String()) {
+		t.Errorf("want match for %q, got %q", want, buf.String())
+	}
+}
+
+func TestStep_ShowsCrossAndErrorWhenPipeFails(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	err := script.Step("Failing", script.NewPipe().WithStdout(buf).WithError(errors.New("oh no")))
+	if err == nil {
+		t.Fatal("want error from failed pipe")
+	}
+	want := regexp.MustCompile(`^✗ Failing \(\S+\): oh no\n$`)
+	if !want.MatchString(buf.String()) {
+		t.Errorf("want match for %q, got %q", want, buf.String())
+	}
+}
+
+func TestSync_CopiesNewAndChangedFilesAndReportsThem(t *testing.T) {
+	t.Parallel()
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "same.txt"), "same")
+	writeTestFile(t, filepath.Join(src, "sub", "new.txt"), "new")
+	writeTestFile(t, filepath.Join(src, "changed.txt"), "new contents")
+	_, err := script.Sync(src, dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dst, "changed.txt"), "old")
+	os.Remove(filepath.Join(dst, "sub", "new.txt"))
+	got, err := script.Sync(src, dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "changed changed.txt\nnew " + filepath.Join("sub", "new.txt") + "\n"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "changed.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new contents" {
+		t.Errorf("want changed file updated, got %q", data)
+	}
+}
+
+func TestSync_WithSyncDeleteRemovesExtraneousFiles(t *testing.T) {
+	t.Parallel()
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "keep.txt"), "keep")
+	writeTestFile(t, filepath.Join(dst, "extra.txt"), "extra")
+	writeTestFile(t, filepath.Join(dst, "olddir", "file.txt"), "extra")
+	got, err := script.Sync(src, dst, script.SyncDelete).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "new keep.txt\ndeleted extra.txt\ndeleted olddir\n"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+	_, err = os.Stat(filepath.Join(dst, "olddir"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want olddir removed, got %v", err)
+	}
+}
+
+func TestSync_WithSyncChecksumSkipsFilesWithSameContents(t *testing.T) {
+	t.Parallel()
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(src, "a.txt"), "same")
+	writeTestFile(t, filepath.Join(dst, "a.txt"), "same")
+	writeTestFile(t, filepath.Join(src, "b.txt"), "ours")
+	writeTestFile(t, filepath.Join(dst, "b.txt"), "them")
+	got, err := script.Sync(src, dst, script.SyncChecksum).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "changed b.txt\n"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+// writeTestFile writes data to path, creating any parent directories.
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, []byte(data), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTailFile_ProducesLastNLinesOfFile(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		n    int
+		want string
+	}{
+		{-1, ""},
+		{0, ""},
+		{1, "This is another line in the file.\n"},
+		{2, "Hello, world.\nThis is another line in the file.\n"},
+		{3, "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"},
+		{10, "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"},
+	}
+	for _, tc := range tcs {
+		got, err := script.TailFile("testdata/test.txt", tc.n).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%d lines: want %q, got %q", tc.n, tc.want, got)
+		}
+	}
+}
+
+func TestTailFile_HandlesFileLargerThanReadBuffer(t *testing.T) {
+	t.Parallel()
+	path := t.TempDir() + "/long.txt"
+	_, err := script.Echo(longLine + "one\ntwo\nthree").WriteFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "last line\none\ntwo\nthree"
+	got, err := script.TailFile(path, 4).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	got, err = script.TailFile(path, 5).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, want) || len(got) != len(longLine)+len("one\ntwo\nthree") {
+		t.Errorf("want whole file, got %d bytes", len(got))
+	}
+}
+
+func TestTailFile_ErrorsOnNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.TailFile("doesntexist", 1)
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+}
+
+func TestTarget_BuildsOnlyWhenTargetIsMissingOrOutOfDate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.txt"), filepath.Join(dir, "dst.txt")
+	err := os.WriteFile(src, []byte("hello"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builds := 0
+	build := func(srcs *script.Pipe) error {
+		builds++
+		_, err := srcs.Concat().WriteFile(dst)
+		return err
+	}
+	err = script.Target(dst, script.Echo(src), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 {
+		t.Fatalf("missing target: want 1 build, got %d", builds)
+	}
+	err = script.Target(dst, script.Echo(src), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 {
+		t.Fatalf("up-to-date target: want no more builds, got %d", builds)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(src, later, later)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = script.Target(dst, script.Echo(src), build)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if builds != 2 {
+		t.Fatalf("out-of-date target: want 2 builds, got %d", builds)
+	}
+	got, err := script.File(dst).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("want %q, got %q", "hello", got)
+	}
+}
+
+func TestTarget_ReturnsErrorFromBuild(t *testing.T) {
+	t.Parallel()
+	dst := filepath.Join(t.TempDir(), "dst.txt")
+	err := script.Target(dst, script.Echo("testdata/hello.txt"), func(*script.Pipe) error {
+		return errors.New("oh no")
+	})
+	if err == nil {
+		t.Error("want error from build, got nil")
+	}
+}
+
+func TestTarget_ErrorsWithoutBuildingWhenSourceDoesNotExist(t *testing.T) {
+	t.Parallel()
+	dst := filepath.Join(t.TempDir(), "dst.txt")
+	err := script.Target(dst, script.Echo("doesntexist"), func(*script.Pipe) error {
+		t.Error("build called unexpectedly")
+		return nil
+	})
+	if err == nil {
+		t.Error("want error for nonexistent source, got nil")
+	}
+}
+
+func TestTeeUsesConfiguredStdoutAsDefault(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	_, err := script.Echo("hello").WithStdout(buf).Tee().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello"
+	got := buf.String()
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestTeeWritesDataToSuppliedWritersAsWellAsToPipe(t *testing.T) {
+	t.Parallel()
+	buf1, buf2 := new(bytes.Buffer), new(bytes.Buffer)
+	got, err := script.Echo("hello world").Tee(buf1, buf2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello world"
+	if want != got {
+		t.Errorf("want %q on pipe, got %q", want, got)
+	}
+	if want != buf1.String() {
+		t.Errorf("want %q on writer 1, got %q", want, buf1.String())
+	}
+	if want != buf2.String() {
+		t.Errorf("want %q on writer 2, got %q", want, buf2.String())
+	}
+}
+
+func TestExecErrorsWhenTheSpecifiedCommandDoesNotExist(t *testing.T) {
+	t.Parallel()
+	p := script.Exec("doesntexist")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error running non-existent command")
+	}
+}
+
+func TestExecRunsGoWithNoArgsAndGetsUsageMessagePlusErrorExitStatus2(t *testing.T) {
+	t.Parallel()
+	// We can't make many cross-platform assumptions about what external
+	// commands will be available, but it seems logical that 'go' would be
+	// (though it may not be in the user's path)
+	p := script.Exec("go")
+	output, err := p.String()
+	if err == nil {
+		t.Fatal("want error when command returns a non-zero exit status")
+	}
+	if !strings.Contains(output, "Usage") {
+		t.Fatalf("want output containing the word 'Usage', got %q", output)
+	}
+	want := 2
+	got := p.ExitStatus()
+	if want != got {
+		t.Errorf("want exit status %d, got %d", want, got)
+	}
+}
+
+func TestExec_SetsExecErrorWithExitCodeAndStderrWhenCommandFails(t *testing.T) {
+	t.Parallel()
+	p := script.Exec("go bogus").WithStderr(io.Discard)
+	p.Wait()
+	var execErr *script.ExecError
+	if !errors.As(p.Error(), &execErr) {
+		t.Fatalf("want *script.ExecError, got %#v", p.Error())
+	}
+	if execErr.Cmd != "go bogus" {
+		t.Errorf("want command %q, got %q", "go bogus", execErr.Cmd)
+	}
+	if execErr.ExitCode != 2 {
+		t.Errorf("want exit code 2, got %d", execErr.ExitCode)
+	}
+	if !strings.Contains(execErr.Stderr, "unknown command") {
+		t.Errorf("want stderr output captured, got %q", execErr.Stderr)
+	}
+	if p.ExitStatus() != 2 {
+		t.Errorf("want exit status 2, got %d", p.ExitStatus())
+	}
+}
+
+func TestExec_SetsExecErrorWrappingErrNotFoundWhenCommandDoesNotExist(t *testing.T) {
+	t.Parallel()
+	p := script.Exec("doesntexist")
+	p.Wait()
+	var execErr *script.ExecError
+	if !errors.As(p.Error(), &execErr) {
+		t.Fatalf("want *script.ExecError, got %#v", p.Error())
+	}
+	if execErr.ExitCode != -1 {
+		t.Errorf("want exit code -1, got %d", execErr.ExitCode)
+	}
+	if !errors.Is(p.Error(), exec.ErrNotFound) {
+		t.Errorf("want error wrapping exec.ErrNotFound, got %v", p.Error())
+	}
+}
+
+func TestExecRunsGoHelpAndGetsUsageMessage(t *testing.T) {
+	t.Parallel()
+	p := script.Exec("go help")
+	if p.Error() != nil {
+		t.Fatal(p.Error())
+	}
+	output, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "Usage") {
+		t.Fatalf("want output containing the word 'Usage', got %q", output)
+	}
+}
+
+func TestFileOutputsContentsOfSpecifiedFile(t *testing.T) {
+	t.Parallel()
+	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
+	got, err := script.File("testdata/test.txt").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFileErrorsOnNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.File("doesntexist")
+	if p.Error() == nil {
+		t.Error("want error for non-existent file")
+	}
+}
+
+func TestFileMmap_OutputsContentsOfSpecifiedFile(t *testing.T) {
+	t.Parallel()
+	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
+	got, err := script.FileMmap("testdata/test.txt").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFileMmap_OutputsNothingForEmptyFile(t *testing.T) {
+	t.Parallel()
+	got, err := script.FileMmap("testdata/empty.txt").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestFileMmap_CanBeFilteredAndSkipped(t *testing.T) {
+	t.Parallel()
+	want := "Hello, world.\n"
+	got, err := script.FileMmap("testdata/test.txt").Skip(36).First(1).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFileMmap_CanBeClosedByStageTimeoutWhileBeingRead(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "big")
+	writeTestFile(t, path, strings.Repeat("x", 10<<20))
+	p := script.FileMmap(path).StageTimeout(10 * time.Millisecond).Filter(func(r io.Reader, w io.Writer) error {
+		buf := make([]byte, 1)
+		for {
+			_, err := r.Read(buf)
+			if err != nil {
+				return nil
+			}
+		}
+	})
+	err := p.Wait()
+	if err == nil {
+		t.Error("want timeout error, got nil")
+	}
+}
+
+func TestFileMmap_ErrorsOnNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.FileMmap("doesntexist")
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+}
+
+func TestFileRange_ProducesSpecifiedRangeOfFile(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, -1, "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"},
+		{0, 4, "This"},
+		{8, 9, "the first"},
+		{36, 0, ""},
+		{-9, -1, "he file.\n"},
+		{-9, 3, "he "},
+		{-1000, 4, "This"},
+		{1000, -1, ""},
+	}
+	for _, tc := range tcs {
+		got, err := script.FileRange("testdata/test.txt", tc.offset, tc.length).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("offset %d, length %d: want %q, got %q", tc.offset, tc.length, tc.want, got)
+		}
+	}
+}
+
+func TestFileRange_ErrorsOnNonexistentFile(t *testing.T) {
+	t.Parallel()
+	p := script.FileRange("doesntexist", 0, -1)
+	if p.Error() == nil {
+		t.Error("want error for nonexistent file, got nil")
+	}
+}
+
+func TestFindDirs_ListsDirectoriesRecursively(t *testing.T) {
+	t.Parallel()
+	want := []string{
+		"testdata/multiple_files_with_subdirectory",
+		filepath.Join("testdata/multiple_files_with_subdirectory", "dir"),
+	}
+	got, err := script.FindDirs("testdata/multiple_files_with_subdirectory").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFindDirs_InNonexistentPathReturnsError(t *testing.T) {
+	t.Parallel()
+	p := script.FindDirs("nonexistent_path")
+	if p.Error() == nil {
+		t.Fatal("want error for nonexistent path")
+	}
+}
+
+func TestFindDuplicates_OutputsGroupsOfIdenticalFiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	files := []struct {
+		name, content string
+	}{
+		{"a1", "apple"},
+		{"b1", "bread"},
+		{"unique", "unique content"},
+		{"a2", "apple"},
+		{"c1", "cheese"},
+		{"b2", "bread"},
+		{"a3", "apple"},
+		{"samesize", "apply"},
+	}
+	var input []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		err := os.WriteFile(path, []byte(f.content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input = append(input, path)
+	}
+	input = append(input, filepath.Join(dir, "doesntexist"), filepath.Join(dir, "a1"))
+	want := []string{
+		filepath.Join(dir, "a1"),
+		filepath.Join(dir, "a2"),
+		filepath.Join(dir, "a3"),
+		"",
+		filepath.Join(dir, "b1"),
+		filepath.Join(dir, "b2"),
+	}
+	got, err := script.Slice(input).FindDuplicates().Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestFindDuplicates_OutputsNothingWhenNoFilesAreIdentical(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("testdata/test.txt\ntestdata/hello.txt\n").FindDuplicates().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestFindFiles_ReturnsListOfFiles(t *testing.T) {
+	t.Parallel()
+	p := script.FindFiles("testdata/multiple_files")
+	if p.Error() != nil {
+		t.Fatal(p.Error())
+	}
+	p.SetError(nil) // else p.String() would be a no-op
+	// Expect result to use this platform's path separator
+	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestFindFiles_RecursesIntoSubdirectories(t *testing.T) {
+	t.Parallel()
+	p := script.FindFiles("testdata/multiple_files_with_subdirectory")
+	if p.Error() != nil {
+		t.Fatal(p.Error())
+	}
+	p.SetError(nil) // else p.String() would be a no-op
+	// Expect result to use this platform's path separator
+	want := filepath.Clean("testdata/multiple_files_with_subdirectory/1.txt\ntestdata/multiple_files_with_subdirectory/2.txt\ntestdata/multiple_files_with_subdirectory/3.tar.zip\ntestdata/multiple_files_with_subdirectory/dir/.hidden\ntestdata/multiple_files_with_subdirectory/dir/1.txt\ntestdata/multiple_files_with_subdirectory/dir/2.txt\n")
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+}
+
+func TestFindFiles_InNonexistentPathReturnsError(t *testing.T) {
+	t.Parallel()
+	p := script.FindFiles("nonexistent_path")
+	if p.Error() == nil {
+		t.Fatal("want error for nonexistent path")
+	}
+}
+
+func TestFindFilesJSON_DescribesEachFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "hello.txt")
+	writeTestFile(t, path, "hello")
+	mtime := time.Date(2024, 5, 1, 9, 30, 0, 0, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []bool{false, true} {
+		lines, err := script.FindFilesJSON(dir, hash).Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) != 1 {
+			t.Fatalf("want 1 record, got %q", lines)
+		}
+		var got struct {
+			Path   string    `json:"path"`
+			Size   int64     `json:"size"`
+			Mode   string    `json:"mode"`
+			MTime  time.Time `json:"mtime"`
+			SHA256 string    `json:"sha256"`
+		}
+		if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Path != path || got.Size != 5 || got.Mode != info.Mode().String() || !got.MTime.Equal(mtime) {
+			t.Errorf("wrong record: %s", lines[0])
+		}
+		wantHash := ""
+		if hash {
+			wantHash = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+		}
+		if got.SHA256 != wantHash {
+			t.Errorf("want hash %q, got %q", wantHash, got.SHA256)
+		}
+	}
+}
+
+func TestHandler_StreamsPipeOutputAsResponse(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(script.Handler(func(r *http.Request) *script.Pipe {
+		return script.Echo("a\nb\nc\n").Match(r.URL.Query().Get("q"))
+	}))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "?q=b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want status 200, got %d", resp.StatusCode)
+	}
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "b\n" {
+		t.Errorf("want %q, got %q", "b\n", got)
+	}
+}
+
+func TestHandler_RespondsWithErrorStatusWhenPipeFailsBeforeOutput(t *testing.T) {
+	t.Parallel()
+	tcs := []struct {
+		p    *script.Pipe
+		want int
+	}{
+		{script.File("doesntexist"), http.StatusNotFound},
+		{script.NewPipe().WithError(errors.New("oh no")), http.StatusInternalServerError},
+		{script.NewPipe().WithError(context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{script.Echo("x").Gunzip(), http.StatusInternalServerError},
+		{script.NewPipe().WithStderr(io.Discard).Exec("go bogus"), http.StatusInternalServerError},
+	}
+	for _, tc := range tcs {
+		p := tc.p
+		ts := httptest.NewServer(script.Handler(func(*http.Request) *script.Pipe {
+			return p
+		}))
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		ts.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%v: want status %d, got %d", p.Error(), tc.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestIfExists_ProducesErrorPlusNoOutputForNonexistentFile(t *testing.T) {
+	t.Parallel()
+	want := ""
+	got, err := script.IfExists("testdata/doesntexist").Echo("hello").String()
+	if err == nil {
+		t.Fatal("want error")
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestIfExists_ProducesOutputAndNoErrorWhenFileExists(t *testing.T) {
+	t.Parallel()
+	want := "hello"
+	got, err := script.IfExists("testdata/empty.txt").Echo("hello").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestListFiles_OutputsDirectoryContentsGivenDirectoryPath(t *testing.T) {
+	t.Parallel()
+	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n")
+	got, err := script.ListFiles("testdata/multiple_files").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestListFiles_ErrorsOnNonexistentPath(t *testing.T) {
+	t.Parallel()
+	p := script.ListFiles("nonexistentpath")
+	if p.Error() == nil {
+		t.Error("want error status on listing non-existent path, but got nil")
+	}
+}
+
+func TestListFiles_OutputsSingleFileGivenFilePath(t *testing.T) {
+	t.Parallel()
+	got, err := script.ListFiles("testdata/multiple_files/1.txt").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "testdata/multiple_files/1.txt"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestListFiles_OutputsAllFilesMatchingSpecifiedGlobExpression(t *testing.T) {
+	t.Parallel()
+	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\n")
+	got, err := script.ListFiles("testdata/multi?le_files/*.txt").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestReadAutoCloser_WriteToCopiesAllDataFromSourceAndClosesIt(t *testing.T) {
+	t.Parallel()
+	want := "hello world"
+	input, err := os.Open("testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acr := script.NewReadAutoCloser(input)
+	buf := new(bytes.Buffer)
+	_, err = acr.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != buf.String() {
+		t.Fatal(cmp.Diff(want, buf.String()))
+	}
+	_, err = io.ReadAll(acr)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+func TestReadAutoCloser_ReadsAllDataFromSourceAndClosesItAutomatically(t *testing.T) {
+	t.Parallel()
+	want := []byte("hello world")
+	input, err := os.Open("testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acr := script.NewReadAutoCloser(input)
+	got, err := io.ReadAll(acr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Fatal(cmp.Diff(want, got))
+	}
+	_, err = io.ReadAll(acr)
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+func TestSort_SortsLinesLexically(t *testing.T) {
+	t.Parallel()
+	input := "pear\napple\nBanana\n10\n9\n"
+	tcs := []struct {
+		name string
+		p    *script.Pipe
+		want string
+	}{
+		{"Sort", script.Echo(input).Sort(), "10\n9\nBanana\napple\npear\n"},
+		{"SortDesc", script.Echo(input).SortDesc(), "pear\napple\nBanana\n9\n10\n"},
+	}
+	for _, tc := range tcs {
+		got, err := tc.p.String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%s: %s", tc.name, cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestSortNumeric_SortsLinesByLeadingNumber(t *testing.T) {
+	t.Parallel()
+	input := "10 ten\n  9 nine\n-1.5 minus\nnone\n100 hundred\n0 zero\n"
+	want := "-1.5 minus\nnone\n0 zero\n  9 nine\n10 ten\n100 hundred\n"
+	got, err := script.Echo(input).SortNumeric().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	want = "100 hundred\n10 ten\n  9 nine\nnone\n0 zero\n-1.5 minus\n"
+	got, err = script.Echo(input).SortNumericDesc().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSortFiles_SortsPathsByGivenOrder(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"b.txt", 30, time.Hour},
+		{"c.txt", 10, 3 * time.Hour},
+		{"a.txt", 20, 2 * time.Hour},
+	}
+	var paths []string
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		err := os.WriteFile(path, make([]byte, f.size), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-f.age)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	paths = append(paths, filepath.Join(dir, "doesntexist.txt"))
+	tcs := []struct {
+		order script.FileOrder
+		want  []string
+	}{
+		{script.ByName, []string{"a.txt", "b.txt", "c.txt", "doesntexist.txt"}},
+		{script.ByModTime, []string{"c.txt", "a.txt", "b.txt", "doesntexist.txt"}},
+		{script.BySize, []string{"c.txt", "a.txt", "b.txt", "doesntexist.txt"}},
+	}
+	for _, tc := range tcs {
+		got, err := script.Slice(paths).SortFiles(tc.order).Basename().Slice()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("order %d: %s", tc.order, cmp.Diff(tc.want, got))
+		}
+	}
+}
+
+func TestSliceProducesElementsOfSpecifiedSliceOnePerLine(t *testing.T) {
+	t.Parallel()
+	want := "1\n2\n3\n"
+	got, err := script.Slice([]string{"1", "2", "3"}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestSliceGivenEmptySliceProducesEmptyPipe(t *testing.T) {
+	t.Parallel()
+	want := ""
+	got, err := script.Slice([]string{}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestStageTimeout_KeepsPartialOutputAndSetsErrorWhenStageOverruns(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	defer close(release)
+	p := script.NewPipe().StageTimeout(50 * time.Millisecond).Filter(func(r io.Reader, w io.Writer) error {
+		fmt.Fprintln(w, "partial")
+		<-release
+		fmt.Fprintln(w, "too late")
+		return nil
+	})
+	got, err := p.String()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want context.DeadlineExceeded, got %v", err)
+	}
+	if got != "partial\n" {
+		t.Errorf("want partial output %q, got %q", "partial\n", got)
+	}
+}
+
+func TestStageTimeout_ClosesInputOfStageThatOverruns(t *testing.T) {
+	t.Parallel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	readErr := make(chan error, 1)
+	script.NewPipe().WithReader(pr).StageTimeout(50 * time.Millisecond).Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.ReadAll(r)
+		readErr <- err
+		return err
+	}).Wait()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("want read error from closed input, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("want abandoned stage's input closed, but it's still reading")
+	}
+}
+
+func TestStageTimeout_AppliesOnlyToNextStage(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello\n").StageTimeout(time.Second).Filter(func(r io.Reader, w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}).Filter(func(r io.Reader, w io.Writer) error {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		time.Sleep(1500 * time.Millisecond)
+		_, err = w.Write(data)
+		return err
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+}
+
+func TestStdoutReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithStdout(io.Discard).
+		WithReader(brokenReader).Stdout()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestStdoutSendsPipeContentsToConfiguredStandardOutput(t *testing.T) {
+	t.Parallel()
+	buf := new(bytes.Buffer)
+	want := "hello world"
+	p := script.File("testdata/hello.txt").WithStdout(buf)
+	wrote, err := p.Stdout()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrote != len(want) {
+		t.Fatalf("want %d bytes written, got %d", len(want), wrote)
+	}
+	got := buf.String()
+	if want != got {
+		t.Fatalf("want %q, got %q", want, string(got))
+	}
+	_, err = p.String()
+	if err == nil {
+		t.Error("input not closed after reading")
+	}
+}
+
+func TestAppendJSONArray_AppendsRecordsToExistingArray(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	err := os.WriteFile(path, []byte(`[{"host":"web1"}]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo(`{"host":"web2"}` + "\n" + `{"host":"web3"}` + "\n").AppendJSONArray(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]string
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{{"host": "web1"}, {"host": "web2"}, {"host": "web3"}}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestAppendJSONArray_CreatesFileIfNecessary(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "new.json")
+	_, err := script.Echo("1 2\n").AppendJSONArray(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[\n  1,\n  2\n]\n"
+	if want != string(got) {
+		t.Error(cmp.Diff(want, string(got)))
+	}
+}
+
+func TestAppendJSONArray_LeavesFileUnchangedGivenInvalidInput(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "inventory.json")
+	err := os.WriteFile(path, []byte(`[1]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("2\n{bogus\n").AppendJSONArray(path)
+	if err == nil {
+		t.Fatal("want error for invalid JSON input")
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "[1]" {
+		t.Errorf("want file unchanged, got %q", got)
+	}
+}
+
+func TestAppendFileRotating_RotatesFileWhenItWouldExceedMaxBytes(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	for _, input := range []string{"zero\n", "one\ntwo\n", "three\nfour\n", "five\nsix\n"} {
+		_, err := script.Echo(input).AppendFileRotating(path, 10, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "two\nthree\n",
+	}
+	for name, wantContents := range want {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != wantContents {
+			t.Errorf("%s: want %q, got %q", name, wantContents, got)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want no more than 2 old files kept, got %v", err)
+	}
+}
+
+func TestAppendFileRotating_EmptiesFileWhenKeepIsZero(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	wrote, err := script.Echo("one\ntwo\nthree\n").AppendFileRotating(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrote != 14 {
+		t.Errorf("want 14 bytes written, got %d", wrote)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "three\n" {
+		t.Errorf("want %q, got %q", "three\n", got)
+	}
+}
+
+func TestAppendFile_AppendsAllItsInputToSpecifiedFile(t *testing.T) {
+	t.Parallel()
+	orig := "Hello, world"
+	path := t.TempDir() + "/" + t.Name()
+	_, err := script.Echo(orig).WriteFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra := " and goodbye"
+	wrote, err := script.Echo(extra).AppendFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(wrote) != len(extra) {
+		t.Fatalf("want %d bytes written, got %d", len(extra), int(wrote))
+	}
+	// check file contains both contents
+	got, err := script.File(path).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != orig+extra {
+		t.Errorf("want %q, got %q", orig+extra, got)
+	}
+}
+
+func TestAppendFile_ReturnsBytesWrittenAndErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	var want int64 = 1
+	got, err := script.NewPipe().WithReader(partialErrReader{}).AppendFile(t.TempDir() + "/tmp")
+	if err == nil {
+		t.Fatal("want error reading pipe with error status, got nil")
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestBytesOutputsInputBytesUnchanged(t *testing.T) {
+	t.Parallel()
+	want := []byte{8, 0, 0, 16}
+	input := bytes.NewReader(want)
+	got, err := script.NewPipe().WithReader(input).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestBytesReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).Bytes()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestNumericSinks_AggregateNumbersSkippingOtherLines(t *testing.T) {
+	t.Parallel()
+	input := "size\n 3\n-1.5\n\nn/a\n10\n"
+	tcs := []struct {
+		name string
+		sink func(*script.Pipe) (float64, error)
+		want float64
+	}{
+		{"Sum", (*script.Pipe).Sum, 11.5},
+		{"Mean", (*script.Pipe).Mean, 11.5 / 3},
+		{"Min", (*script.Pipe).Min, -1.5},
+		{"Max", (*script.Pipe).Max, 10},
+	}
+	for _, tc := range tcs {
+		got, err := tc.sink(script.Echo(input))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if tc.want != got {
+			t.Errorf("%s: want %v, got %v", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestNumericSinks_HandleInputWithNoNumbers(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("none\n").Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("want Sum 0, got %v", got)
+	}
+	for name, sink := range map[string]func(*script.Pipe) (float64, error){
+		"Mean": (*script.Pipe).Mean,
+		"Min":  (*script.Pipe).Min,
+		"Max":  (*script.Pipe).Max,
+	} {
+		_, err := sink(script.Echo("none\n"))
+		if err == nil {
+			t.Errorf("%s: want error for input with no numbers", name)
+		}
+	}
+}
+
+func TestNumericSinks_ReturnErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).Sum()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestFileSize_ProducesSizeOfEachFileSkippingMissingOnes(t *testing.T) {
+	t.Parallel()
+	input := "testdata/hello.txt\ntestdata/doesntexist\ntestdata/hello.txt\n"
+	got, err := script.Echo(input).FileSize().Sum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 22 {
+		t.Errorf("want total size 22, got %v", got)
+	}
+}
+
+func TestCountDistinct_CountsSmallNumbersOfDistinctLinesExactly(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\na\nc\nb\n").CountDistinct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 3 {
+		t.Errorf("want 3 distinct lines, got %d", got)
+	}
+}
+
+func TestCountDistinct_EstimatesLargeNumbersOfDistinctLinesClosely(t *testing.T) {
+	t.Parallel()
+	input := new(strings.Builder)
+	for i := 0; i < 200000; i++ {
+		fmt.Fprintf(input, "user%d\n", i%50000)
+	}
+	got, err := script.Echo(input.String()).CountDistinct()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got < 49000 || got > 51000 {
+		t.Errorf("want about 50000 distinct lines, got %d", got)
+	}
+}
+
+func TestCountLines_CountsCorrectNumberOfLinesInInput(t *testing.T) {
+	t.Parallel()
+	want := 3
+	got, err := script.Echo("a\nb\nc").CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %d, got %d", want, got)
+	}
+}
+
+func TestCountLines_Counts0LinesInEmptyInput(t *testing.T) {
+	t.Parallel()
+	want := 0
+	got, err := script.Echo("").CountLines()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("want %d, got %d", want, got)
 	}
 }
 
-func TestMatchOutputsOnlyMatchingLinesOfInput(t *testing.T) {
+func TestCountLines_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).CountLines()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestSHA256Sum_OutputsCorrectHash(t *testing.T) {
 	t.Parallel()
-	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
 	tcs := []struct {
-		match, want string
+		name, input, want string
 	}{
 		{
-			match: "line",
-			want:  "This is the first line in the file.\nThis is another line in the file.\n",
+			name:  "for no data",
+			input: "",
+			want:  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
 		},
 		{
-			match: "another",
-			want:  "This is another line in the file.\n",
+			name:  "for short string",
+			input: "hello, world",
+			want:  "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b",
 		},
 		{
-			match: "definitely won't match any lines",
-			want:  "",
+			name:  "for string containing newline",
+			input: "The tao that can be told\nis not the eternal Tao",
+			want:  "788542cb92d37f67e187992bdb402fdfb68228a1802947f74c6576e04790a688",
 		},
 	}
+
 	for _, tc := range tcs {
-		got, err := script.Echo(input).Match(tc.match).String()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if tc.want != got {
-			t.Error(cmp.Diff(tc.want, got))
-		}
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := script.Echo(tc.input).SHA256Sum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
 	}
 }
 
-func TestMatchOutputsNothingGivenEmptyInput(t *testing.T) {
+func TestSHA256Sum_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
 	t.Parallel()
-	got, err := script.NewPipe().Match("anything").String()
-	if err != nil {
-		t.Fatal(err)
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).SHA256Sum()
+	if err == nil {
+		t.Fatal(nil)
 	}
-	if got != "" {
-		t.Error("want no output given empty input")
+}
+
+func TestSliceSink_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).Slice()
+	if err == nil {
+		t.Fatal(nil)
 	}
 }
 
-func TestMatchRegexp_OutputsOnlyLinesMatchingRegexp(t *testing.T) {
+func TestSliceSink_(t *testing.T) {
 	t.Parallel()
-	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
-	tcs := []struct {
-		regex, want string
+	tests := []struct {
+		name string
+		pipe *script.Pipe
+		want []string
 	}{
 		{
-			regex: `Hello|file`,
-			want:  "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n",
-		},
-		{
-			regex: `an.ther`,
-			want:  "This is another line in the file.\n",
+			name: "returns three elements for three lines of input",
+			pipe: script.Echo("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n"),
+			want: []string{
+				"testdata/multiple_files/1.txt",
+				"testdata/multiple_files/2.txt",
+				"testdata/multiple_files/3.tar.zip",
+			},
 		},
 		{
-			regex: `r[a-z]*s`,
-			want:  "This is the first line in the file.\n",
+			name: "returns an empty slice given empty input",
+			pipe: script.Echo(""),
+			want: []string{},
 		},
 		{
-			regex: `r[a-z]+s`,
-			want:  "",
+			name: "returns one empty string given input containing a single newline",
+			pipe: script.Echo("\n"),
+			want: []string{""},
 		},
 		{
-			regex: `bogus$`,
-			want:  "",
+			name: "returns an empty string for each empty input line",
+			pipe: script.Echo("testdata/multiple_files/1.txt\n\ntestdata/multiple_files/3.tar.zip"),
+			want: []string{
+				"testdata/multiple_files/1.txt",
+				"",
+				"testdata/multiple_files/3.tar.zip",
+			},
 		},
 	}
-	for _, tc := range tcs {
-		got, err := script.Echo(input).MatchRegexp(regexp.MustCompile(tc.regex)).String()
-		if err != nil {
-			t.Fatal(err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.pipe
+			got, err := p.Slice()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(tt.want, got) {
+				t.Error(cmp.Diff(tt.want, got))
+			}
+		})
+	}
+}
+
+func TestStringOutputsInputStringUnchanged(t *testing.T) {
+	t.Parallel()
+	want := "hello, world"
+	got, err := script.Echo(want).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestStringReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+	t.Parallel()
+	brokenReader := iotest.ErrReader(errors.New("oh no"))
+	_, err := script.NewPipe().WithReader(brokenReader).String()
+	if err == nil {
+		t.Fatal(nil)
+	}
+}
+
+func TestSummary_CountsSuccessesAndFailuresOfExecForEachCommands(t *testing.T) {
+	t.Parallel()
+	sum, err := script.Echo("version\nbogus\nversion\n").WithStderr(io.Discard).ExecForEach("go {{.}}").Summary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.OK != 2 || sum.Failed != 1 {
+		t.Errorf("want 2 succeeded and 1 failed, got %d succeeded and %d failed", sum.OK, sum.Failed)
+	}
+	if sum.FirstErr == nil || sum.FirstErr != sum.LastErr {
+		t.Errorf("want first and last errors to be the single failure, got %v and %v", sum.FirstErr, sum.LastErr)
+	}
+	err = sum.Err()
+	if !errors.Is(err, sum.FirstErr) {
+		t.Errorf("want error wrapping first error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "1 of 3 commands failed") {
+		t.Errorf("want error summarising failures, got %q", err)
+	}
+}
+
+func TestSummary_ErrIsNilWhenNoCommandsFailed(t *testing.T) {
+	t.Parallel()
+	sum, err := script.Echo("version\n").ExecForEach("go {{.}}").Summary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum.OK != 1 {
+		t.Errorf("want 1 succeeded, got %d", sum.OK)
+	}
+	if sum.Err() != nil {
+		t.Errorf("want nil error, got %v", sum.Err())
+	}
+}
+
+func TestTopBy_ProducesNLinesWithLargestNumbersInColumn(t *testing.T) {
+	t.Parallel()
+	input := "a 5\nb 1\nc 9\nd x\ne\nf 5\ng 7\nh 9\n"
+	want := "c 9\nh 9\ng 7\na 5\n"
+	got, err := script.Echo(input).TopBy(2, 4).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestBottomBy_ProducesNLinesWithSmallestNumbersInColumn(t *testing.T) {
+	t.Parallel()
+	input := "a 5\nb 1\nc 9\nd -2.5\nf 5\n"
+	want := "d -2.5\nb 1\na 5\n"
+	got, err := script.Echo(input).BottomBy(2, 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTopK_ProducesMostFrequentLinesWithCounts(t *testing.T) {
+	t.Parallel()
+	input := new(strings.Builder)
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(input, "rare%d\n", i)
+		if i%5 == 0 {
+			input.WriteString("a\na\n")
 		}
-		if tc.want != got {
-			t.Error(cmp.Diff(tc.want, got))
+		if i%10 == 0 {
+			input.WriteString("b\n")
 		}
+		if i%25 == 0 {
+			input.WriteString("c\n")
+		}
+	}
+	want := "2000 a\n 500 b\n 200 c\n"
+	got, err := script.Echo(input.String()).TopK(3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTopK_ProducesNothingForKLessThanOne(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\n").TopK(0).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestTruncate_ShortensLongLinesWithEllipsis(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("hello world\nhi\n").Truncate(8).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "hello w…\nhi\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestTruncate_IgnoresANSIEscapesWhenCountingWidth(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("\x1b[31mred\x1b[0m\n\x1b[32mgreen text\x1b[0m\n").Truncate(5).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "\x1b[31mred\x1b[0m\n\x1b[32mgree…\x1b[0m\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestUniq_RemovesAllDuplicateLinesKeepingFirstOccurrence(t *testing.T) {
+	t.Parallel()
+	want := "b\na\n\nc\n"
+	got, err := script.Echo("b\na\nb\n\nb\nc\na\n\n").Uniq().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestUniqAdjacent_RemovesOnlyRepeatedAdjacentLines(t *testing.T) {
+	t.Parallel()
+	want := "\na\nb\na\n"
+	got, err := script.Echo("\na\na\nb\nb\nb\na\n").UniqAdjacent().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestValidateCSV_PassesConformingInputThroughUnchanged(t *testing.T) {
+	t.Parallel()
+	want := "name,age,admin\n\"Smith, Jo\",42,true\n\n\"multi\nline\",7,false\n"
+	got, err := script.Echo(want).ValidateCSV("name,age:int,admin:bool").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestReplaceReplacesMatchesWithSpecifiedText(t *testing.T) {
+func TestValidateCSV_StopsAtFirstNonConformingRecord(t *testing.T) {
 	t.Parallel()
-	input := "hello world"
 	tcs := []struct {
-		search, replace, want string
+		input, want, wantErr string
 	}{
 		{
-			search:  "hello",
-			replace: "bye",
-			want:    "bye world\n",
+			input:   "name,age\nJo,42\n",
+			wantErr: `line 1: want header "name,age,admin", got "name,age"`,
 		},
 		{
-			search:  "Does not exist in input",
-			replace: "Will not appear in output",
-			want:    "hello world\n",
+			input:   "name,age,admin\nJo,42,true\nAl,old,false\nBo,7,true\n",
+			want:    "name,age,admin\nJo,42,true\n",
+			wantErr: `line 3: column "age": "old" is not a valid int`,
 		},
 		{
-			search:  " world",
-			replace: " string with newline\n",
-			want:    "hello string with newline\n\n",
+			input:   "name,age,admin\nJo,42\n",
+			want:    "name,age,admin\n",
+			wantErr: "line 2: want 3 fields, got 2",
 		},
 		{
-			search:  "hello",
-			replace: "Ж9",
-			want:    "Ж9 world\n",
+			input:   "name,age,admin\n\"Jo,42,true\n",
+			want:    "name,age,admin\n",
+			wantErr: "line 2: unterminated quoted field",
 		},
 	}
 	for _, tc := range tcs {
-		got, err := script.Echo(input).Replace(tc.search, tc.replace).String()
-		if err != nil {
-			t.Fatal(err)
+		got, err := script.Echo(tc.input).ValidateCSV("name,age:int,admin:bool").String()
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%q: want error %q, got %v", tc.input, tc.wantErr, err)
 		}
 		if tc.want != got {
 			t.Error(cmp.Diff(tc.want, got))
@@ -994,643 +5026,861 @@ func TestReplaceReplacesMatchesWithSpecifiedText(t *testing.T) {
 	}
 }
 
-func TestReplaceRegexp_ReplacesMatchesWithSpecifiedText(t *testing.T) {
+func TestValidateCSV_ErrorsOnInvalidSpec(t *testing.T) {
 	t.Parallel()
-	input := "hello world"
-	tcs := []struct {
-		regex, replace, want string
-	}{
-		{
-			regex:   "hel+o",
-			replace: "bye",
-			want:    "bye world\n",
-		},
-		{
-			regex:   "Does not .* in input",
-			replace: "Will not appear in output",
-			want:    "hello world\n",
-		},
-		{
-			regex:   "^([a-z]+) ([a-z]+)",
-			replace: "$1 cruel $2",
-			want:    "hello cruel world\n",
-		},
-		{
-			regex:   "hello{1}",
-			replace: "Ж9",
-			want:    "Ж9 world\n",
-		},
+	p := script.Echo("a\n").ValidateCSV("a:date")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error for unknown column type")
 	}
-	for _, tc := range tcs {
-		got, err := script.Echo(input).ReplaceRegexp(regexp.MustCompile(tc.regex), tc.replace).String()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if tc.want != got {
-			t.Error(cmp.Diff(tc.want, got))
-		}
+}
+
+const userSchema = `{
+	"type": "object",
+	"required": ["id", "name"],
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+	},
+	"additionalProperties": false
+}`
+
+func TestValidateJSONSchema_PassesConformingInputThroughUnchanged(t *testing.T) {
+	t.Parallel()
+	want := `{"id":1,"name":"Alice","role":"admin"}` + "\n\n" + `{"id": 2, "name": "Bob", "tags": ["x"]}` + "\n"
+	got, err := script.Echo(want).ValidateJSONSchema(userSchema).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestRejectDropsMatchingLinesFromInput(t *testing.T) {
+func TestValidateJSONSchema_StopsAtFirstNonConformingLine(t *testing.T) {
 	t.Parallel()
-	input := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
 	tcs := []struct {
-		reject, want string
+		input, wantErr string
 	}{
-		{
-			reject: "line",
-			want:   "Hello, world.\n",
-		},
-		{
-			reject: "another",
-			want:   "This is the first line in the file.\nHello, world.\n",
-		},
-		{
-			reject: "definitely won't match any lines",
-			want:   "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n",
-		},
+		{input: `{"id":1}`, wantErr: `line 2: $: missing required property "name"`},
+		{input: `{"id":1.5,"name":"A"}`, wantErr: "line 2: $.id: want integer, got number"},
+		{input: `{"id":0,"name":"A"}`, wantErr: "line 2: $.id: want at least 1, got 0"},
+		{input: `{"id":1,"name":"al"}`, wantErr: `line 2: $.name: "al" doesn't match pattern "^[A-Z]"`},
+		{input: `{"id":1,"name":"A","role":"root"}`, wantErr: `line 2: $.role: "root" is not one of ["admin","user"]`},
+		{input: `{"id":1,"name":"A","tags":["x",2]}`, wantErr: "line 2: $.tags[1]: want string, got integer"},
+		{input: `{"id":1,"name":"A","extra":true}`, wantErr: "line 2: $.extra: not allowed"},
+		{input: `[]`, wantErr: "line 2: $: want object, got array"},
+		{input: `{`, wantErr: "line 2: unexpected end of JSON input"},
 	}
 	for _, tc := range tcs {
-		got, err := script.Echo(input).Reject(tc.reject).String()
-		if err != nil {
-			t.Fatal(err)
+		input := `{"id":1,"name":"A"}` + "\n" + tc.input + "\n" + `{"id":3,"name":"C"}` + "\n"
+		got, err := script.Echo(input).ValidateJSONSchema(userSchema).String()
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("%s: want error %q, got %v", tc.input, tc.wantErr, err)
 		}
-		if tc.want != got {
-			t.Error(cmp.Diff(tc.want, got))
+		want := `{"id":1,"name":"A"}` + "\n"
+		if want != got {
+			t.Error(cmp.Diff(want, got))
 		}
 	}
 }
 
-func TestPostPostsToGivenURLUsingPipeAsRequestBody(t *testing.T) {
+func TestValidateJSONSchema_ErrorsOnInvalidSchema(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			t.Errorf("want HTTP method POST, got %q", r.Method)
-		}
-		want := []byte("request data")
-		got, err := io.ReadAll(r.Body)
-		if err != nil {
-			t.Fatal("reading request body", err)
-		}
-		if !cmp.Equal(want, got) {
-			t.Fatal(cmp.Diff(want, string(got)))
+	for _, schema := range []string{"{", `{"pattern": "("}`} {
+		p := script.Echo("{}\n").ValidateJSONSchema(schema)
+		p.Wait()
+		if p.Error() == nil {
+			t.Errorf("%s: want error for invalid schema", schema)
 		}
-		fmt.Fprintln(w, "response data")
-	}))
-	defer ts.Close()
-	want := "response data\n"
-	got, err := script.Echo("request data").Post(ts.URL).String()
+	}
+}
+
+func TestWithRejects_DivertsInvalidRecordsAndContinues(t *testing.T) {
+	t.Parallel()
+	rejects := new(bytes.Buffer)
+	input := "name,age\nJo,42\nAl,old\n\"Bo\",7\n\"Cy,\n"
+	got, err := script.Echo(input).WithRejects(rejects).ValidateCSV("name,age:int").String()
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
+	want := "name,age\nJo,42\n\"Bo\",7\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	wantRejects := "line 3: column \"age\": \"old\" is not a valid int\tAl,old\n" +
+		"line 5: unterminated quoted field\t\"Cy,\n"
+	if wantRejects != rejects.String() {
+		t.Error(cmp.Diff(wantRejects, rejects.String()))
+	}
+	rejects.Reset()
+	got, err = script.Echo(`{"id":1}` + "\n" + `{"id":"x"}` + "\n").WithRejects(rejects).ValidateJSONSchema(`{"properties":{"id":{"type":"integer"}}}`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `{"id":1}` + "\n"
+	if want != got {
 		t.Error(cmp.Diff(want, got))
 	}
+	wantRejects = "line 2: $.id: want integer, got string\t" + `{"id":"x"}` + "\n"
+	if wantRejects != rejects.String() {
+		t.Error(cmp.Diff(wantRejects, rejects.String()))
+	}
 }
 
-func TestRejectRegexp_DropsMatchingLinesFromInput(t *testing.T) {
+func TestWithRejects_StillFailsOnInvalidCSVHeader(t *testing.T) {
 	t.Parallel()
-	input := "hello world"
+	p := script.Echo("nom,age\nJo,42\n").WithRejects(io.Discard).ValidateCSV("name,age:int")
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error for invalid header")
+	}
+}
+
+func TestWaitReadsPipeSourceToCompletion(t *testing.T) {
+	t.Parallel()
+	source := bytes.NewBufferString("hello")
+	script.NewPipe().WithReader(source).FilterLine(strings.ToUpper).Wait()
+	if source.Len() > 0 {
+		t.Errorf("incomplete read: %d bytes of input remaining: %q", source.Len(), source.String())
+	}
+}
+
+func TestWhereNum_FiltersLinesByNumericColumnComparison(t *testing.T) {
+	t.Parallel()
+	input := "USER PID RSS\nroot 1 2048\nbob 42 1048577\nalice 7 512.5\nshort\n"
 	tcs := []struct {
-		regex, want string
+		op    string
+		value float64
+		want  string
 	}{
-		{
-			regex: `Hello|line`,
-			want:  "hello world\n",
-		},
-		{
-			regex: `hello|bogus`,
-			want:  "",
-		},
-		{
-			regex: `w.*d`,
-			want:  "",
-		},
-		{
-			regex: "wontmatch",
-			want:  "hello world\n",
-		},
+		{op: ">", value: 1024, want: "root 1 2048\nbob 42 1048577\n"},
+		{op: "<=", value: 2048, want: "root 1 2048\nalice 7 512.5\n"},
+		{op: "==", value: 512.5, want: "alice 7 512.5\n"},
+		{op: "!=", value: 2048, want: "bob 42 1048577\nalice 7 512.5\n"},
 	}
 	for _, tc := range tcs {
-		got, err := script.Echo(input).RejectRegexp(regexp.MustCompile(tc.regex)).String()
+		got, err := script.Echo(input).WhereNum(3, tc.op, tc.value).String()
 		if err != nil {
 			t.Fatal(err)
 		}
 		if tc.want != got {
-			t.Error(cmp.Diff(tc.want, got))
+			t.Errorf("%s %v: %s", tc.op, tc.value, cmp.Diff(tc.want, got))
 		}
 	}
 }
 
-func TestSHA256Sums_OutputsCorrectHashForEachSpecifiedFile(t *testing.T) {
+func TestWhereNum_SetsErrorGivenInvalidOperator(t *testing.T) {
 	t.Parallel()
-	tcs := []struct {
-		testFileName string
-		want         string
-	}{
-		// To get the checksum run: openssl dgst -sha256 <file_name>
-		{"testdata/hashSum.input.txt", "1870478d23b0b4db37735d917f4f0ff9393dd3e52d8b0efa852ab85536ddad8e\n"},
-		{"testdata/hello.txt", "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9\n"},
-		{"testdata/multiple_files", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n"},
+	p := script.Echo("1\n").WhereNum(1, "=>", 0)
+	if p.Error() == nil {
+		t.Error("want error for invalid operator")
 	}
-	for _, tc := range tcs {
-		got, err := script.ListFiles(tc.testFileName).SHA256Sums().String()
-		if err != nil {
-			t.Fatal(err)
-		}
-		if got != tc.want {
-			t.Errorf("%q: want %q, got %q", tc.testFileName, tc.want, got)
-		}
+}
+
+func TestWindow_CallsFunctionOnEachSlidingWindowOfLines(t *testing.T) {
+	t.Parallel()
+	want := "a b c\nb c d\nc d e\n"
+	got, err := script.Echo("a\nb\nc\nd\ne\n").Window(3, func(lines []string) string {
+		return strings.Join(lines, " ")
+	}).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestTeeUsesConfiguredStdoutAsDefault(t *testing.T) {
+func TestWindow_ProducesNothingGivenFewerThanNLines(t *testing.T) {
 	t.Parallel()
-	buf := new(bytes.Buffer)
-	_, err := script.Echo("hello").WithStdout(buf).Tee().String()
+	got, err := script.Echo("a\nb\n").Window(3, func(lines []string) string {
+		return strings.Join(lines, " ")
+	}).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := "hello"
-	got := buf.String()
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+}
+
+func TestWorkspace_ProvidesTemporaryDirectoryRemovedOnClose(t *testing.T) {
+	t.Parallel()
+	ws, err := script.NewWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	path := ws.Path("sub", "file.txt")
+	if want := filepath.Join(ws.Dir, "sub", "file.txt"); want != path {
+		t.Errorf("want path %q, got %q", want, path)
+	}
+	_, err = script.Echo("hello\n").WriteFile(ws.Path("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := ws.Files().Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{ws.Path("a.txt")}; !cmp.Equal(want, files) {
+		t.Error(cmp.Diff(want, files))
+	}
+	err = ws.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(ws.Dir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("want workspace directory removed, got %v", err)
+	}
+	if err := ws.Close(); err != nil {
+		t.Errorf("want second Close to succeed, got %v", err)
+	}
+}
+
+func TestWorkspaceWritten_ListsFilesWrittenIntoWorkspaceBySinks(t *testing.T) {
+	t.Parallel()
+	ws, err := script.NewWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	outside := filepath.Join(t.TempDir(), "outside.txt")
+	_, err = script.Echo("a\n").WriteFile(ws.Path("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("b\n").WriteFileAtomic(ws.Path("sub", "b.txt"), false)
+	if err == nil {
+		t.Fatal("want error writing into missing directory, got nil")
+	}
+	err = os.Mkdir(ws.Path("sub"), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("b\n").WriteFileAtomic(ws.Path("sub", "b.txt"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("c\n").AppendFile(ws.Path("a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = script.Echo("d\n").WriteFile(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	written, err := ws.Written().Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ws.Path("a.txt"), ws.Path("sub", "b.txt")}
+	if !cmp.Equal(want, written) {
+		t.Error(cmp.Diff(want, written))
+	}
+}
+
+func TestWords_SplitsUnicodeTextIntoWords(t *testing.T) {
+	t.Parallel()
+	input := "Ça va? Don't panic: π ≈ 3.14, not 1,000!\nnaïve—café 東京\n"
+	want := "Ça\nva\nDon't\npanic\nπ\n3.14\nnot\n1,000\nnaïve\ncafé\n東\n京\n"
+	got, err := script.Echo(input).Words().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestWords_HandlesWordsSplitAcrossReadBoundaries(t *testing.T) {
+	t.Parallel()
+	input := "héllo wörld 2.5"
+	want := "héllo\nwörld\n2.5\n"
+	r := iotest.OneByteReader(strings.NewReader(input))
+	got, err := script.NewPipe().WithReader(r).Words().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestWrap_BreaksLongLinesAtSpaces(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("the quick brown fox jumps\n\nabcdefghijkl\n").Wrap(10).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "the quick\nbrown fox\njumps\n\nabcdefghij\nkl\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestTeeWritesDataToSuppliedWritersAsWellAsToPipe(t *testing.T) {
+func TestWriteFile_WritesInputToFileCreatingItIfNecessary(t *testing.T) {
 	t.Parallel()
-	buf1, buf2 := new(bytes.Buffer), new(bytes.Buffer)
-	got, err := script.Echo("hello world").Tee(buf1, buf2).String()
+	want := "Hello, world"
+	path := t.TempDir() + "/" + t.Name()
+	wrote, err := script.Echo(want).WriteFile(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := "hello world"
-	if want != got {
-		t.Errorf("want %q on pipe, got %q", want, got)
+	if int(wrote) != len(want) {
+		t.Fatalf("want %d bytes written, got %d", len(want), int(wrote))
 	}
-	if want != buf1.String() {
-		t.Errorf("want %q on writer 1, got %q", want, buf1.String())
+	got, err := script.File(path).String()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if want != buf2.String() {
-		t.Errorf("want %q on writer 2, got %q", want, buf2.String())
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestExecErrorsWhenTheSpecifiedCommandDoesNotExist(t *testing.T) {
-	t.Parallel()
-	p := script.Exec("doesntexist")
-	p.Wait()
-	if p.Error() == nil {
-		t.Error("want error running non-existent command")
-	}
+// partialErrReader returns 1 and a non-EOF error on reading.
+type partialErrReader struct{}
+
+func (r partialErrReader) Read(p []byte) (int, error) {
+	return 1, errors.New("oh no")
 }
 
-func TestExecRunsGoWithNoArgsAndGetsUsageMessagePlusErrorExitStatus2(t *testing.T) {
+func TestWriteFile_ReturnsBytesWrittenAndErrorGivenReadErrorOnPipe(t *testing.T) {
 	t.Parallel()
-	// We can't make many cross-platform assumptions about what external
-	// commands will be available, but it seems logical that 'go' would be
-	// (though it may not be in the user's path)
-	p := script.Exec("go")
-	output, err := p.String()
+	var want int64 = 1
+	got, err := script.NewPipe().WithReader(partialErrReader{}).WriteFile(t.TempDir() + "/tmp")
 	if err == nil {
-		t.Fatal("want error when command returns a non-zero exit status")
-	}
-	if !strings.Contains(output, "Usage") {
-		t.Fatalf("want output containing the word 'Usage', got %q", output)
+		t.Fatal("want error reading pipe with error status, got nil")
 	}
-	want := 2
-	got := p.ExitStatus()
-	if want != got {
-		t.Errorf("want exit status %d, got %d", want, got)
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestExecRunsGoHelpAndGetsUsageMessage(t *testing.T) {
+func TestWriteFile_TruncatesExistingFile(t *testing.T) {
 	t.Parallel()
-	p := script.Exec("go help")
-	if p.Error() != nil {
-		t.Fatal(p.Error())
+	want := "Hello, world"
+	path := t.TempDir() + "/" + t.Name()
+	// write some data first so we can check for truncation
+	data := make([]byte, 15)
+	err := os.WriteFile(path, data, 0o600)
+	if err != nil {
+		t.Fatal(err)
 	}
-	output, err := p.String()
+	wrote, err := script.Echo(want).WriteFile(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !strings.Contains(output, "Usage") {
-		t.Fatalf("want output containing the word 'Usage', got %q", output)
+	if int(wrote) != len(want) {
+		t.Fatalf("want %d bytes written, got %d", len(want), int(wrote))
+	}
+	got, err := script.File(path).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == want+"\x00\x00\x00" {
+		t.Fatalf("file not truncated on write")
+	}
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestFileOutputsContentsOfSpecifiedFile(t *testing.T) {
+func TestWriteFile_CopiesBinaryFileUnchanged(t *testing.T) {
 	t.Parallel()
-	want := "This is the first line in the file.\nHello, world.\nThis is another line in the file.\n"
-	got, err := script.File("testdata/test.txt").String()
+	want := make([]byte, 1<<20)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	err := os.WriteFile(src, want, 0o600)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	dst := filepath.Join(dir, "dst.bin")
+	wrote, err := script.Echo(src).Concat().WriteFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(wrote) != len(want) {
+		t.Fatalf("want %d bytes written, got %d", len(want), wrote)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Error("copied file differs from original")
 	}
 }
 
-func TestFileErrorsOnNonexistentFile(t *testing.T) {
+func TestWithSparseFiles_WritesContentsUnchanged(t *testing.T) {
 	t.Parallel()
-	p := script.File("doesntexist")
-	if p.Error() == nil {
-		t.Error("want error for non-existent file")
+	want := make([]byte, 3*4096+100)
+	copy(want[5000:], "hello")
+	copy(want[len(want)-1:], "!")
+	dir := t.TempDir()
+	for _, name := range []string{"WriteFile", "WriteFileAtomic", "TrailingHole"} {
+		data := want
+		if name == "TrailingHole" {
+			data = want[:len(want)-1]
+		}
+		// one byte at a time, so that blocks arrive in pieces
+		p := script.NewPipe().WithReader(iotest.OneByteReader(bytes.NewReader(data))).WithSparseFiles()
+		path := filepath.Join(dir, name)
+		var wrote int64
+		var err error
+		if name == "WriteFileAtomic" {
+			wrote, err = p.WriteFileAtomic(path, false)
+		} else {
+			wrote, err = p.WriteFile(path)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wrote != int64(len(data)) {
+			t.Errorf("%s: want %d bytes written, got %d", name, len(data), wrote)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, got) {
+			t.Errorf("%s: contents differ", name)
+		}
 	}
 }
 
-func TestFindFiles_ReturnsListOfFiles(t *testing.T) {
+func TestWriteFileAtomic_ReplacesFileContentsPreservingPermissions(t *testing.T) {
 	t.Parallel()
-	p := script.FindFiles("testdata/multiple_files")
-	if p.Error() != nil {
-		t.Fatal(p.Error())
+	path := filepath.Join(t.TempDir(), "config.txt")
+	err := os.WriteFile(path, []byte("old\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
 	}
-	p.SetError(nil) // else p.String() would be a no-op
-	// Expect result to use this platform's path separator
-	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n")
-	got, err := p.String()
+	wrote, err := script.Echo("new contents\n").WriteFileAtomic(path, true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Fatal(cmp.Diff(want, got))
+	if wrote != 13 {
+		t.Errorf("want 13 bytes written, got %d", wrote)
 	}
-}
-
-func TestFindFiles_RecursesIntoSubdirectories(t *testing.T) {
-	t.Parallel()
-	p := script.FindFiles("testdata/multiple_files_with_subdirectory")
-	if p.Error() != nil {
-		t.Fatal(p.Error())
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
 	}
-	p.SetError(nil) // else p.String() would be a no-op
-	// Expect result to use this platform's path separator
-	want := filepath.Clean("testdata/multiple_files_with_subdirectory/1.txt\ntestdata/multiple_files_with_subdirectory/2.txt\ntestdata/multiple_files_with_subdirectory/3.tar.zip\ntestdata/multiple_files_with_subdirectory/dir/.hidden\ntestdata/multiple_files_with_subdirectory/dir/1.txt\ntestdata/multiple_files_with_subdirectory/dir/2.txt\n")
-	got, err := p.String()
+	if string(got) != "new contents\n" {
+		t.Errorf("want %q, got %q", "new contents\n", got)
+	}
+	info, err := os.Stat(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Fatal(cmp.Diff(want, got))
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0o600 {
+		t.Errorf("want permissions 0600 preserved, got %v", info.Mode().Perm())
 	}
 }
 
-func TestFindFiles_InNonexistentPathReturnsError(t *testing.T) {
+func TestWriteFileAtomic_LeavesFileUnchangedOnPipeError(t *testing.T) {
 	t.Parallel()
-	p := script.FindFiles("nonexistent_path")
-	if p.Error() == nil {
-		t.Fatal("want error for nonexistent path")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.txt")
+	err := os.WriteFile(path, []byte("old\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestIfExists_ProducesErrorPlusNoOutputForNonexistentFile(t *testing.T) {
-	t.Parallel()
-	want := ""
-	got, err := script.IfExists("testdata/doesntexist").Echo("hello").String()
+	_, err = script.NewPipe().WithReader(iotest.ErrReader(errors.New("oh no"))).WriteFileAtomic(path, false)
 	if err == nil {
 		t.Fatal("want error")
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-func TestIfExists_ProducesOutputAndNoErrorWhenFileExists(t *testing.T) {
-	t.Parallel()
-	want := "hello"
-	got, err := script.IfExists("testdata/empty.txt").Echo("hello").String()
+	if string(got) != "old\n" {
+		t.Errorf("want file unchanged, got %q", got)
+	}
+	entries, err := os.ReadDir(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Error(cmp.Diff(want, got))
+	if len(entries) != 1 {
+		t.Errorf("want temporary file removed, got %d files", len(entries))
 	}
 }
 
-func TestListFiles_OutputsDirectoryContentsGivenDirectoryPath(t *testing.T) {
+func TestWriteFilesByTemplate_RoutesEachLineToFileNamedByTemplate(t *testing.T) {
 	t.Parallel()
-	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n")
-	got, err := script.ListFiles("testdata/multiple_files").String()
+	dir := t.TempDir()
+	input := "2024-01-01 a\n2024-01-02 b\n2024-01-01 c\n"
+	wrote, err := script.Echo(input).WriteFilesByTemplate(dir + `/logs/{{slice . 0 10}}.log`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("Want %q, got %q", want, got)
+	if wrote != int64(len(input)) {
+		t.Errorf("want %d bytes written, got %d", len(input), wrote)
 	}
-}
-
-func TestListFiles_ErrorsOnNonexistentPath(t *testing.T) {
-	t.Parallel()
-	p := script.ListFiles("nonexistentpath")
-	if p.Error() == nil {
-		t.Error("want error status on listing non-existent path, but got nil")
+	want := map[string]string{
+		"2024-01-01.log": "2024-01-01 a\n2024-01-01 c\n",
+		"2024-01-02.log": "2024-01-02 b\n",
+	}
+	for name, wantContents := range want {
+		got, err := os.ReadFile(filepath.Join(dir, "logs", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != wantContents {
+			t.Errorf("%s: want %q, got %q", name, wantContents, got)
+		}
 	}
 }
 
-func TestListFiles_OutputsSingleFileGivenFilePath(t *testing.T) {
+func TestWriteFilesByTemplate_UsesFieldsOfJSONRecords(t *testing.T) {
 	t.Parallel()
-	got, err := script.ListFiles("testdata/multiple_files/1.txt").String()
+	dir := t.TempDir()
+	input := `{"host":"web1","msg":"up"}` + "\n" + `{"host":"web2","msg":"down"}` + "\n"
+	_, err := script.Echo(input).WriteFilesByTemplate(dir + `/{{.host}}.json`)
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := "testdata/multiple_files/1.txt"
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	got, err := os.ReadFile(filepath.Join(dir, "web2.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"host":"web2","msg":"down"}` + "\n"
+	if string(got) != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestListFiles_OutputsAllFilesMatchingSpecifiedGlobExpression(t *testing.T) {
+func TestWriteFileTx_UpdatesAllFilesOnlyOnCommit(t *testing.T) {
 	t.Parallel()
-	want := filepath.Clean("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\n")
-	got, err := script.ListFiles("testdata/multi?le_files/*.txt").String()
-	if err != nil {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")
+	writeTestFile(t, a, "old a\n")
+	tx := script.NewTxWriter()
+	defer tx.Rollback()
+	if _, err := script.Echo("new a\n").WriteFileTx(tx, a); err != nil {
 		t.Fatal(err)
 	}
-	if want != got {
-		t.Errorf("Want %q, got %q", want, got)
+	if _, err := script.Echo("new b\n").WriteFileTx(tx, b); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := script.File(a).String()
+	if got != "old a\n" {
+		t.Errorf("want file unchanged before commit, got %q", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = script.ListFiles(dir).Basename().String()
+	if got != "a.conf\nb.conf\n" {
+		t.Errorf("want only destination files left, got %q", got)
+	}
+	got, _ = script.Slice([]string{a, b}).Concat().String()
+	if got != "new a\nnew b\n" {
+		t.Errorf("want new contents after commit, got %q", got)
+	}
+	if err := tx.Commit(); err == nil {
+		t.Error("want error committing twice")
 	}
 }
 
-func TestReadAutoCloser_ReadsAllDataFromSourceAndClosesItAutomatically(t *testing.T) {
+func TestWriteFileTx_RollsBackAllFilesWhenAnyWriteFails(t *testing.T) {
 	t.Parallel()
-	want := []byte("hello world")
-	input, err := os.Open("testdata/hello.txt")
-	if err != nil {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.conf"), filepath.Join(dir, "b.conf")
+	writeTestFile(t, a, "old a\n")
+	writeTestFile(t, b, "old b\n")
+	tx := script.NewTxWriter()
+	if _, err := script.Echo("new a\n").WriteFileTx(tx, a); err != nil {
 		t.Fatal(err)
 	}
-	acr := script.NewReadAutoCloser(input)
-	got, err := io.ReadAll(acr)
-	if err != nil {
-		t.Fatal(err)
+	_, err := script.NewPipe().WithReader(iotest.ErrReader(errors.New("oh no"))).WriteFileTx(tx, b)
+	if err == nil {
+		t.Fatal("want error from failed pipe")
 	}
-	if !cmp.Equal(want, got) {
-		t.Fatal(cmp.Diff(want, got))
+	err = tx.Commit()
+	if err == nil || !strings.Contains(err.Error(), "oh no") {
+		t.Errorf("want commit to fail with pipe error, got %v", err)
 	}
-	_, err = io.ReadAll(acr)
-	if err == nil {
-		t.Error("input not closed after reading")
+	got, _ := script.ListFiles(dir).Basename().String()
+	if got != "a.conf\nb.conf\n" {
+		t.Errorf("want temporary files removed, got %q", got)
+	}
+	got, _ = script.Slice([]string{a, b}).Concat().String()
+	if got != "old a\nold b\n" {
+		t.Errorf("want files unchanged after rollback, got %q", got)
 	}
 }
 
-func TestSliceProducesElementsOfSpecifiedSliceOnePerLine(t *testing.T) {
+func TestWriteTo_WritesPipeContentsToSuppliedWriter(t *testing.T) {
 	t.Parallel()
-	want := "1\n2\n3\n"
-	got, err := script.Slice([]string{"1", "2", "3"}).String()
+	want := "hello world"
+	buf := new(bytes.Buffer)
+	n, err := script.Echo(want).WriteTo(buf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	if int(n) != len(want) {
+		t.Errorf("want %d bytes written, got %d", len(want), n)
+	}
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
 }
 
-func TestSliceGivenEmptySliceProducesEmptyPipe(t *testing.T) {
+func TestWriteTo_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
 	t.Parallel()
-	want := ""
-	got, err := script.Slice([]string{}).String()
+	p := script.NewPipe().WithReader(partialErrReader{})
+	_, err := p.WriteTo(io.Discard)
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if p.Error() == nil {
+		t.Error("want error status set on pipe, got nil")
+	}
+}
+
+func TestWithAuthBasic_SetsBasicAuthOnSubsequentRequests(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		fmt.Fprintln(w, user, pass, ok)
+	}))
+	defer ts.Close()
+	got, err := script.NewPipe().WithAuthBasic("alice", "s3cret:x").Get(ts.URL).String()
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := "alice s3cret:x true\n"
 	if want != got {
-		t.Fatalf("want %q, got %q", want, got)
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestStdoutReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithAuthBearer_SetsBearerTokenOnSubsequentRequests(t *testing.T) {
 	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithStdout(io.Discard).
-		WithReader(brokenReader).Stdout()
-	if err == nil {
-		t.Fatal(nil)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+	got, err := script.NewPipe().WithAuthBearer("abc123").Get(ts.URL).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Bearer abc123\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestStdoutSendsPipeContentsToConfiguredStandardOutput(t *testing.T) {
+func TestWithHeader_SetsHeaderOnSubsequentRequests(t *testing.T) {
 	t.Parallel()
-	buf := new(bytes.Buffer)
-	want := "hello world"
-	p := script.File("testdata/hello.txt").WithStdout(buf)
-	wrote, err := p.Stdout()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s %s\n", r.Header.Get("Authorization"), r.Header.Get("Content-Type"), r.Header.Get("X-Request"))
+	}))
+	defer ts.Close()
+	p := script.Echo("{}").WithHeader("Authorization", "token abc").WithHeaders(map[string]string{
+		"Content-Type": "application/json",
+		"X-Request":    "pipe",
+	})
+	got, err := p.Post(ts.URL).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if wrote != len(want) {
-		t.Fatalf("want %d bytes written, got %d", len(want), wrote)
-	}
-	got := buf.String()
+	want := "token abc application/json pipe\n"
 	if want != got {
-		t.Fatalf("want %q, got %q", want, string(got))
-	}
-	_, err = p.String()
-	if err == nil {
-		t.Error("input not closed after reading")
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestAppendFile_AppendsAllItsInputToSpecifiedFile(t *testing.T) {
+func TestWithHeader_DoesNotOverrideHeaderSetOnRequest(t *testing.T) {
 	t.Parallel()
-	orig := "Hello, world"
-	path := t.TempDir() + "/" + t.Name()
-	_, err := script.Echo(orig).WriteFile(path)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, r.Header.Get("X-Request"))
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
-	extra := " and goodbye"
-	wrote, err := script.Echo(extra).AppendFile(path)
+	req.Header.Set("X-Request", "request")
+	got, err := script.NewPipe().WithHeader("X-Request", "pipe").Do(req).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if int(wrote) != len(extra) {
-		t.Fatalf("want %d bytes written, got %d", len(extra), int(wrote))
+	want := "request\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
-	// check file contains both contents
-	got, err := script.File(path).String()
+}
+
+func TestWithHTTPRetries_RetriesServerErrorsResendingRequestBody(t *testing.T) {
+	t.Parallel()
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		body, _ := io.ReadAll(r.Body)
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			fmt.Fprintf(w, "%s\n", body)
+		}
+	}))
+	defer ts.Close()
+	got, err := script.Echo("request data").WithHTTPRetries(3, time.Millisecond).Post(ts.URL).String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != orig+extra {
-		t.Errorf("want %q, got %q", orig+extra, got)
+	want := "request data\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("want 3 attempts, got %d", n)
 	}
 }
 
-func TestAppendFile_ReturnsBytesWrittenAndErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithHTTPRetries_GivesUpAfterNRetries(t *testing.T) {
 	t.Parallel()
-	var want int64 = 1
-	got, err := script.NewPipe().WithReader(partialErrReader{}).AppendFile(t.TempDir() + "/tmp")
-	if err == nil {
-		t.Fatal("want error reading pipe with error status, got nil")
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	p := script.NewPipe().WithHTTPRetries(2, time.Millisecond).Get(ts.URL)
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error after retries are exhausted")
 	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	if n := atomic.LoadInt32(&attempts); n != 3 {
+		t.Errorf("want 3 attempts, got %d", n)
 	}
 }
 
-func TestBytesOutputsInputBytesUnchanged(t *testing.T) {
+func TestWithHTTPRetries_DoesNotRetryClientErrors(t *testing.T) {
 	t.Parallel()
-	want := []byte{8, 0, 0, 16}
-	input := bytes.NewReader(want)
-	got, err := script.NewPipe().WithReader(input).Bytes()
-	if err != nil {
-		t.Fatal(err)
-	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	var attempts int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+	script.NewPipe().WithHTTPRetries(2, time.Millisecond).Get(ts.URL).Wait()
+	if n := atomic.LoadInt32(&attempts); n != 1 {
+		t.Errorf("want 1 attempt, got %d", n)
 	}
 }
 
-func TestBytesReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithTimeout_AbortsHTTPRequestThatOverruns(t *testing.T) {
 	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithReader(brokenReader).Bytes()
-	if err == nil {
-		t.Fatal(nil)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+	defer close(release)
+	err := script.NewPipe().WithTimeout(50 * time.Millisecond).Get(ts.URL).Wait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
 	}
 }
 
-func TestCountLines_CountsCorrectNumberOfLinesInInput(t *testing.T) {
+func TestWithTimeout_AppliesToEverySubsequentStage(t *testing.T) {
 	t.Parallel()
-	want := 3
-	got, err := script.Echo("a\nb\nc").CountLines()
-	if err != nil {
-		t.Fatal(err)
+	block := func(r io.Reader, w io.Writer) error {
+		time.Sleep(time.Second)
+		return nil
 	}
-	if got != want {
-		t.Errorf("want %d, got %d", want, got)
+	p := script.Echo("hello\n").WithTimeout(50 * time.Millisecond).FilterLine(strings.ToUpper).Filter(block)
+	err := p.Wait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
 	}
 }
 
-func TestCountLines_Counts0LinesInEmptyInput(t *testing.T) {
+func TestWithHTTPClient_SetsSuppliedClientOnPipe(t *testing.T) {
 	t.Parallel()
-	want := 0
-	got, err := script.Echo("").CountLines()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "some data")
+	}))
+	defer ts.Close()
+	req, err := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("want %d, got %d", want, got)
+	want := "some data\n"
+	// Unless the pipe uses the supplied ts.Client, we'll get a
+	// 'certificate is not trusted' error on making the request
+	got, err := script.NewPipe().WithHTTPClient(ts.Client()).Do(req).String()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
-}
-
-func TestCountLines_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
-	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithReader(brokenReader).CountLines()
-	if err == nil {
-		t.Fatal(nil)
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestSHA256Sum_OutputsCorrectHash(t *testing.T) {
+func TestWithReader_SetsSuppliedReaderOnPipe(t *testing.T) {
 	t.Parallel()
-	tcs := []struct {
-		name, input, want string
-	}{
-		{
-			name:  "for no data",
-			input: "",
-			want:  "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
-		},
-		{
-			name:  "for short string",
-			input: "hello, world",
-			want:  "09ca7e4eaa6e8ae9c7d261167129184883644d07dfba7cbfbc4c8a2e08360d5b",
-		},
-		{
-			name:  "for string containing newline",
-			input: "The tao that can be told\nis not the eternal Tao",
-			want:  "788542cb92d37f67e187992bdb402fdfb68228a1802947f74c6576e04790a688",
-		},
+	want := "Hello, world."
+	p := script.NewPipe().WithReader(strings.NewReader(want))
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	for _, tc := range tcs {
-		t.Run(tc.name, func(t *testing.T) {
-			got, err := script.Echo(tc.input).SHA256Sum()
-			if err != nil {
-				t.Fatal(err)
-			}
-			if got != tc.want {
-				t.Errorf("want %q, got %q", tc.want, got)
-			}
-		})
+	if got != want {
+		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-func TestSHA256Sum_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithError_SetsSpecifiedErrorOnPipe(t *testing.T) {
 	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithReader(brokenReader).SHA256Sum()
-	if err == nil {
-		t.Fatal(nil)
+	fakeErr := errors.New("oh no")
+	p := script.NewPipe().WithError(fakeErr)
+	if p.Error() != fakeErr {
+		t.Errorf("want %q, got %q", fakeErr, p.Error())
 	}
 }
 
-func TestSliceSink_ReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithScannerBuffer_ErrorsOnLinesLongerThanMax(t *testing.T) {
 	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithReader(brokenReader).Slice()
-	if err == nil {
-		t.Fatal(nil)
+	p := script.Echo(longLine).WithScannerBuffer(16, 1024).Match("last")
+	p.Wait()
+	if !errors.Is(p.Error(), bufio.ErrTooLong) {
+		t.Errorf("want bufio.ErrTooLong, got %v", p.Error())
 	}
 }
 
-func TestSliceSink_(t *testing.T) {
+func TestWithScannerBuffer_AllowsLinesUpToMax(t *testing.T) {
 	t.Parallel()
-	tests := []struct {
-		name string
-		pipe *script.Pipe
-		want []string
-	}{
-		{
-			name: "returns three elements for three lines of input",
-			pipe: script.Echo("testdata/multiple_files/1.txt\ntestdata/multiple_files/2.txt\ntestdata/multiple_files/3.tar.zip\n"),
-			want: []string{
-				"testdata/multiple_files/1.txt",
-				"testdata/multiple_files/2.txt",
-				"testdata/multiple_files/3.tar.zip",
-			},
-		},
-		{
-			name: "returns an empty slice given empty input",
-			pipe: script.Echo(""),
-			want: []string{},
-		},
-		{
-			name: "returns one empty string given input containing a single newline",
-			pipe: script.Echo("\n"),
-			want: []string{""},
-		},
-		{
-			name: "returns an empty string for each empty input line",
-			pipe: script.Echo("testdata/multiple_files/1.txt\n\ntestdata/multiple_files/3.tar.zip"),
-			want: []string{
-				"testdata/multiple_files/1.txt",
-				"",
-				"testdata/multiple_files/3.tar.zip",
-			},
-		},
+	want := "last line\n"
+	got, err := script.Echo(longLine).WithScannerBuffer(16, len(longLine)).Match("last").String()
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			p := tt.pipe
-			got, err := p.Slice()
-			if err != nil {
-				t.Fatal(err)
-			}
-			if !cmp.Equal(tt.want, got) {
-				t.Error(cmp.Diff(tt.want, got))
-			}
-		})
+	if want != got {
+		t.Error(cmp.Diff(want, got))
 	}
 }
 
-func TestStringOutputsInputStringUnchanged(t *testing.T) {
+func TestWithScannerBuffer_UsesDefaultsGivenZeroMax(t *testing.T) {
 	t.Parallel()
-	want := "hello, world"
-	got, err := script.Echo(want).String()
+	want := "last line\n"
+	got, err := script.Echo(longLine).WithScannerBuffer(0, 0).Match("last").String()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1639,147 +5889,179 @@ func TestStringOutputsInputStringUnchanged(t *testing.T) {
 	}
 }
 
-func TestStringReturnsErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithScannerBuffer_SetsErrorGivenInvalidSize(t *testing.T) {
 	t.Parallel()
-	brokenReader := iotest.ErrReader(errors.New("oh no"))
-	_, err := script.NewPipe().WithReader(brokenReader).String()
-	if err == nil {
-		t.Fatal(nil)
+	tcs := []struct {
+		size, max int
+	}{
+		{-1, 100},
+		{0, 100},
+		{101, 100},
 	}
-}
-
-func TestWaitReadsPipeSourceToCompletion(t *testing.T) {
-	t.Parallel()
-	source := bytes.NewBufferString("hello")
-	script.NewPipe().WithReader(source).FilterLine(strings.ToUpper).Wait()
-	if source.Len() > 0 {
-		t.Errorf("incomplete read: %d bytes of input remaining: %q", source.Len(), source.String())
+	for _, tc := range tcs {
+		p := script.Echo("hello\n").WithScannerBuffer(tc.size, tc.max).Match("hello")
+		p.Wait()
+		if p.Error() == nil {
+			t.Errorf("WithScannerBuffer(%d, %d): want error, got nil", tc.size, tc.max)
+		}
 	}
 }
 
-func TestWriteFile_WritesInputToFileCreatingItIfNecessary(t *testing.T) {
+func TestWithStdout_SetsSpecifiedWriterAsStdout(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world"
-	path := t.TempDir() + "/" + t.Name()
-	wrote, err := script.Echo(want).WriteFile(path)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if int(wrote) != len(want) {
-		t.Fatalf("want %d bytes written, got %d", len(want), int(wrote))
-	}
-	got, err := script.File(path).String()
+	buf := new(bytes.Buffer)
+	want := "Hello, world."
+	_, err := script.Echo(want).WithStdout(buf).Stdout()
 	if err != nil {
 		t.Fatal(err)
 	}
+	got := buf.String()
 	if got != want {
 		t.Errorf("want %q, got %q", want, got)
 	}
 }
 
-// partialErrReader returns 1 and a non-EOF error on reading.
-type partialErrReader struct{}
-
-func (r partialErrReader) Read(p []byte) (int, error) {
-	return 1, errors.New("oh no")
-}
-
-func TestWriteFile_ReturnsBytesWrittenAndErrorGivenReadErrorOnPipe(t *testing.T) {
+func TestWithCommandLog_LogsEachCommandRun(t *testing.T) {
 	t.Parallel()
-	var want int64 = 1
-	got, err := script.NewPipe().WithReader(partialErrReader{}).WriteFile(t.TempDir() + "/tmp")
-	if err == nil {
-		t.Fatal("want error reading pipe with error status, got nil")
+	buf := new(bytes.Buffer)
+	script.Echo("help\nbogus\n").WithCommandLog(buf).ExecForEach("go {{.}}").Wait()
+	script.NewPipe().WithCommandLog(buf).Exec("doesntexist").Wait()
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("want 3 log lines, got %d: %q", len(lines), buf.String())
+	}
+	want := []*regexp.Regexp{
+		regexp.MustCompile(`^\S+ dir=` + regexp.QuoteMeta(fmt.Sprintf("%q", dir)) + ` cmd="go help" status=0 duration=\S+$`),
+		regexp.MustCompile(`^\S+ dir=\S+ cmd="go bogus" status=2 duration=\S+$`),
+		regexp.MustCompile(`^\S+ dir=\S+ cmd="doesntexist" status=-1 duration=\S+ error=".+"$`),
+	}
+	for i, re := range want {
+		if !re.MatchString(lines[i]) {
+			t.Errorf("log line %d: want match for %q, got %q", i+1, re, lines[i])
+		}
 	}
 }
 
-func TestWriteFile_TruncatesExistingFile(t *testing.T) {
+func TestWithDryRun_DescribesCommandsInsteadOfRunningThem(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world"
-	path := t.TempDir() + "/" + t.Name()
-	// write some data first so we can check for truncation
-	data := make([]byte, 15)
-	err := os.WriteFile(path, data, 0o600)
+	buf := new(bytes.Buffer)
+	got, err := script.Echo("a\nb\n").WithDryRun(buf).Exec("rm -rf /").ExecForEach("rm {{.}}").String()
 	if err != nil {
 		t.Fatal(err)
 	}
-	wrote, err := script.Echo(want).WriteFile(path)
-	if err != nil {
-		t.Fatal(err)
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
 	}
-	if int(wrote) != len(want) {
-		t.Fatalf("want %d bytes written, got %d", len(want), int(wrote))
+	want := "exec: rm -rf /\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
-	got, err := script.File(path).String()
+	buf.Reset()
+	err = script.Echo("a\nb\n").WithDryRun(buf).ExecForEach("rm {{.}}").Wait()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got == want+"\x00\x00\x00" {
-		t.Fatalf("file not truncated on write")
-	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	want = "exec: rm a\nexec: rm b\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
 }
 
-func TestWithHTTPClient_SetsSuppliedClientOnPipe(t *testing.T) {
+func TestWithDryRun_QuotesArgumentsOfExecArgsCommands(t *testing.T) {
 	t.Parallel()
-	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "some data")
-	}))
-	defer ts.Close()
-	req, err := http.NewRequest(http.MethodGet, ts.URL, http.NoBody)
+	buf := new(bytes.Buffer)
+	err := script.NewPipe().WithDryRun(buf).ExecArgs("rm", "-f", "a b").Wait()
 	if err != nil {
 		t.Fatal(err)
 	}
-	want := "some data\n"
-	// Unless the pipe uses the supplied ts.Client, we'll get a
-	// 'certificate is not trusted' error on making the request
-	got, err := script.NewPipe().WithHTTPClient(ts.Client()).Do(req).String()
+	err = script.Echo("it's here\n").WithDryRun(buf).ExecForEachArgs("rm", "{{.}}").Wait()
 	if err != nil {
-		t.Fatalf("unexpected error: %v", err)
+		t.Fatal(err)
 	}
-	if !cmp.Equal(want, got) {
-		t.Error(cmp.Diff(want, got))
+	want := "exec: rm -f 'a b'\nexec: rm 'it'\\''s here'\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
 }
 
-func TestWithReader_SetsSuppliedReaderOnPipe(t *testing.T) {
+func TestWithDryRun_DescribesXArgsBatchesInsteadOfRunningThem(t *testing.T) {
 	t.Parallel()
-	want := "Hello, world."
-	p := script.NewPipe().WithReader(strings.NewReader(want))
-	got, err := p.String()
+	buf := new(bytes.Buffer)
+	err := script.Echo("a\nb\nc\n").WithDryRun(buf).XArgs("rm -f", 2).Wait()
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	want := "exec: rm -f a b\nexec: rm -f c\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
 }
 
-func TestWithError_SetsSpecifiedErrorOnPipe(t *testing.T) {
+func TestXArgs_SetsErrorIfAnyCommandFails(t *testing.T) {
 	t.Parallel()
-	fakeErr := errors.New("oh no")
-	p := script.NewPipe().WithError(fakeErr)
-	if p.Error() != fakeErr {
-		t.Errorf("want %q, got %q", fakeErr, p.Error())
+	p := script.Echo("bogus\n").WithStderr(io.Discard).XArgs("go", 0)
+	p.Wait()
+	if p.Error() == nil {
+		t.Error("want error when command fails")
 	}
 }
 
-func TestWithStdout_SetsSpecifiedWriterAsStdout(t *testing.T) {
+func TestWithDryRun_DescribesFileWritesInsteadOfWriting(t *testing.T) {
 	t.Parallel()
 	buf := new(bytes.Buffer)
-	want := "Hello, world."
-	_, err := script.Echo(want).WithStdout(buf).Stdout()
+	path := filepath.Join(t.TempDir(), "out.txt")
+	wrote, err := script.Echo("hello").WithDryRun(buf).WriteFile(path)
 	if err != nil {
 		t.Fatal(err)
 	}
-	got := buf.String()
-	if got != want {
-		t.Errorf("want %q, got %q", want, got)
+	if wrote != 0 {
+		t.Errorf("want 0 bytes written, got %d", wrote)
+	}
+	_, err = script.Echo("hello").WithDryRun(buf).AppendFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "write: 5 bytes to " + path + "\nappend: 5 bytes to " + path + "\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		t.Error("want file not to be created in dry-run mode")
+	}
+}
+
+func TestWithDryRun_DescribesNonGETRequestsButMakesGETRequests(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected %s request in dry-run mode", r.Method)
+		}
+		fmt.Fprint(w, "some data")
+	}))
+	defer ts.Close()
+	buf := new(bytes.Buffer)
+	got, err := script.NewPipe().WithDryRun(buf).Get(ts.URL).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "some data" {
+		t.Errorf("want GET response, got %q", got)
+	}
+	got, err = script.Echo("body").WithDryRun(buf).Post(ts.URL).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "" {
+		t.Errorf("want no output, got %q", got)
+	}
+	want := "http: POST " + ts.URL + "\n"
+	if want != buf.String() {
+		t.Error(cmp.Diff(want, buf.String()))
 	}
 }
 
@@ -1825,6 +6107,19 @@ func TestErrorReturnsErrorSetByPreviousPipeStage(t *testing.T) {
 	}
 }
 
+func TestSentences_ProducesOneSentencePerLine(t *testing.T) {
+	t.Parallel()
+	input := "It cost $3.50 in the U.S. last\nyear, e.g. in Ohio. \"Really?\" she asked!\n\nA heading\n\n日本語です。次の文。"
+	want := "It cost $3.50 in the U.S. last year, e.g. in Ohio.\n\"Really?\" she asked!\nA heading\n日本語です。\n次の文。\n"
+	got, err := script.Echo(input).Sentences().String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestSetError_SetsSuppliedErrorOnPipe(t *testing.T) {
 	t.Parallel()
 	p := script.NewPipe()
@@ -1863,6 +6158,26 @@ func TestExitStatus_CorrectlyParsesExitStatusValueFromErrorMessage(t *testing.T)
 	}
 }
 
+func TestProfile_PassesInputThroughUnchangedAndWritesProfiles(t *testing.T) {
+	t.Parallel()
+	cpu, allocs := new(bytes.Buffer), new(bytes.Buffer)
+	got, err := script.Echo(longLine).Profile(cpu, allocs).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longLine != got {
+		t.Error(cmp.Diff(longLine, got))
+	}
+	// pprof profiles are gzip-compressed
+	gzipMagic := []byte{0x1f, 0x8b}
+	if !bytes.HasPrefix(cpu.Bytes(), gzipMagic) {
+		t.Errorf("want CPU profile, got %q", cpu.Bytes())
+	}
+	if !bytes.HasPrefix(allocs.Bytes(), gzipMagic) {
+		t.Errorf("want allocs profile, got %q", allocs.Bytes())
+	}
+}
+
 func TestReadProducesCompletePipeContents(t *testing.T) {
 	t.Parallel()
 	want := []byte("hello")
@@ -2028,6 +6343,92 @@ func TestWithStdErr_IsConcurrencySafeAfterExec(t *testing.T) {
 	}
 }
 
+func TestHeartbeat_PrintsMessageWhileStageIsSilent(t *testing.T) {
+	t.Parallel()
+	stderr := new(bytes.Buffer)
+	got, err := script.NewPipe().Filter(func(r io.Reader, w io.Writer) error {
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintln(w, "done")
+		return nil
+	}).WithStderr(stderr).Heartbeat(20*time.Millisecond, "still working").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "done\n" {
+		t.Errorf("want input passed through unchanged, got %q", got)
+	}
+	if !strings.HasPrefix(stderr.String(), "still working (") {
+		t.Errorf("want heartbeat message, got %q", stderr.String())
+	}
+}
+
+func TestHeartbeat_PrintsNothingWhenStageProducesOutputPromptly(t *testing.T) {
+	t.Parallel()
+	stderr := new(bytes.Buffer)
+	got, err := script.Echo("hello\n").WithStderr(stderr).Heartbeat(time.Minute, "still working").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello\n" {
+		t.Errorf("want %q, got %q", "hello\n", got)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("want no heartbeat message, got %q", stderr.String())
+	}
+}
+
+func TestHeartbeat_ErrorsOnNonPositiveInterval(t *testing.T) {
+	t.Parallel()
+	for _, interval := range []time.Duration{0, -time.Second} {
+		_, err := script.Echo("x\n").Heartbeat(interval, "hb").String()
+		if err == nil {
+			t.Errorf("%s: want error for invalid interval, got nil", interval)
+		}
+	}
+}
+
+func TestGroup_WaitsForAllPipesAndReturnsFirstError(t *testing.T) {
+	t.Parallel()
+	var buf1, buf2 bytes.Buffer
+	g := script.NewGroup()
+	g.Go(script.Echo("one\n").Tee(&buf1))
+	g.Go(script.Echo("two\n").Tee(&buf2))
+	g.Go(script.NewPipe().WithError(errors.New("oh no")))
+	err := g.Wait()
+	if err == nil || err.Error() != "oh no" {
+		t.Errorf("want error %q, got %v", "oh no", err)
+	}
+	if buf1.String() != "one\n" || buf2.String() != "two\n" {
+		t.Errorf("want all pipes run to completion, got %q and %q", buf1.String(), buf2.String())
+	}
+}
+
+func TestGroup_CancelsOtherPipesOnFirstFailureInFailFastMode(t *testing.T) {
+	t.Parallel()
+	g := script.NewGroup().FailFast()
+	endless := script.NewPipe().Filter(func(r io.Reader, w io.Writer) error {
+		for {
+			_, err := w.Write([]byte("x\n"))
+			if err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	g.Go(endless)
+	g.Go(script.NewPipe().Filter(func(r io.Reader, w io.Writer) error {
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("oh no")
+	}))
+	err := g.Wait()
+	if err == nil || err.Error() != "oh no" {
+		t.Errorf("want error %q, got %v", "oh no", err)
+	}
+	if endless.Error() == nil {
+		t.Error("want cancelled pipe to have error status set")
+	}
+}
+
 func TestHash_OutputsCorrectHash(t *testing.T) {
 	t.Parallel()
 	tcs := []struct {
@@ -2132,6 +6533,138 @@ func TestHashSums_OutputsEmptyStringForFileThatCannotBeHashed(t *testing.T) {
 	}
 }
 
+// benchmarkFile creates a file of the given size in a temporary directory,
+// and returns its path.
+func benchmarkFile(b *testing.B, size int) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "input.txt")
+	data := bytes.Repeat([]byte("This is a line of benchmark data.\n"), size/34+1)
+	err := os.WriteFile(path, data[:size], 0o600)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func BenchmarkFile_WriteFile(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	dst := filepath.Join(b.TempDir(), "output.txt")
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := script.File(src).WriteFile(dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConcat_WriteFile(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	dst := filepath.Join(b.TempDir(), "output.txt")
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := script.Echo(src).Concat().WriteFile(dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGet_WriteFile(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 16<<20)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer ts.Close()
+	dst := filepath.Join(b.TempDir(), "output.txt")
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := script.Get(ts.URL).WriteFile(dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFile_Match(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := script.File(src).Match("line").Wait()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFile_FilterBytes(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lines := 0
+		err := script.File(src).FilterBytes(func(line []byte, w io.Writer) {
+			lines++
+		}).Wait()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFile_FilterScan(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lines := 0
+		err := script.File(src).FilterScan(func(line string, w io.Writer) {
+			lines++
+		}).Wait()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewPipe(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, err := script.NewPipe().Echo("hello").String()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNewPooledPipe(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := script.NewPooledPipe()
+		_, err := p.Echo("hello").String()
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.Release()
+	}
+}
+
+func BenchmarkFile_CountLines(b *testing.B) {
+	src := benchmarkFile(b, 16<<20)
+	b.SetBytes(16 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := script.File(src).CountLines()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func ExampleArgs() {
 	script.Args().Stdout()
 	// prints command-line arguments
@@ -2180,6 +6713,12 @@ func ExampleFile() {
 	// hello world
 }
 
+func ExampleFileRange() {
+	script.FileRange("testdata/test.txt", 8, 9).Stdout()
+	// Output:
+	// the first
+}
+
 func ExampleGet() {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "some data")
@@ -2202,6 +6741,13 @@ func ExampleIfExists_false() {
 	//
 }
 
+func ExampleTailFile() {
+	script.TailFile("testdata/test.txt", 2).Stdout()
+	// Output:
+	// Hello, world.
+	// This is another line in the file.
+}
+
 func ExamplePipe_Bytes() {
 	data, err := script.Echo("hello").Bytes()
 	if err != nil {
@@ -2241,6 +6787,33 @@ func ExamplePipe_Concat() {
 	// hello world
 }
 
+func ExamplePipe_ConcatWithHeaders() {
+	input := []string{
+		"testdata/test.txt",
+		"testdata/hello.txt",
+	}
+	script.Slice(input).ConcatWithHeaders().Stdout()
+	// Output:
+	// ==> testdata/test.txt <==
+	// This is the first line in the file.
+	// Hello, world.
+	// This is another line in the file.
+	//
+	// ==> testdata/hello.txt <==
+	// hello world
+}
+
+func ExamplePipe_ConcatWithPrefix() {
+	input := []string{
+		"testdata/test.txt",
+		"testdata/hello.txt",
+	}
+	script.Slice(input).ConcatWithPrefix().Match("world").Stdout()
+	// Output:
+	// testdata/test.txt:2:Hello, world.
+	// testdata/hello.txt:1:hello world
+}
+
 func ExamplePipe_CountLines() {
 	n, err := script.Echo("a\nb\nc\n").CountLines()
 	if err != nil {
@@ -2257,6 +6830,12 @@ func ExamplePipe_DecodeBase64() {
 	// Hello, world!
 }
 
+func ExamplePipe_DetectMIME() {
+	script.Echo("testdata/hello.txt\n").DetectMIME().Stdout()
+	// Output:
+	// text/plain; charset=utf-8
+}
+
 func ExamplePipe_Do() {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		data, err := io.ReadAll(r.Body)
@@ -2333,6 +6912,17 @@ func ExamplePipe_FilterScan() {
 	// scanned line: "c"
 }
 
+func ExamplePipe_FilterBytes() {
+	script.Echo("a\nb\nc\n").FilterBytes(func(line []byte, w io.Writer) {
+		w.Write(bytes.ToUpper(line))
+		w.Write([]byte("\n"))
+	}).Stdout()
+	// Output:
+	// A
+	// B
+	// C
+}
+
 func ExamplePipe_FilterLine_user() {
 	script.Echo("a\nb\nc").FilterLine(func(line string) string {
 		return "> " + line
@@ -2441,6 +7031,13 @@ func ExamplePipe_Match() {
 	// b
 }
 
+func ExamplePipe_MatchInFiles() {
+	script.Echo("testdata/test.txt\ntestdata/hello.txt\n").MatchInFiles("world").Stdout()
+	// Output:
+	// testdata/test.txt:2:Hello, world.
+	// testdata/hello.txt:1:hello world
+}
+
 func ExamplePipe_MatchRegexp() {
 	re := regexp.MustCompile("w.*d")
 	script.Echo("hello\nworld\n").MatchRegexp(re).Stdout()
@@ -2503,6 +7100,12 @@ func ExamplePipe_ReplaceRegexp() {
 	// replacement
 }
 
+func ExamplePipe_Skip() {
+	script.Echo("hello world\n").Skip(6).Stdout()
+	// Output:
+	// world
+}
+
 func ExamplePipe_SHA256Sum() {
 	sum, err := script.Echo("hello world").SHA256Sum()
 	if err != nil {
@@ -2579,6 +7182,13 @@ func ExamplePipe_Tee_writers() {
 	// hello
 }
 
+func ExamplePipe_WithDryRun() {
+	script.Echo("old.bak\nolder.bak\n").WithDryRun(os.Stdout).ExecForEach("rm {{.}}").Wait()
+	// Output:
+	// exec: rm old.bak
+	// exec: rm older.bak
+}
+
 func ExamplePipe_WithStderr() {
 	buf := new(bytes.Buffer)
 	script.NewPipe().WithStderr(buf).Exec("go").Wait()
@@ -3,9 +3,18 @@
 package script_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/bitfield/script"
 	"github.com/google/go-cmp/cmp"
@@ -38,6 +47,20 @@ func TestExecRunsShWithEchoHelloAndGetsOutputHello(t *testing.T) {
 	}
 }
 
+func TestExec_KeepsOutputAndErrorOutputInOrderWrittenByCommand(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 20; i++ {
+		got, err := script.Exec("sh -c 'echo a; echo b >&2; echo c; echo d >&2'").String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "a\nb\nc\nd\n"
+		if want != got {
+			t.Fatal(cmp.Diff(want, got))
+		}
+	}
+}
+
 func TestExecRunsShWithinShWithEchoInceptionAndGetsOutputInception(t *testing.T) {
 	t.Parallel()
 	p := script.Exec("sh -c 'sh -c \"echo inception\"'")
@@ -79,6 +102,77 @@ func TestExecForEach_RunsEchoWithABCAndGetsOutputABC(t *testing.T) {
 	}
 }
 
+func TestExecArgs_PassesArgumentsVerbatim(t *testing.T) {
+	t.Parallel()
+	got, err := script.ExecArgs("echo", "it's", "two  spaces").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "it's two  spaces\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestExecForEachArgs_PassesRenderedArgumentsVerbatim(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("it's here\n\"quoted\"\n").ExecForEachArgs("echo", "[{{.}}]").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[it's here]\n[\"quoted\"]\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestExecForEachMap_ReturnsOutputOfEachCommandKeyedByInputLine(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\nfail\n").ExecForEachMap(`sh -c 'echo got {{.}}; test {{.}} != fail'`)
+	if err == nil {
+		t.Fatal("want error when a command fails")
+	}
+	if want := "1 of 3 commands failed: exit status 1"; err.Error() != want {
+		t.Errorf("want error %q, got %q", want, err)
+	}
+	want := map[string]string{
+		"a":    "got a\n",
+		"b":    "got b\n",
+		"fail": "got fail\nexit status 1\n",
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestExecForEachParallel_RunsCommandsConcurrentlyPreservingInputOrder(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	got, err := script.Echo("0.3\n0.1\n0.2\n").ExecForEachParallel("sh -c 'sleep {{.}}; echo {{.}}'", 3).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "0.3\n0.1\n0.2\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+	if elapsed := time.Since(start); elapsed > 550*time.Millisecond {
+		t.Errorf("want commands run concurrently, but took %s", elapsed)
+	}
+}
+
+func TestExecForEachStdin_SendsRenderedTemplateToEachCommandsStdin(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\n").ExecForEachStdin("cat", "line: {{.}}").String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "line: a\nline: b\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func TestExecForEach_CorrectlyEvaluatesTemplateContainingIfStatement(t *testing.T) {
 	t.Parallel()
 	p := script.Echo("a").ExecForEach("echo {{if .}}it worked!{{end}}")
@@ -108,6 +202,211 @@ func TestExecPipesDataToExternalCommandAndGetsExpectedOutput(t *testing.T) {
 	}
 }
 
+func TestXArgs_BatchesInputLinesAsArguments(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a\nb\nc\n").XArgs("echo", 2).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "a b\nc\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestXArgs_PassesEachLineAsSingleArgument(t *testing.T) {
+	t.Parallel()
+	got, err := script.Echo("a b\nc\n").XArgs(`printf "[%s]\n"`, 0).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[a b]\n[c]\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
+func TestWithTimeout_KillsCommandThatOverruns(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	err := script.NewPipe().WithTimeout(100 * time.Millisecond).Exec("sleep 10").Wait()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("want command killed, but took %s", elapsed)
+	}
+}
+
+func TestWithTimeout_KillsProcessesStartedByCommandThatOverruns(t *testing.T) {
+	t.Parallel()
+	out, err := script.NewPipe().WithTimeout(500 * time.Millisecond).Exec(`sh -c 'sleep 10 & echo $!; wait'`).String()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForExit(t, pid)
+}
+
+func TestStageTimeout_KillsCommandRunByStageThatOverruns(t *testing.T) {
+	t.Parallel()
+	out, err := script.Echo("x\n").StageTimeout(500 * time.Millisecond).ExecForEach(`sh -c 'sleep 10 & echo $!; wait'`).String()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForExit(t, pid)
+}
+
+func TestWithTimeout_KillsEachOverrunningCommandInExecForEach(t *testing.T) {
+	t.Parallel()
+	stderr := new(bytes.Buffer)
+	sum, err := script.Echo("0\n10\n").WithTimeout(time.Second).WithStderr(stderr).ExecForEach("sleep {{.}}").Summary()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("want deadline exceeded error, got %v", err)
+	}
+	if sum.OK != 1 {
+		t.Errorf("want first command to succeed, got %+v", sum)
+	}
+}
+
+func TestWithExecLimits_RestrictsOpenFilesForCommands(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limits are only supported on Linux")
+	}
+	got, err := script.NewPipe().WithExecLimits(0, 0, 16).Exec(`sh -c "ulimit -n"`).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "16\n" {
+		t.Errorf("want open file limit 16, got %q", got)
+	}
+}
+
+func TestWithoutNetwork_RunsCommandsInNewNetworkNamespace(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("network isolation is only supported on Linux")
+	}
+	host, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Skip(err)
+	}
+	got, err := script.NewPipe().WithoutNetwork().Exec("readlink /proc/self/ns/net").String()
+	if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC) {
+		t.Skip("this system doesn't permit creating network namespaces")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == host+"\n" {
+		t.Error("command ran in host network namespace")
+	}
+	if !strings.HasPrefix(got, "net:") {
+		t.Errorf("want network namespace, got %q", got)
+	}
+}
+
+func TestCopyFileMeta_GivesWrittenFilesSameModeAndModTimeAsSource(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	if err := os.WriteFile(src, []byte("#!/bin/sh\n"), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(src, 0o750); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	write := map[string]func(*script.Pipe, string) (int64, error){
+		"WriteFile": (*script.Pipe).WriteFile,
+		"WriteFileAtomic": func(p *script.Pipe, path string) (int64, error) {
+			return p.WriteFileAtomic(path, false)
+		},
+		"AppendFile": (*script.Pipe).AppendFile,
+	}
+	for name, fn := range write {
+		dst := filepath.Join(tmpDir, name)
+		_, err := fn(script.File(src).CopyFileMeta(src), dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o750 {
+			t.Errorf("%s: want mode 0750, got %#o", name, info.Mode().Perm())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: want mod time %s, got %s", name, mtime, info.ModTime())
+		}
+	}
+}
+
+func TestCopyFileMeta_SetsErrorWhenSourceDoesNotExist(t *testing.T) {
+	t.Parallel()
+	dst := filepath.Join(t.TempDir(), "dst")
+	_, err := script.Echo("hello").CopyFileMeta("doesntexist").WriteFile(dst)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want not-exist error, got %v", err)
+	}
+}
+
+func TestCopyFileMetaWriteFileAtomic_LeavesFileUnchangedWhenMetadataCannotBeApplied(t *testing.T) {
+	t.Parallel()
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := os.WriteFile(dst, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := script.Echo("new\n").CopyFileMeta("doesntexist").WriteFileAtomic(dst, false)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want not-exist error, got %v", err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old\n" {
+		t.Errorf("want file unchanged, got %q", got)
+	}
+}
+
+func TestWithSparseFiles_LeavesHolesForZeroBlocks(t *testing.T) {
+	t.Parallel()
+	data := make([]byte, 1<<20)
+	copy(data[len(data)/2:], "hello")
+	path := filepath.Join(t.TempDir(), "sparse")
+	_, err := script.Echo(string(data)).WithSparseFiles().WriteFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(data)) {
+		t.Fatalf("want size %d, got %d", len(data), info.Size())
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		t.Skip("can't determine disk usage on this platform")
+	}
+	if used := st.Blocks * 512; used >= info.Size() {
+		t.Errorf("want sparse file using less than %d bytes on disk, got %d", info.Size(), used)
+	}
+}
+
 func TestFindFiles_DoesNotErrorWhenSubDirectoryIsNotReadable(t *testing.T) {
 	t.Parallel()
 	tmpDir := t.TempDir()
@@ -132,6 +431,30 @@ func TestFindFiles_DoesNotErrorWhenSubDirectoryIsNotReadable(t *testing.T) {
 	}
 }
 
+func TestFindFiles_FollowsSymlinkToDirectoryAtRoot(t *testing.T) {
+	t.Parallel()
+	tmpDir := t.TempDir()
+	target := filepath.Join(tmpDir, "target")
+	if err := os.Mkdir(target, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "a.txt"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(tmpDir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	got, err := script.FindFiles(link).String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(link, "a.txt") + "\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
+
 func ExampleExec_ok() {
 	script.Exec("echo Hello, world!").Stdout()
 	// Output:
@@ -225,3 +548,54 @@ func ExamplePipe_ExecForEach() {
 	// b
 	// c
 }
+
+// waitForExit fails the test if the process pid hasn't exited within a few
+// seconds.
+func waitForExit(t *testing.T, pid int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if syscall.Kill(pid, 0) != nil {
+			return
+		}
+		stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err == nil && strings.Contains(string(stat), ") Z ") {
+			return // dead, but not yet reaped
+		}
+	}
+	t.Errorf("want process %d killed, but it's still running", pid)
+}
+
+func TestFollowFile_ReadsRestOfOldFileBeforeFollowingRotatedFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := script.FollowFile(ctx, path)
+	go func() {
+		defer cancel()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprintln(f, "before rotation")
+		if err := os.Rename(path, path+".1"); err != nil {
+			panic(err)
+		}
+		if err := os.WriteFile(path, []byte("after rotation\n"), 0o644); err != nil {
+			panic(err)
+		}
+		time.Sleep(800 * time.Millisecond)
+	}()
+	got, err := p.String()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "before rotation\nafter rotation\n"
+	if want != got {
+		t.Error(cmp.Diff(want, got))
+	}
+}
@@ -1,6 +1,9 @@
 package script_test
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/bitfield/script"
@@ -18,6 +21,13 @@ func TestDirnameReturnsExpectedResultsOnPlatformsWithBackslashPathSeparator(t *t
 		{`\\host\share`, "\\\\host\\share\n"},
 		{`\\host\share\a\b`, "\\\\host\\share\\a\n"},
 		{`C:\Program Files\PHP\a`, "C:\\Program Files\\PHP\n"},
+		{`C:\a\b\`, "C:\\a\n"},
+		{`C:a\b\`, "C:a\n"},
+		{`\\host\share\`, "\\\\host\\share\\\n"},
+		{`.\src\filters`, ".\\src\n"},
+		{`\\?\C:\a\b`, "\\\\?\\C:\\a\n"},
+		{`\\?\C:\a\b\`, "\\\\?\\C:\\a\n"},
+		{`\\?\UNC\host\share\a\b`, "\\\\?\\UNC\\host\\share\\a\n"},
 	}
 	for _, tc := range testCases {
 		got, err := script.Echo(tc.path).Dirname().String()
@@ -30,6 +40,56 @@ func TestDirnameReturnsExpectedResultsOnPlatformsWithBackslashPathSeparator(t *t
 	}
 }
 
+func TestBasenameReturnsExpectedResultsOnPlatformsWithBackslashPathSeparator(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		path string
+		want string
+	}{
+		{`C:\`, "\\\n"},
+		{`C:\a\b`, "b\n"},
+		{`C:\a\b\`, "b\n"},
+		{`C:a`, "a\n"},
+		{`\\host\share\a`, "a\n"},
+		{`\\?\C:\a\b.txt`, "b.txt\n"},
+		{`\\?\UNC\host\share\a\b.txt`, "b.txt\n"},
+	}
+	for _, tc := range testCases {
+		got, err := script.Echo(tc.path).Basename().String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("%q: want %q, got %q", tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestFindFiles_ListsFilesBeyondMaxPathWithLongPathPrefix(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	for i := 0; i < 6; i++ {
+		dir = filepath.Join(dir, strings.Repeat("x", 50))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{dir, `\\?\` + dir} {
+		got, err := script.FindFiles(root).String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := filepath.Join(root, "file.txt") + "\n"
+		if want != got {
+			t.Errorf("%q: want %q, got %q", root, want, got)
+		}
+	}
+}
+
 func ExampleFindFiles() {
 	script.FindFiles("testdata/multiple_files_with_subdirectory").Stdout()
 	// Output:
@@ -0,0 +1,11 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package script
+
+import "os"
+
+// ttyWidth returns zero, because terminal sizes can't be detected on this
+// platform.
+func ttyWidth(f *os.File) int {
+	return 0
+}